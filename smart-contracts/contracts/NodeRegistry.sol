@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: MIT
+pragma solidity ^0.8.22;
+
+import "@openzeppelin/contracts/access/Ownable.sol";
+
+// Volunteers register their nodes here so the DAO can see who is out there
+// and what they can run. Whether a node is up right now travels over libp2p
+// heartbeats, this is the lasting record.
+//
+// Only operators the owner allowed can register, since nodes let the
+// registered peers through their allowlists. The owner is meant to be handed
+// over to the DAO's governor once it is deployed.
+contract NodeRegistry is Ownable {
+    struct Node {
+        string peerId;
+        string arch;
+        uint32 cpus;
+        uint64 memoryBytes;
+        string[] runtimes;
+        uint256 registeredAt;
+        uint256 updatedAt;
+    }
+
+    mapping(address => Node) private _nodes;
+    address[] private _operators;
+    // Position of each operator in _operators, plus one.
+    mapping(address => uint256) private _positions;
+    // A peer ID can only be claimed by one operator.
+    mapping(bytes32 => address) private _peerOperators;
+    mapping(address => bool) private _allowedOperators;
+
+    event NodeRegistered(address indexed operator, string peerId);
+    event NodeDeregistered(address indexed operator);
+    event OperatorAllowed(address indexed operator, bool allowed);
+
+    error OperatorNotAllowed(address operator);
+    error EmptyPeerId();
+    error PeerIdTaken(string peerId, address operator);
+    error NotRegistered(address operator);
+
+    constructor(address initialOwner) Ownable(initialOwner) {}
+
+    // Lets operator register, or stops it from registering. Taking an
+    // operator off the list doesn't deregister its node, nodes check the list
+    // along with the registrations.
+    function setOperatorAllowed(address operator, bool allowed) external onlyOwner {
+        _allowedOperators[operator] = allowed;
+        emit OperatorAllowed(operator, allowed);
+    }
+
+    function isAllowedOperator(address operator) external view returns (bool) {
+        return _allowedOperators[operator];
+    }
+
+    // Registers the sender's node, or updates it if it is already registered.
+    function register(
+        string calldata peerId,
+        string calldata arch,
+        uint32 cpus,
+        uint64 memoryBytes,
+        string[] memory runtimes
+    ) external {
+        if (!_allowedOperators[msg.sender]) {
+            revert OperatorNotAllowed(msg.sender);
+        }
+        if (bytes(peerId).length == 0) {
+            revert EmptyPeerId();
+        }
+        bytes32 peerKey = keccak256(bytes(peerId));
+        address owner = _peerOperators[peerKey];
+        if (owner != address(0) && owner != msg.sender) {
+            revert PeerIdTaken(peerId, owner);
+        }
+
+        Node storage node = _nodes[msg.sender];
+        if (_positions[msg.sender] == 0) {
+            _operators.push(msg.sender);
+            _positions[msg.sender] = _operators.length;
+            node.registeredAt = block.timestamp;
+        } else {
+            delete _peerOperators[keccak256(bytes(node.peerId))];
+        }
+        _peerOperators[peerKey] = msg.sender;
+
+        node.peerId = peerId;
+        node.arch = arch;
+        node.cpus = cpus;
+        node.memoryBytes = memoryBytes;
+        node.runtimes = runtimes;
+        node.updatedAt = block.timestamp;
+
+        emit NodeRegistered(msg.sender, peerId);
+    }
+
+    function deregister() external {
+        uint256 position = _positions[msg.sender];
+        if (position == 0) {
+            revert NotRegistered(msg.sender);
+        }
+
+        // Move the last operator into the gap.
+        address last = _operators[_operators.length - 1];
+        _operators[position - 1] = last;
+        _positions[last] = position;
+        _operators.pop();
+        delete _positions[msg.sender];
+
+        delete _peerOperators[keccak256(bytes(_nodes[msg.sender].peerId))];
+        delete _nodes[msg.sender];
+
+        emit NodeDeregistered(msg.sender);
+    }
+
+    function isRegistered(address operator) external view returns (bool) {
+        return _positions[operator] != 0;
+    }
+
+    function getNode(address operator) external view returns (Node memory) {
+        return _nodes[operator];
+    }
+
+    function operatorOf(string calldata peerId) external view returns (address) {
+        return _peerOperators[keccak256(bytes(peerId))];
+    }
+
+    function getOperators() external view returns (address[] memory) {
+        return _operators;
+    }
+
+    function nodeCount() external view returns (uint256) {
+        return _operators.length;
+    }
+}
@@ -0,0 +1,249 @@
+// SPDX-License-Identifier: MIT
+pragma solidity ^0.8.22;
+
+import "@openzeppelin/contracts/governance/IGovernor.sol";
+import "./NodeRegistry.sol";
+
+// Nodes report here what happened when they ran a program the DAO voted for.
+// It hands out the shards of a job to nodes, each shard once per replica, and
+// nodes running the same shard flag each other here when their results differ.
+contract ResultsRegistry {
+    struct Result {
+        address node;
+        uint256 shard;
+        string programCid;
+        int256 exitCode;
+        string outputCid;
+        uint256 runtime;
+        uint256 submittedAt;
+    }
+
+    // A claim on a replica of a shard lasts until the node submits a result,
+    // or until it is claimTimeout seconds old without one.
+    struct Claim {
+        address node;
+        uint256 claimedAt;
+    }
+
+    // The replica of a shard a node claimed for a job.
+    struct ClaimedShard {
+        bool claimed;
+        uint256 shard;
+        uint256 replica;
+    }
+
+    IGovernor public immutable governor;
+    // Shards can only be claimed by its allowed, registered nodes.
+    NodeRegistry public immutable nodeRegistry;
+    uint256 public immutable claimTimeout;
+
+    mapping(uint256 => mapping(address => Result)) private _results;
+    mapping(uint256 => address[]) private _nodes;
+    mapping(uint256 => mapping(uint256 => mapping(uint256 => Claim))) private _shardClaims;
+    mapping(uint256 => mapping(address => ClaimedShard)) private _claimedShards;
+    mapping(uint256 => mapping(address => uint256)) private _disputes;
+    mapping(uint256 => mapping(address => mapping(address => bool))) private _disputed;
+
+    event ResultSubmitted(
+        uint256 indexed proposalId,
+        address indexed node,
+        uint256 shard,
+        string programCid,
+        int256 exitCode,
+        string outputCid,
+        uint256 runtime
+    );
+
+    event ShardClaimed(uint256 indexed proposalId, uint256 indexed shard, address indexed node, uint256 replica);
+
+    event ResultDisputed(uint256 indexed proposalId, address indexed reporter, address indexed node, uint256 shard);
+
+    error UnknownProposal(uint256 proposalId);
+    error AlreadySubmitted(uint256 proposalId, address node);
+    error EmptyProgramCid();
+    error ShardTaken(uint256 proposalId, uint256 shard, uint256 replica, address node);
+    error AlreadyClaimed(uint256 proposalId, address node, uint256 shard);
+    error NotANode(address node);
+    error NotClaimed(uint256 proposalId, address node, uint256 shard);
+    error NoResult(uint256 proposalId, address node);
+    error DifferentShards(uint256 proposalId, address node);
+    error ResultsMatch(uint256 proposalId, address node);
+    error AlreadyDisputed(uint256 proposalId, address reporter, address node);
+
+    constructor(IGovernor _governor, NodeRegistry _nodeRegistry, uint256 _claimTimeout) {
+        governor = _governor;
+        nodeRegistry = _nodeRegistry;
+        claimTimeout = _claimTimeout;
+    }
+
+    // The sender is the node, so a result can only be reported by the node's own key.
+    // It has to be a node and hold a claim on the shard it reports, so it ran
+    // what it was given. Jobs that aren't sharded report shard 0.
+    function submitResult(
+        uint256 proposalId,
+        uint256 shard,
+        string calldata programCid,
+        int256 exitCode,
+        string calldata outputCid,
+        uint256 runtime
+    ) external {
+        _requireProposal(proposalId);
+        if (bytes(programCid).length == 0) {
+            revert EmptyProgramCid();
+        }
+        if (_results[proposalId][msg.sender].submittedAt != 0) {
+            revert AlreadySubmitted(proposalId, msg.sender);
+        }
+        _requireClaim(proposalId, shard);
+
+        _results[proposalId][msg.sender] = Result({
+            node: msg.sender,
+            shard: shard,
+            programCid: programCid,
+            exitCode: exitCode,
+            outputCid: outputCid,
+            runtime: runtime,
+            submittedAt: block.timestamp
+        });
+        _nodes[proposalId].push(msg.sender);
+
+        emit ResultSubmitted(proposalId, msg.sender, shard, programCid, exitCode, outputCid, runtime);
+    }
+
+    // First come, first served, one replica of one shard per node and job.
+    // The registry doesn't know how many shards and replicas a job has, nodes
+    // only claim the ones the program manifest asks for; nodes that pick
+    // their shard themselves claim the first free replica of it. A claim that
+    // expired without a result frees the replica for another node, and lets
+    // its node claim again.
+    function claimShard(uint256 proposalId, uint256 shard, uint256 replica) external {
+        _requireProposal(proposalId);
+        if (!isNode(msg.sender)) {
+            revert NotANode(msg.sender);
+        }
+
+        (bool claimed, uint256 own, ) = claimOf(proposalId, msg.sender);
+        if (claimed) {
+            revert AlreadyClaimed(proposalId, msg.sender, own);
+        }
+        address current = shardClaimant(proposalId, shard, replica);
+        if (current != address(0)) {
+            revert ShardTaken(proposalId, shard, replica, current);
+        }
+
+        // Let go of the node's expired claim, unless someone took it over.
+        ClaimedShard storage previous = _claimedShards[proposalId][msg.sender];
+        if (previous.claimed && _shardClaims[proposalId][previous.shard][previous.replica].node == msg.sender) {
+            delete _shardClaims[proposalId][previous.shard][previous.replica];
+        }
+        Claim storage stale = _shardClaims[proposalId][shard][replica];
+        if (stale.node != address(0)) {
+            delete _claimedShards[proposalId][stale.node];
+        }
+
+        _shardClaims[proposalId][shard][replica] = Claim({node: msg.sender, claimedAt: block.timestamp});
+        _claimedShards[proposalId][msg.sender] = ClaimedShard({claimed: true, shard: shard, replica: replica});
+        emit ShardClaimed(proposalId, shard, msg.sender, replica);
+    }
+
+    // The node holding a claim on the replica of the shard, or the zero
+    // address if it is free or its claim expired.
+    function shardClaimant(uint256 proposalId, uint256 shard, uint256 replica) public view returns (address) {
+        Claim storage claim = _shardClaims[proposalId][shard][replica];
+        if (claim.node == address(0) || !_claimLive(proposalId, claim)) {
+            return address(0);
+        }
+        return claim.node;
+    }
+
+    // The shard, and replica of it, node holds a claim on for the job, if any.
+    function claimOf(uint256 proposalId, address node) public view returns (bool, uint256, uint256) {
+        ClaimedShard storage claimed = _claimedShards[proposalId][node];
+        if (!claimed.claimed || shardClaimant(proposalId, claimed.shard, claimed.replica) != node) {
+            return (false, 0, 0);
+        }
+        return (true, claimed.shard, claimed.replica);
+    }
+
+    // Whether node can claim shards: it has to be registered on the node
+    // registry by an operator that is still allowed.
+    function isNode(address node) public view returns (bool) {
+        return nodeRegistry.isRegistered(node) && nodeRegistry.isAllowedOperator(node);
+    }
+
+    // A node that ran the same shard can flag another node's result as wrong.
+    // Both results were submitted under a claim on the shard, so only its
+    // replicas can, and only while they are still nodes. The registry only
+    // checks that the two results really differ; which one is right is
+    // decided off-chain by the majority of the replicas.
+    function reportDispute(uint256 proposalId, address node) external {
+        if (!isNode(msg.sender)) {
+            revert NotANode(msg.sender);
+        }
+        Result storage own = _results[proposalId][msg.sender];
+        Result storage other = _results[proposalId][node];
+        if (own.submittedAt == 0) {
+            revert NoResult(proposalId, msg.sender);
+        }
+        if (other.submittedAt == 0) {
+            revert NoResult(proposalId, node);
+        }
+        if (own.shard != other.shard) {
+            revert DifferentShards(proposalId, node);
+        }
+        if (
+            own.exitCode == other.exitCode &&
+            keccak256(bytes(own.outputCid)) == keccak256(bytes(other.outputCid))
+        ) {
+            revert ResultsMatch(proposalId, node);
+        }
+        if (_disputed[proposalId][msg.sender][node]) {
+            revert AlreadyDisputed(proposalId, msg.sender, node);
+        }
+
+        _disputed[proposalId][msg.sender][node] = true;
+        _disputes[proposalId][node]++;
+        emit ResultDisputed(proposalId, msg.sender, node, own.shard);
+    }
+
+    // How many nodes flagged node's result for the proposal.
+    function disputeCount(uint256 proposalId, address node) external view returns (uint256) {
+        return _disputes[proposalId][node];
+    }
+
+    function hasSubmitted(uint256 proposalId, address node) external view returns (bool) {
+        return _results[proposalId][node].submittedAt != 0;
+    }
+
+    function getResult(uint256 proposalId, address node) external view returns (Result memory) {
+        return _results[proposalId][node];
+    }
+
+    function getNodes(uint256 proposalId) external view returns (address[] memory) {
+        return _nodes[proposalId];
+    }
+
+    function resultCount(uint256 proposalId) external view returns (uint256) {
+        return _nodes[proposalId].length;
+    }
+
+    function _claimLive(uint256 proposalId, Claim storage claim) private view returns (bool) {
+        return _results[proposalId][claim.node].submittedAt != 0 || block.timestamp < claim.claimedAt + claimTimeout;
+    }
+
+    function _requireClaim(uint256 proposalId, uint256 shard) private view {
+        if (!isNode(msg.sender)) {
+            revert NotANode(msg.sender);
+        }
+        (bool claimed, uint256 claimedShard, ) = claimOf(proposalId, msg.sender);
+        if (!claimed || claimedShard != shard) {
+            revert NotClaimed(proposalId, msg.sender, shard);
+        }
+    }
+
+    function _requireProposal(uint256 proposalId) private view {
+        if (governor.proposalSnapshot(proposalId) == 0) {
+            revert UnknownProposal(proposalId);
+        }
+    }
+}
@@ -0,0 +1,24 @@
+const { ethers } = require("hardhat");
+
+// Fixture for deploying NodeRegistry with a couple of allowed operators and
+// one that isn't
+async function deployNodeRegistryFixture() {
+  const [deployer, operator, otherOperator, stranger] = await ethers.getSigners();
+
+  const NodeRegistry = await ethers.getContractFactory("NodeRegistry");
+  const registry = await NodeRegistry.deploy(deployer.address);
+  await registry.setOperatorAllowed(operator.address, true);
+  await registry.setOperatorAllowed(otherOperator.address, true);
+
+  return {
+    registry,
+    deployer,
+    operator,
+    otherOperator,
+    stranger
+  };
+}
+
+module.exports = {
+  deployNodeRegistryFixture,
+};
@@ -0,0 +1,57 @@
+const { mine } = require("@nomicfoundation/hardhat-network-helpers");
+const { ethers } = require("hardhat");
+
+// Shard claims expire after an hour without a result
+const CLAIM_TIMEOUT = 3600;
+
+// Fixture for deploying ResultsRegistry next to a DAO with one open proposal,
+// and a NodeRegistry with two registered nodes
+async function deployResultsRegistryFixture() {
+  const [deployer, proposer, node, otherNode, stranger] = await ethers.getSigners();
+
+  const Token = await ethers.getContractFactory("ComputeToken");
+  const token = await Token.deploy(deployer.address);
+
+  // The proposer needs voting power to propose
+  await token.safeMint(proposer.address);
+  await token.connect(proposer).delegate(proposer.address);
+  await mine(1);
+
+  const ComputeDAO = await ethers.getContractFactory("ComputeDAO");
+  const computeDAO = await ComputeDAO.deploy(await token.getAddress());
+
+  const NodeRegistry = await ethers.getContractFactory("NodeRegistry");
+  const nodeRegistry = await NodeRegistry.deploy(deployer.address);
+  for (const [i, signer] of [node, otherNode].entries()) {
+    await nodeRegistry.setOperatorAllowed(signer.address, true);
+    await nodeRegistry.connect(signer).register(`QmNode${i}`, "amd64", 4, 1n << 30n, ["native"]);
+  }
+
+  const ResultsRegistry = await ethers.getContractFactory("ResultsRegistry");
+  const registry = await ResultsRegistry.deploy(await computeDAO.getAddress(), await nodeRegistry.getAddress(), CLAIM_TIMEOUT);
+
+  const targets = [proposer.address];
+  const values = [0];
+  const calldatas = [ethers.toUtf8Bytes("bafkqaaa")];
+  const description = "Run a program";
+  await computeDAO.connect(proposer).propose(targets, values, calldatas, description);
+  const proposalId = await computeDAO.hashProposal(targets, values, calldatas, ethers.id(description));
+
+  return {
+    token,
+    computeDAO,
+    nodeRegistry,
+    registry,
+    proposalId,
+    deployer,
+    proposer,
+    node,
+    otherNode,
+    stranger
+  };
+}
+
+module.exports = {
+  CLAIM_TIMEOUT,
+  deployResultsRegistryFixture,
+};
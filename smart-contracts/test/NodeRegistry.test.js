@@ -0,0 +1,106 @@
+const { loadFixture } = require("@nomicfoundation/hardhat-network-helpers");
+const { expect } = require("chai");
+const { ethers } = require("hardhat");
+
+const { deployNodeRegistryFixture } = require("../fixtures/node_registry_fixture");
+
+const GiB = 1024n * 1024n * 1024n;
+
+describe("NodeRegistry", function () {
+  it("Should register a node with its capabilities", async function () {
+    const { registry, operator } = await loadFixture(deployNodeRegistryFixture);
+
+    await expect(registry.connect(operator).register("QmPeer", "amd64", 8, 16n * GiB, ["native", "wasm"]))
+      .to.emit(registry, "NodeRegistered")
+      .withArgs(operator.address, "QmPeer");
+
+    const node = await registry.getNode(operator.address);
+    expect(node.peerId).to.equal("QmPeer");
+    expect(node.arch).to.equal("amd64");
+    expect(node.cpus).to.equal(8);
+    expect(node.memoryBytes).to.equal(16n * GiB);
+    expect(node.runtimes).to.deep.equal(["native", "wasm"]);
+    expect(node.registeredAt).to.be.greaterThan(0);
+
+    expect(await registry.isRegistered(operator.address)).to.equal(true);
+    expect(await registry.operatorOf("QmPeer")).to.equal(operator.address);
+    expect(await registry.getOperators()).to.deep.equal([operator.address]);
+  });
+
+  it("Should update a registered node in place", async function () {
+    const { registry, operator } = await loadFixture(deployNodeRegistryFixture);
+
+    await registry.connect(operator).register("QmPeer", "amd64", 8, GiB, ["native"]);
+    await registry.connect(operator).register("QmNewPeer", "arm64", 4, GiB, ["native", "oci"]);
+
+    expect(await registry.nodeCount()).to.equal(1);
+    const node = await registry.getNode(operator.address);
+    expect(node.peerId).to.equal("QmNewPeer");
+    expect(node.arch).to.equal("arm64");
+    expect(await registry.operatorOf("QmPeer")).to.equal(ethers.ZeroAddress);
+  });
+
+  it("Should not let two operators claim the same peer ID", async function () {
+    const { registry, operator, otherOperator } = await loadFixture(deployNodeRegistryFixture);
+
+    await registry.connect(operator).register("QmPeer", "amd64", 8, GiB, ["native"]);
+    await expect(registry.connect(otherOperator).register("QmPeer", "amd64", 8, GiB, ["native"]))
+      .to.be.revertedWithCustomError(registry, "PeerIdTaken")
+      .withArgs("QmPeer", operator.address);
+  });
+
+  it("Should reject an empty peer ID", async function () {
+    const { registry, operator } = await loadFixture(deployNodeRegistryFixture);
+
+    await expect(registry.connect(operator).register("", "amd64", 8, GiB, ["native"]))
+      .to.be.revertedWithCustomError(registry, "EmptyPeerId");
+  });
+
+  it("Should deregister a node", async function () {
+    const { registry, operator, otherOperator } = await loadFixture(deployNodeRegistryFixture);
+
+    await registry.connect(operator).register("QmPeer", "amd64", 8, GiB, ["native"]);
+    await registry.connect(otherOperator).register("QmOther", "arm64", 2, GiB, ["wasm"]);
+
+    await expect(registry.connect(operator).deregister())
+      .to.emit(registry, "NodeDeregistered")
+      .withArgs(operator.address);
+
+    expect(await registry.isRegistered(operator.address)).to.equal(false);
+    expect(await registry.getOperators()).to.deep.equal([otherOperator.address]);
+    expect(await registry.operatorOf("QmPeer")).to.equal(ethers.ZeroAddress);
+
+    await expect(registry.connect(operator).deregister())
+      .to.be.revertedWithCustomError(registry, "NotRegistered")
+      .withArgs(operator.address);
+  });
+
+  it("Should only let allowed operators register", async function () {
+    const { registry, stranger } = await loadFixture(deployNodeRegistryFixture);
+
+    await expect(registry.connect(stranger).register("QmStranger", "amd64", 8, GiB, ["native"]))
+      .to.be.revertedWithCustomError(registry, "OperatorNotAllowed")
+      .withArgs(stranger.address);
+    expect(await registry.isAllowedOperator(stranger.address)).to.equal(false);
+  });
+
+  it("Should let the owner allow and disallow operators", async function () {
+    const { registry, deployer, operator, stranger } = await loadFixture(deployNodeRegistryFixture);
+
+    await expect(registry.connect(deployer).setOperatorAllowed(stranger.address, true))
+      .to.emit(registry, "OperatorAllowed")
+      .withArgs(stranger.address, true);
+    await registry.connect(stranger).register("QmStranger", "amd64", 8, GiB, ["native"]);
+
+    // Disallowed operators keep their registration but can't update it.
+    await registry.connect(deployer).setOperatorAllowed(stranger.address, false);
+    expect(await registry.isAllowedOperator(stranger.address)).to.equal(false);
+    expect(await registry.isRegistered(stranger.address)).to.equal(true);
+    await expect(registry.connect(stranger).register("QmOther", "amd64", 8, GiB, ["native"]))
+      .to.be.revertedWithCustomError(registry, "OperatorNotAllowed");
+
+    await expect(registry.connect(operator).setOperatorAllowed(stranger.address, true))
+      .to.be.revertedWithCustomError(registry, "OwnableUnauthorizedAccount")
+      .withArgs(operator.address);
+  });
+});
@@ -0,0 +1,237 @@
+const { loadFixture, time } = require("@nomicfoundation/hardhat-network-helpers");
+const { expect } = require("chai");
+const { ethers } = require("hardhat");
+
+const { CLAIM_TIMEOUT, deployResultsRegistryFixture } = require("../fixtures/results_registry_fixture");
+
+// Has node claim the first replica of shard and submit a result for it
+async function claimAndSubmit(registry, proposalId, node, shard, exitCode, outputCid, runtime) {
+  await registry.connect(node).claimShard(proposalId, shard, 0);
+  await registry.connect(node).submitResult(proposalId, shard, "bafyprogram", exitCode, outputCid, runtime);
+}
+
+describe("ResultsRegistry", function () {
+  it("Should record a node's result for a proposal", async function () {
+    const { registry, proposalId, node } = await loadFixture(deployResultsRegistryFixture);
+
+    await registry.connect(node).claimShard(proposalId, 0, 0);
+    await expect(registry.connect(node).submitResult(proposalId, 0, "bafyprogram", 0, "bafyoutput", 42))
+      .to.emit(registry, "ResultSubmitted")
+      .withArgs(proposalId, node.address, 0, "bafyprogram", 0, "bafyoutput", 42);
+
+    const result = await registry.getResult(proposalId, node.address);
+    expect(result.node).to.equal(node.address);
+    expect(result.programCid).to.equal("bafyprogram");
+    expect(result.exitCode).to.equal(0);
+    expect(result.outputCid).to.equal("bafyoutput");
+    expect(result.runtime).to.equal(42);
+    expect(result.submittedAt).to.be.greaterThan(0);
+
+    expect(await registry.hasSubmitted(proposalId, node.address)).to.equal(true);
+    expect(await registry.getNodes(proposalId)).to.deep.equal([node.address]);
+  });
+
+  it("Should keep results from different nodes apart", async function () {
+    const { registry, proposalId, node, otherNode } = await loadFixture(deployResultsRegistryFixture);
+
+    await claimAndSubmit(registry, proposalId, node, 0, 0, "bafyoutput", 42);
+    await claimAndSubmit(registry, proposalId, otherNode, 1, -9, "", 7);
+
+    expect(await registry.resultCount(proposalId)).to.equal(2);
+    const other = await registry.getResult(proposalId, otherNode.address);
+    expect(other.exitCode).to.equal(-9);
+    expect(other.shard).to.equal(1);
+  });
+
+  it("Should reject a second result from the same node", async function () {
+    const { registry, proposalId, node } = await loadFixture(deployResultsRegistryFixture);
+
+    await claimAndSubmit(registry, proposalId, node, 0, 0, "bafyoutput", 42);
+    await expect(registry.connect(node).submitResult(proposalId, 0, "bafyprogram", 1, "", 1))
+      .to.be.revertedWithCustomError(registry, "AlreadySubmitted")
+      .withArgs(proposalId, node.address);
+  });
+
+  it("Should reject results for unknown proposals", async function () {
+    const { registry, node } = await loadFixture(deployResultsRegistryFixture);
+
+    await expect(registry.connect(node).submitResult(1234, 0, "bafyprogram", 0, "", 1))
+      .to.be.revertedWithCustomError(registry, "UnknownProposal")
+      .withArgs(1234);
+  });
+
+  it("Should reject an empty program CID", async function () {
+    const { registry, proposalId, node } = await loadFixture(deployResultsRegistryFixture);
+
+    await registry.connect(node).claimShard(proposalId, 0, 0);
+    await expect(registry.connect(node).submitResult(proposalId, 0, "", 0, "", 1))
+      .to.be.revertedWithCustomError(registry, "EmptyProgramCid");
+  });
+
+  it("Should only take results from nodes, for the shard they claimed", async function () {
+    const { nodeRegistry, registry, proposalId, node, otherNode, stranger } = await loadFixture(deployResultsRegistryFixture);
+
+    await expect(registry.connect(stranger).submitResult(proposalId, 0, "bafyprogram", 0, "", 1))
+      .to.be.revertedWithCustomError(registry, "NotANode")
+      .withArgs(stranger.address);
+    await expect(registry.connect(node).submitResult(proposalId, 0, "bafyprogram", 0, "", 1))
+      .to.be.revertedWithCustomError(registry, "NotClaimed")
+      .withArgs(proposalId, node.address, 0);
+
+    await registry.connect(node).claimShard(proposalId, 3, 1);
+    await expect(registry.connect(node).submitResult(proposalId, 1, "bafyprogram", 0, "", 1))
+      .to.be.revertedWithCustomError(registry, "NotClaimed")
+      .withArgs(proposalId, node.address, 1);
+    // The shard counts, not the replica.
+    await registry.connect(node).submitResult(proposalId, 3, "bafyprogram", 0, "", 1);
+
+    // A claim that expired doesn't count either.
+    await registry.connect(otherNode).claimShard(proposalId, 4, 0);
+    await time.increase(CLAIM_TIMEOUT);
+    await expect(registry.connect(otherNode).submitResult(proposalId, 4, "bafyprogram", 0, "", 1))
+      .to.be.revertedWithCustomError(registry, "NotClaimed")
+      .withArgs(proposalId, otherNode.address, 4);
+
+    // Nor does a node whose operator was taken off the node registry's list.
+    await registry.connect(otherNode).claimShard(proposalId, 4, 0);
+    await nodeRegistry.setOperatorAllowed(otherNode.address, false);
+    await expect(registry.connect(otherNode).submitResult(proposalId, 4, "bafyprogram", 0, "", 1))
+      .to.be.revertedWithCustomError(registry, "NotANode")
+      .withArgs(otherNode.address);
+  });
+
+  it("Should give each replica of a shard to the first node that claims it", async function () {
+    const { registry, proposalId, node, otherNode } = await loadFixture(deployResultsRegistryFixture);
+
+    await expect(registry.connect(node).claimShard(proposalId, 3, 0))
+      .to.emit(registry, "ShardClaimed")
+      .withArgs(proposalId, 3, node.address, 0);
+    expect(await registry.shardClaimant(proposalId, 3, 0)).to.equal(node.address);
+
+    await expect(registry.connect(otherNode).claimShard(proposalId, 3, 0))
+      .to.be.revertedWithCustomError(registry, "ShardTaken")
+      .withArgs(proposalId, 3, 0, node.address);
+
+    await registry.connect(otherNode).claimShard(proposalId, 3, 1);
+    expect(await registry.shardClaimant(proposalId, 3, 1)).to.equal(otherNode.address);
+  });
+
+  it("Should give each node one shard per job", async function () {
+    const { registry, proposalId, node } = await loadFixture(deployResultsRegistryFixture);
+
+    await registry.connect(node).claimShard(proposalId, 3, 1);
+    await expect(registry.connect(node).claimShard(proposalId, 4, 0))
+      .to.be.revertedWithCustomError(registry, "AlreadyClaimed")
+      .withArgs(proposalId, node.address, 3);
+    expect(await registry.claimOf(proposalId, node.address)).to.deep.equal([true, 3n, 1n]);
+  });
+
+  it("Should only let registered nodes claim shards", async function () {
+    const { nodeRegistry, registry, proposalId, node, stranger } = await loadFixture(deployResultsRegistryFixture);
+
+    await expect(registry.connect(stranger).claimShard(proposalId, 0, 0))
+      .to.be.revertedWithCustomError(registry, "NotANode")
+      .withArgs(stranger.address);
+
+    // Nor nodes whose operator was taken off the node registry's list.
+    await nodeRegistry.setOperatorAllowed(node.address, false);
+    await expect(registry.connect(node).claimShard(proposalId, 0, 0))
+      .to.be.revertedWithCustomError(registry, "NotANode")
+      .withArgs(node.address);
+  });
+
+  it("Should free shards whose claims expired without a result", async function () {
+    const { registry, proposalId, node, otherNode } = await loadFixture(deployResultsRegistryFixture);
+
+    await registry.connect(node).claimShard(proposalId, 3, 0);
+    await time.increase(CLAIM_TIMEOUT);
+    expect(await registry.shardClaimant(proposalId, 3, 0)).to.equal(ethers.ZeroAddress);
+    expect(await registry.claimOf(proposalId, node.address)).to.deep.equal([false, 0n, 0n]);
+
+    await expect(registry.connect(otherNode).claimShard(proposalId, 3, 0))
+      .to.emit(registry, "ShardClaimed")
+      .withArgs(proposalId, 3, otherNode.address, 0);
+    // The node that let its claim expire can claim another shard.
+    await registry.connect(node).claimShard(proposalId, 4, 0);
+    expect(await registry.shardClaimant(proposalId, 4, 0)).to.equal(node.address);
+  });
+
+  it("Should keep claims with a result past the timeout", async function () {
+    const { registry, proposalId, node, otherNode } = await loadFixture(deployResultsRegistryFixture);
+
+    await claimAndSubmit(registry, proposalId, node, 3, 0, "bafyoutput", 42);
+    await time.increase(CLAIM_TIMEOUT);
+
+    expect(await registry.shardClaimant(proposalId, 3, 0)).to.equal(node.address);
+    await expect(registry.connect(otherNode).claimShard(proposalId, 3, 0))
+      .to.be.revertedWithCustomError(registry, "ShardTaken")
+      .withArgs(proposalId, 3, 0, node.address);
+  });
+
+  it("Should let a node dispute a different result for the same shard", async function () {
+    const { registry, proposalId, node, otherNode } = await loadFixture(deployResultsRegistryFixture);
+
+    await registry.connect(node).claimShard(proposalId, 2, 0);
+    await registry.connect(node).submitResult(proposalId, 2, "bafyprogram", 0, "bafygood", 42);
+    await registry.connect(otherNode).claimShard(proposalId, 2, 1);
+    await registry.connect(otherNode).submitResult(proposalId, 2, "bafyprogram", 0, "bafybad", 40);
+
+    await expect(registry.connect(node).reportDispute(proposalId, otherNode.address))
+      .to.emit(registry, "ResultDisputed")
+      .withArgs(proposalId, node.address, otherNode.address, 2);
+    expect(await registry.disputeCount(proposalId, otherNode.address)).to.equal(1);
+
+    await expect(registry.connect(node).reportDispute(proposalId, otherNode.address))
+      .to.be.revertedWithCustomError(registry, "AlreadyDisputed")
+      .withArgs(proposalId, node.address, otherNode.address);
+  });
+
+  it("Should reject disputes between matching results", async function () {
+    const { registry, proposalId, node, otherNode } = await loadFixture(deployResultsRegistryFixture);
+
+    await claimAndSubmit(registry, proposalId, node, 0, 0, "bafyoutput", 42);
+    await expect(registry.connect(node).reportDispute(proposalId, otherNode.address))
+      .to.be.revertedWithCustomError(registry, "NoResult")
+      .withArgs(proposalId, otherNode.address);
+
+    await registry.connect(otherNode).claimShard(proposalId, 0, 1);
+    await registry.connect(otherNode).submitResult(proposalId, 0, "bafyprogram", 0, "bafyoutput", 7);
+    await expect(registry.connect(node).reportDispute(proposalId, otherNode.address))
+      .to.be.revertedWithCustomError(registry, "ResultsMatch")
+      .withArgs(proposalId, otherNode.address);
+  });
+
+  it("Should reject disputes across shards", async function () {
+    const { registry, proposalId, node, otherNode } = await loadFixture(deployResultsRegistryFixture);
+
+    await claimAndSubmit(registry, proposalId, node, 0, 0, "bafyoutput", 42);
+    await claimAndSubmit(registry, proposalId, otherNode, 1, 0, "bafyother", 42);
+    await expect(registry.connect(node).reportDispute(proposalId, otherNode.address))
+      .to.be.revertedWithCustomError(registry, "DifferentShards")
+      .withArgs(proposalId, otherNode.address);
+  });
+
+  it("Should only take disputes from nodes", async function () {
+    const { nodeRegistry, registry, proposalId, node, otherNode, stranger } = await loadFixture(deployResultsRegistryFixture);
+
+    await claimAndSubmit(registry, proposalId, node, 0, 0, "bafygood", 42);
+    await registry.connect(otherNode).claimShard(proposalId, 0, 1);
+    await registry.connect(otherNode).submitResult(proposalId, 0, "bafyprogram", 0, "bafybad", 40);
+
+    await expect(registry.connect(stranger).reportDispute(proposalId, otherNode.address))
+      .to.be.revertedWithCustomError(registry, "NotANode")
+      .withArgs(stranger.address);
+    await nodeRegistry.setOperatorAllowed(node.address, false);
+    await expect(registry.connect(node).reportDispute(proposalId, otherNode.address))
+      .to.be.revertedWithCustomError(registry, "NotANode")
+      .withArgs(node.address);
+  });
+
+  it("Should reject shard claims for unknown proposals", async function () {
+    const { registry, node } = await loadFixture(deployResultsRegistryFixture);
+
+    await expect(registry.connect(node).claimShard(1234, 0, 0))
+      .to.be.revertedWithCustomError(registry, "UnknownProposal")
+      .withArgs(1234);
+  });
+});
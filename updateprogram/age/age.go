@@ -0,0 +1,100 @@
+// Package age encrypts and decrypts files in the age v1 format
+// (https://age-encryption.org/v1) with X25519 keys, on top of filippo.io/age,
+// for keys the node derives rather than reads from a key file.
+package age
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// ErrNoIdentityMatch is returned by Decrypt when the file isn't encrypted to
+// the identity.
+var ErrNoIdentityMatch = errors.New("file is not encrypted to this identity")
+
+// Identity is an X25519 private key, which decrypts the files encrypted to
+// its Recipient.
+type Identity struct {
+	id *age.X25519Identity
+}
+
+// NewIdentity makes an identity out of a 32 byte X25519 scalar.
+func NewIdentity(scalar []byte) (*Identity, error) {
+	if len(scalar) != 32 {
+		return nil, fmt.Errorf("X25519 scalar is %d bytes, not 32", len(scalar))
+	}
+	// filippo.io/age only makes identities out of their key file encoding.
+	s, err := bech32Encode("age-secret-key-", scalar)
+	if err != nil {
+		return nil, err
+	}
+	id, err := age.ParseX25519Identity(strings.ToUpper(s))
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{id: id}, nil
+}
+
+func (i *Identity) Recipient() *Recipient {
+	return &Recipient{r: i.id.Recipient()}
+}
+
+// Recipient is an X25519 public key, written as "age1...".
+type Recipient struct {
+	r *age.X25519Recipient
+}
+
+func ParseRecipient(s string) (*Recipient, error) {
+	r, err := age.ParseX25519Recipient(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad recipient %q: %w", s, err)
+	}
+	return &Recipient{r: r}, nil
+}
+
+func (r *Recipient) String() string {
+	return r.r.String()
+}
+
+// Encrypt encrypts plaintext so that any of recipients can decrypt it.
+func Encrypt(plaintext []byte, recipients ...*Recipient) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	rs := make([]age.Recipient, len(recipients))
+	for i, r := range recipients {
+		rs[i] = r.r
+	}
+
+	var out bytes.Buffer
+	w, err := age.Encrypt(&out, rs...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Decrypt decrypts a file encrypted to identity, checking that it hasn't
+// been tampered with.
+func Decrypt(ciphertext []byte, identity *Identity) ([]byte, error) {
+	r, err := age.Decrypt(bytes.NewReader(ciphertext), identity.id)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return nil, ErrNoIdentityMatch
+	}
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
@@ -0,0 +1,101 @@
+package age
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func newTestIdentity(t *testing.T) *Identity {
+	t.Helper()
+	scalar := make([]byte, 32)
+	rand.Read(scalar)
+	id, err := NewIdentity(scalar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestRoundTrip(t *testing.T) {
+	alice, bob, eve := newTestIdentity(t), newTestIdentity(t), newTestIdentity(t)
+	// Empty, one chunk, and over a chunk of 64 KiB.
+	for _, size := range []int{0, 1000, 200 << 10} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		ciphertext, err := Encrypt(plaintext, alice.Recipient(), bob.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []*Identity{alice, bob} {
+			got, err := Decrypt(ciphertext, id)
+			if err != nil || !bytes.Equal(got, plaintext) {
+				t.Errorf("%d bytes: decrypted %d bytes, %v", size, len(got), err)
+			}
+		}
+		if _, err := Decrypt(ciphertext, eve); !errors.Is(err, ErrNoIdentityMatch) {
+			t.Errorf("%d bytes: decrypting with another identity: %v", size, err)
+		}
+
+		tampered := append([]byte{}, ciphertext...)
+		tampered[len(tampered)-1] ^= 1
+		if _, err := Decrypt(tampered, alice); err == nil {
+			t.Errorf("%d bytes: decrypted a tampered file", size)
+		}
+	}
+}
+
+// The recipient is the scalar's X25519 public key, as nodes have always
+// announced it.
+func TestRecipient(t *testing.T) {
+	scalar := make([]byte, 32)
+	rand.Read(scalar)
+	id, err := NewIdentity(scalar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(scalar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := bech32Encode("age", key.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := id.Recipient().String(); got != want {
+		t.Errorf("recipient %s, want %s", got, want)
+	}
+
+	r, err := ParseRecipient(want)
+	if err != nil || r.String() != want {
+		t.Errorf("parsed %s as %v, %v", want, r, err)
+	}
+	for _, bad := range []string{"", want[:len(want)-1] + "q", "AGE" + want[3:] + "x", "age1qqqq"} {
+		if _, err := ParseRecipient(bad); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+	if _, err := NewIdentity(scalar[:31]); err == nil {
+		t.Error("made an identity out of a short scalar")
+	}
+}
+
+// Valid strings from BIP 173 that hold whole bytes.
+func TestBech32Encode(t *testing.T) {
+	for _, tc := range []struct {
+		hrp  string
+		data []byte
+		want string
+	}{
+		{"a", nil, "a12uel5l"},
+		{"abcdef", []byte{0x00, 0x44, 0x32, 0x14, 0xc7, 0x42, 0x54, 0xb6, 0x35, 0xcf, 0x84, 0x65, 0x3a, 0x56, 0xd7, 0xc6, 0x75, 0xbe, 0x77, 0xdf}, "abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw"},
+		{"split", []byte{0xc5, 0xf3, 0x8b, 0x70, 0x30, 0x5f, 0x51, 0x9b, 0xf6, 0x6d, 0x85, 0xfb, 0x6c, 0xf0, 0x30, 0x58, 0xf3, 0xdd, 0xe4, 0x63, 0xec, 0xd7, 0x91, 0x8f, 0x2d, 0xc7, 0x43, 0x91, 0x8f, 0x2d}, "split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w"},
+	} {
+		got, err := bech32Encode(tc.hrp, tc.data)
+		if err != nil || got != tc.want {
+			t.Errorf("bech32Encode(%q, %x) = %s, %v, want %s", tc.hrp, tc.data, got, err, tc.want)
+		}
+	}
+}
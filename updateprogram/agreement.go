@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Gossip topic nodes announce the results of replicated jobs on.
+const resultsTopic = "updateprogram/results"
+
+// AgreementConfig controls checking the results of jobs that several nodes
+// run, so no single volunteer's output has to be trusted. Results are checked
+// against the ResultsRegistry, so it needs results reporting.
+type AgreementConfig struct {
+	// How long to wait for the other replicas of a job to announce their
+	// results before deciding on what arrived.
+	Timeout Duration `yaml:"timeout"`
+	// Flag nodes that disagree with the majority on the ResultsRegistry.
+	// Needs results reporting.
+	ReportDisputes bool `yaml:"report_disputes"`
+}
+
+func (cfg *Config) validateAgreement(bad func(field, format string, args ...interface{})) {
+	if cfg.Agreement.Timeout <= 0 {
+		bad("agreement.timeout", "must be positive")
+	}
+	if cfg.Agreement.ReportDisputes && !cfg.Results.enabled() {
+		bad("agreement.report_disputes", "needs results.registry_address")
+	}
+}
+
+// How long a job is kept after its vote, for the status API and for late
+// results to be held against the majority.
+const agreementTTL = 24 * time.Hour
+
+// Most announcements being checked against the registry at once.
+// Announcements beyond that are dropped.
+const maxResultChecks = 8
+
+// errResultUnchecked is why an announcement that couldn't be checked yet,
+// as opposed to one found not to hold, is dropped.
+var errResultUnchecked = errors.New("can't check the result")
+
+// resultAnnouncement is what a node tells its peers after running a
+// replicated job and submitting the result to the ResultsRegistry.
+type resultAnnouncement struct {
+	ProposalID string `json:"proposal_id"`
+	Shard      int    `json:"shard"`
+	ProgramCID string `json:"program_cid"`
+	ExitCode   int    `json:"exit_code"`
+	OutputCID  string `json:"output_cid,omitempty"`
+	// Account the node submitted the result from.
+	Operator string `json:"operator"`
+}
+
+// outcome is the part of a result the replicas have to agree on.
+func (a *resultAnnouncement) outcome() string {
+	return fmt.Sprintf("%s exit %d", a.OutputCID, a.ExitCode)
+}
+
+// resultRegistry is the part of the ResultsRegistry agreement needs.
+type resultRegistry interface {
+	address() common.Address
+	// checkResult errors unless node is registered and submitted the result
+	// ann announces, wrapping errResultUnchecked if it couldn't tell.
+	checkResult(ctx context.Context, proposal *big.Int, node common.Address, ann *resultAnnouncement) error
+	reportDispute(ctx context.Context, proposal *big.Int, node common.Address) error
+}
+
+type nodeResult struct {
+	Node      peer.ID `json:"node"`
+	Operator  string  `json:"operator"`
+	ExitCode  int     `json:"exit_code"`
+	OutputCID string  `json:"output_cid,omitempty"`
+}
+
+type jobKey struct {
+	proposal string
+	shard    int
+}
+
+// expectedJob is what the vote for a replicated job asked for.
+// Announcements for it have to match.
+type expectedJob struct {
+	replicas   int
+	programCID string
+	shards     int
+	seen       time.Time
+}
+
+// jobTally collects the announced results of one shard of a job.
+type jobTally struct {
+	ProposalID string       `json:"proposal_id"`
+	Shard      int          `json:"shard"`
+	Replicas   int          `json:"replicas"`
+	ProgramCID string       `json:"program_cid"`
+	Results    []nodeResult `json:"results"`
+	FirstSeen  time.Time    `json:"first_seen"`
+
+	Decided bool `json:"decided"`
+	// Result most replicas agreed on, empty if there was no majority.
+	Majority string `json:"majority,omitempty"`
+	// Nodes whose result differs from the majority.
+	Dissenters []peer.ID `json:"dissenters,omitempty"`
+	Disputed   bool      `json:"disputed"`
+
+	// Outcomes by operator, so each registered node counts once.
+	outcomes map[common.Address]string
+	timer    *time.Timer
+}
+
+// agreement tallies the results replicas announce and decides on the
+// majority once all of them are in or the timeout passes. Only jobs this
+// node saw the vote for are tallied, with the replicas the vote asked for,
+// and only results that registered nodes submitted to the registry count.
+type agreement struct {
+	ctx     context.Context
+	cfg     AgreementConfig
+	log     *slog.Logger
+	topic   *pubsub.Topic
+	metrics *metrics
+
+	mu       sync.Mutex
+	expected map[string]*expectedJob
+	jobs     map[jobKey]*jobTally
+	pruned   time.Time
+	// Set once the chain client is up, if results are reported. Until then
+	// announcements are dropped.
+	registry resultRegistry
+}
+
+func newAgreement(ctx context.Context, cfg AgreementConfig, log *slog.Logger, ps *pubsub.PubSub, m *metrics) (*agreement, error) {
+	a := &agreement{
+		ctx:      ctx,
+		cfg:      cfg,
+		log:      log,
+		metrics:  m,
+		expected: map[string]*expectedJob{},
+		jobs:     map[jobKey]*jobTally{},
+		pruned:   time.Now(),
+	}
+	topic, err := joinTopic(ctx, ps, log, resultsTopic, a.validate, a.handle,
+		pubsub.WithValidatorConcurrency(maxResultChecks), pubsub.WithValidatorTimeout(30*time.Second))
+	if err != nil {
+		return nil, err
+	}
+	a.topic = topic
+	return a, nil
+}
+
+// useRegistry checks announcements against r, and reports disputes
+// through it.
+func (a *agreement) useRegistry(r resultRegistry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.registry = r
+}
+
+// Expect starts tallying announcements for the replicated job m, whose vote
+// this node saw, or keeps them tallied for another agreementTTL once a
+// scheduled job activates.
+func (a *agreement) Expect(m *Manifest) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	a.prune(now)
+	// Every vote for the proposal carries it; the first one counts.
+	if job, ok := a.expected[m.proposal.String()]; ok {
+		job.seen = now
+		return
+	}
+	shards := len(m.Shards)
+	if shards == 0 {
+		shards = 1
+	}
+	a.expected[m.proposal.String()] = &expectedJob{
+		replicas:   m.replicas(),
+		programCID: m.CID,
+		shards:     shards,
+		seen:       now,
+	}
+}
+
+// Announce tells the network what this node got for a replicated job. The
+// node's own announcement is tallied like everyone else's.
+func (a *agreement) Announce(ann resultAnnouncement) error {
+	data, err := json.Marshal(ann)
+	if err != nil {
+		return err
+	}
+	return publish(a.ctx, a.topic, data)
+}
+
+// validate only lets announcements through that check out.
+func (a *agreement) validate(ctx context.Context, msg *pubsub.Message) pubsub.ValidationResult {
+	var ann resultAnnouncement
+	if err := json.Unmarshal(msg.Data, &ann); err != nil {
+		a.log.Warn("bad result announcement", "from", msg.GetFrom(), "err", err)
+		return pubsub.ValidationReject
+	}
+	if err := a.check(ctx, &ann); err != nil {
+		if errors.Is(err, errResultUnchecked) {
+			a.log.Debug("ignoring result announcement", "from", msg.GetFrom(), "proposal", ann.ProposalID, "err", err)
+			return pubsub.ValidationIgnore
+		}
+		a.log.Warn("rejecting result announcement", "from", msg.GetFrom(), "proposal", ann.ProposalID, "operator", ann.Operator, "err", err)
+		return pubsub.ValidationReject
+	}
+	msg.ValidatorData = &ann
+	return pubsub.ValidationAccept
+}
+
+// check errors unless ann is for a job this node saw the vote for, and is
+// the result its operator submitted to the registry.
+func (a *agreement) check(ctx context.Context, ann *resultAnnouncement) error {
+	proposal, ok := new(big.Int).SetString(ann.ProposalID, 10)
+	if !ok {
+		return fmt.Errorf("bad proposal ID %q", ann.ProposalID)
+	}
+	if !common.IsHexAddress(ann.Operator) {
+		return fmt.Errorf("bad operator %q", ann.Operator)
+	}
+
+	a.mu.Lock()
+	job, registry := a.expected[ann.ProposalID], a.registry
+	a.mu.Unlock()
+	switch {
+	case registry == nil:
+		return fmt.Errorf("%w: not following the registry", errResultUnchecked)
+	case job == nil:
+		return fmt.Errorf("%w: no vote seen for the proposal", errResultUnchecked)
+	case ann.ProgramCID != job.programCID:
+		return fmt.Errorf("program %s, the vote asked for %s", ann.ProgramCID, job.programCID)
+	case ann.Shard < 0 || ann.Shard >= job.shards:
+		return fmt.Errorf("shard %d of a job with %d", ann.Shard, job.shards)
+	}
+	return registry.checkResult(ctx, proposal, common.HexToAddress(ann.Operator), ann)
+}
+
+func (a *agreement) handle(msg *pubsub.Message) {
+	a.tally(msg.GetFrom(), msg.ValidatorData.(*resultAnnouncement))
+}
+
+// tally counts from's announced result towards its job, once per operator.
+func (a *agreement) tally(from peer.ID, ann *resultAnnouncement) {
+	a.log.Debug("result announced", "from", from, "proposal", ann.ProposalID, "shard", ann.Shard, "outcome", ann.outcome())
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	expected := a.expected[ann.ProposalID]
+	if expected == nil {
+		// Pruned since it was checked.
+		return
+	}
+	key := jobKey{ann.ProposalID, ann.Shard}
+	job, ok := a.jobs[key]
+	if !ok {
+		job = &jobTally{
+			ProposalID: ann.ProposalID,
+			Shard:      ann.Shard,
+			Replicas:   expected.replicas,
+			ProgramCID: expected.programCID,
+			FirstSeen:  time.Now(),
+			outcomes:   map[common.Address]string{},
+		}
+		a.jobs[key] = job
+		job.timer = time.AfterFunc(time.Duration(a.cfg.Timeout), func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			if !job.Decided {
+				a.decide(job)
+			}
+		})
+	}
+
+	operator := common.HexToAddress(ann.Operator)
+	if _, ok := job.outcomes[operator]; ok {
+		return
+	}
+	job.outcomes[operator] = ann.outcome()
+	job.Results = append(job.Results, nodeResult{
+		Node:      from,
+		Operator:  operator.Hex(),
+		ExitCode:  ann.ExitCode,
+		OutputCID: ann.OutputCID,
+	})
+
+	switch {
+	case job.Decided:
+		// Late results are held against the decided majority.
+		if job.Majority != "" && ann.outcome() != job.Majority {
+			a.dissent(job, from, operator)
+		}
+	case len(job.outcomes) >= job.Replicas:
+		job.timer.Stop()
+		a.decide(job)
+	}
+}
+
+// decide picks the outcome more than half the announced results agree on.
+// a.mu must be held.
+func (a *agreement) decide(job *jobTally) {
+	job.Decided = true
+
+	counts := map[string]int{}
+	for _, o := range job.outcomes {
+		counts[o]++
+	}
+	for o, n := range counts {
+		if 2*n > len(job.outcomes) {
+			job.Majority = o
+		}
+	}
+
+	if job.Majority == "" {
+		job.Disputed = true
+		a.metrics.resultDisputes.Inc()
+		a.log.Warn("replicas don't agree on a result", "proposal", job.ProposalID, "shard", job.Shard, "results", len(job.outcomes), "outcomes", len(counts))
+		return
+	}
+
+	a.log.Info("replicas agreed on a result", "proposal", job.ProposalID, "shard", job.Shard, "outcome", job.Majority, "results", len(job.outcomes), "replicas", job.Replicas)
+	for _, r := range job.Results {
+		operator := common.HexToAddress(r.Operator)
+		if job.outcomes[operator] != job.Majority {
+			a.dissent(job, r.Node, operator)
+		}
+	}
+}
+
+// dissent flags a node whose result differs from the majority, and reports
+// it on-chain if this node is part of that majority. a.mu must be held.
+func (a *agreement) dissent(job *jobTally, node peer.ID, operator common.Address) {
+	job.Disputed = true
+	job.Dissenters = append(job.Dissenters, node)
+	a.metrics.resultDisputes.Inc()
+	a.log.Warn("node disagrees with the majority", "proposal", job.ProposalID, "shard", job.Shard, "node", node, "operator", operator)
+
+	registry := a.registry
+	if !a.cfg.ReportDisputes || registry == nil || job.outcomes[registry.address()] != job.Majority {
+		return
+	}
+	proposal, _ := new(big.Int).SetString(job.ProposalID, 10)
+	go func() {
+		if err := registry.reportDispute(a.ctx, proposal, operator); err != nil {
+			a.log.Error("failed to report dispute", "proposal", proposal, "node", node, "err", err)
+		}
+	}()
+}
+
+// prune drops jobs and expected jobs older than agreementTTL, checking at
+// most once a minute. a.mu must be held.
+func (a *agreement) prune(now time.Time) {
+	if now.Sub(a.pruned) < time.Minute {
+		return
+	}
+	a.pruned = now
+	for key, job := range a.jobs {
+		if now.Sub(job.FirstSeen) > agreementTTL {
+			job.timer.Stop()
+			delete(a.jobs, key)
+		}
+	}
+	for id, job := range a.expected {
+		if now.Sub(job.seen) > agreementTTL {
+			delete(a.expected, id)
+		}
+	}
+}
+
+// Jobs returns the tallies of all replicated jobs seen, newest first.
+func (a *agreement) Jobs() []jobTally {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	jobs := make([]jobTally, 0, len(a.jobs))
+	for _, job := range a.jobs {
+		j := *job
+		j.outcomes, j.timer = nil, nil
+		j.Results = append([]nodeResult{}, job.Results...)
+		j.Dissenters = append([]peer.ID{}, job.Dissenters...)
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].FirstSeen.After(jobs[j].FirstSeen)
+	})
+	return jobs
+}
+
+// reportDispute flags node's result for the proposal on the registry. The
+// registry rejects it unless both results are in and differ.
+func (r *resultReporter) reportDispute(ctx context.Context, proposal *big.Int, node common.Address) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	input, err := r.abi.Pack("reportDispute", proposal, node)
+	if err != nil {
+		return err
+	}
+	receipt, err := r.transact(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	r.log.Info("dispute reported", "proposal", proposal, "node", node, "tx", receipt.TxHash)
+	return nil
+}
+
+// registeredResult is a Result as the registry returns it.
+type registeredResult struct {
+	Node        common.Address
+	Shard       *big.Int
+	ProgramCid  string
+	ExitCode    *big.Int
+	OutputCid   string
+	Runtime     *big.Int
+	SubmittedAt *big.Int
+}
+
+// checkResult errors unless node can submit results and the one it
+// submitted for the proposal is what ann says.
+func (r *resultReporter) checkResult(ctx context.Context, proposal *big.Int, node common.Address, ann *resultAnnouncement) error {
+	values, err := r.call(ctx, "isNode", node)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errResultUnchecked, err)
+	}
+	if !values[0].(bool) {
+		return fmt.Errorf("%s isn't registered by an allowed operator", node)
+	}
+
+	values, err = r.call(ctx, "getResult", proposal, node)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errResultUnchecked, err)
+	}
+	res := abi.ConvertType(values[0], new(registeredResult)).(*registeredResult)
+	switch {
+	case res.SubmittedAt.Sign() == 0:
+		// Not mined yet, as far as this node's RPC knows.
+		return fmt.Errorf("%w: %s has no result on the registry", errResultUnchecked, node)
+	case res.Shard.Cmp(big.NewInt(int64(ann.Shard))) != 0,
+		res.ProgramCid != ann.ProgramCID,
+		res.ExitCode.Cmp(big.NewInt(int64(ann.ExitCode))) != 0,
+		res.OutputCid != ann.OutputCID:
+		return fmt.Errorf("%s submitted a different result to the registry", node)
+	}
+	return nil
+}
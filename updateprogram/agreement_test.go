@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// registryFake is a ResultsRegistry holding the results of registered nodes.
+type registryFake struct {
+	self common.Address
+
+	mu         sync.Mutex
+	registered map[common.Address]bool
+	results    map[common.Address]resultAnnouncement
+	disputes   []common.Address
+}
+
+func newRegistryFake(self common.Address) *registryFake {
+	return &registryFake{
+		self:       self,
+		registered: map[common.Address]bool{},
+		results:    map[common.Address]resultAnnouncement{},
+	}
+}
+
+// submit registers node and records ann as its result.
+func (r *registryFake) submit(node common.Address, ann resultAnnouncement) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.registered[node] = true
+	r.results[node] = ann
+}
+
+func (r *registryFake) address() common.Address {
+	return r.self
+}
+
+func (r *registryFake) checkResult(ctx context.Context, proposal *big.Int, node common.Address, ann *resultAnnouncement) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.registered[node] {
+		return fmt.Errorf("%s isn't registered", node)
+	}
+	res, ok := r.results[node]
+	if !ok {
+		return fmt.Errorf("%w: no result", errResultUnchecked)
+	}
+	if res != *ann {
+		return errors.New("different result")
+	}
+	return nil
+}
+
+func (r *registryFake) reportDispute(ctx context.Context, proposal *big.Int, node common.Address) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.disputes = append(r.disputes, node)
+	return nil
+}
+
+func (r *registryFake) reported() []common.Address {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]common.Address{}, r.disputes...)
+}
+
+func newTestAgreement(t *testing.T, registry resultRegistry) *agreement {
+	t.Helper()
+	return &agreement{
+		ctx:      context.Background(),
+		cfg:      AgreementConfig{Timeout: Duration(time.Hour), ReportDisputes: true},
+		log:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		metrics:  newMetrics(nil, nil, nil),
+		expected: map[string]*expectedJob{},
+		jobs:     map[jobKey]*jobTally{},
+		pruned:   time.Now(),
+		registry: registry,
+	}
+}
+
+var testProposal = big.NewInt(42)
+
+func replicatedManifest(replicas int) *Manifest {
+	return &Manifest{CID: "bafyprogram", Replicas: replicas, proposal: testProposal}
+}
+
+// announceResult has operator n submit and announce output, checking it the
+// way the topic validator does, and tallies it if it passes.
+func announceResult(t *testing.T, a *agreement, registry *registryFake, n int, output string) {
+	t.Helper()
+	ann := resultAnnouncement{
+		ProposalID: testProposal.String(),
+		ProgramCID: "bafyprogram",
+		OutputCID:  output,
+		Operator:   operatorAddress(n).Hex(),
+	}
+	registry.submit(operatorAddress(n), ann)
+	if err := a.check(context.Background(), &ann); err != nil {
+		t.Fatalf("announcement of operator %d: %v", n, err)
+	}
+	a.tally(peer.ID(fmt.Sprintf("peer%d", n)), &ann)
+}
+
+func operatorAddress(n int) common.Address {
+	return common.BigToAddress(big.NewInt(int64(0xa0 + n)))
+}
+
+func onlyJob(t *testing.T, a *agreement) jobTally {
+	t.Helper()
+	jobs := a.Jobs()
+	if len(jobs) != 1 {
+		t.Fatalf("%d jobs, want 1", len(jobs))
+	}
+	return jobs[0]
+}
+
+func TestAgreementDecide(t *testing.T) {
+	registry := newRegistryFake(operatorAddress(0))
+	a := newTestAgreement(t, registry)
+	a.Expect(replicatedManifest(3))
+
+	announceResult(t, a, registry, 0, "bafyright")
+	announceResult(t, a, registry, 1, "bafywrong")
+	if job := onlyJob(t, a); job.Decided {
+		t.Fatal("decided before all replicas announced")
+	}
+	announceResult(t, a, registry, 2, "bafyright")
+
+	job := onlyJob(t, a)
+	if !job.Decided || job.Majority != "bafyright exit 0" {
+		t.Fatalf("decided %v on %q, want the majority result", job.Decided, job.Majority)
+	}
+	if len(job.Dissenters) != 1 || job.Dissenters[0] != "peer1" {
+		t.Errorf("dissenters %v, want peer1", job.Dissenters)
+	}
+	waitFor(t, "the dissent to be reported", func() bool { return len(registry.reported()) == 1 })
+	if got := registry.reported()[0]; got != operatorAddress(1) {
+		t.Errorf("reported %s, want %s", got, operatorAddress(1))
+	}
+}
+
+func TestAgreementNoMajority(t *testing.T) {
+	registry := newRegistryFake(operatorAddress(0))
+	a := newTestAgreement(t, registry)
+	a.Expect(replicatedManifest(2))
+
+	announceResult(t, a, registry, 0, "bafyone")
+	announceResult(t, a, registry, 1, "bafytwo")
+
+	job := onlyJob(t, a)
+	if !job.Decided || job.Majority != "" || !job.Disputed {
+		t.Errorf("decided %v, majority %q, disputed %v; want a disputed job without a majority", job.Decided, job.Majority, job.Disputed)
+	}
+	if got := registry.reported(); len(got) != 0 {
+		t.Errorf("reported %v without a majority", got)
+	}
+}
+
+func TestAgreementDecidesOnTimeout(t *testing.T) {
+	registry := newRegistryFake(operatorAddress(0))
+	a := newTestAgreement(t, registry)
+	a.cfg.Timeout = Duration(10 * time.Millisecond)
+	a.Expect(replicatedManifest(3))
+
+	announceResult(t, a, registry, 0, "bafyright")
+	waitFor(t, "the job to be decided", func() bool { return onlyJob(t, a).Decided })
+	if job := onlyJob(t, a); job.Majority != "bafyright exit 0" {
+		t.Errorf("majority %q, want the only result", job.Majority)
+	}
+}
+
+func TestAgreementCountsOperatorsOnce(t *testing.T) {
+	registry := newRegistryFake(operatorAddress(0))
+	a := newTestAgreement(t, registry)
+	a.Expect(replicatedManifest(3))
+
+	announceResult(t, a, registry, 1, "bafywrong")
+	// Other peers passing on the same operator's result don't add to it.
+	ann := registry.results[operatorAddress(1)]
+	a.tally("sybil1", &ann)
+	a.tally("sybil2", &ann)
+
+	if job := onlyJob(t, a); job.Decided || len(job.Results) != 1 {
+		t.Errorf("decided %v with %d results, want one undecided result", job.Decided, len(job.Results))
+	}
+}
+
+func TestAgreementCheck(t *testing.T) {
+	registry := newRegistryFake(operatorAddress(0))
+	a := newTestAgreement(t, registry)
+	a.Expect(replicatedManifest(2))
+
+	good := resultAnnouncement{
+		ProposalID: testProposal.String(),
+		ProgramCID: "bafyprogram",
+		OutputCID:  "bafyout",
+		Operator:   operatorAddress(1).Hex(),
+	}
+	registry.submit(operatorAddress(1), good)
+
+	tests := []struct {
+		name      string
+		change    func(ann *resultAnnouncement)
+		unchecked bool
+		ok        bool
+	}{
+		{"submitted", func(ann *resultAnnouncement) {}, false, true},
+		{"other program", func(ann *resultAnnouncement) { ann.ProgramCID = "bafyother" }, false, false},
+		{"shard past the job's", func(ann *resultAnnouncement) { ann.Shard = 1 }, false, false},
+		{"not what was submitted", func(ann *resultAnnouncement) { ann.OutputCID = "bafyother" }, false, false},
+		{"unregistered operator", func(ann *resultAnnouncement) { ann.Operator = operatorAddress(9).Hex() }, false, false},
+		{"bad operator", func(ann *resultAnnouncement) { ann.Operator = "me" }, false, false},
+		{"bad proposal", func(ann *resultAnnouncement) { ann.ProposalID = "x" }, false, false},
+		{"no vote seen", func(ann *resultAnnouncement) { ann.ProposalID = "43" }, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ann := good
+			tt.change(&ann)
+			err := a.check(context.Background(), &ann)
+			if tt.ok != (err == nil) || tt.unchecked != errors.Is(err, errResultUnchecked) {
+				t.Errorf("check: %v, want ok %v, unchecked %v", err, tt.ok, tt.unchecked)
+			}
+		})
+	}
+
+	a.useRegistry(nil)
+	if err := a.check(context.Background(), &good); !errors.Is(err, errResultUnchecked) {
+		t.Errorf("check without a registry: %v, want it unchecked", err)
+	}
+}
+
+func TestAgreementPrune(t *testing.T) {
+	registry := newRegistryFake(operatorAddress(0))
+	a := newTestAgreement(t, registry)
+	a.Expect(replicatedManifest(2))
+	announceResult(t, a, registry, 0, "bafyout")
+
+	a.mu.Lock()
+	a.prune(time.Now().Add(agreementTTL + time.Minute))
+	jobs, expected := len(a.jobs), len(a.expected)
+	a.mu.Unlock()
+	if jobs != 0 || expected != 0 {
+		t.Errorf("%d jobs and %d expected jobs left after they expired", jobs, expected)
+	}
+}
@@ -0,0 +1,93 @@
+//go:build e2e
+
+package main
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Typed bindings for the parts of the contracts the end-to-end test uses,
+// in the shape abigen would generate them.
+
+type computeToken struct {
+	*bind.BoundContract
+}
+
+func deployComputeToken(opts *bind.TransactOpts, backend bind.ContractBackend, a *contractArtifact, initialOwner common.Address) (common.Address, *types.Transaction, *computeToken, error) {
+	address, tx, contract, err := bind.DeployContract(opts, a.abi, a.bytecode, backend, initialOwner)
+	if err != nil {
+		return common.Address{}, nil, nil, err
+	}
+	return address, tx, &computeToken{contract}, nil
+}
+
+func (t *computeToken) SafeMint(opts *bind.TransactOpts, to common.Address) (*types.Transaction, error) {
+	return t.Transact(opts, "safeMint", to)
+}
+
+func (t *computeToken) Delegate(opts *bind.TransactOpts, delegatee common.Address) (*types.Transaction, error) {
+	return t.Transact(opts, "delegate", delegatee)
+}
+
+// daoProposal is what a Governor proposal is made of. The same values are
+// passed to propose, hashProposal and execute.
+type daoProposal struct {
+	Targets     []common.Address
+	Values      []*big.Int
+	Calldatas   [][]byte
+	Description string
+}
+
+func (p daoProposal) descriptionHash() [32]byte {
+	return crypto.Keccak256Hash([]byte(p.Description))
+}
+
+type computeDAO struct {
+	*bind.BoundContract
+	abi abi.ABI
+}
+
+func deployComputeDAO(opts *bind.TransactOpts, backend bind.ContractBackend, a *contractArtifact, token common.Address) (common.Address, *types.Transaction, *computeDAO, error) {
+	address, tx, contract, err := bind.DeployContract(opts, a.abi, a.bytecode, backend, token)
+	if err != nil {
+		return common.Address{}, nil, nil, err
+	}
+	return address, tx, &computeDAO{contract, a.abi}, nil
+}
+
+func (d *computeDAO) Propose(opts *bind.TransactOpts, p daoProposal) (*types.Transaction, error) {
+	return d.Transact(opts, "propose", p.Targets, p.Values, p.Calldatas, p.Description)
+}
+
+func (d *computeDAO) HashProposal(opts *bind.CallOpts, p daoProposal) (*big.Int, error) {
+	var out []interface{}
+	if err := d.Call(opts, &out, "hashProposal", p.Targets, p.Values, p.Calldatas, p.descriptionHash()); err != nil {
+		return nil, err
+	}
+	return *abi.ConvertType(out[0], new(*big.Int)).(**big.Int), nil
+}
+
+func (d *computeDAO) CastVoteWithReasonAndParams(opts *bind.TransactOpts, proposalID *big.Int, support uint8, reason string, params []byte) (*types.Transaction, error) {
+	return d.Transact(opts, "castVoteWithReasonAndParams", proposalID, support, reason, params)
+}
+
+func (d *computeDAO) Execute(opts *bind.TransactOpts, p daoProposal) (*types.Transaction, error) {
+	return d.Transact(opts, "execute", p.Targets, p.Values, p.Calldatas, p.descriptionHash())
+}
+
+// Emitted reports whether receipt has a log of the named event.
+func (d *computeDAO) Emitted(receipt *types.Receipt, event string) bool {
+	id := d.abi.Events[event].ID
+	for _, l := range receipt.Logs {
+		if len(l.Topics) > 0 && l.Topics[0] == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+// Package chain follows the DAO contract for votes and executed proposals.
+package chain
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Vote is a VoteCastWithParams log.
+type Vote struct {
+	// Indexed, so read from the topics rather than the data.
+	Voter      common.Address
+	ProposalId *big.Int `abi:"proposalId"`
+	Support    uint8    `abi:"support"`
+	Weight     *big.Int `abi:"weight"`
+	Reason     string   `abi:"reason"`
+	Params     []byte   `abi:"params"`
+
+	// Where the vote was cast.
+	Block  uint64
+	TxHash common.Hash
+}
+
+// UnpackVote reads a VoteCastWithParams log of the contract described by
+// parsedAbi.
+func UnpackVote(parsedAbi abi.ABI, l types.Log) (*Vote, error) {
+	var v Vote
+	if err := parsedAbi.UnpackIntoInterface(&v, "VoteCastWithParams", l.Data); err != nil {
+		return nil, err
+	}
+	if len(l.Topics) > 1 {
+		v.Voter = common.BytesToAddress(l.Topics[1].Bytes())
+	}
+	v.Block = l.BlockNumber
+	v.TxHash = l.TxHash
+	return &v, nil
+}
+
+// Batch is what one poll of the chain found.
+type Batch struct {
+	// Latest block of the chain, and the range of blocks that was read.
+	Head, From, To uint64
+	// Every log in the range, including ones that couldn't be read.
+	Logs  int
+	Votes []*Vote
+	// Proposals executed in the range.
+	Executed []*big.Int
+}
+
+// ChainWatcher reads votes off the chain.
+type ChainWatcher interface {
+	// Poll returns the votes cast and proposals executed from block from up
+	// to the latest block with enough confirmations, or nil if there is no
+	// such block yet.
+	Poll(ctx context.Context, from uint64) (*Batch, error)
+}
+
+// Client is the part of an Ethereum client the Watcher uses.
+type Client interface {
+	BlockNumber(ctx context.Context) (uint64, error)
+	FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error)
+}
+
+// Most blocks asked for in one FilterLogs, which RPC providers limit.
+const MaxLogRange = 5000
+
+// Watcher is a ChainWatcher over a JSON-RPC client.
+type Watcher struct {
+	log           *slog.Logger
+	client        Client
+	abi           abi.ABI
+	contract      common.Address
+	confirmations uint64
+}
+
+func NewWatcher(log *slog.Logger, client Client, parsedAbi abi.ABI, contract common.Address, confirmations uint64) *Watcher {
+	return &Watcher{
+		log:           log,
+		client:        client,
+		abi:           parsedAbi,
+		contract:      contract,
+		confirmations: confirmations,
+	}
+}
+
+func (w *Watcher) Poll(ctx context.Context, from uint64) (*Batch, error) {
+	head, err := w.client.BlockNumber(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get block number: %w", err)
+	}
+
+	// Only look at blocks with enough confirmations.
+	if head < w.confirmations || head-w.confirmations < from {
+		return nil, nil
+	}
+	to := head - w.confirmations
+
+	// A fresh node starts far behind, so the range is asked for in chunks.
+	// If one fails, the batch ends at the last one that didn't.
+	var logs []types.Log
+	next := from
+	for next <= to {
+		end := min(next+MaxLogRange-1, to)
+		chunk, err := w.client.FilterLogs(ctx, ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(next),
+			ToBlock:   new(big.Int).SetUint64(end),
+			Addresses: []common.Address{w.contract},
+			Topics:    [][]common.Hash{{w.abi.Events["VoteCastWithParams"].ID, w.abi.Events["ProposalExecuted"].ID}},
+		})
+		if err != nil {
+			err = fmt.Errorf("filter logs from %d to %d: %w", next, end, err)
+			if next == from {
+				return nil, err
+			}
+			w.log.Warn("stopping at the last block read", "block", next-1, "err", err)
+			break
+		}
+		logs = append(logs, chunk...)
+		next = end + 1
+	}
+
+	batch := &Batch{Head: head, From: from, To: next - 1, Logs: len(logs)}
+	for _, l := range logs {
+		if len(l.Topics) > 0 && l.Topics[0] == w.abi.Events["ProposalExecuted"].ID {
+			values, err := w.abi.Unpack("ProposalExecuted", l.Data)
+			if err != nil || len(values) == 0 {
+				w.log.Warn("failed to unpack log", "tx", l.TxHash, "err", err)
+				continue
+			}
+			id, _ := values[0].(*big.Int)
+			w.log.Debug("found execution log", "block", l.BlockNumber, "tx", l.TxHash, "proposal", id)
+			batch.Executed = append(batch.Executed, id)
+			continue
+		}
+		w.log.Debug("found vote log", "block", l.BlockNumber, "tx", l.TxHash)
+
+		v, err := UnpackVote(w.abi, l)
+		if err != nil {
+			w.log.Warn("failed to unpack log", "tx", l.TxHash, "err", err)
+			continue
+		}
+		batch.Votes = append(batch.Votes, v)
+	}
+	return batch, nil
+}
@@ -0,0 +1,76 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// rangeClient records the block ranges it is asked for logs over, and fails
+// from the failAt'th call on.
+type rangeClient struct {
+	head   uint64
+	ranges [][2]uint64
+	failAt int
+}
+
+func (c *rangeClient) BlockNumber(context.Context) (uint64, error) {
+	return c.head, nil
+}
+
+func (c *rangeClient) FilterLogs(_ context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	if c.failAt > 0 && len(c.ranges)+1 >= c.failAt {
+		return nil, errors.New("range too large")
+	}
+	c.ranges = append(c.ranges, [2]uint64{q.FromBlock.Uint64(), q.ToBlock.Uint64()})
+	return nil, nil
+}
+
+func TestPollChunksRange(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	client := &rangeClient{head: 3*MaxLogRange + 10}
+	w := NewWatcher(log, client, abi.ABI{}, common.Address{}, 2)
+
+	batch, err := w.Poll(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.From != 0 || batch.To != client.head-2 {
+		t.Errorf("batch from %d to %d, want 0 to %d", batch.From, batch.To, client.head-2)
+	}
+	next := uint64(0)
+	for _, r := range client.ranges {
+		if r[0] != next || r[1] < r[0] || r[1]-r[0]+1 > MaxLogRange {
+			t.Fatalf("asked for %v", client.ranges)
+		}
+		next = r[1] + 1
+	}
+	if next != batch.To+1 {
+		t.Fatalf("asked for %v, up to %d", client.ranges, batch.To)
+	}
+
+	// A failed chunk ends the batch at the last one read.
+	client = &rangeClient{head: 3 * MaxLogRange, failAt: 3}
+	w = NewWatcher(log, client, abi.ABI{}, common.Address{}, 0)
+	batch, err = w.Poll(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.From != 1 || batch.To != 2*MaxLogRange {
+		t.Errorf("batch from %d to %d after a failed chunk, want 1 to %d", batch.From, batch.To, 2*MaxLogRange)
+	}
+
+	// Failing on the first chunk is an error.
+	client = &rangeClient{head: 10, failAt: 1}
+	w = NewWatcher(log, client, abi.ABI{}, common.Address{}, 0)
+	if _, err := w.Poll(context.Background(), 0); err == nil {
+		t.Error("no error when no logs could be read")
+	}
+}
@@ -0,0 +1,77 @@
+package chain
+
+import (
+	"context"
+	"math/big"
+	"sync"
+)
+
+type fakeExecution struct {
+	block uint64
+	id    *big.Int
+}
+
+// Fake is a ChainWatcher for tests. Votes and executions are added to the
+// current block, and Mine moves on to the next one.
+type Fake struct {
+	mu       sync.Mutex
+	head     uint64
+	votes    []*Vote
+	executed []fakeExecution
+	// Returned by Poll instead of the votes while set.
+	Err error
+}
+
+func NewFake() *Fake {
+	return &Fake{head: 1}
+}
+
+// AddVote casts v in the current block.
+func (f *Fake) AddVote(v *Vote) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v.Block = f.head
+	f.votes = append(f.votes, v)
+}
+
+// AddExecuted executes proposal id in the current block.
+func (f *Fake) AddExecuted(id *big.Int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.executed = append(f.executed, fakeExecution{block: f.head, id: id})
+}
+
+// Mine starts a new block and returns its number.
+func (f *Fake) Mine() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.head++
+	return f.head
+}
+
+// Poll only returns blocks that have been mined past.
+func (f *Fake) Poll(ctx context.Context, from uint64) (*Batch, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	if f.head-1 < from {
+		return nil, nil
+	}
+
+	batch := &Batch{Head: f.head, From: from, To: f.head - 1}
+	for _, v := range f.votes {
+		if v.Block >= from && v.Block <= batch.To {
+			batch.Votes = append(batch.Votes, v)
+		}
+	}
+	for _, e := range f.executed {
+		if e.block >= from && e.block <= batch.To {
+			batch.Executed = append(batch.Executed, e.id)
+		}
+	}
+	batch.Logs = len(batch.Votes) + len(batch.Executed)
+	return batch, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"golang.org/x/crypto/hkdf"
+
+	"example.com/v2/age"
+	"example.com/v2/executor"
+)
+
+// ageIdentity derives the node's age identity from its libp2p key, so it
+// lasts as long as the peer ID whose heartbeats announce its recipient.
+func ageIdentity(priv crypto.PrivKey) (*age.Identity, error) {
+	raw, err := priv.Raw()
+	if err != nil {
+		return nil, err
+	}
+	scalar := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, raw, nil, []byte("updateprogram age identity")), scalar); err != nil {
+		return nil, err
+	}
+	return age.NewIdentity(scalar)
+}
+
+// decryptInput decrypts the shard input saved at saved for the program's
+// sandbox, returning it as a secret and where the program finds it.
+func (n *node) decryptInput(saved string) (executor.Secret, string, error) {
+	if n.identity == nil {
+		return executor.Secret{}, "", fmt.Errorf("node has no age identity")
+	}
+	data, err := os.ReadFile(saved)
+	if err != nil {
+		return executor.Secret{}, "", err
+	}
+	plaintext, err := age.Decrypt(data, n.identity)
+	if err != nil {
+		return executor.Secret{}, "", err
+	}
+	secret := executor.Secret{Name: "input", Data: plaintext}
+	return secret, path.Join(executor.SecretDir, secret.Name), nil
+}
+
+// outputRecipient is who m's published output and logs are encrypted to, or
+// nil if they are published as they are.
+func (m *Manifest) outputRecipient() *age.Recipient {
+	if m.OutputRecipient == "" {
+		return nil
+	}
+	r, _ := age.ParseRecipient(m.OutputRecipient)
+	return r
+}
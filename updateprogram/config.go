@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"gopkg.in/yaml.v3"
+)
+
+// Seed node for network, used when no seeds are configured.
+const defaultSeed = "/ip4/45.32.243.35/tcp/4001/p2p/12D3KooWE5jRAPoZQSe59FQpsftBJ1Gxj4NquaHT152tso6hCuAm"
+
+const defaultConfigPath = "updateprogram.yaml"
+
+// Duration is a time.Duration that reads as "30s" style strings in the config file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+type ChainConfig struct {
+	RPCURL          string   `yaml:"rpc_url"`
+	ChainID         uint64   `yaml:"chain_id"`
+	ContractAddress string   `yaml:"contract_address"`
+	TokenAddress    string   `yaml:"token_address"`
+	StartBlock      uint64   `yaml:"start_block"`
+	Confirmations   uint64   `yaml:"confirmations"`
+	PollInterval    Duration `yaml:"poll_interval"`
+}
+
+type P2PConfig struct {
+	Seeds       []string `yaml:"seeds"`
+	ListenAddrs []string `yaml:"listen_addrs"`
+
+	// File with a pre-shared key in the swarm.key format. Only nodes with
+	// the same key can connect at all. Empty joins the public network.
+	SwarmKey string `yaml:"swarm_key"`
+	// Only these peer IDs, plus the seeds and relays, may connect. Empty and without
+	// allow_registered lets everyone connect.
+	AllowedPeers []string `yaml:"allowed_peers"`
+	// Also allow the nodes registered on heartbeat.registry_address.
+	AllowRegistered  bool     `yaml:"allow_registered"`
+	AllowlistRefresh Duration `yaml:"allowlist_refresh"`
+
+	// Relays a node behind NAT can be reached through. Empty tries the seeds.
+	Relays []string `yaml:"relays"`
+	// Relay for nodes behind NAT and answer their AutoNAT probes. Only
+	// makes sense on a publicly reachable node, like a seed.
+	RelayService bool `yaml:"relay_service"`
+	// Ask the router to forward a port with UPnP or NAT-PMP.
+	NATPortMap bool `yaml:"nat_port_map"`
+	// Upgrade relayed connections to direct ones through the NAT.
+	HolePunching bool `yaml:"hole_punching"`
+
+	// Find and connect to other nodes on the local network with mDNS.
+	MDNS bool `yaml:"mdns"`
+	// mDNS service name. Fleets sharing a LAN can keep apart with their own.
+	MDNSService string `yaml:"mdns_service"`
+}
+
+// allowlist reports whether connections are limited to allowed peers.
+func (cfg *P2PConfig) allowlist() bool {
+	return len(cfg.AllowedPeers) > 0 || cfg.AllowRegistered
+}
+
+type ExecutorConfig struct {
+	Args        []string `yaml:"args"`
+	Env         []string `yaml:"env"`
+	WorkDir     string   `yaml:"work_dir"`
+	StopTimeout Duration `yaml:"stop_timeout"`
+	// A cgroup v2 directory delegated to the node, which runs each workload
+	// in a child cgroup held to its resources. Empty doesn't hold them.
+	Cgroup string `yaml:"cgroup"`
+	// Run OCI images as well as native programs, and say so in heartbeats.
+	OCI bool `yaml:"oci"`
+}
+
+// PolicyConfig decides which votes are allowed to upgrade the program.
+type PolicyConfig struct {
+	// Only votes cast by these addresses are acted on. Empty allows everyone.
+	AllowedVoters []string `yaml:"allowed_voters"`
+	// Votes must be in favour of the proposal (support == 1).
+	RequireSupport bool `yaml:"require_support"`
+	// Minimum voting weight a vote needs to trigger an upgrade.
+	MinWeight uint64 `yaml:"min_weight"`
+	// Largest program in bytes that will be downloaded. 0 means no limit.
+	MaxProgramSize int64    `yaml:"max_program_size"`
+	FetchTimeout   Duration `yaml:"fetch_timeout"`
+}
+
+// APIConfig is the local status and control API.
+type APIConfig struct {
+	// TCP address to serve on, must be loopback. Empty disables it.
+	Listen string `yaml:"listen"`
+	// Optional unix socket to serve on as well.
+	Socket string `yaml:"socket"`
+	// Bearer token for the control endpoints. If empty one is generated
+	// into the data dir as api_token.
+	Token string `yaml:"token"`
+	// Extra address that only serves /metrics, which may be public so
+	// Prometheus can scrape it. /metrics is always on the API as well.
+	MetricsListen string `yaml:"metrics_listen"`
+}
+
+type Config struct {
+	Chain    ChainConfig    `yaml:"chain"`
+	P2P      P2PConfig      `yaml:"p2p"`
+	DataDir  string         `yaml:"data_dir"`
+	Executor ExecutorConfig `yaml:"executor"`
+	Policy   PolicyConfig   `yaml:"policy"`
+	API      APIConfig      `yaml:"api"`
+	Log      LogConfig      `yaml:"log"`
+
+	ProgramLogs ProgramLogsConfig `yaml:"program_logs"`
+	Results     ResultsConfig     `yaml:"results"`
+	Agreement   AgreementConfig   `yaml:"agreement"`
+	Heartbeat   HeartbeatConfig   `yaml:"heartbeat"`
+	Limits      LimitsConfig      `yaml:"limits"`
+	Workloads   WorkloadsConfig   `yaml:"workloads"`
+	Prefetch    PrefetchConfig    `yaml:"prefetch"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Chain: ChainConfig{
+			PollInterval: Duration(3 * time.Second),
+		},
+		P2P: P2PConfig{
+			Seeds:            []string{defaultSeed},
+			ListenAddrs:      []string{"/ip4/0.0.0.0/tcp/0", "/ip4/0.0.0.0/udp/0/quic-v1"},
+			AllowlistRefresh: Duration(5 * time.Minute),
+			NATPortMap:       true,
+			HolePunching:     true,
+			MDNSService:      "updateprogram",
+		},
+		DataDir: "updateprogram-data",
+		Executor: ExecutorConfig{
+			StopTimeout: Duration(5 * time.Second),
+		},
+		Policy: PolicyConfig{
+			FetchTimeout: Duration(5 * time.Minute),
+		},
+		API: APIConfig{
+			Listen: "127.0.0.1:5080",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		ProgramLogs: ProgramLogsConfig{
+			MaxSize:  10 << 20,
+			MaxFiles: 5,
+		},
+		Results: ResultsConfig{
+			MaxRetries:     5,
+			RetryInterval:  Duration(30 * time.Second),
+			ReceiptTimeout: Duration(2 * time.Minute),
+		},
+		Agreement: AgreementConfig{
+			Timeout: Duration(10 * time.Minute),
+		},
+		Heartbeat: HeartbeatConfig{
+			Interval: Duration(30 * time.Second),
+		},
+		Workloads: WorkloadsConfig{
+			Default: Resources{CPUs: 1, MemoryMB: 512},
+		},
+		Prefetch: PrefetchConfig{
+			MaxSize: 256 << 20,
+		},
+	}
+}
+
+// loadConfigFile reads path over cfg. A missing file is only an error when
+// the path was given explicitly.
+func loadConfigFile(cfg *Config, path string, explicit bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && !explicit {
+			return nil
+		}
+		return err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv overrides cfg with any environment variables that are set. The
+// names used by the original .env file keep working.
+func applyEnv(cfg *Config) error {
+	var errs []error
+
+	str := func(name string, dst *string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = v
+		}
+	}
+	list := func(name string, dst *[]string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = strings.Fields(v)
+		}
+	}
+	number := func(name string, dst *uint64) {
+		if v, ok := os.LookupEnv(name); ok {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*dst = n
+		}
+	}
+
+	boolean := func(name string, dst *bool) {
+		if v, ok := os.LookupEnv(name); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*dst = b
+		}
+	}
+
+	str("RPC_URL", &cfg.Chain.RPCURL)
+	number("CHAIN_ID", &cfg.Chain.ChainID)
+	str("CONTRACT_ADDR", &cfg.Chain.ContractAddress)
+	str("TOKEN_ADDR", &cfg.Chain.TokenAddress)
+	number("START_BLOCK", &cfg.Chain.StartBlock)
+	number("CONFIRMATIONS", &cfg.Chain.Confirmations)
+	list("SEEDS", &cfg.P2P.Seeds)
+	list("LISTEN_ADDRS", &cfg.P2P.ListenAddrs)
+	str("SWARM_KEY", &cfg.P2P.SwarmKey)
+	list("ALLOWED_PEERS", &cfg.P2P.AllowedPeers)
+	list("RELAYS", &cfg.P2P.Relays)
+	boolean("RELAY_SERVICE", &cfg.P2P.RelayService)
+	boolean("MDNS", &cfg.P2P.MDNS)
+	str("DATA_DIR", &cfg.DataDir)
+	str("API_LISTEN", &cfg.API.Listen)
+	str("API_TOKEN", &cfg.API.Token)
+	str("METRICS_LISTEN", &cfg.API.MetricsListen)
+	str("LOG_LEVEL", &cfg.Log.Level)
+	str("LOG_FORMAT", &cfg.Log.Format)
+	str("RESULTS_REGISTRY", &cfg.Results.RegistryAddress)
+	str("OPERATOR_KEYSTORE", &cfg.Results.Keystore)
+	str("NODE_REGISTRY", &cfg.Heartbeat.RegistryAddress)
+	str("EXECUTOR_CGROUP", &cfg.Executor.Cgroup)
+	boolean("EXECUTOR_OCI", &cfg.Executor.OCI)
+	boolean("PUBLISH_LOGS", &cfg.ProgramLogs.Publish)
+	boolean("REPORT_DISPUTES", &cfg.Agreement.ReportDisputes)
+	boolean("PREFETCH", &cfg.Prefetch.Enabled)
+	list("PREFETCH_PROPOSERS", &cfg.Prefetch.Proposers)
+
+	// Extra peers to connect to on top of the seeds.
+	if v, ok := os.LookupEnv("AUTOCONNECT_ADDRESSES"); ok {
+		cfg.P2P.Seeds = append(cfg.P2P.Seeds, strings.Fields(v)...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// stringList is a flag that splits on whitespace and commas.
+type stringList struct{ dst *[]string }
+
+func (l stringList) String() string {
+	if l.dst == nil {
+		return ""
+	}
+	return strings.Join(*l.dst, ",")
+}
+
+func (l stringList) Set(v string) error {
+	*l.dst = strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })
+	return nil
+}
+
+// loadConfig builds the config from defaults, then the config file, then the
+// environment and finally the command line flags in args. Commands can add
+// flags of their own with extraFlags.
+func loadConfig(name string, args []string, extraFlags ...func(fs *flag.FlagSet)) (Config, error) {
+	cfg := defaultConfig()
+
+	// Flags are parsed into a scratch config so they can be applied last.
+	var path string
+	var flagCfg Config
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&path, "config", "", "path to the config file (default "+defaultConfigPath+")")
+	fs.StringVar(&flagCfg.Chain.RPCURL, "rpc-url", "", "Ethereum JSON-RPC endpoint")
+	fs.Uint64Var(&flagCfg.Chain.ChainID, "chain-id", 0, "expected chain ID")
+	fs.StringVar(&flagCfg.Chain.ContractAddress, "contract", "", "ComputeDAO contract address")
+	fs.StringVar(&flagCfg.Chain.TokenAddress, "token", "", "ComputeToken contract address")
+	fs.Uint64Var(&flagCfg.Chain.StartBlock, "start-block", 0, "first block to scan for votes")
+	fs.Uint64Var(&flagCfg.Chain.Confirmations, "confirmations", 0, "blocks to wait before acting on a log")
+	fs.Var(stringList{&flagCfg.P2P.Seeds}, "seeds", "comma separated seed multiaddrs")
+	fs.Var(stringList{&flagCfg.P2P.ListenAddrs}, "listen", "comma separated listen multiaddrs")
+	fs.BoolVar(&flagCfg.P2P.RelayService, "relay", false, "relay for nodes behind NAT (needs a public address)")
+	fs.BoolVar(&flagCfg.P2P.MDNS, "mdns", false, "find peers on the local network with mDNS")
+	fs.StringVar(&flagCfg.DataDir, "data-dir", "", "directory for node state")
+	fs.StringVar(&flagCfg.Log.Level, "log-level", "", "debug, info, warn or error")
+	fs.StringVar(&flagCfg.Log.Format, "log-format", "", "text or json")
+	for _, f := range extraFlags {
+		f(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigPath
+	}
+	if err := loadConfigFile(&cfg, path, explicit); err != nil {
+		return cfg, err
+	}
+	if err := applyEnv(&cfg); err != nil {
+		return cfg, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "rpc-url":
+			cfg.Chain.RPCURL = flagCfg.Chain.RPCURL
+		case "chain-id":
+			cfg.Chain.ChainID = flagCfg.Chain.ChainID
+		case "contract":
+			cfg.Chain.ContractAddress = flagCfg.Chain.ContractAddress
+		case "token":
+			cfg.Chain.TokenAddress = flagCfg.Chain.TokenAddress
+		case "start-block":
+			cfg.Chain.StartBlock = flagCfg.Chain.StartBlock
+		case "confirmations":
+			cfg.Chain.Confirmations = flagCfg.Chain.Confirmations
+		case "seeds":
+			cfg.P2P.Seeds = flagCfg.P2P.Seeds
+		case "listen":
+			cfg.P2P.ListenAddrs = flagCfg.P2P.ListenAddrs
+		case "relay":
+			cfg.P2P.RelayService = flagCfg.P2P.RelayService
+		case "mdns":
+			cfg.P2P.MDNS = flagCfg.P2P.MDNS
+		case "data-dir":
+			cfg.DataDir = flagCfg.DataDir
+		case "log-level":
+			cfg.Log.Level = flagCfg.Log.Level
+		case "log-format":
+			cfg.Log.Format = flagCfg.Log.Format
+		}
+	})
+
+	return cfg, nil
+}
+
+// Validate returns every problem with the config joined into one error.
+func (cfg *Config) Validate() error {
+	var errs []error
+	bad := func(field, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if cfg.Chain.RPCURL == "" {
+		bad("chain.rpc_url", "is required")
+	} else if u, err := url.Parse(cfg.Chain.RPCURL); err != nil {
+		bad("chain.rpc_url", "%v", err)
+	} else {
+		switch u.Scheme {
+		case "http", "https", "ws", "wss", "":
+		default:
+			bad("chain.rpc_url", "unsupported scheme %q", u.Scheme)
+		}
+	}
+
+	if cfg.Chain.ContractAddress == "" {
+		bad("chain.contract_address", "is required")
+	} else if !common.IsHexAddress(cfg.Chain.ContractAddress) {
+		bad("chain.contract_address", "%q is not an address", cfg.Chain.ContractAddress)
+	}
+	if cfg.Chain.TokenAddress != "" && !common.IsHexAddress(cfg.Chain.TokenAddress) {
+		bad("chain.token_address", "%q is not an address", cfg.Chain.TokenAddress)
+	}
+	if cfg.Chain.PollInterval <= 0 {
+		bad("chain.poll_interval", "must be positive")
+	}
+
+	for _, s := range cfg.P2P.Seeds {
+		maddr, err := multiaddr.NewMultiaddr(s)
+		if err == nil {
+			_, err = peer.AddrInfoFromP2pAddr(maddr)
+		}
+		if err != nil {
+			bad("p2p.seeds", "%q: %v", s, err)
+		}
+	}
+	if len(cfg.P2P.ListenAddrs) == 0 {
+		bad("p2p.listen_addrs", "at least one address is required")
+	}
+	for _, s := range cfg.P2P.ListenAddrs {
+		if _, err := multiaddr.NewMultiaddr(s); err != nil {
+			bad("p2p.listen_addrs", "%q: %v", s, err)
+		}
+	}
+	for _, s := range cfg.P2P.Relays {
+		maddr, err := multiaddr.NewMultiaddr(s)
+		if err == nil {
+			_, err = peer.AddrInfoFromP2pAddr(maddr)
+		}
+		if err != nil {
+			bad("p2p.relays", "%q: %v", s, err)
+		}
+	}
+	if cfg.P2P.MDNS && cfg.P2P.MDNSService == "" {
+		bad("p2p.mdns_service", "required with mdns")
+	}
+	if cfg.P2P.SwarmKey != "" {
+		if _, err := loadSwarmKey(cfg.P2P.SwarmKey); err != nil {
+			bad("p2p.swarm_key", "%v", err)
+		}
+	}
+	for _, s := range cfg.P2P.AllowedPeers {
+		if _, err := peer.Decode(s); err != nil {
+			bad("p2p.allowed_peers", "%q: %v", s, err)
+		}
+	}
+	if cfg.P2P.AllowRegistered {
+		if cfg.Heartbeat.RegistryAddress == "" {
+			bad("p2p.allow_registered", "needs heartbeat.registry_address")
+		}
+		if cfg.P2P.AllowlistRefresh <= 0 {
+			bad("p2p.allowlist_refresh", "must be positive")
+		}
+	}
+
+	if cfg.DataDir == "" {
+		bad("data_dir", "is required")
+	}
+
+	if cfg.Executor.WorkDir != "" {
+		if fi, err := os.Stat(cfg.Executor.WorkDir); err != nil {
+			bad("executor.work_dir", "%v", err)
+		} else if !fi.IsDir() {
+			bad("executor.work_dir", "%q is not a directory", cfg.Executor.WorkDir)
+		}
+	}
+	for _, kv := range cfg.Executor.Env {
+		if !strings.Contains(kv, "=") {
+			bad("executor.env", "%q is not KEY=VALUE", kv)
+		}
+	}
+	if cfg.Executor.StopTimeout < 0 {
+		bad("executor.stop_timeout", "must not be negative")
+	}
+	if cfg.Executor.Cgroup != "" {
+		if _, err := os.Stat(filepath.Join(cfg.Executor.Cgroup, "cgroup.controllers")); err != nil {
+			bad("executor.cgroup", "%q is not a cgroup v2 directory: %v", cfg.Executor.Cgroup, err)
+		}
+	}
+
+	for _, a := range cfg.Policy.AllowedVoters {
+		if !common.IsHexAddress(a) {
+			bad("policy.allowed_voters", "%q is not an address", a)
+		}
+	}
+	if cfg.Policy.MaxProgramSize < 0 {
+		bad("policy.max_program_size", "must not be negative")
+	}
+	if cfg.Policy.FetchTimeout <= 0 {
+		bad("policy.fetch_timeout", "must be positive")
+	}
+
+	if cfg.API.Listen != "" {
+		host, _, err := net.SplitHostPort(cfg.API.Listen)
+		if err != nil {
+			bad("api.listen", "%v", err)
+		} else if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			bad("api.listen", "%q is not a loopback address", host)
+		}
+	}
+	if cfg.API.MetricsListen != "" {
+		if _, _, err := net.SplitHostPort(cfg.API.MetricsListen); err != nil {
+			bad("api.metrics_listen", "%v", err)
+		}
+	}
+
+	cfg.Log.validate(bad)
+
+	if cfg.ProgramLogs.MaxSize < 0 {
+		bad("program_logs.max_size", "must not be negative")
+	}
+	if cfg.ProgramLogs.MaxFiles < 0 {
+		bad("program_logs.max_files", "must not be negative")
+	}
+
+	cfg.Results.validate(bad)
+	cfg.validateAgreement(bad)
+	cfg.validateHeartbeat(bad)
+	cfg.validateLimits(bad)
+	cfg.validateWorkloads(bad)
+	cfg.validatePrefetch(bad)
+
+	return errors.Join(errs...)
+}
+
+// statePath is where the node keeps the given file inside the data dir.
+func (cfg *Config) statePath(name string) string {
+	return filepath.Join(cfg.DataDir, name)
+}
+
+// redacted returns a copy of cfg safe to print, without the API token or a
+// password in the RPC URL.
+func (cfg *Config) redacted() *Config {
+	out := *cfg
+	if out.API.Token != "" {
+		out.API.Token = "xxxxx"
+	}
+	if u, err := url.Parse(out.Chain.RPCURL); err == nil {
+		out.Chain.RPCURL = u.Redacted()
+	}
+	return &out
+}
+
+// configCommand implements "updateprogram config check".
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "usage: updateprogram config check [flags]")
+		return 2
+	}
+
+	cfg, err := loadConfig("config check", args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	if err := cfg.Validate(); err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintln(os.Stderr, "error:", line)
+		}
+		return 1
+	}
+
+	out, err := yaml.Marshal(cfg.redacted())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	fmt.Print(string(out))
+	fmt.Println("Config OK.")
+	return 0
+}
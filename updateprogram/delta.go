@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+
+	chunker "github.com/ipfs/boxo/chunker"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/balanced"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/helpers"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/klauspost/compress/zstd"
+
+	"example.com/v2/policy"
+)
+
+// Programs are published with content-defined chunking, so the blocks a
+// change doesn't touch stay the same from one version to the next.
+const publishChunker = "buzhash"
+
+// Largest program a patch is applied to get, whatever the policy allows, so
+// a small patch can't fill up the node's memory.
+const maxPatchedProgram = 1 << 30
+
+// Delta is a zstd patch from a base program to the manifest's, made with the
+// base as a raw dictionary: what `zstd --patch-from` writes.
+type Delta struct {
+	Base  string `json:"base"`
+	Patch string `json:"patch"`
+	// How the program was split into blocks, as `ipfs add --chunker` takes
+	// it, for the rebuilt program to hash to the manifest's CID. Empty is
+	// ipfs's default.
+	Chunker string `json:"chunker,omitempty"`
+}
+
+func (d *Delta) validate() error {
+	if _, err := cid.Parse(d.Base); err != nil {
+		return fmt.Errorf("not a valid base cid %q: %w", d.Base, err)
+	}
+	if _, err := cid.Parse(d.Patch); err != nil {
+		return fmt.Errorf("not a valid patch cid %q: %w", d.Patch, err)
+	}
+	if _, err := chunker.FromString(bytes.NewReader(nil), d.Chunker); err != nil {
+		return err
+	}
+	return nil
+}
+
+// fetchDelta rebuilds m's program from the base program the node saved
+// before and m's patch, and checks that it is what m's CID names.
+func (n *node) fetchDelta(ctx context.Context, m *Manifest) ([]byte, error) {
+	base, err := n.state.Program(m.Delta.Base)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("don't have the base program")
+	} else if err != nil {
+		return nil, err
+	}
+
+	patch, err := n.fetch(ctx, cid.MustParse(m.Delta.Patch))
+	if err != nil {
+		return nil, fmt.Errorf("patch: %w", err)
+	}
+	data, err := applyPatch(base, patch, maxPatchedProgram, n.policy)
+	if err != nil {
+		return nil, fmt.Errorf("apply patch: %w", err)
+	}
+
+	// The blocks go to the node's DAG like fetched ones would, so it can
+	// serve them, once they check out.
+	var blocks heldBlocks
+	c, err := importFile(&blocks, data, m.Delta.Chunker, m.cid().Prefix())
+	if err != nil {
+		return nil, err
+	}
+	if !c.Equals(m.cid()) {
+		return nil, fmt.Errorf("rebuilt program is %s", c)
+	}
+	if err := n.dag.AddMany(ctx, blocks.nodes); err != nil {
+		return nil, err
+	}
+	n.log.fetch.Info("rebuilt program from delta", "cid", m.CID, "base", m.Delta.Base, "patch_bytes", len(patch), "bytes", len(data))
+	return data, nil
+}
+
+// makePatch returns the patch from base to target that applyPatch takes.
+func makePatch(base, target []byte) ([]byte, error) {
+	enc, err := zstd.NewWriter(nil,
+		zstd.WithEncoderDictRaw(0, base),
+		zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+		zstd.WithWindowSize(patchWindow(len(base)+len(target))))
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+	return enc.EncodeAll(target, nil), nil
+}
+
+// patchWindow is the window a patch needs to reach back to the start of its
+// base from the end of its target: the next power of two up from size.
+func patchWindow(size int) int {
+	window := 1 << bits.Len(uint(max(size, zstd.MinWindowSize)-1))
+	return min(window, zstd.MaxWindowSize)
+}
+
+// applyPatch rebuilds the program patch was made for from base. The program
+// may be up to limit bytes, and what the policy allows; the decoder's window
+// only as large as a patch to that size needs.
+func applyPatch(base, patch []byte, limit int, p policy.Policy) ([]byte, error) {
+	dec, err := zstd.NewReader(bytes.NewReader(patch),
+		zstd.WithDecoderDictRaw(0, base),
+		zstd.WithDecoderMaxMemory(uint64(patchWindow(len(base)+limit))))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	out := &sizeCheckedBuffer{policy: p, limit: limit}
+	if _, err := io.Copy(out, dec); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// sizeCheckedBuffer stops filling up past limit, or once the policy finds it
+// too large.
+type sizeCheckedBuffer struct {
+	bytes.Buffer
+	policy policy.Policy
+	limit  int
+}
+
+func (b *sizeCheckedBuffer) Write(p []byte) (int, error) {
+	size := b.Len() + len(p)
+	if size > b.limit {
+		return 0, fmt.Errorf("program is over %d bytes", b.limit)
+	}
+	if err := b.policy.CheckSize(int64(size)); err != nil {
+		return 0, err
+	}
+	return b.Buffer.Write(p)
+}
+
+// heldBlocks holds the nodes an import adds, for them to be added to the
+// node's DAG only if the file checks out. The importer only adds.
+type heldBlocks struct {
+	ipld.DAGService
+	nodes []ipld.Node
+}
+
+func (h *heldBlocks) Add(ctx context.Context, nd ipld.Node) error {
+	h.nodes = append(h.nodes, nd)
+	return nil
+}
+
+func (h *heldBlocks) AddMany(ctx context.Context, nds []ipld.Node) error {
+	h.nodes = append(h.nodes, nds...)
+	return nil
+}
+
+// importFile adds data to dag as a UnixFS file split by the named chunker,
+// with CIDs like prefix's, and returns its CID. CIDv1 files get raw leaves,
+// as `ipfs add` gives them.
+func importFile(dag ipld.DAGService, data []byte, chunkerName string, prefix cid.Prefix) (cid.Cid, error) {
+	if prefix.Codec == cid.Raw {
+		// A file in a single block.
+		nd, err := merkledag.NewRawNodeWPrefix(data, prefix)
+		if err != nil {
+			return cid.Undef, err
+		}
+		return nd.Cid(), dag.Add(context.Background(), nd)
+	}
+	spl, err := chunker.FromString(bytes.NewReader(data), chunkerName)
+	if err != nil {
+		return cid.Undef, err
+	}
+	params := helpers.DagBuilderParams{
+		Dagserv:    dag,
+		Maxlinks:   helpers.DefaultLinksPerBlock,
+		RawLeaves:  prefix.Version == 1,
+		CidBuilder: prefix,
+	}
+	db, err := params.New(spl)
+	if err != nil {
+		return cid.Undef, err
+	}
+	nd, err := balanced.Layout(db)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
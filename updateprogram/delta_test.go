@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/klauspost/compress/zstd"
+
+	"example.com/v2/policy"
+)
+
+// programVersions returns a program and the next version of it, which
+// changes a few bytes in the middle and adds some at the end.
+func programVersions(size int) ([]byte, []byte) {
+	base := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(base)
+	target := append([]byte{}, base...)
+	copy(target[size/2:], "a new version")
+	target = append(target, "and a bit more"...)
+	return base, target
+}
+
+func TestPatchRoundTrip(t *testing.T) {
+	base, target := programVersions(1 << 20)
+
+	patch, err := makePatch(base, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) > len(target)/100 {
+		t.Errorf("patch is %d bytes, more than a hundredth of the %d byte program", len(patch), len(target))
+	}
+	got, err := applyPatch(base, patch, len(target), &policy.Fake{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, target) {
+		t.Error("patched program isn't the one the patch was made for")
+	}
+
+	if _, err := applyPatch(base[1:], patch, len(target), &policy.Fake{}); err == nil {
+		t.Error("applied the patch to another base")
+	}
+	tooLarge := errors.New("too large")
+	if _, err := applyPatch(base, patch, len(target), &policy.Fake{SizeErr: tooLarge}); !errors.Is(err, tooLarge) {
+		t.Errorf("applying a patch the policy finds too large: %v", err)
+	}
+}
+
+func TestPatchOutputCapped(t *testing.T) {
+	base, target := programVersions(1 << 16)
+	patch, err := makePatch(base, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyPatch(base, patch, len(target)-1, &policy.Fake{}); err == nil {
+		t.Error("applied a patch past the limit")
+	}
+
+	// Nor does the decoder take more memory than a program up to the limit
+	// needs.
+	big := make([]byte, 8<<20)
+	patch, err = makePatch(nil, big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyPatch(nil, patch, 1<<20, &policy.Fake{}); !errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		t.Errorf("decoding a patch past the decoder's memory: %v", err)
+	}
+}
+
+// A node rebuilds a program from its base and a patch, and only keeps the
+// blocks of a rebuild that matches the manifest.
+func TestFetchDelta(t *testing.T) {
+	fn := newFakeNode(t, nil, nil, nil)
+	ctx := context.Background()
+	base, target := programVersions(1 << 20)
+	baseCid := fn.fetcher.Add(base)
+	fn.state.Programs[baseCid.String()] = base
+	patch, err := makePatch(base, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := &Delta{Base: baseCid.String(), Patch: fn.fetcher.Add(patch).String(), Chunker: publishChunker}
+
+	other, err := importFile(newMemoryDAG(), []byte("another program"), publishChunker, merkledag.V0CidPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fn.fetchDelta(ctx, &Manifest{CID: other.String(), Delta: delta}); err == nil {
+		t.Fatal("rebuilt a program that isn't the manifest's")
+	}
+	keys, err := fn.bstore.AllKeysChan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range keys {
+		t.Errorf("kept block %s of a bad rebuild", k)
+	}
+
+	want, err := importFile(newMemoryDAG(), target, publishChunker, merkledag.V0CidPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := fn.fetchDelta(ctx, &Manifest{CID: want.String(), Delta: delta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, target) {
+		t.Error("rebuilt program isn't the target")
+	}
+	if has, err := fn.bstore.Has(ctx, want); err != nil || !has {
+		t.Errorf("rebuilt program's root isn't in the blockstore: %v, %v", has, err)
+	}
+}
+
+func newMemoryDAG() ipld.DAGService {
+	bstore := blockstore.NewBlockstore(dsync.MutexWrap(datastore.NewMapDatastore()))
+	return merkledag.NewDAGService(blockservice.New(bstore, nil))
+}
+
+// importFile gives the CIDs `ipfs add` does, so a rebuilt program matches
+// the published one.
+func TestImportFileMatchesIPFSAdd(t *testing.T) {
+	_, program := programVersions(1 << 20)
+	tests := []struct {
+		name    string
+		data    []byte
+		chunker string
+		want    string
+	}{
+		// `printf "hello world" | ipfs add`, and with --cid-version 1.
+		{"v0", []byte("hello world"), "", "Qmf412jQZiuVUtdgnB36FXFX7xg5V6KEbSJ4dpQuhkLyfD"},
+		{"v1 raw", []byte("hello world"), "", "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e"},
+		// The program, with `ipfs add` and --chunker and --cid-version set
+		// the same way, from kubo 0.32.
+		{"v0 blocks", program, "", "Qmde6uJL8NRfLKmLGEFX1tfzMYfi61U7ZHW3KrJThgU3qj"},
+		{"v0 buzhash", program, "buzhash", "QmPRw2JNiaah9mwSeMgMSNMLMVR1fJia7PWijnaz5Yd1ZM"},
+		{"v1 blocks", program, "", "bafybeicysy7ljncbu747rylawr5gik72hjqx3r2qxqsyei4l5zmqumycgu"},
+		{"v1 buzhash", program, "buzhash", "bafybeibk3dm62wssqqrttshhzyywjmnlxbcqmskkz6r4f344gowbugcdgy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := importFile(newMemoryDAG(), tt.data, tt.chunker, cid.MustParse(tt.want).Prefix())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.String() != tt.want {
+				t.Errorf("imported as %s, ipfs add gives %s", c, tt.want)
+			}
+		})
+	}
+}
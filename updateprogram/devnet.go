@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"gopkg.in/yaml.v3"
+)
+
+// The devnet command stands up what a node needs on one machine: a Hardhat
+// chain with the contracts deployed, test accounts holding voting tokens and
+// a seed node. It writes configs for a node and the webapp that point at it
+// all, and tears everything down again on Ctrl-C.
+
+type devnet struct {
+	dir       string
+	contracts string
+	rpcPort   int
+	seedPort  int
+	seedAPI   string
+	voters    int
+	blockTime time.Duration
+}
+
+func devnetCommand(args []string) int {
+	var d devnet
+	fs := flag.NewFlagSet("devnet", flag.ContinueOnError)
+	fs.StringVar(&d.dir, "dir", "devnet", "directory for the accounts, configs and logs")
+	fs.StringVar(&d.contracts, "contracts", filepath.Join("..", "smart-contracts"), "Hardhat project with the contracts")
+	fs.IntVar(&d.rpcPort, "rpc-port", 8545, "port of the chain's JSON-RPC endpoint")
+	fs.IntVar(&d.seedPort, "seed-port", 4001, "libp2p port of the seed node")
+	fs.StringVar(&d.seedAPI, "seed-api", "127.0.0.1:5090", "status API address of the seed node")
+	fs.IntVar(&d.voters, "accounts", 3, "test accounts to give voting tokens to")
+	fs.DurationVar(&d.blockTime, "block-time", time.Second, "mine a block this often, 0 only mines on transactions")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := d.run(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+func (d *devnet) run(ctx context.Context) error {
+	dir, err := filepath.Abs(d.dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	fmt.Println("compiling the contracts in", d.contracts)
+	compile := exec.CommandContext(ctx, "npx", "hardhat", "compile")
+	compile.Dir = d.contracts
+	compile.Stdout = os.Stdout
+	compile.Stderr = os.Stderr
+	if err := compile.Run(); err != nil {
+		return fmt.Errorf("npx hardhat compile: %w", err)
+	}
+
+	chainProc, err := startDevProcess(filepath.Join(dir, "chain.log"), d.contracts,
+		"npx", "hardhat", "node", "--hostname", "127.0.0.1", "--port", fmt.Sprint(d.rpcPort))
+	if err != nil {
+		return fmt.Errorf("start chain: %w", err)
+	}
+	defer chainProc.stop()
+
+	rpcURL := fmt.Sprintf("http://127.0.0.1:%d", d.rpcPort)
+	client, chainID, err := dialDevChain(ctx, rpcURL, chainProc)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	accounts, err := loadDevAccounts(filepath.Join(dir, "accounts.json"), d.voters)
+	if err != nil {
+		return err
+	}
+	for _, a := range accounts {
+		if err := client.Client().CallContext(ctx, nil, "hardhat_setBalance", a.Address, hexutil.EncodeBig(devBalance)); err != nil {
+			return fmt.Errorf("fund %s: %w", a.Name, err)
+		}
+	}
+
+	contracts, err := deployDevContracts(ctx, client, chainID, d.contracts, accounts)
+	if err != nil {
+		return err
+	}
+
+	// The node's operator signs with a keystore, like on a real network.
+	operator := accounts[devOperator]
+	password := make([]byte, 16)
+	rand.Read(password)
+	keystorePath, passwordPath, err := writeDevKeystore(dir, operator.key, hex.EncodeToString(password))
+	if err != nil {
+		return err
+	}
+
+	// The seed's identity is made up front so the node config can name it.
+	seedDir := filepath.Join(dir, "seed")
+	if err := os.MkdirAll(seedDir, 0755); err != nil {
+		return err
+	}
+	seedKey, err := loadIdentity(filepath.Join(seedDir, "identity"))
+	if err != nil {
+		return err
+	}
+	seedID, err := peer.IDFromPrivateKey(seedKey)
+	if err != nil {
+		return err
+	}
+	seedAddr := fmt.Sprintf("/ip4/127.0.0.1/tcp/%d/p2p/%s", d.seedPort, seedID)
+
+	chainCfg := ChainConfig{
+		RPCURL:          rpcURL,
+		ChainID:         chainID.Uint64(),
+		ContractAddress: contracts.dao.Hex(),
+		TokenAddress:    contracts.token.Hex(),
+		PollInterval:    Duration(time.Second),
+	}
+
+	seedCfg := defaultConfig()
+	seedCfg.Chain = chainCfg
+	seedCfg.P2P.Seeds = []string{}
+	seedCfg.P2P.ListenAddrs = []string{fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", d.seedPort)}
+	seedCfg.P2P.NATPortMap = false
+	seedCfg.DataDir = seedDir
+	seedCfg.API.Listen = d.seedAPI
+	seedConfigPath := filepath.Join(dir, "seed.yaml")
+	if err := writeDevConfig(seedConfigPath, &seedCfg); err != nil {
+		return err
+	}
+
+	nodeCfg := defaultConfig()
+	nodeCfg.Chain = chainCfg
+	nodeCfg.P2P.Seeds = []string{seedAddr}
+	nodeCfg.P2P.NATPortMap = false
+	nodeCfg.DataDir = filepath.Join(dir, "node")
+	nodeCfg.Results.RegistryAddress = contracts.resultsRegistry.Hex()
+	nodeCfg.Results.Keystore = keystorePath
+	nodeCfg.Results.PasswordFile = passwordPath
+	nodeCfg.Heartbeat.RegistryAddress = contracts.nodeRegistry.Hex()
+	nodeConfigPath := filepath.Join(dir, "updateprogram.yaml")
+	if err := writeDevConfig(nodeConfigPath, &nodeCfg); err != nil {
+		return err
+	}
+
+	webappPath := filepath.Join(dir, "webapp.env")
+	webapp := fmt.Sprintf("# Written by updateprogram devnet. Copy to webapp/.env.local.\n"+
+		"# Add the chain to the wallet as %s, chain ID %d.\n"+
+		"GOVERNANCE_CONTRACT=%s\n", rpcURL, chainID, contracts.dao.Hex())
+	if err := os.WriteFile(webappPath, []byte(webapp), 0644); err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	seedProc, err := startDevProcess(filepath.Join(dir, "seed.log"), "", exe, "seed", "-config", seedConfigPath)
+	if err != nil {
+		return fmt.Errorf("start seed: %w", err)
+	}
+	defer seedProc.stop()
+
+	// Voting periods are counted in blocks, so keep them coming.
+	if d.blockTime > 0 {
+		if err := client.Client().CallContext(ctx, nil, "evm_setIntervalMining", d.blockTime.Milliseconds()); err != nil {
+			return fmt.Errorf("set block time: %w", err)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "\ndevnet is up, Ctrl-C stops it.")
+	fmt.Fprintf(w, "chain\t%s, chain ID %d, log in %s\n", rpcURL, chainID, chainProc.logPath)
+	fmt.Fprintf(w, "ComputeToken\t%s\n", contracts.token.Hex())
+	fmt.Fprintf(w, "ComputeDAO\t%s\n", contracts.dao.Hex())
+	fmt.Fprintf(w, "NodeRegistry\t%s\n", contracts.nodeRegistry.Hex())
+	fmt.Fprintf(w, "ResultsRegistry\t%s\n", contracts.resultsRegistry.Hex())
+	fmt.Fprintf(w, "seed\t%s, log in %s\n", seedAddr, seedProc.logPath)
+	for _, a := range accounts {
+		fmt.Fprintf(w, "%s\t%s\n", a.Name, a.Address.Hex())
+	}
+	w.Flush()
+	fmt.Println("\nPrivate keys are in", filepath.Join(dir, "accounts.json"))
+	fmt.Println("Run a node with:           updateprogram -config", nodeConfigPath)
+	fmt.Println("Point the webapp at it with: cp", webappPath, "webapp/.env.local")
+
+	select {
+	case <-ctx.Done():
+		fmt.Println("stopping the devnet")
+		return nil
+	case <-chainProc.done:
+		return fmt.Errorf("chain exited, see %s", chainProc.logPath)
+	case <-seedProc.done:
+		return fmt.Errorf("seed exited, see %s", seedProc.logPath)
+	}
+}
+
+// devProcess is a command the devnet runs in the background.
+type devProcess struct {
+	cmd     *exec.Cmd
+	logPath string
+	// Closed once the command has exited.
+	done chan struct{}
+}
+
+// startDevProcess runs name with its output in logPath. It gets a process
+// group of its own, so whatever it starts in turn is stopped along with it.
+func startDevProcess(logPath, dir, name string, args ...string) (*devProcess, error) {
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		return nil, err
+	}
+
+	p := &devProcess{cmd: cmd, logPath: logPath, done: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		logFile.Close()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+func (p *devProcess) stop() {
+	syscall.Kill(-p.cmd.Process.Pid, syscall.SIGTERM)
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+		syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+		<-p.done
+	}
+}
+
+// dialDevChain waits for the chain started by proc to answer on rpcURL.
+func dialDevChain(ctx context.Context, rpcURL string, proc *devProcess) (*ethclient.Client, *big.Int, error) {
+	client, err := ethclient.DialContext(ctx, rpcURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	timeout := time.After(time.Minute)
+	for {
+		chainID, err := client.ChainID(ctx)
+		if err == nil {
+			return client, chainID, nil
+		}
+
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-proc.done:
+			client.Close()
+			return nil, nil, fmt.Errorf("chain exited, see %s", proc.logPath)
+		case <-timeout:
+			client.Close()
+			return nil, nil, fmt.Errorf("chain didn't come up on %s: %w", rpcURL, err)
+		case <-ctx.Done():
+			client.Close()
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// Every devnet account starts with this much ETH.
+var devBalance = new(big.Int).Mul(big.NewInt(1000), big.NewInt(1e18))
+
+// How long a devnet shard claim lasts without a result.
+const devClaimTimeout = time.Hour
+
+// The first accounts have fixed roles, the rest are voters.
+const (
+	devDeployer = iota
+	devOperator
+	devFirstVoter
+)
+
+// devAccount is a test account. They are kept in the devnet dir so the
+// contracts get the same addresses on every run.
+type devAccount struct {
+	Name       string         `json:"name"`
+	Address    common.Address `json:"address"`
+	PrivateKey string         `json:"private_key"`
+
+	key *ecdsa.PrivateKey
+}
+
+// loadDevAccounts reads the accounts in path, generating any that are missing
+// for a deployer, an operator and the given number of voters.
+func loadDevAccounts(path string, voters int) ([]*devAccount, error) {
+	var accounts []*devAccount
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &accounts); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	for _, a := range accounts {
+		a.key, err = crypto.HexToECDSA(a.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: account %s: %w", path, a.Name, err)
+		}
+	}
+
+	names := []string{"deployer", "operator"}
+	for i := 1; i <= voters; i++ {
+		names = append(names, fmt.Sprintf("voter%d", i))
+	}
+	if len(accounts) >= len(names) {
+		return accounts[:len(names)], nil
+	}
+	for _, name := range names[len(accounts):] {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, &devAccount{
+			Name:       name,
+			Address:    crypto.PubkeyToAddress(key.PublicKey),
+			PrivateKey: hex.EncodeToString(crypto.FromECDSA(key)),
+			key:        key,
+		})
+	}
+
+	data, err = json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return accounts, os.WriteFile(path, data, 0600)
+}
+
+// writeDevKeystore saves key in a keystore in dir, and its password next to
+// it, returning the paths of both.
+func writeDevKeystore(dir string, key *ecdsa.PrivateKey, password string) (string, string, error) {
+	keyPath := filepath.Join(dir, "operator.json")
+	passwordPath := filepath.Join(dir, "operator.password")
+
+	encrypted, err := keystore.EncryptKey(&keystore.Key{
+		Address:    crypto.PubkeyToAddress(key.PublicKey),
+		PrivateKey: key,
+	}, password, keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(keyPath, encrypted, 0600); err != nil {
+		return "", "", err
+	}
+	return keyPath, passwordPath, os.WriteFile(passwordPath, []byte(password+"\n"), 0600)
+}
+
+func writeDevConfig(path string, cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append([]byte("# Written by updateprogram devnet.\n"), out...), 0644)
+}
+
+// contractArtifact is a contract as compiled by Hardhat.
+type contractArtifact struct {
+	abi      abi.ABI
+	bytecode []byte
+}
+
+// loadContractArtifact reads the build of contract name, defined in source,
+// from the Hardhat project in dir.
+func loadContractArtifact(dir, source, name string) (*contractArtifact, error) {
+	path := filepath.Join(dir, "artifacts", "contracts", source, name+".json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var compiled struct {
+		ABI      json.RawMessage `json:"abi"`
+		Bytecode string          `json:"bytecode"`
+	}
+	if err := json.Unmarshal(data, &compiled); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	parsed, err := abi.JSON(bytes.NewReader(compiled.ABI))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &contractArtifact{abi: parsed, bytecode: common.FromHex(compiled.Bytecode)}, nil
+}
+
+type devContracts struct {
+	token, dao, nodeRegistry, resultsRegistry common.Address
+}
+
+// deployDevContracts deploys the contracts from the deployer account, and
+// gives every voter a token with its votes delegated to itself.
+func deployDevContracts(ctx context.Context, client *ethclient.Client, chainID *big.Int, dir string, accounts []*devAccount) (*devContracts, error) {
+	artifacts := map[string]*contractArtifact{}
+	for source, name := range map[string]string{
+		"ComputerToken.sol":   "ComputeToken",
+		"ComputeDAO.sol":      "ComputeDAO",
+		"NodeRegistry.sol":    "NodeRegistry",
+		"ResultsRegistry.sol": "ResultsRegistry",
+	} {
+		a, err := loadContractArtifact(dir, source, name)
+		if err != nil {
+			return nil, err
+		}
+		artifacts[name] = a
+	}
+
+	transactor := func(a *devAccount) (*bind.TransactOpts, error) {
+		opts, err := bind.NewKeyedTransactorWithChainID(a.key, chainID)
+		if err != nil {
+			return nil, err
+		}
+		opts.Context = ctx
+		return opts, nil
+	}
+	deployer, err := transactor(accounts[devDeployer])
+	if err != nil {
+		return nil, err
+	}
+	deploy := func(name string, params ...interface{}) (common.Address, *bind.BoundContract, error) {
+		a := artifacts[name]
+		address, tx, contract, err := bind.DeployContract(deployer, a.abi, a.bytecode, client, params...)
+		if err != nil {
+			return common.Address{}, nil, fmt.Errorf("deploy %s: %w", name, err)
+		}
+		if _, err := bind.WaitDeployed(ctx, client, tx); err != nil {
+			return common.Address{}, nil, fmt.Errorf("deploy %s: %w", name, err)
+		}
+		return address, contract, nil
+	}
+	transact := func(contract *bind.BoundContract, opts *bind.TransactOpts, method string, params ...interface{}) error {
+		tx, err := contract.Transact(opts, method, params...)
+		if err != nil {
+			return fmt.Errorf("%s: %w", method, err)
+		}
+		receipt, err := bind.WaitMined(ctx, client, tx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", method, err)
+		}
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			return fmt.Errorf("%s: transaction %s reverted", method, tx.Hash())
+		}
+		return nil
+	}
+
+	var c devContracts
+	var token *bind.BoundContract
+	c.token, token, err = deploy("ComputeToken", accounts[devDeployer].Address)
+	if err != nil {
+		return nil, err
+	}
+	for _, voter := range accounts[devFirstVoter:] {
+		if err := transact(token, deployer, "safeMint", voter.Address); err != nil {
+			return nil, err
+		}
+		opts, err := transactor(voter)
+		if err != nil {
+			return nil, err
+		}
+		if err := transact(token, opts, "delegate", voter.Address); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.dao, _, err = deploy("ComputeDAO", c.token); err != nil {
+		return nil, err
+	}
+	var nodeRegistry *bind.BoundContract
+	if c.nodeRegistry, nodeRegistry, err = deploy("NodeRegistry", accounts[devDeployer].Address); err != nil {
+		return nil, err
+	}
+	if err := transact(nodeRegistry, deployer, "setOperatorAllowed", accounts[devOperator].Address, true); err != nil {
+		return nil, err
+	}
+	claimTimeout := big.NewInt(int64(devClaimTimeout / time.Second))
+	if c.resultsRegistry, _, err = deploy("ResultsRegistry", c.dao, c.nodeRegistry, claimTimeout); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Accounts are kept between runs, so the contracts land on the same
+// addresses, and more voters are added as asked for.
+func TestLoadDevAccounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	first, err := loadDevAccounts(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, a := range first {
+		names = append(names, a.Name)
+		if crypto.PubkeyToAddress(a.key.PublicKey) != a.Address {
+			t.Errorf("%s's key isn't for %s", a.Name, a.Address)
+		}
+	}
+	if strings.Join(names, " ") != "deployer operator voter1 voter2" {
+		t.Fatalf("accounts %v", names)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("accounts file is %v, readable by others", fi.Mode())
+	}
+
+	more, err := loadDevAccounts(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(more) != 5 || more[4].Name != "voter3" {
+		t.Fatalf("%d accounts after asking for another voter", len(more))
+	}
+	for i, a := range first {
+		if more[i].Address != a.Address {
+			t.Errorf("%s is %s on the next run, was %s", a.Name, more[i].Address, a.Address)
+		}
+	}
+
+	fewer, err := loadDevAccounts(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fewer) != 3 || fewer[2].Address != first[2].Address {
+		t.Errorf("%d accounts with one voter", len(fewer))
+	}
+}
+
+func TestWriteDevKeystore(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath, passwordPath, err := writeDevKeystore(t.TempDir(), key, "devnet-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, err := os.ReadFile(passwordPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := keystore.DecryptKey(encrypted, strings.TrimSpace(string(password)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted.Address != crypto.PubkeyToAddress(key.PublicKey) {
+		t.Errorf("keystore holds %s, not the operator", decrypted.Address)
+	}
+}
+
+// The configs the devnet writes load back as they were, and pass validation.
+func TestWriteDevConfig(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Chain.RPCURL = "http://127.0.0.1:8545"
+	cfg.Chain.ChainID = 31337
+	cfg.Chain.ContractAddress = "0x5FbDB2315678afecb367f032d93F642f64180aa3"
+	cfg.Chain.PollInterval = Duration(time.Second)
+	// A seed has no seeds of its own.
+	cfg.P2P.Seeds = []string{}
+	cfg.DataDir = t.TempDir()
+	path := filepath.Join(t.TempDir(), "seed.yaml")
+	if err := writeDevConfig(path, &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := defaultConfig()
+	if err := loadConfigFile(&loaded, path, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Chain != cfg.Chain || loaded.DataDir != cfg.DataDir {
+		t.Errorf("loaded chain %+v in %s, want %+v in %s", loaded.Chain, loaded.DataDir, cfg.Chain, cfg.DataDir)
+	}
+	if len(loaded.P2P.Seeds) != 0 {
+		t.Errorf("seed config loaded with seeds %v", loaded.P2P.Seeds)
+	}
+
+	cfg.Chain.RPCURL = ""
+	if err := writeDevConfig(filepath.Join(t.TempDir(), "bad.yaml"), &cfg); err == nil {
+		t.Error("wrote a config that doesn't validate")
+	}
+}
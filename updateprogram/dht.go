@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Keeps the nodes' DHT apart from the public IPFS one.
+const dhtPrefix = protocol.ID("/updateprogram")
+
+// newDHT starts the DHT bitswap finds providers beyond its direct peers
+// through. Seeds serve it; other nodes only query it and announce what they
+// hold. Both start from the seeds in the config.
+func newDHT(ctx context.Context, log *slog.Logger, h host.Host, seed bool, seeds []string) (*dht.IpfsDHT, error) {
+	mode := dht.ModeClient
+	if seed {
+		mode = dht.ModeServer
+	}
+
+	var bootstrap []peer.AddrInfo
+	for _, s := range seeds {
+		info, err := peer.AddrInfoFromString(s)
+		if err != nil {
+			log.Error("bad seed address", "addr", s, "err", err)
+			continue
+		}
+		if info.ID != h.ID() {
+			bootstrap = append(bootstrap, *info)
+		}
+	}
+
+	return dht.New(ctx, h, dht.Mode(mode), dht.ProtocolPrefix(dhtPrefix), dht.BootstrapPeers(bootstrap...))
+}
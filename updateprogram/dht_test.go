@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/host"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multihash"
+)
+
+// Nodes that only know the seed find each other's blocks through its DHT.
+func TestDHTThroughSeed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+	var hosts []host.Host
+	for i := 0; i < 3; i++ {
+		h, err := mn.GenPeer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts = append(hosts, h)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	seed, a, b := hosts[0], hosts[1], hosts[2]
+	seeds := []string{seed.Addrs()[0].String() + "/p2p/" + seed.ID().String()}
+
+	seedDHT, err := newDHT(ctx, log, seed, true, seeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seedDHT.Close()
+	aDHT, err := newDHT(ctx, log, a, false, seeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aDHT.Close()
+	bDHT, err := newDHT(ctx, log, b, false, seeds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bDHT.Close()
+
+	waitFor(t, "the nodes to bootstrap off the seed", func() bool {
+		return aDHT.RoutingTable().Size() > 0 && bDHT.RoutingTable().Size() > 0
+	})
+	if seedDHT.RoutingTable().Size() != 0 {
+		t.Error("seed put client nodes in its routing table")
+	}
+
+	hash, err := multihash.Sum([]byte("program"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cid.NewCidV1(cid.Raw, hash)
+	if err := aDHT.Provide(ctx, c, true); err != nil {
+		t.Fatal(err)
+	}
+	for p := range bDHT.FindProvidersAsync(ctx, c, 1) {
+		if p.ID != a.ID() {
+			t.Errorf("found %s, want %s", p.ID, a.ID())
+		}
+		return
+	}
+	t.Fatal("found no provider")
+}
@@ -0,0 +1,304 @@
+//go:build e2e
+
+// The end-to-end test runs the whole upgrade flow in process: the contracts on
+// go-ethereum's simulated backend, and a publisher and a node on two libp2p
+// hosts. It needs the compiled contracts:
+//
+//	(cd ../smart-contracts && npx hardhat compile)
+//	go test -tags e2e -run TestEndToEnd -v .
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	gethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	bsclient "github.com/ipfs/boxo/bitswap/client"
+	bsnet "github.com/ipfs/boxo/bitswap/network"
+	bsserver "github.com/ipfs/boxo/bitswap/server"
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	chunker "github.com/ipfs/boxo/chunker"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/ipld/unixfs/importer"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"example.com/v2/chain"
+	"example.com/v2/executor"
+	"example.com/v2/fetch"
+	"example.com/v2/state"
+)
+
+// Writes its first argument to a file in its output dir.
+const e2eProgram = `#!/bin/sh
+echo "$1" > "$UPDATEPROGRAM_OUTPUT_DIR/greeting"
+`
+
+func TestEndToEnd(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tokenArtifact := loadArtifact(t, "ComputerToken.sol", "ComputeToken")
+	daoArtifact := loadArtifact(t, "ComputeDAO.sol", "ComputeDAO")
+
+	// The chain, with one funded account that deploys, proposes and votes.
+	key, err := gethcrypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := gethcrypto.PubkeyToAddress(key.PublicKey)
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		account: {Balance: new(big.Int).Mul(big.NewInt(100), big.NewInt(1e18))},
+	})
+	defer backend.Close()
+	client := backend.Client()
+	opts := transactor(t, ctx, client, key)
+
+	tokenAddress, tx, token, err := deployComputeToken(opts, client, tokenArtifact, account)
+	mine(t, ctx, backend, tx, err)
+	tx, err = token.SafeMint(opts, account)
+	mine(t, ctx, backend, tx, err)
+	tx, err = token.Delegate(opts, account)
+	mine(t, ctx, backend, tx, err)
+
+	daoAddress, tx, dao, err := deployComputeDAO(opts, client, daoArtifact, tokenAddress)
+	mine(t, ctx, backend, tx, err)
+
+	// The publisher adds the program, the node fetches it from there.
+	publisher := newTestPeer(t, ctx)
+	program, err := importer.BuildDagFromReader(merkledag.NewDAGService(publisher.bservice), chunker.DefaultSplitter(strings.NewReader(e2eProgram)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, nodePeer := newTestNode(t, ctx, client, daoAddress, publisher.host)
+	if err := nodePeer.host.Connect(ctx, peer.AddrInfo{ID: publisher.host.ID(), Addrs: publisher.host.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	go n.run(ctx)
+
+	// Propose, vote for it with the manifest as params, and execute it.
+	manifest, err := json.Marshal(Manifest{CID: program.Cid().String(), Args: []string{"hello from the dao"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposal := daoProposal{
+		Targets:     []common.Address{daoAddress},
+		Values:      []*big.Int{big.NewInt(0)},
+		Calldatas:   [][]byte{manifest},
+		Description: "Run the end-to-end test program",
+	}
+	tx, err = dao.Propose(opts, proposal)
+	mine(t, ctx, backend, tx, err)
+	proposalID, err := dao.HashProposal(&bind.CallOpts{Context: ctx}, proposal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err = dao.CastVoteWithReasonAndParams(opts, proposalID, 1, "e2e", manifest)
+	mine(t, ctx, backend, tx, err)
+
+	// Wait out the voting period, which is counted in blocks.
+	for i := 0; i < 200; i++ {
+		backend.Commit()
+	}
+	tx, err = dao.Execute(opts, proposal)
+	receipt := mine(t, ctx, backend, tx, err)
+	if !dao.Emitted(receipt, "VotedProgramData") {
+		t.Fatal("execute didn't emit VotedProgramData")
+	}
+
+	// The node should have fetched the program from the publisher and run it.
+	programCID := program.Cid().String()
+	var status workloadStatus
+	var fetch *fetchProgress
+	var output string
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		n.status.update(func(s *nodeStatus) {
+			status = *s.workload(defaultWorkload)
+			fetch = s.fetch
+			output = s.outputs[programCID]
+		})
+		if status.state == stateExited && status.manifest != nil && status.manifest.CID == programCID {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("program didn't run: state %s, manifest %+v, fetch %+v", status.state, status.manifest, fetch)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if status.manifest.proposal == nil || status.manifest.proposal.Cmp(proposalID) != 0 {
+		t.Errorf("ran for proposal %v, want %v", status.manifest.proposal, proposalID)
+	}
+	if *status.exitCode != 0 {
+		t.Errorf("program exited with %d", *status.exitCode)
+	}
+	saved, err := os.ReadFile(filepath.Join(n.cfg.DataDir, "programs", programCID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(saved) != e2eProgram {
+		t.Errorf("saved program is %q", saved)
+	}
+	greeting, err := os.ReadFile(filepath.Join(n.cfg.programOutputDir(programCID), "greeting"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(greeting)) != "hello from the dao" {
+		t.Errorf("program wrote %q", greeting)
+	}
+	if output == "" {
+		t.Error("program output wasn't published")
+	}
+}
+
+// loadArtifact reads a contract compiled by Hardhat, skipping the test if the
+// contracts haven't been compiled.
+func loadArtifact(t *testing.T, source, name string) *contractArtifact {
+	t.Helper()
+
+	a, err := loadContractArtifact(filepath.Join("..", "smart-contracts"), source, name)
+	if errors.Is(err, os.ErrNotExist) {
+		t.Skipf("%s isn't compiled, compile the contracts with npx hardhat compile", name)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func transactor(t *testing.T, ctx context.Context, client simulated.Client, key *ecdsa.PrivateKey) *bind.TransactOpts {
+	t.Helper()
+
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := bind.NewKeyedTransactorWithChainID(key, chainID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Context = ctx
+	return opts
+}
+
+// mine commits the block with tx in it and fails the test unless tx
+// succeeded.
+func mine(t *testing.T, ctx context.Context, backend *simulated.Backend, tx *types.Transaction, err error) *types.Receipt {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.Commit()
+	receipt, err := bind.WaitMined(ctx, backend.Client(), tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		t.Fatalf("transaction %s reverted", tx.Hash())
+	}
+	return receipt
+}
+
+// testPeer is a libp2p host serving and fetching over bitswap, set up the
+// same way main sets up a node's.
+type testPeer struct {
+	host     host.Host
+	net      bsnet.BitSwapNetwork
+	client   *bsclient.Client
+	server   *bsserver.Server
+	bstore   *countedBlockstore
+	bservice blockservice.BlockService
+}
+
+func newTestPeer(t *testing.T, ctx context.Context) *testPeer {
+	t.Helper()
+
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPeer{host: NewHost([]string{"/ip4/127.0.0.1/tcp/0"}, priv, nil)}
+	t.Cleanup(func() { p.host.Close() })
+
+	p.bstore, err = newCountedBlockstore(ctx, blockstore.NewBlockstore(dsync.MutexWrap(datastore.NewMapDatastore())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.net = bsnet.NewFromIpfsHost(p.host, routinghelpers.Null{})
+	p.client = bsclient.New(ctx, p.net, p.bstore)
+	p.server = bsserver.New(ctx, p.net, p.bstore)
+	p.bservice = blockservice.New(p.bstore, p.client)
+	p.net.Start(p.client, p.server)
+	return p
+}
+
+// newTestNode makes a node that follows the DAO at dao and fetches from
+// publisher. It runs programs for real, in a temporary data dir.
+func newTestNode(t *testing.T, ctx context.Context, client chain.Client, dao common.Address, publisher host.Host) (*node, *testPeer) {
+	t.Helper()
+
+	cfg := defaultConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.Chain.PollInterval = Duration(100 * time.Millisecond)
+	cfg.Policy.FetchTimeout = Duration(20 * time.Second)
+
+	var diagnostics, programOutput io.Writer = io.Discard, io.Discard
+	if testing.Verbose() {
+		diagnostics, programOutput = os.Stderr, os.Stdout
+	}
+	log := newLoggers(cfg.Log, diagnostics, programOutput)
+
+	parsedAbi, err := abi.JSON(strings.NewReader(contractAbi))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPeer(t, ctx)
+	fetcher := fetch.NewBitswap(log.fetch, p.bservice, func(ctx context.Context, c cid.Cid) {
+		if err := p.host.Connect(ctx, peer.AddrInfo{ID: publisher.ID(), Addrs: publisher.Addrs()}); err != nil {
+			log.p2p.Warn("failed to connect to publisher", "err", err)
+		}
+	})
+
+	n := &node{
+		cfg:       &cfg,
+		log:       log,
+		id:        p.host.ID(),
+		chain:     chain.NewWatcher(log.chain, client, parsedAbi, dao, cfg.Chain.Confirmations),
+		fetcher:   fetcher,
+		executor:  executor.Native{},
+		state:     state.Dir(cfg.DataDir),
+		policy:    cfg.Policy.rules(),
+		status:    newNodeStatus(),
+		metrics:   newMetrics(p.client, p.server, p.bstore),
+		workloads: map[string]*workload{},
+		dag:       merkledag.NewDAGService(p.bservice),
+		control:   make(chan controlCommand),
+	}
+	return n, p
+}
@@ -0,0 +1,49 @@
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// cgroupPeriod is the cpu.max period, in microseconds.
+const cgroupPeriod = 100000
+
+// cgroupAttr sets up the cgroup for spec's workload under parent and returns
+// the attributes that start a process in it, and a func to call once it has
+// started.
+func cgroupAttr(parent string, spec Spec) (*syscall.SysProcAttr, func(), error) {
+	if spec.Workload == "" {
+		return nil, nil, errors.New("no workload to name the cgroup after")
+	}
+	dir := filepath.Join(parent, spec.Workload)
+	if err := os.Mkdir(dir, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, nil, err
+	}
+
+	// The cgroup outlives its programs, so each start sets the limits anew.
+	cpuMax := fmt.Sprintf("max %d", cgroupPeriod)
+	if spec.CPUs > 0 {
+		cpuMax = fmt.Sprintf("%d %d", int64(spec.CPUs*cgroupPeriod), cgroupPeriod)
+	}
+	memoryMax := "max"
+	if spec.Memory > 0 {
+		memoryMax = strconv.FormatInt(spec.Memory, 10)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(cpuMax), 0); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(memoryMax), 0); err != nil {
+		return nil, nil, err
+	}
+
+	fd, err := syscall.Open(dir, syscall.O_DIRECTORY|syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	attr := &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: fd}
+	return attr, func() { syscall.Close(fd) }, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package executor
+
+import (
+	"errors"
+	"syscall"
+)
+
+func cgroupAttr(parent string, spec Spec) (*syscall.SysProcAttr, func(), error) {
+	return nil, nil, errors.New("cgroups are only supported on Linux")
+}
@@ -0,0 +1,165 @@
+// Package executor runs programs.
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Spec is a program to run.
+type Spec struct {
+	Path string
+	Args []string
+	// Added to PATH, HOME and the UPDATEPROGRAM_ variables of the node's
+	// own environment. Nothing else of it gets to the program.
+	Env []string
+	Dir string
+
+	// The workload the program runs in, and the resources it is held to
+	// where the executor can: CPU cores, which may be fractional, and bytes
+	// of memory. 0 means no limit.
+	Workload string
+	CPUs     float64
+	Memory   int64
+
+	// For executors that run programs in a root filesystem of their own:
+	// the directory to use as it, and the host paths to bind into it. Path
+	// and Dir are then inside it.
+	Rootfs string
+	Binds  []Bind
+	// Files only the program can see, in a tmpfs at SecretDir inside its
+	// sandbox. Executors without a sandbox refuse them.
+	Secrets []Secret
+
+	Stdout, Stderr io.Writer
+}
+
+// Bind makes a host path visible at the same path inside a sandbox.
+type Bind struct {
+	Path     string
+	ReadOnly bool
+}
+
+// Where a sandboxed program finds its secrets.
+const SecretDir = "/run/updateprogram"
+
+// Secret is a file for the program's eyes only, named Name in SecretDir.
+type Secret struct {
+	Name string
+	Data []byte
+}
+
+// Process is a started program.
+type Process interface {
+	Pid() int
+	// Done is closed once the program has exited and its output has been
+	// written out.
+	Done() <-chan struct{}
+	// ExitCode is the program's exit code, once Done is closed.
+	ExitCode() int
+	// Stop asks the program to exit, and kills it if it hasn't within
+	// timeout. It returns once the program has exited.
+	Stop(timeout time.Duration) error
+}
+
+// Executor starts programs.
+type Executor interface {
+	Start(spec Spec) (Process, error)
+}
+
+// Native runs programs as child processes of the node.
+type Native struct {
+	// A cgroup v2 directory delegated to the node. Each workload gets a
+	// child cgroup there, held to the spec's resources. Empty runs programs
+	// in the node's own cgroup, without limits.
+	Cgroup string
+}
+
+func (e Native) Start(spec Spec) (Process, error) {
+	if len(spec.Secrets) > 0 {
+		return nil, errors.New("can't keep secrets from the host, they need a sandbox")
+	}
+
+	cmd := exec.Command(spec.Path, spec.Args...)
+	cmd.Env = append(passedEnv(), spec.Env...)
+	cmd.Dir = spec.Dir
+	cmd.Stdout = spec.Stdout
+	cmd.Stderr = spec.Stderr
+
+	if e.Cgroup != "" {
+		attr, closeCgroup, err := cgroupAttr(e.Cgroup, spec)
+		if err != nil {
+			return nil, fmt.Errorf("cgroup: %w", err)
+		}
+		defer closeCgroup()
+		cmd.SysProcAttr = attr
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &nativeProcess{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// passedEnv is what of the node's environment programs get. The rest can
+// hold the node's secrets, such as its operator password and API token.
+func passedEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if key == "PATH" || key == "HOME" || strings.HasPrefix(key, "UPDATEPROGRAM_") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+type nativeProcess struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+func (p *nativeProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+func (p *nativeProcess) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *nativeProcess) ExitCode() int {
+	return p.cmd.ProcessState.ExitCode()
+}
+
+func (p *nativeProcess) Stop(timeout time.Duration) error {
+	select {
+	case <-p.done:
+		return nil
+	default:
+	}
+
+	p.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-p.done:
+		return nil
+	case <-time.After(timeout):
+		err := p.cmd.Process.Kill()
+		if err != nil && !errors.Is(err, os.ErrProcessDone) {
+			return err
+		}
+		<-p.done
+		return nil
+	}
+}
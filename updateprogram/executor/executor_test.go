@@ -0,0 +1,38 @@
+package executor
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNativeEnv(t *testing.T) {
+	t.Setenv("API_TOKEN", "secret")
+	t.Setenv("UPDATEPROGRAM_FROM_NODE", "1")
+
+	var out bytes.Buffer
+	p, err := Native{}.Start(Spec{Path: "/bin/sh", Args: []string{"-c", "env"}, Env: []string{"FROM_SPEC=1"}, Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-p.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("program didn't exit")
+	}
+
+	env := map[string]bool{}
+	for _, kv := range strings.Split(out.String(), "\n") {
+		key, _, _ := strings.Cut(kv, "=")
+		env[key] = true
+	}
+	for _, key := range []string{"PATH", "UPDATEPROGRAM_FROM_NODE", "FROM_SPEC"} {
+		if !env[key] {
+			t.Errorf("program didn't get %s", key)
+		}
+	}
+	if env["API_TOKEN"] {
+		t.Error("program got the node's API_TOKEN")
+	}
+}
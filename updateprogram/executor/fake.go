@@ -0,0 +1,79 @@
+package executor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Fake is an Executor for tests. Its programs run until they are stopped or
+// told to Exit.
+type Fake struct {
+	mu      sync.Mutex
+	nextPid int
+	// Every program started so far, in order.
+	Started []*FakeProcess
+	// Returned by Start instead of a process while set.
+	Err error
+}
+
+func (f *Fake) Start(spec Spec) (Process, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	f.nextPid++
+	p := &FakeProcess{Spec: spec, pid: f.nextPid, done: make(chan struct{})}
+	f.Started = append(f.Started, p)
+	return p, nil
+}
+
+// Last returns the last program started, or nil.
+func (f *Fake) Last() *FakeProcess {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.Started) == 0 {
+		return nil
+	}
+	return f.Started[len(f.Started)-1]
+}
+
+type FakeProcess struct {
+	Spec Spec
+
+	pid  int
+	once sync.Once
+	done chan struct{}
+	code int
+}
+
+// Exit ends the program with code, writing a line to its stdout first.
+func (p *FakeProcess) Exit(code int) {
+	p.once.Do(func() {
+		if p.Spec.Stdout != nil {
+			fmt.Fprintf(p.Spec.Stdout, "exiting with %d\n", code)
+		}
+		p.code = code
+		close(p.done)
+	})
+}
+
+func (p *FakeProcess) Pid() int {
+	return p.pid
+}
+
+func (p *FakeProcess) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *FakeProcess) ExitCode() int {
+	return p.code
+}
+
+// Stop exits with -1, as a program killed by a signal does.
+func (p *FakeProcess) Stop(time.Duration) error {
+	p.Exit(-1)
+	return nil
+}
@@ -0,0 +1,356 @@
+package executor
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ImageConfig is what an OCI image runs.
+type ImageConfig struct {
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	Env        []string `json:"Env,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
+}
+
+// The parts of the OCI image layout and image spec UnpackImage reads.
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	Config ociDescriptor   `json:"config"`
+	Layers []ociDescriptor `json:"layers"`
+}
+
+// Images can nest an index for several platforms in the layout's.
+const maxIndexDepth = 4
+
+// UnpackImage unpacks the image in the OCI image layout at layout into
+// rootfs and returns its config. Images built for several platforms are
+// unpacked for the one the node runs on. Every blob is checked against its
+// digest.
+func UnpackImage(layout, rootfs string) (*ImageConfig, error) {
+	if _, err := os.Stat(filepath.Join(layout, "oci-layout")); err != nil {
+		return nil, fmt.Errorf("not an OCI image layout: %w", err)
+	}
+	data, err := os.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var index ociIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("index.json: %w", err)
+	}
+
+	manifest, err := findManifest(layout, index, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Config ImageConfig `json:"config"`
+	}
+	if err := readBlobJSON(layout, manifest.Config, &config); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return nil, err
+	}
+	// Files get their owners in the image, as sandboxes see them.
+	var owners *idRange
+	if os.Geteuid() == 0 {
+		ids, err := sandboxIDs()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chown(rootfs, ids.UID, ids.GID); err != nil {
+			return nil, err
+		}
+		owners = &ids
+	}
+	for i, layer := range manifest.Layers {
+		if err := applyLayer(layout, rootfs, layer, owners); err != nil {
+			return nil, fmt.Errorf("layer %d: %w", i, err)
+		}
+	}
+	return &config.Config, nil
+}
+
+// findManifest picks the image manifest for this platform out of index.
+func findManifest(layout string, index ociIndex, depth int) (*ociManifest, error) {
+	if depth > maxIndexDepth {
+		return nil, errors.New("image indexes nested too deep")
+	}
+	for _, d := range index.Manifests {
+		if d.Platform != nil && (d.Platform.OS != runtime.GOOS || d.Platform.Architecture != runtime.GOARCH) {
+			continue
+		}
+		switch d.MediaType {
+		case "application/vnd.oci.image.manifest.v1+json", "application/vnd.docker.distribution.manifest.v2+json":
+			var m ociManifest
+			if err := readBlobJSON(layout, d, &m); err != nil {
+				return nil, fmt.Errorf("manifest: %w", err)
+			}
+			return &m, nil
+		case "application/vnd.oci.image.index.v1+json", "application/vnd.docker.distribution.manifest.list.v2+json":
+			var nested ociIndex
+			if err := readBlobJSON(layout, d, &nested); err != nil {
+				return nil, fmt.Errorf("index: %w", err)
+			}
+			if m, err := findManifest(layout, nested, depth+1); err == nil {
+				return m, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no image for %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+// openBlob opens the blob d describes. Reading it to the end checks its
+// digest and size.
+func openBlob(layout string, d ociDescriptor) (io.ReadCloser, error) {
+	algorithm, encoded, ok := strings.Cut(d.Digest, ":")
+	if !ok || algorithm != "sha256" || len(encoded) != sha256.Size*2 || strings.ContainsAny(encoded, "/.") {
+		return nil, fmt.Errorf("unsupported digest %q", d.Digest)
+	}
+	f, err := os.Open(filepath.Join(layout, "blobs", algorithm, encoded))
+	if err != nil {
+		return nil, err
+	}
+	return &verifiedBlob{f: f, hash: sha256.New(), want: encoded, size: d.Size}, nil
+}
+
+type verifiedBlob struct {
+	f    *os.File
+	hash hash.Hash
+	want string
+	size int64
+	read int64
+}
+
+func (b *verifiedBlob) Read(p []byte) (int, error) {
+	n, err := b.f.Read(p)
+	b.hash.Write(p[:n])
+	b.read += int64(n)
+	if err == io.EOF {
+		if b.read != b.size {
+			return n, fmt.Errorf("blob %s is %d bytes, not %d", b.want, b.read, b.size)
+		}
+		if got := hex.EncodeToString(b.hash.Sum(nil)); got != b.want {
+			return n, fmt.Errorf("blob %s has digest %s", b.want, got)
+		}
+	}
+	return n, err
+}
+
+func (b *verifiedBlob) Close() error {
+	return b.f.Close()
+}
+
+func readBlobJSON(layout string, d ociDescriptor, v interface{}) error {
+	blob, err := openBlob(layout, d)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// applyLayer extracts the layer d describes over rootfs, applying its
+// whiteouts to the layers below. With owners, files are owned by the IDs
+// their owners in the layer map to.
+func applyLayer(layout, rootfs string, d ociDescriptor, owners *idRange) error {
+	blob, err := openBlob(layout, d)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	var r io.Reader = blob
+	switch {
+	case strings.HasSuffix(d.MediaType, "+gzip"), strings.HasSuffix(d.MediaType, ".tar.gzip"):
+		gz, err := gzip.NewReader(blob)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case strings.HasSuffix(d.MediaType, "+zstd"):
+		zr, err := zstd.NewReader(blob)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case strings.HasSuffix(d.MediaType, ".tar"):
+	default:
+		return fmt.Errorf("unsupported layer type %q", d.MediaType)
+	}
+
+	// Whiteouts only hide what the layers below added.
+	added := map[string]bool{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean("/" + hdr.Name)
+		dir, base := path.Split(name)
+		parent, err := resolveInRoot(rootfs, dir)
+		if err != nil {
+			return err
+		}
+
+		if base == ".wh..wh..opq" {
+			entries, err := os.ReadDir(parent)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			for _, e := range entries {
+				if !added[path.Join(dir, e.Name())] {
+					os.RemoveAll(filepath.Join(parent, e.Name()))
+				}
+			}
+			continue
+		}
+		if hidden, ok := strings.CutPrefix(base, ".wh."); ok {
+			// The entry itself goes, not what it links to, so only its
+			// directory is resolved.
+			if hidden == "" || hidden == "." || hidden == ".." || strings.Contains(hidden, "/") {
+				return fmt.Errorf("bad whiteout %q", hdr.Name)
+			}
+			os.RemoveAll(filepath.Join(parent, hidden))
+			continue
+		}
+
+		if name == "/" {
+			continue
+		}
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		target := filepath.Join(parent, base)
+		added[name] = true
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+				os.Remove(target)
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			os.Chmod(target, hdr.FileInfo().Mode().Perm())
+		case tar.TypeReg:
+			os.RemoveAll(target)
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			os.RemoveAll(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			source, err := resolveInRoot(rootfs, path.Clean("/"+hdr.Linkname))
+			if err != nil {
+				return err
+			}
+			os.RemoveAll(target)
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+		default:
+			// Devices and pipes can't be made unprivileged, and the
+			// sandbox has a /dev of its own.
+			continue
+		}
+		if owners != nil && hdr.Uid < owners.Size && hdr.Gid < owners.Size {
+			os.Lchown(target, owners.UID+hdr.Uid, owners.GID+hdr.Gid)
+		}
+	}
+
+	// Drain the blob so its digest gets checked.
+	_, err = io.Copy(io.Discard, blob)
+	return err
+}
+
+// resolveInRoot returns where name, a slash separated path inside rootfs,
+// is on the host, following symlinks as if rootfs were the root so that a
+// layer can't write outside of it.
+func resolveInRoot(rootfs, name string) (string, error) {
+	resolved := "/"
+	rest := strings.Split(strings.Trim(name, "/"), "/")
+	for links := 0; len(rest) > 0; {
+		part := rest[0]
+		rest = rest[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(rootfs, next))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			// Whatever doesn't exist yet will be made as a directory.
+			resolved = next
+			continue
+		}
+
+		if links++; links > 255 {
+			return "", fmt.Errorf("too many symlinks in %s", name)
+		}
+		link, err := os.Readlink(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(link) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(link, "/"), rest...)
+	}
+	return filepath.Join(rootfs, resolved), nil
+}
@@ -0,0 +1,76 @@
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeLayer adds an uncompressed layer with the given entries to a new
+// image layout and returns the layout and the layer's descriptor.
+func writeLayer(t *testing.T, entries ...*tar.Header) (string, ociDescriptor) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range entries {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	layout := t.TempDir()
+	sum := sha256.Sum256(buf.Bytes())
+	digest := hex.EncodeToString(sum[:])
+	if err := os.MkdirAll(filepath.Join(layout, "blobs", "sha256"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(layout, "blobs", "sha256", digest), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return layout, ociDescriptor{
+		MediaType: "application/vnd.oci.image.layer.v1.tar",
+		Digest:    "sha256:" + digest,
+		Size:      int64(buf.Len()),
+	}
+}
+
+func TestApplyLayerWhiteouts(t *testing.T) {
+	for _, name := range []string{"dir/.wh...", "dir/.wh..", "dir/.wh."} {
+		t.Run(name, func(t *testing.T) {
+			outside := t.TempDir()
+			rootfs := filepath.Join(outside, "rootfs")
+			if err := os.MkdirAll(filepath.Join(rootfs, "dir"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			layout, d := writeLayer(t, &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644})
+
+			if err := applyLayer(layout, rootfs, d, nil); err == nil {
+				t.Fatal("bad whiteout accepted")
+			}
+			if _, err := os.Stat(filepath.Join(rootfs, "dir")); err != nil {
+				t.Fatal("whiteout removed the directory it is in:", err)
+			}
+		})
+	}
+
+	rootfs := t.TempDir()
+	for _, p := range []string{"dir/gone", "dir/kept"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, p), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	layout, d := writeLayer(t, &tar.Header{Name: "dir/.wh.gone", Typeflag: tar.TypeReg, Mode: 0644})
+	if err := applyLayer(layout, rootfs, d, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "dir/gone")); !os.IsNotExist(err) {
+		t.Fatal("whited out entry is still there")
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "dir/kept")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,172 @@
+package executor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The argument the node is re-executed with to set up a sandbox. main hands
+// it to SandboxInit.
+const SandboxInitCommand = "sandbox-init"
+
+// OCI runs programs from unpacked OCI images, each in its own user, mount,
+// PID, UTS, IPC and network namespaces with the image's rootfs as its root.
+// It runs as root in its user namespace, without any capabilities, and that
+// root is the node's user on the host, or the first of root's subordinate
+// IDs when the node runs as root. Its network has only a loopback interface.
+//
+// The program is PID 1 in its namespace, so it only gets the SIGTERM Stop
+// sends if it handles it; otherwise it is killed once the timeout passes.
+type OCI struct {
+	// As for Native.
+	Cgroup string
+}
+
+// sandboxConfig is what SandboxInit sets up before running the program.
+type sandboxConfig struct {
+	Rootfs   string `json:"rootfs"`
+	Dir      string `json:"dir,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Binds    []Bind `json:"binds,omitempty"`
+	// The names of the secrets, read from the files after stderr in order.
+	Secrets []string `json:"secrets,omitempty"`
+}
+
+func (e OCI) Start(spec Spec) (Process, error) {
+	if spec.Rootfs == "" {
+		return nil, errors.New("no rootfs to run the program in")
+	}
+	sandbox := sandboxConfig{
+		Rootfs:   spec.Rootfs,
+		Dir:      spec.Dir,
+		Hostname: spec.Workload,
+		Binds:    spec.Binds,
+	}
+	for _, s := range spec.Secrets {
+		if s.Name != filepath.Base(s.Name) || s.Name == "." || s.Name == ".." {
+			return nil, fmt.Errorf("bad secret name %q", s.Name)
+		}
+		sandbox.Secrets = append(sandbox.Secrets, s.Name)
+	}
+	// The sandbox's root writes the program's outputs.
+	if os.Geteuid() == 0 {
+		ids, err := sandboxIDs()
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range spec.Binds {
+			if !b.ReadOnly {
+				if err := os.Chown(b.Path, ids.UID, ids.GID); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	config, err := json.Marshal(sandbox)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the image's environment gets into the sandbox, not the node's.
+	args := append([]string{SandboxInitCommand, string(config), "--", spec.Path}, spec.Args...)
+	cmd := exec.Command("/proc/self/exe", args...)
+	cmd.Env = spec.Env
+	cmd.Stdout = spec.Stdout
+	cmd.Stderr = spec.Stderr
+
+	attr, closeSandbox, err := sandboxAttr(e.Cgroup, spec)
+	if err != nil {
+		return nil, fmt.Errorf("sandbox: %w", err)
+	}
+	defer closeSandbox()
+	cmd.SysProcAttr = attr
+
+	// Secrets go in through pipes, so they are never on the host's disk.
+	for _, s := range spec.Secrets {
+		r, w, err := os.Pipe()
+		if err != nil {
+			closeFiles(cmd.ExtraFiles)
+			return nil, err
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+		go func(data []byte) {
+			// Fails once the sandbox is gone, if it never read it.
+			w.Write(data)
+			w.Close()
+		}(s.Data)
+	}
+	err = cmd.Start()
+	closeFiles(cmd.ExtraFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &nativeProcess{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// idRange is the host user and group IDs the IDs in a sandbox map to, from
+// its root's up.
+type idRange struct {
+	UID, GID, Size int
+}
+
+// sandboxIDs is the IDs sandboxes run as on the host. An unprivileged node
+// only has its own to give. A node running as root uses root's subordinate
+// IDs in /etc/subuid and /etc/subgid, so that nothing in the sandbox is ever
+// the host's root.
+func sandboxIDs() (idRange, error) {
+	if os.Geteuid() != 0 {
+		return idRange{UID: os.Getuid(), GID: os.Getgid(), Size: 1}, nil
+	}
+	uid, uids, err := subordinateIDs("/etc/subuid")
+	if err != nil {
+		return idRange{}, err
+	}
+	gid, gids, err := subordinateIDs("/etc/subgid")
+	if err != nil {
+		return idRange{}, err
+	}
+	return idRange{UID: uid, GID: gid, Size: min(uids, gids, maxSandboxIDs)}, nil
+}
+
+// The most IDs a sandbox gets, those images use.
+const maxSandboxIDs = 65536
+
+// subordinateIDs reads root's first range of IDs from file, in the format of
+// /etc/subuid.
+func subordinateIDs(file string) (start, size int, err error) {
+	data, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ":")
+		if len(fields) != 3 || (fields[0] != "root" && fields[0] != "0") {
+			continue
+		}
+		start, err1 := strconv.Atoi(fields[1])
+		size, err2 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil || start <= 0 || size <= 0 {
+			return 0, 0, fmt.Errorf("%s: bad range for root %q", file, line)
+		}
+		return start, size, nil
+	}
+	return 0, 0, fmt.Errorf("running sandboxes as root needs a range of IDs for root in %s, such as root:100000:65536", file)
+}
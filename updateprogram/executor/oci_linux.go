@@ -0,0 +1,333 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// sandboxAttr returns the attributes that start a process in new namespaces,
+// and in spec's workload cgroup under cgroup if set, and a func to call once
+// it has started.
+func sandboxAttr(cgroup string, spec Spec) (*syscall.SysProcAttr, func(), error) {
+	ids, err := sandboxIDs()
+	if err != nil {
+		return nil, nil, err
+	}
+	attr := &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWNET,
+		// Root in the sandbox is ids.UID on the host, never the node's root.
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: ids.UID, Size: ids.Size}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: ids.GID, Size: ids.Size}},
+		Credential:  &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: true},
+		Pdeathsig:   syscall.SIGKILL,
+	}
+
+	if cgroup == "" {
+		return attr, func() {}, nil
+	}
+	cgroupAttr, closeCgroup, err := cgroupAttr(cgroup, spec)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cgroup: %w", err)
+	}
+	attr.UseCgroupFD, attr.CgroupFD = cgroupAttr.UseCgroupFD, cgroupAttr.CgroupFD
+	return attr, closeCgroup, nil
+}
+
+// Devices bound into the sandbox's /dev from the host's.
+var sandboxDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// SandboxInit runs in the namespaces OCI.Start made, as the node re-executed
+// with SandboxInitCommand. It sets up the root filesystem described by its
+// first argument and then execs the program after the "--". It only returns
+// if that fails.
+func SandboxInit(args []string) int {
+	if len(args) < 3 || args[1] != "--" {
+		fmt.Fprintln(os.Stderr, "usage: updateprogram sandbox-init <config> -- <program> [args...]")
+		return 2
+	}
+	var cfg sandboxConfig
+	if err := json.Unmarshal([]byte(args[0]), &cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "sandbox-init: bad config:", err)
+		return 2
+	}
+
+	// Capabilities and no_new_privs are the calling thread's, and exec
+	// keeps the calling thread's.
+	runtime.LockOSThread()
+	if err := setupSandbox(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "sandbox-init:", err)
+		return 1
+	}
+	if err := dropPrivileges(); err != nil {
+		fmt.Fprintln(os.Stderr, "sandbox-init:", err)
+		return 1
+	}
+
+	// PATH is the image's, and is looked up in the image.
+	program := args[2]
+	path, err := exec.LookPath(program)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sandbox-init:", err)
+		return 127
+	}
+	err = syscall.Exec(path, append([]string{program}, args[3:]...), os.Environ())
+	fmt.Fprintln(os.Stderr, "sandbox-init: exec:", err)
+	return 126
+}
+
+func setupSandbox(cfg sandboxConfig) error {
+	// Nothing mounted here gets back to the host.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %w", err)
+	}
+	// pivot_root needs the new root to be a mount point.
+	rootfs := cfg.Rootfs
+	if err := syscall.Mount(rootfs, rootfs, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind rootfs: %w", err)
+	}
+
+	for _, b := range cfg.Binds {
+		target, err := resolveInRoot(rootfs, b.Path)
+		if err != nil {
+			return err
+		}
+		if err := mountPoint(b.Path, target); err != nil {
+			return err
+		}
+		if err := syscall.Mount(b.Path, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind %s: %w", b.Path, err)
+		}
+		if b.ReadOnly {
+			if err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|lockedFlags(target), ""); err != nil {
+				return fmt.Errorf("make %s read-only: %w", b.Path, err)
+			}
+		}
+	}
+
+	if len(cfg.Secrets) > 0 {
+		if err := setupSecrets(filepath.Join(rootfs, SecretDir), cfg.Secrets); err != nil {
+			return err
+		}
+	}
+
+	proc := filepath.Join(rootfs, "proc")
+	if err := os.MkdirAll(proc, 0555); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mount /proc: %w", err)
+	}
+	if err := setupDev(filepath.Join(rootfs, "dev")); err != nil {
+		return err
+	}
+
+	if err := setupLoopback(); err != nil {
+		return err
+	}
+
+	if cfg.Hostname != "" {
+		if err := syscall.Sethostname([]byte(cfg.Hostname)); err != nil {
+			return fmt.Errorf("set hostname: %w", err)
+		}
+	}
+
+	// Swap the host's root for the rootfs and drop it.
+	if err := os.Chdir(rootfs); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount host root: %w", err)
+	}
+
+	dir := cfg.Dir
+	if dir == "" {
+		dir = "/"
+	}
+	return os.Chdir(dir)
+}
+
+// setupDev mounts a tmpfs at dev with the few devices programs expect. Only
+// those bound from the host work: no device made in it can be opened.
+func setupDev(dev string) error {
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=755"); err != nil {
+		return fmt.Errorf("mount /dev: %w", err)
+	}
+	for _, name := range sandboxDevices {
+		if _, err := os.Stat("/dev/" + name); err != nil {
+			continue
+		}
+		target := filepath.Join(dev, name)
+		if err := mountPoint("/dev/"+name, target); err != nil {
+			return err
+		}
+		if err := syscall.Mount("/dev/"+name, target, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("bind /dev/%s: %w", name, err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dev, "shm"), 01777); err != nil {
+		return err
+	}
+	if err := syscall.Mount("shm", filepath.Join(dev, "shm"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=1777"); err != nil {
+		return fmt.Errorf("mount /dev/shm: %w", err)
+	}
+	for link, target := range map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	} {
+		if err := os.Symlink(target, filepath.Join(dev, link)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupLoopback brings up lo in the sandbox's network namespace, the only
+// interface it has.
+func setupLoopback() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// struct ifreq, with ifr_flags.
+	var req struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(req.name[:], "lo")
+	req.flags = syscall.IFF_UP | syscall.IFF_RUNNING
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return fmt.Errorf("bring up lo: %w", errno)
+	}
+	return nil
+}
+
+// dropPrivileges gives up every capability root has in the sandbox, for
+// good: neither the program nor anything it execs, setuid or with file
+// capabilities, gets any back.
+func dropPrivileges() error {
+	last := 63
+	if data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			last = n
+		}
+	}
+	for c := 0; c <= last; c++ {
+		if err := prctl(syscall.PR_CAPBSET_DROP, uintptr(c)); err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("drop capability %d: %w", c, err)
+		}
+	}
+	// Kernels before 4.3 have no ambient capabilities to clear.
+	if err := prctl(prCapAmbient, prCapAmbientClearAll); err != nil && err != syscall.EINVAL {
+		return fmt.Errorf("clear ambient capabilities: %w", err)
+	}
+
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapabilityVersion3}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data)), 0); errno != 0 {
+		return fmt.Errorf("capset: %w", errno)
+	}
+
+	if err := prctl(prSetNoNewPrivs, 1); err != nil {
+		return fmt.Errorf("set no_new_privs: %w", err)
+	}
+	return nil
+}
+
+// What syscall doesn't have of prctl and capset.
+const (
+	prSetNoNewPrivs         = 38
+	prCapAmbient            = 47
+	prCapAmbientClearAll    = 4
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+func prctl(option, arg uintptr) error {
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, option, arg, 0, 0, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setupSecrets mounts a tmpfs at dir and copies the secrets into it from the
+// files after stderr.
+func setupSecrets(dir string, names []string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=700"); err != nil {
+		return fmt.Errorf("mount %s: %w", SecretDir, err)
+	}
+	for i, name := range names {
+		r := os.NewFile(uintptr(3+i), name)
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("read secret %s: %w", name, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0400); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockedFlags are the flags of the mount at path that a remount in a user
+// namespace has to keep.
+func lockedFlags(path string) uintptr {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0
+	}
+	// The ST_ flags share their values with the MS_ ones, but for relatime.
+	flags := uintptr(st.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME)
+	if st.Flags&stRelatime != 0 {
+		flags |= syscall.MS_RELATIME
+	}
+	return flags
+}
+
+// ST_RELATIME, which syscall doesn't have.
+const stRelatime = 0x1000
+
+// mountPoint makes target something source can be bound over: a directory
+// if source is one, an empty file if not.
+func mountPoint(source, target string) error {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return os.MkdirAll(target, 0755)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func sandboxAttr(cgroup string, spec Spec) (*syscall.SysProcAttr, func(), error) {
+	return nil, nil, errors.New("sandboxes are only supported on Linux")
+}
+
+func SandboxInit(args []string) int {
+	fmt.Fprintln(os.Stderr, "sandbox-init: sandboxes are only supported on Linux")
+	return 2
+}
@@ -0,0 +1,120 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ipfs/boxo/files"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// Fake is a ContentFetcher for tests that serves the files and directories
+// added to it.
+type Fake struct {
+	mu    sync.Mutex
+	files map[cid.Cid][]byte
+	dirs  map[cid.Cid]map[string][]byte
+	// CIDs opened so far, in order.
+	Opened []cid.Cid
+}
+
+func NewFake() *Fake {
+	return &Fake{files: map[cid.Cid][]byte{}, dirs: map[cid.Cid]map[string][]byte{}}
+}
+
+// Add makes data available and returns its CID.
+func (f *Fake) Add(data []byte) cid.Cid {
+	mh, _ := multihash.Sum(data, multihash.SHA2_256, -1)
+	c := cid.NewCidV1(cid.Raw, mh)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[c] = data
+	return c
+}
+
+// AddDir makes a directory of the files in entries available, by slash
+// separated path, and returns its CID.
+func (f *Fake) AddDir(entries map[string][]byte) cid.Cid {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s\x00%d\x00", name, len(entries[name]))
+		buf.Write(entries[name])
+	}
+	mh, _ := multihash.Sum(buf.Bytes(), multihash.SHA2_256, -1)
+	c := cid.NewCidV1(cid.DagProtobuf, mh)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dirs[c] = entries
+	return c
+}
+
+func (f *Fake) OpenDir(ctx context.Context, c cid.Cid) (files.Directory, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Opened = append(f.Opened, c)
+	entries, ok := f.dirs[c]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", c)
+	}
+	return fakeDirectory(entries), nil
+}
+
+// fakeDirectory makes a directory of the files in entries, by slash
+// separated path.
+func fakeDirectory(entries map[string][]byte) files.Directory {
+	nodes := map[string]files.Node{}
+	subdirs := map[string]map[string][]byte{}
+	for name, data := range entries {
+		dir, rest, nested := strings.Cut(name, "/")
+		if !nested {
+			nodes[name] = files.NewBytesFile(data)
+			continue
+		}
+		if subdirs[dir] == nil {
+			subdirs[dir] = map[string][]byte{}
+		}
+		subdirs[dir][rest] = data
+	}
+	for name, sub := range subdirs {
+		nodes[name] = fakeDirectory(sub)
+	}
+	return files.NewMapDirectory(nodes)
+}
+
+func (f *Fake) Open(ctx context.Context, c cid.Cid) (File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Opened = append(f.Opened, c)
+	data, ok := f.files[c]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", c)
+	}
+	return &fakeFile{Reader: bytes.NewReader(data)}, nil
+}
+
+type fakeFile struct {
+	*bytes.Reader
+}
+
+func (f *fakeFile) Size() (int64, error) {
+	return f.Reader.Size(), nil
+}
+
+func (f *fakeFile) Close() error {
+	return nil
+}
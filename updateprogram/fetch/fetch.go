@@ -0,0 +1,81 @@
+// Package fetch gets programs and their inputs from the network.
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/files"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	unixfile "github.com/ipfs/boxo/ipld/unixfs/file"
+	"github.com/ipfs/go-cid"
+)
+
+// File is a file being fetched. Its blocks are fetched as it is read.
+type File interface {
+	io.ReadCloser
+	Size() (int64, error)
+}
+
+// ContentFetcher finds files and directories by CID.
+type ContentFetcher interface {
+	Open(ctx context.Context, c cid.Cid) (File, error)
+	// OpenDir opens the directory c. Its files are fetched as they are
+	// read.
+	OpenDir(ctx context.Context, c cid.Cid) (files.Directory, error)
+}
+
+// Bitswap is a ContentFetcher for UnixFS files over bitswap.
+type Bitswap struct {
+	log      *slog.Logger
+	bservice blockservice.BlockService
+	// Connects to the peers likely to have c.
+	connect func(ctx context.Context, c cid.Cid)
+}
+
+func NewBitswap(log *slog.Logger, bservice blockservice.BlockService, connect func(ctx context.Context, c cid.Cid)) *Bitswap {
+	return &Bitswap{log: log, bservice: bservice, connect: connect}
+}
+
+func (b *Bitswap) Open(ctx context.Context, c cid.Cid) (File, error) {
+	n, err := b.get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := n.(files.File)
+	if !ok {
+		n.Close()
+		return nil, fmt.Errorf("%s is not a file", c)
+	}
+	return f, nil
+}
+
+func (b *Bitswap) OpenDir(ctx context.Context, c cid.Cid) (files.Directory, error) {
+	n, err := b.get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := n.(files.Directory)
+	if !ok {
+		n.Close()
+		return nil, fmt.Errorf("%s is not a directory", c)
+	}
+	return d, nil
+}
+
+// get opens the UnixFS node c, whatever it is.
+func (b *Bitswap) get(ctx context.Context, c cid.Cid) (files.Node, error) {
+	b.connect(ctx, c)
+
+	dserv := merkledag.NewReadOnlyDagService(merkledag.NewSession(ctx, merkledag.NewDAGService(b.bservice)))
+	b.log.Info("downloading", "cid", c)
+	nd, err := dserv.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return unixfile.NewUnixfsFile(ctx, dserv, nd)
+}
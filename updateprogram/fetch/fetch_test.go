@@ -0,0 +1,102 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	bsclient "github.com/ipfs/boxo/bitswap/client"
+	bsnet "github.com/ipfs/boxo/bitswap/network"
+	bsserver "github.com/ipfs/boxo/bitswap/server"
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	chunker "github.com/ipfs/boxo/chunker"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/balanced"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/helpers"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// bitswapPeer serves and fetches blocks over bitswap.
+func bitswapPeer(t *testing.T, ctx context.Context, h host.Host) blockservice.BlockService {
+	t.Helper()
+	bstore := blockstore.NewBlockstore(dsync.MutexWrap(datastore.NewMapDatastore()))
+	net := bsnet.NewFromIpfsHost(h, routinghelpers.Null{})
+	client := bsclient.New(ctx, net, bstore)
+	server := bsserver.New(ctx, net, bstore)
+	net.Start(client, server)
+	t.Cleanup(func() {
+		net.Stop()
+		client.Close()
+		server.Close()
+	})
+	return blockservice.New(bstore, client)
+}
+
+// A node gets a file from the peer it connects to, without reconnecting
+// to the peers it already has.
+func TestBitswapFetchesFromPeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+	var hosts []host.Host
+	for i := 0; i < 3; i++ {
+		h, err := mn.GenPeer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts = append(hosts, h)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	publisher, fetcher, other := hosts[0], hosts[1], hosts[2]
+
+	data := bytes.Repeat([]byte("program "), 100_000)
+	dag := merkledag.NewDAGService(bitswapPeer(t, ctx, publisher))
+	db, err := (&helpers.DagBuilderParams{Dagserv: dag, Maxlinks: helpers.DefaultLinksPerBlock}).New(chunker.DefaultSplitter(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := balanced.Layout(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A connection the fetch has no business closing.
+	if _, err := mn.ConnectPeers(fetcher.ID(), other.ID()); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBitswap(slog.New(slog.NewTextHandler(io.Discard, nil)), bitswapPeer(t, ctx, fetcher), func(ctx context.Context, c cid.Cid) {
+		if err := fetcher.Connect(ctx, peer.AddrInfo{ID: publisher.ID()}); err != nil {
+			t.Errorf("connect to publisher: %v", err)
+		}
+	})
+
+	f, err := b.Open(ctx, root.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("fetched %d bytes, not the %d published", len(got), len(data))
+	}
+	if len(fetcher.Network().ConnsToPeer(other.ID())) == 0 {
+		t.Error("fetching dropped the connection to another peer")
+	}
+}
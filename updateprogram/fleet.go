@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+type fleetNode struct {
+	heartbeat
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// How far ahead of the node's clock a heartbeat's may be.
+const heartbeatMaxSkew = time.Minute
+
+// fleet keeps the latest heartbeat of every node heard from.
+type fleet struct {
+	log *slog.Logger
+	// Nodes not heard from for this long are gone.
+	expiry time.Duration
+	// The topic heartbeats are gossiped on.
+	topic *pubsub.Topic
+
+	mu    sync.Mutex
+	nodes map[peer.ID]*fleetNode
+}
+
+func newFleet(ctx context.Context, log *slog.Logger, ps *pubsub.PubSub, interval time.Duration) (*fleet, error) {
+	f := &fleet{
+		log:    log,
+		expiry: 3 * interval,
+		nodes:  map[peer.ID]*fleetNode{},
+	}
+	topic, err := joinTopic(ctx, ps, log, heartbeatTopic, f.validate, f.handle)
+	if err != nil {
+		return nil, err
+	}
+	f.topic = topic
+	return f, nil
+}
+
+// validate lets through heartbeats their nodes sent, recently. Operators
+// that don't prove they run the node are dropped from the heartbeat.
+func (f *fleet) validate(ctx context.Context, msg *pubsub.Message) pubsub.ValidationResult {
+	var hb heartbeat
+	if err := json.Unmarshal(msg.Data, &hb); err != nil {
+		f.log.Warn("bad heartbeat", "from", msg.GetFrom(), "err", err)
+		return pubsub.ValidationReject
+	}
+	if hb.PeerID != msg.GetFrom() {
+		f.log.Warn("heartbeat for another peer", "from", msg.GetFrom(), "peer", hb.PeerID)
+		return pubsub.ValidationReject
+	}
+	now := time.Now()
+	if now.Sub(hb.SentAt) > f.expiry || hb.SentAt.Sub(now) > heartbeatMaxSkew {
+		f.log.Debug("heartbeat out of date", "peer", hb.PeerID, "sent", hb.SentAt)
+		return pubsub.ValidationIgnore
+	}
+	if hb.Operator != "" {
+		if err := hb.verifyOperator(); err != nil {
+			f.log.Warn("ignoring unproven operator", "peer", hb.PeerID, "operator", hb.Operator, "err", err)
+			hb.Operator, hb.OperatorSig = "", nil
+		}
+	}
+	msg.ValidatorData = &hb
+	return pubsub.ValidationAccept
+}
+
+func (f *fleet) handle(msg *pubsub.Message) {
+	hb := msg.ValidatorData.(*heartbeat)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nodes[hb.PeerID] = &fleetNode{heartbeat: *hb, LastSeen: time.Now()}
+}
+
+// Live returns the nodes heard from recently, by peer ID.
+func (f *fleet) Live() []fleetNode {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	nodes := []fleetNode{}
+	for id, n := range f.nodes {
+		if time.Since(n.LastSeen) > f.expiry {
+			delete(f.nodes, id)
+			continue
+		}
+		nodes = append(nodes, *n)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].PeerID < nodes[j].PeerID
+	})
+	return nodes
+}
+
+// fleetCommand implements "updateprogram fleet", listing the live nodes the
+// local node has heard from.
+func fleetCommand(args []string) int {
+	cfg, err := loadConfig("fleet", args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	client, base, err := apiClient(&cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	resp, err := client.Get(base + "/fleet")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: is the node running?", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, "error:", resp.Status)
+		return 1
+	}
+
+	var nodes []fleetNode
+	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tOPERATOR\tPLATFORM\tCPUS\tMEMORY\tRUNTIMES\tRECIPIENT\tWORKLOADS\tLAST SEEN")
+	for _, n := range nodes {
+		operator := n.Operator
+		if operator == "" {
+			operator = "-"
+		}
+		recipient := n.Recipient
+		if recipient == "" {
+			recipient = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s/%s\t%d\t%dMiB\t%s\t%s\t%s\t%s ago\n",
+			n.PeerID, operator, n.OS, n.Arch, n.CPUs, n.Memory>>20,
+			strings.Join(n.Runtimes, ","), recipient, describeWorkloads(n.Workloads), time.Since(n.LastSeen).Round(time.Second))
+	}
+	w.Flush()
+	return 0
+}
+
+// describeWorkloads sums up a heartbeat's workloads in one line, as
+// name=cid (state), followed by the scheduled program if there is one.
+func describeWorkloads(workloads map[string]workloadHeartbeat) string {
+	if len(workloads) == 0 {
+		return "-"
+	}
+	var parts []string
+	for _, name := range sortedNames(workloads) {
+		w := workloads[name]
+		cid := w.CID
+		if cid == "" {
+			cid = "-"
+		}
+		part := fmt.Sprintf("%s=%s (%s)", name, cid, w.State)
+		if w.Scheduled != "" {
+			next := "waiting"
+			if w.Ready {
+				next = "ready"
+			}
+			part += fmt.Sprintf(", next %s (%s)", w.Scheduled, next)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// apiClient returns a client for the local status API and its base URL,
+// preferring the TCP address over the unix socket.
+func apiClient(cfg *Config) (*http.Client, string, error) {
+	switch {
+	case cfg.API.Listen != "":
+		return http.DefaultClient, "http://" + cfg.API.Listen, nil
+	case cfg.API.Socket != "":
+		dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", cfg.API.Socket)
+		}
+		return &http.Client{Transport: &http.Transport{DialContext: dial}}, "http://unix", nil
+	default:
+		return nil, "", fmt.Errorf("the status API is disabled")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// loadSwarmKey reads a libp2p pre-shared key in the swarm.key format used by
+// IPFS private networks.
+func loadSwarmKey(path string) (pnet.PSK, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return pnet.DecodeV1PSK(f)
+}
+
+// allowlistGater only lets allowlisted peers connect, in either direction.
+// The list is the configured peers, seeds and relays, plus the nodes the
+// NodeRegistry's allowed operators registered if that is enabled.
+type allowlistGater struct {
+	log *slog.Logger
+
+	mu         sync.RWMutex
+	static     map[peer.ID]bool
+	registered map[peer.ID]bool
+}
+
+func newAllowlistGater(log *slog.Logger, cfg *P2PConfig) *allowlistGater {
+	g := &allowlistGater{
+		log:        log,
+		static:     map[peer.ID]bool{},
+		registered: map[peer.ID]bool{},
+	}
+	for _, s := range cfg.AllowedPeers {
+		if id, err := peer.Decode(s); err == nil {
+			g.static[id] = true
+		}
+	}
+	// The node has to be able to reach its own seeds and relays.
+	for _, s := range append(append([]string{}, cfg.Seeds...), cfg.Relays...) {
+		if maddr, err := multiaddr.NewMultiaddr(s); err == nil {
+			if info, err := peer.AddrInfoFromP2pAddr(maddr); err == nil {
+				g.static[info.ID] = true
+			}
+		}
+	}
+	return g
+}
+
+func (g *allowlistGater) allowed(id peer.ID) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.static[id] || g.registered[id]
+}
+
+func (g *allowlistGater) InterceptPeerDial(id peer.ID) bool {
+	return g.allowed(id)
+}
+
+func (g *allowlistGater) InterceptAddrDial(id peer.ID, _ multiaddr.Multiaddr) bool {
+	return g.allowed(id)
+}
+
+// The peer ID isn't known until the connection is secured.
+func (g *allowlistGater) InterceptAccept(network.ConnMultiaddrs) bool {
+	return true
+}
+
+func (g *allowlistGater) InterceptSecured(dir network.Direction, id peer.ID, addrs network.ConnMultiaddrs) bool {
+	if !g.allowed(id) {
+		g.log.Debug("refusing peer", "peer", id, "addr", addrs.RemoteMultiaddr(), "direction", dir)
+		return false
+	}
+	return true
+}
+
+func (g *allowlistGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+// refreshFromRegistry reloads the peer IDs allowed operators registered on
+// the NodeRegistry every interval, and drops connections to peers that are no longer allowed.
+func (g *allowlistGater) refreshFromRegistry(ctx context.Context, h host.Host, client *ethclient.Client, registry common.Address, interval time.Duration) {
+	parsed, err := abi.JSON(strings.NewReader(nodeRegistryAbi))
+	if err != nil {
+		g.log.Error("bad node registry abi", "err", err)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := g.loadRegistered(ctx, client, registry, parsed); err != nil {
+			g.log.Warn("failed to load allowlist from the node registry", "registry", registry, "err", err)
+		} else {
+			for _, id := range h.Network().Peers() {
+				if !g.allowed(id) {
+					g.log.Info("disconnecting peer no longer allowed", "peer", id)
+					h.Network().ClosePeer(id)
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (g *allowlistGater) loadRegistered(ctx context.Context, client *ethclient.Client, registry common.Address, parsed abi.ABI) error {
+	values, err := callContract(ctx, client, registry, parsed, "getOperators")
+	if err != nil {
+		return err
+	}
+
+	registered := map[peer.ID]bool{}
+	for _, operator := range values[0].([]common.Address) {
+		// Operators taken off the registry's list keep their registration.
+		values, err := callContract(ctx, client, registry, parsed, "isAllowedOperator", operator)
+		if err != nil {
+			return err
+		}
+		if !values[0].(bool) {
+			g.log.Debug("operator in node registry not allowed", "operator", operator)
+			continue
+		}
+
+		values, err = callContract(ctx, client, registry, parsed, "getNode", operator)
+		if err != nil {
+			return err
+		}
+		node := abi.ConvertType(values[0], new(registeredNode)).(*registeredNode)
+		id, err := peer.Decode(node.PeerId)
+		if err != nil {
+			g.log.Debug("bad peer id in node registry", "operator", operator, "peer", node.PeerId)
+			continue
+		}
+		registered[id] = true
+	}
+
+	g.mu.Lock()
+	g.registered = registered
+	g.mu.Unlock()
+
+	g.log.Debug("loaded allowlist from the node registry", "peers", len(registered))
+	return nil
+}
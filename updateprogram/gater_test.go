@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// remoteAddr is an inbound connection's addresses.
+type remoteAddr struct{}
+
+func (remoteAddr) LocalMultiaddr() multiaddr.Multiaddr {
+	return multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001")
+}
+
+func (remoteAddr) RemoteMultiaddr() multiaddr.Multiaddr {
+	return multiaddr.StringCast("/ip4/10.0.0.9/tcp/50000")
+}
+
+func randomPeer(t *testing.T) peer.ID {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// The allowlist takes in the configured peers, and the seeds and relays the
+// node has to reach, but no one else until they register.
+func TestAllowlistGater(t *testing.T) {
+	allowed, seed, relay, registered, stranger := randomPeer(t), randomPeer(t), randomPeer(t), randomPeer(t), randomPeer(t)
+	g := newAllowlistGater(slog.New(slog.NewTextHandler(io.Discard, nil)), &P2PConfig{
+		AllowedPeers: []string{allowed.String(), "not a peer"},
+		Seeds:        []string{"/ip4/10.0.0.1/tcp/4001/p2p/" + seed.String(), "/ip4/10.0.0.2/tcp/4001"},
+		Relays:       []string{"/ip4/10.0.0.3/udp/4001/quic-v1/p2p/" + relay.String()},
+	})
+	g.registered = map[peer.ID]bool{registered: true}
+
+	for _, tt := range []struct {
+		name string
+		id   peer.ID
+		ok   bool
+	}{
+		{"allowed peer", allowed, true},
+		{"seed", seed, true},
+		{"relay", relay, true},
+		{"registered node", registered, true},
+		{"stranger", stranger, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := g.InterceptPeerDial(tt.id); got != tt.ok {
+				t.Errorf("dial allowed %v, want %v", got, tt.ok)
+			}
+			if got := g.InterceptSecured(network.DirInbound, tt.id, remoteAddr{}); got != tt.ok {
+				t.Errorf("inbound allowed %v, want %v", got, tt.ok)
+			}
+		})
+	}
+}
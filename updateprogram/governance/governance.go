@@ -0,0 +1,556 @@
+// Package governance rebuilds the DAO's proposals from its logs.
+package governance
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"slices"
+	"sync"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"example.com/v2/chain"
+)
+
+// State is where a proposal is in its lifecycle. The values are the
+// Governor's ProposalState.
+type State uint8
+
+const (
+	Pending State = iota
+	Active
+	Canceled
+	Defeated
+	Succeeded
+	Queued
+	Expired
+	Executed
+)
+
+var stateNames = []string{"pending", "active", "canceled", "defeated", "succeeded", "queued", "expired", "executed"}
+
+func (s State) String() string {
+	if int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return fmt.Sprintf("state(%d)", uint8(s))
+}
+
+// ParseState reads a state by its name, as String writes it.
+func ParseState(name string) (State, error) {
+	i := slices.Index(stateNames, name)
+	if i < 0 {
+		return 0, fmt.Errorf("unknown proposal state %q", name)
+	}
+	return State(i), nil
+}
+
+// Proposal is everything the logs and the contract say about a proposal.
+type Proposal struct {
+	ID          *big.Int
+	Proposer    common.Address
+	Targets     []common.Address
+	Values      []*big.Int
+	Calldatas   [][]byte
+	Description string
+	// Programs named in the calldatas or the votes' params.
+	CIDs []string
+
+	// Voting opens after the snapshot and closes after the deadline. Both
+	// are block numbers, like the token's clock.
+	Snapshot uint64
+	Deadline uint64
+	// Votes needed, nil until the snapshot has passed.
+	Quorum                *big.Int
+	Against, For, Abstain *big.Int
+	Votes                 []*chain.Vote
+
+	State State
+
+	// Zero for a proposal created before the first block read, which is
+	// loaded from the contract when its logs come up. The contract doesn't
+	// keep its targets, values, calldatas and description, and the votes
+	// cast before that block are missing, though they count in the tallies.
+	CreatedBlock uint64
+	CreatedTx    common.Hash
+	// Zero until it happens.
+	QueuedBlock   uint64
+	ExecutedBlock uint64
+	CanceledBlock uint64
+	// When a queued proposal can be executed, in seconds since the epoch.
+	ETA uint64
+
+	// The tallies can't change once the deadline has passed.
+	talliesFinal bool
+	// The contract says the queued proposal expired.
+	expired bool
+}
+
+// Query picks proposals. Zero fields match everything.
+type Query struct {
+	// Any of these states.
+	States   []State
+	Proposer common.Address
+	CID      string
+}
+
+func (q Query) matches(p *Proposal) bool {
+	if len(q.States) > 0 && !slices.Contains(q.States, p.State) {
+		return false
+	}
+	if q.Proposer != (common.Address{}) && q.Proposer != p.Proposer {
+		return false
+	}
+	if q.CID != "" && !slices.Contains(p.CIDs, q.CID) {
+		return false
+	}
+	return true
+}
+
+// Client is the part of an Ethereum client the Tracker uses.
+type Client interface {
+	chain.Client
+	CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error)
+}
+
+var events = []string{
+	"ProposalCreated",
+	"VoteCast",
+	"VoteCastWithParams",
+	"ProposalQueued",
+	"ProposalExecuted",
+	"ProposalCanceled",
+}
+
+// Tracker follows the DAO's proposals.
+type Tracker struct {
+	log           *slog.Logger
+	client        Client
+	abi           abi.ABI
+	contract      common.Address
+	confirmations uint64
+	// Reads the program CID out of calldata or vote params, if there is one.
+	programCID func(data []byte) (string, bool)
+
+	mu        sync.Mutex
+	next      uint64
+	head      uint64
+	proposals map[string]*Proposal
+	// In the order they were created.
+	order []*Proposal
+}
+
+// NewTracker makes a Tracker that reads the contract's logs from block start
+// on.
+func NewTracker(log *slog.Logger, client Client, parsedAbi abi.ABI, contract common.Address, start, confirmations uint64, programCID func([]byte) (string, bool)) *Tracker {
+	return &Tracker{
+		log:           log,
+		client:        client,
+		abi:           parsedAbi,
+		contract:      contract,
+		confirmations: confirmations,
+		programCID:    programCID,
+		next:          start,
+		proposals:     map[string]*Proposal{},
+	}
+}
+
+// Poll reads the logs up to the latest block with enough confirmations and
+// brings the proposals up to date.
+func (t *Tracker) Poll(ctx context.Context) error {
+	head, err := t.client.BlockNumber(ctx)
+	if err != nil {
+		return fmt.Errorf("get block number: %w", err)
+	}
+	if head < t.confirmations {
+		return nil
+	}
+	to := head - t.confirmations
+
+	var topics []common.Hash
+	for _, name := range events {
+		topics = append(topics, t.abi.Events[name].ID)
+	}
+
+	t.mu.Lock()
+	from := t.next
+	t.mu.Unlock()
+	for from <= to {
+		end := min(from+chain.MaxLogRange-1, to)
+		logs, err := t.client.FilterLogs(ctx, ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(from),
+			ToBlock:   new(big.Int).SetUint64(end),
+			Addresses: []common.Address{t.contract},
+			Topics:    [][]common.Hash{topics},
+		})
+		if err != nil {
+			return fmt.Errorf("filter logs from %d to %d: %w", from, end, err)
+		}
+
+		// Proposals created before the first block read are loaded before
+		// the logs about them are applied.
+		t.mu.Lock()
+		unseen := t.unseen(logs)
+		t.mu.Unlock()
+		var loaded []*Proposal
+		for _, id := range unseen {
+			p, err := t.load(ctx, id, new(big.Int).SetUint64(end))
+			if err != nil {
+				return fmt.Errorf("load proposal %s: %w", id, err)
+			}
+			loaded = append(loaded, p)
+		}
+
+		t.mu.Lock()
+		for _, p := range loaded {
+			t.add(p)
+		}
+		for _, l := range logs {
+			if err := t.apply(l); err != nil {
+				t.log.Warn("failed to read governance log", "tx", l.TxHash, "err", err)
+			}
+		}
+		t.next = end + 1
+		t.mu.Unlock()
+		from = end + 1
+	}
+
+	return t.refresh(ctx, to)
+}
+
+// apply adds what l says to the proposals. t.mu must be held.
+func (t *Tracker) apply(l types.Log) error {
+	if len(l.Topics) == 0 {
+		return nil
+	}
+	event, err := t.abi.EventByID(l.Topics[0])
+	if err != nil {
+		return err
+	}
+
+	if event.Name == "ProposalCreated" {
+		var created struct {
+			ProposalId  *big.Int
+			Proposer    common.Address
+			Targets     []common.Address
+			Values      []*big.Int
+			Signatures  []string
+			Calldatas   [][]byte
+			VoteStart   *big.Int
+			VoteEnd     *big.Int
+			Description string
+		}
+		if err := t.abi.UnpackIntoInterface(&created, event.Name, l.Data); err != nil {
+			return err
+		}
+		p := &Proposal{
+			ID:           created.ProposalId,
+			Proposer:     created.Proposer,
+			Targets:      created.Targets,
+			Values:       created.Values,
+			Calldatas:    created.Calldatas,
+			Description:  created.Description,
+			Snapshot:     created.VoteStart.Uint64(),
+			Deadline:     created.VoteEnd.Uint64(),
+			Against:      new(big.Int),
+			For:          new(big.Int),
+			Abstain:      new(big.Int),
+			CreatedBlock: l.BlockNumber,
+			CreatedTx:    l.TxHash,
+		}
+		for _, data := range p.Calldatas {
+			t.addCID(p, data)
+		}
+		t.add(p)
+		return nil
+	}
+
+	if event.Name == "VoteCast" || event.Name == "VoteCastWithParams" {
+		var v *chain.Vote
+		if event.Name == "VoteCastWithParams" {
+			if v, err = chain.UnpackVote(t.abi, l); err != nil {
+				return err
+			}
+		} else {
+			// The same vote without params.
+			var cast struct {
+				ProposalId *big.Int
+				Support    uint8
+				Weight     *big.Int
+				Reason     string
+			}
+			if err := t.abi.UnpackIntoInterface(&cast, event.Name, l.Data); err != nil {
+				return err
+			}
+			v = &chain.Vote{ProposalId: cast.ProposalId, Support: cast.Support, Weight: cast.Weight, Reason: cast.Reason, Block: l.BlockNumber, TxHash: l.TxHash}
+			if len(l.Topics) > 1 {
+				v.Voter = common.BytesToAddress(l.Topics[1].Bytes())
+			}
+		}
+
+		p, err := t.proposal(v.ProposalId)
+		if err != nil {
+			return err
+		}
+		p.Votes = append(p.Votes, v)
+		t.addCID(p, v.Params)
+		return nil
+	}
+
+	// The rest only carry the proposal ID, and ProposalQueued the ETA.
+	values, err := event.Inputs.NonIndexed().Unpack(l.Data)
+	if err != nil {
+		return err
+	}
+	id, ok := values[0].(*big.Int)
+	if !ok {
+		return fmt.Errorf("%s: bad proposal ID", event.Name)
+	}
+	p, err := t.proposal(id)
+	if err != nil {
+		return err
+	}
+	switch event.Name {
+	case "ProposalQueued":
+		p.QueuedBlock = l.BlockNumber
+		if eta, ok := values[1].(*big.Int); ok {
+			p.ETA = eta.Uint64()
+		}
+	case "ProposalExecuted":
+		p.ExecutedBlock = l.BlockNumber
+	case "ProposalCanceled":
+		p.CanceledBlock = l.BlockNumber
+	}
+	return nil
+}
+
+func (t *Tracker) proposal(id *big.Int) (*Proposal, error) {
+	p, ok := t.proposals[id.String()]
+	if !ok {
+		return nil, fmt.Errorf("unknown proposal %s", id)
+	}
+	return p, nil
+}
+
+// add starts tracking p. Proposals loaded from the contract were created
+// before any seen in the logs, so they go ahead of those. t.mu must be held.
+func (t *Tracker) add(p *Proposal) {
+	t.proposals[p.ID.String()] = p
+	i := len(t.order)
+	if p.CreatedBlock == 0 {
+		i = slices.IndexFunc(t.order, func(o *Proposal) bool { return o.CreatedBlock != 0 })
+		if i < 0 {
+			i = len(t.order)
+		}
+	}
+	t.order = slices.Insert(t.order, i, p)
+}
+
+// unseen returns the IDs of the proposals logs are about that weren't seen
+// created, in the order they come up. t.mu must be held.
+func (t *Tracker) unseen(logs []types.Log) []*big.Int {
+	seen := map[string]bool{}
+	var ids []*big.Int
+	for _, l := range logs {
+		if len(l.Topics) == 0 {
+			continue
+		}
+		event, err := t.abi.EventByID(l.Topics[0])
+		if err != nil {
+			continue
+		}
+		// Every event's first non-indexed field is the proposal ID.
+		values, err := event.Inputs.NonIndexed().Unpack(l.Data)
+		if err != nil || len(values) == 0 {
+			continue
+		}
+		id, ok := values[0].(*big.Int)
+		if !ok || seen[id.String()] || t.proposals[id.String()] != nil {
+			continue
+		}
+		seen[id.String()] = true
+		if event.Name != "ProposalCreated" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// load reads what the contract keeps of a proposal as of block.
+func (t *Tracker) load(ctx context.Context, id, block *big.Int) (*Proposal, error) {
+	var got []interface{}
+	for _, method := range []string{"proposalSnapshot", "proposalDeadline", "proposalProposer", "proposalEta"} {
+		values, err := t.call(ctx, block, method, id)
+		if err != nil {
+			return nil, err
+		}
+		got = append(got, values[0])
+	}
+	snapshot, deadline, proposer, eta := got[0].(*big.Int), got[1].(*big.Int), got[2].(common.Address), got[3].(*big.Int)
+	if snapshot.Sign() == 0 {
+		return nil, fmt.Errorf("the contract doesn't know it")
+	}
+	return &Proposal{
+		ID:       id,
+		Proposer: proposer,
+		Snapshot: snapshot.Uint64(),
+		Deadline: deadline.Uint64(),
+		Against:  new(big.Int),
+		For:      new(big.Int),
+		Abstain:  new(big.Int),
+		ETA:      eta.Uint64(),
+	}, nil
+}
+
+func (t *Tracker) addCID(p *Proposal, data []byte) {
+	if len(data) == 0 || t.programCID == nil {
+		return
+	}
+	if c, ok := t.programCID(data); ok && !slices.Contains(p.CIDs, c) {
+		p.CIDs = append(p.CIDs, c)
+	}
+}
+
+// refresh reads the tallies and quorums that may have changed from the
+// contract as of block at, and works out every proposal's state. Whether a
+// queued proposal expired depends on the Governor's timelock, so that is
+// asked of the contract.
+func (t *Tracker) refresh(ctx context.Context, at uint64) error {
+	t.mu.Lock()
+	var stale, queued []*Proposal
+	for _, p := range t.order {
+		if !p.talliesFinal || (p.Quorum == nil && at > p.Snapshot) {
+			stale = append(stale, p)
+		}
+		if p.state(at) == Queued {
+			queued = append(queued, p)
+		}
+	}
+	t.mu.Unlock()
+
+	block := new(big.Int).SetUint64(at)
+	for _, p := range queued {
+		state, err := t.call(ctx, block, "state", p.ID)
+		if err != nil {
+			return fmt.Errorf("proposal %s: %w", p.ID, err)
+		}
+		t.mu.Lock()
+		p.expired = State(state[0].(uint8)) == Expired
+		t.mu.Unlock()
+	}
+	for _, p := range stale {
+		tallies, err := t.call(ctx, block, "proposalVotes", p.ID)
+		if err != nil {
+			return fmt.Errorf("proposal %s: %w", p.ID, err)
+		}
+		// The quorum is looked up at the snapshot, which must be in the past.
+		var quorum []interface{}
+		if at > p.Snapshot {
+			quorum, err = t.call(ctx, block, "quorum", new(big.Int).SetUint64(p.Snapshot))
+			if err != nil {
+				return fmt.Errorf("proposal %s: %w", p.ID, err)
+			}
+		}
+
+		t.mu.Lock()
+		p.Against, p.For, p.Abstain = tallies[0].(*big.Int), tallies[1].(*big.Int), tallies[2].(*big.Int)
+		p.talliesFinal = at > p.Deadline
+		if quorum != nil {
+			p.Quorum = quorum[0].(*big.Int)
+		}
+		t.mu.Unlock()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.head = at
+	for _, p := range t.order {
+		p.State = p.state(at)
+	}
+	return nil
+}
+
+func (t *Tracker) call(ctx context.Context, block *big.Int, method string, args ...interface{}) ([]interface{}, error) {
+	input, err := t.abi.Pack(method, args...)
+	if err != nil {
+		return nil, err
+	}
+	out, err := t.client.CallContract(ctx, ethereum.CallMsg{To: &t.contract, Data: input}, block)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", method, err)
+	}
+	return t.abi.Unpack(method, out)
+}
+
+// state works out the proposal's state at block the same way the Governor
+// does.
+func (p *Proposal) state(block uint64) State {
+	switch {
+	case p.ExecutedBlock != 0:
+		return Executed
+	case p.CanceledBlock != 0:
+		return Canceled
+	case p.Snapshot >= block:
+		return Pending
+	case p.Deadline >= block:
+		return Active
+	}
+
+	// Quorum counts the votes for and abstaining.
+	quorumReached := p.Quorum != nil && p.Quorum.Cmp(new(big.Int).Add(p.For, p.Abstain)) <= 0
+	if !quorumReached || p.For.Cmp(p.Against) <= 0 {
+		return Defeated
+	}
+	if p.ETA == 0 {
+		return Succeeded
+	}
+	if p.expired {
+		return Expired
+	}
+	return Queued
+}
+
+// Head is the block the proposals are up to date with.
+func (t *Tracker) Head() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.head
+}
+
+// Proposals returns copies of the proposals q matches, oldest first.
+func (t *Tracker) Proposals(q Query) []*Proposal {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var found []*Proposal
+	for _, p := range t.order {
+		if q.matches(p) {
+			found = append(found, p.clone())
+		}
+	}
+	return found
+}
+
+// Proposal returns a copy of the proposal with the given ID, or nil.
+func (t *Tracker) Proposal(id *big.Int) *Proposal {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.proposals[id.String()]
+	if !ok {
+		return nil
+	}
+	return p.clone()
+}
+
+func (p *Proposal) clone() *Proposal {
+	c := *p
+	c.CIDs = slices.Clone(p.CIDs)
+	c.Votes = slices.Clone(p.Votes)
+	return &c
+}
@@ -0,0 +1,296 @@
+package governance
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// The part of the DAO's ABI the Tracker uses.
+const daoAbi = `[
+{"anonymous":false,"inputs":[{"indexed":false,"name":"proposalId","type":"uint256"}],"name":"ProposalCanceled","type":"event"},
+{"anonymous":false,"inputs":[{"indexed":false,"name":"proposalId","type":"uint256"},{"indexed":false,"name":"proposer","type":"address"},{"indexed":false,"name":"targets","type":"address[]"},{"indexed":false,"name":"values","type":"uint256[]"},{"indexed":false,"name":"signatures","type":"string[]"},{"indexed":false,"name":"calldatas","type":"bytes[]"},{"indexed":false,"name":"voteStart","type":"uint256"},{"indexed":false,"name":"voteEnd","type":"uint256"},{"indexed":false,"name":"description","type":"string"}],"name":"ProposalCreated","type":"event"},
+{"anonymous":false,"inputs":[{"indexed":false,"name":"proposalId","type":"uint256"}],"name":"ProposalExecuted","type":"event"},
+{"anonymous":false,"inputs":[{"indexed":false,"name":"proposalId","type":"uint256"},{"indexed":false,"name":"etaSeconds","type":"uint256"}],"name":"ProposalQueued","type":"event"},
+{"anonymous":false,"inputs":[{"indexed":true,"name":"voter","type":"address"},{"indexed":false,"name":"proposalId","type":"uint256"},{"indexed":false,"name":"support","type":"uint8"},{"indexed":false,"name":"weight","type":"uint256"},{"indexed":false,"name":"reason","type":"string"}],"name":"VoteCast","type":"event"},
+{"anonymous":false,"inputs":[{"indexed":true,"name":"voter","type":"address"},{"indexed":false,"name":"proposalId","type":"uint256"},{"indexed":false,"name":"support","type":"uint8"},{"indexed":false,"name":"weight","type":"uint256"},{"indexed":false,"name":"reason","type":"string"},{"indexed":false,"name":"params","type":"bytes"}],"name":"VoteCastWithParams","type":"event"},
+{"inputs":[{"name":"proposalId","type":"uint256"}],"name":"proposalDeadline","outputs":[{"name":"","type":"uint256"}],"stateMutability":"view","type":"function"},
+{"inputs":[{"name":"proposalId","type":"uint256"}],"name":"proposalEta","outputs":[{"name":"","type":"uint256"}],"stateMutability":"view","type":"function"},
+{"inputs":[{"name":"proposalId","type":"uint256"}],"name":"proposalProposer","outputs":[{"name":"","type":"address"}],"stateMutability":"view","type":"function"},
+{"inputs":[{"name":"proposalId","type":"uint256"}],"name":"proposalSnapshot","outputs":[{"name":"","type":"uint256"}],"stateMutability":"view","type":"function"},
+{"inputs":[{"name":"proposalId","type":"uint256"}],"name":"proposalVotes","outputs":[{"name":"againstVotes","type":"uint256"},{"name":"forVotes","type":"uint256"},{"name":"abstainVotes","type":"uint256"}],"stateMutability":"view","type":"function"},
+{"inputs":[{"name":"blockNumber","type":"uint256"}],"name":"quorum","outputs":[{"name":"","type":"uint256"}],"stateMutability":"view","type":"function"},
+{"inputs":[{"name":"proposalId","type":"uint256"}],"name":"state","outputs":[{"name":"","type":"uint8"}],"stateMutability":"view","type":"function"}
+]`
+
+var (
+	daoAddress = common.HexToAddress("0xda0")
+	proposer   = common.HexToAddress("0x01")
+	voter      = common.HexToAddress("0x02")
+)
+
+// daoFake is a DAO's logs and the state its view methods return.
+type daoFake struct {
+	t    *testing.T
+	abi  abi.ABI
+	head uint64
+	logs []types.Log
+
+	proposals map[string]*daoProposal
+	quorum    int64
+}
+
+// daoProposal is what the contract keeps of a proposal.
+type daoProposal struct {
+	snapshot, deadline, eta    uint64
+	against, votesFor, abstain int64
+	state                      State
+}
+
+func newDAOFake(t *testing.T) *daoFake {
+	parsed, err := abi.JSON(strings.NewReader(daoAbi))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &daoFake{t: t, abi: parsed, proposals: map[string]*daoProposal{}, quorum: 1}
+}
+
+func (d *daoFake) BlockNumber(context.Context) (uint64, error) {
+	return d.head, nil
+}
+
+func (d *daoFake) FilterLogs(_ context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	var logs []types.Log
+	for _, l := range d.logs {
+		if l.BlockNumber >= q.FromBlock.Uint64() && l.BlockNumber <= q.ToBlock.Uint64() {
+			logs = append(logs, l)
+		}
+	}
+	return logs, nil
+}
+
+func (d *daoFake) CallContract(_ context.Context, call ethereum.CallMsg, _ *big.Int) ([]byte, error) {
+	method, err := d.abi.MethodById(call.Data[:4])
+	if err != nil {
+		return nil, err
+	}
+	args, err := method.Inputs.Unpack(call.Data[4:])
+	if err != nil {
+		return nil, err
+	}
+	p := d.proposals[args[0].(*big.Int).String()]
+	if p == nil {
+		p = &daoProposal{}
+	}
+	u := func(v uint64) *big.Int { return new(big.Int).SetUint64(v) }
+	switch method.Name {
+	case "proposalSnapshot":
+		return method.Outputs.Pack(u(p.snapshot))
+	case "proposalDeadline":
+		return method.Outputs.Pack(u(p.deadline))
+	case "proposalEta":
+		return method.Outputs.Pack(u(p.eta))
+	case "proposalProposer":
+		return method.Outputs.Pack(proposer)
+	case "proposalVotes":
+		return method.Outputs.Pack(big.NewInt(p.against), big.NewInt(p.votesFor), big.NewInt(p.abstain))
+	case "quorum":
+		return method.Outputs.Pack(big.NewInt(d.quorum))
+	case "state":
+		return method.Outputs.Pack(uint8(p.state))
+	}
+	d.t.Fatalf("unexpected call of %s", method.Name)
+	return nil, nil
+}
+
+// emit logs event in block with the given non-indexed values.
+func (d *daoFake) emit(block uint64, name string, indexed []common.Hash, values ...interface{}) {
+	event := d.abi.Events[name]
+	data, err := event.Inputs.NonIndexed().Pack(values...)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	d.logs = append(d.logs, types.Log{
+		Address:     daoAddress,
+		Topics:      append([]common.Hash{event.ID}, indexed...),
+		Data:        data,
+		BlockNumber: block,
+	})
+}
+
+// propose creates proposal id in block, voting from snapshot to deadline,
+// with calldata.
+func (d *daoFake) propose(block uint64, id int64, snapshot, deadline uint64, calldata string) {
+	d.proposals[big.NewInt(id).String()] = &daoProposal{snapshot: snapshot, deadline: deadline}
+	d.emit(block, "ProposalCreated", nil, big.NewInt(id), proposer,
+		[]common.Address{daoAddress}, []*big.Int{new(big.Int)}, []string{""}, [][]byte{[]byte(calldata)},
+		new(big.Int).SetUint64(snapshot), new(big.Int).SetUint64(deadline), "Run a program")
+}
+
+// vote has voter vote for proposal id with params in block.
+func (d *daoFake) vote(block uint64, id int64, params string) {
+	d.proposals[big.NewInt(id).String()].votesFor++
+	d.emit(block, "VoteCastWithParams", []common.Hash{common.BytesToHash(voter.Bytes())},
+		big.NewInt(id), uint8(1), big.NewInt(1), "", []byte(params))
+}
+
+func newTestTracker(d *daoFake, start uint64) *Tracker {
+	programCID := func(data []byte) (string, bool) {
+		return string(data), strings.HasPrefix(string(data), "bafy")
+	}
+	return NewTracker(slog.New(slog.NewTextHandler(io.Discard, nil)), d, d.abi, daoAddress, start, 0, programCID)
+}
+
+func TestProposalState(t *testing.T) {
+	proposal := func(change func(p *Proposal)) *Proposal {
+		p := &Proposal{
+			Snapshot: 10,
+			Deadline: 20,
+			Quorum:   big.NewInt(2),
+			Against:  big.NewInt(1),
+			For:      big.NewInt(2),
+			Abstain:  big.NewInt(0),
+		}
+		change(p)
+		return p
+	}
+	none := func(p *Proposal) {}
+
+	tests := []struct {
+		name  string
+		p     *Proposal
+		block uint64
+		want  State
+	}{
+		{"before the snapshot", proposal(none), 5, Pending},
+		{"at the snapshot", proposal(none), 10, Pending},
+		{"voting", proposal(none), 11, Active},
+		{"at the deadline", proposal(none), 20, Active},
+		{"passed", proposal(none), 21, Succeeded},
+		{"abstentions make the quorum", proposal(func(p *Proposal) { p.For, p.Abstain = big.NewInt(2), big.NewInt(1); p.Quorum = big.NewInt(3) }), 21, Succeeded},
+		{"short of the quorum", proposal(func(p *Proposal) { p.Quorum = big.NewInt(3) }), 21, Defeated},
+		{"quorum unknown", proposal(func(p *Proposal) { p.Quorum = nil }), 21, Defeated},
+		{"tied", proposal(func(p *Proposal) { p.Against = big.NewInt(2) }), 21, Defeated},
+		{"queued", proposal(func(p *Proposal) { p.ETA = 1000 }), 21, Queued},
+		{"expired", proposal(func(p *Proposal) { p.ETA, p.expired = 1000, true }), 21, Expired},
+		{"executed", proposal(func(p *Proposal) { p.ETA, p.ExecutedBlock = 1000, 22 }), 23, Executed},
+		{"canceled while voting", proposal(func(p *Proposal) { p.CanceledBlock = 12 }), 15, Canceled},
+		{"executed after the contract said expired", proposal(func(p *Proposal) { p.expired, p.ExecutedBlock = true, 22 }), 23, Executed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.p.state(tt.block); got != tt.want {
+				t.Errorf("state at block %d is %s, want %s", tt.block, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrackerFollowsProposal(t *testing.T) {
+	ctx := context.Background()
+	d := newDAOFake(t)
+	tr := newTestTracker(d, 0)
+
+	d.propose(2, 7, 3, 10, "bafycalldata")
+	d.vote(4, 7, "bafyparams")
+	d.head = 5
+	if err := tr.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	p := tr.Proposal(big.NewInt(7))
+	if p == nil {
+		t.Fatal("proposal not tracked")
+	}
+	if p.State != Active || p.CreatedBlock != 2 || p.Proposer != proposer || len(p.Votes) != 1 || p.Votes[0].Voter != voter {
+		t.Errorf("proposal %s, created in %d by %s with %d votes", p.State, p.CreatedBlock, p.Proposer, len(p.Votes))
+	}
+	if len(p.CIDs) != 2 || p.CIDs[0] != "bafycalldata" || p.CIDs[1] != "bafyparams" {
+		t.Errorf("CIDs %v, want the calldata's and the vote's", p.CIDs)
+	}
+	if p.For.Int64() != 1 {
+		t.Errorf("%v votes for, want the contract's 1", p.For)
+	}
+
+	d.head = 11
+	if err := tr.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := tr.Proposal(big.NewInt(7)).State; got != Succeeded {
+		t.Errorf("proposal %s after the deadline, want succeeded", got)
+	}
+
+	d.emit(12, "ProposalQueued", nil, big.NewInt(7), big.NewInt(1000))
+	d.head = 12
+	if err := tr.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := tr.Proposal(big.NewInt(7)).State; got != Queued {
+		t.Errorf("proposal %s once queued, want queued", got)
+	}
+
+	// The contract decides when a queued proposal expires.
+	d.proposals["7"].state = Expired
+	d.head = 13
+	if err := tr.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := tr.Proposal(big.NewInt(7)).State; got != Expired {
+		t.Errorf("proposal %s once the contract says it expired, want expired", got)
+	}
+}
+
+// Logs about proposals created before the first block read load the
+// proposals from the contract instead of being dropped.
+func TestTrackerLoadsEarlierProposals(t *testing.T) {
+	ctx := context.Background()
+	d := newDAOFake(t)
+	tr := newTestTracker(d, 5)
+
+	d.propose(2, 7, 3, 10, "bafyearlier")
+	d.vote(4, 7, "bafyunread")
+	d.vote(6, 7, "bafyparams")
+	d.propose(7, 8, 8, 20, "bafylater")
+	d.emit(8, "VoteCast", []common.Hash{common.BytesToHash(voter.Bytes())}, big.NewInt(7), uint8(1), big.NewInt(1), "")
+	d.proposals["7"].votesFor++
+	d.head = 9
+	if err := tr.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	all := tr.Proposals(Query{})
+	if len(all) != 2 || all[0].ID.Int64() != 7 || all[1].ID.Int64() != 8 {
+		t.Fatalf("proposals %v, want the earlier one first", all)
+	}
+	p := all[0]
+	if p.CreatedBlock != 0 || p.Proposer != proposer || p.Snapshot != 3 || p.Deadline != 10 || p.State != Active {
+		t.Errorf("loaded proposal created in %d by %s, voting %d to %d, %s", p.CreatedBlock, p.Proposer, p.Snapshot, p.Deadline, p.State)
+	}
+	if len(p.Votes) != 2 || p.For.Int64() != 3 {
+		t.Errorf("%d votes and %v for, want the 2 read and the contract's 3", len(p.Votes), p.For)
+	}
+	if len(p.CIDs) != 1 || p.CIDs[0] != "bafyparams" {
+		t.Errorf("CIDs %v, want only the vote's", p.CIDs)
+	}
+
+	// A log about a proposal the contract doesn't know is retried.
+	d.emit(10, "ProposalExecuted", nil, big.NewInt(9))
+	d.head = 10
+	if err := tr.Poll(ctx); err == nil {
+		t.Error("no error for a proposal the contract doesn't know")
+	}
+	d.proposals["9"] = &daoProposal{snapshot: 1, deadline: 2}
+	if err := tr.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if p := tr.Proposal(big.NewInt(9)); p == nil || p.State != Executed {
+		t.Errorf("proposal %v, want it loaded and executed", p)
+	}
+}
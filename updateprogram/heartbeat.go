@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"example.com/v2/age"
+)
+
+// Gossip topic nodes announce themselves on.
+const heartbeatTopic = "updateprogram/heartbeat"
+
+// Ways a node can run programs.
+const (
+	runtimeNative = "native"
+	runtimeOCI    = "oci"
+)
+
+// HeartbeatConfig controls how the node announces itself to the network.
+type HeartbeatConfig struct {
+	Interval Duration `yaml:"interval"`
+	// Address of a NodeRegistry to register the node on at startup. Empty
+	// skips it. Transactions are signed with results.keystore.
+	RegistryAddress string `yaml:"registry_address"`
+}
+
+func (cfg *Config) validateHeartbeat(bad func(field, format string, args ...interface{})) {
+	if cfg.Heartbeat.Interval <= 0 {
+		bad("heartbeat.interval", "must be positive")
+	}
+	if cfg.Heartbeat.RegistryAddress != "" {
+		if !common.IsHexAddress(cfg.Heartbeat.RegistryAddress) {
+			bad("heartbeat.registry_address", "%q is not an address", cfg.Heartbeat.RegistryAddress)
+		}
+		if cfg.Results.Keystore == "" {
+			bad("heartbeat.registry_address", "needs results.keystore to sign with")
+		}
+	}
+}
+
+// needsOperator reports whether anything in the config sends transactions.
+func (cfg *Config) needsOperator() bool {
+	return cfg.Results.enabled() || cfg.Heartbeat.RegistryAddress != ""
+}
+
+// runtimes are the ways the node runs programs, as it advertises them.
+func (cfg *Config) runtimes() []string {
+	runtimes := []string{runtimeNative}
+	if cfg.Executor.OCI {
+		runtimes = append(runtimes, runtimeOCI)
+	}
+	return runtimes
+}
+
+// heartbeat is what a node periodically tells the network about itself.
+type heartbeat struct {
+	PeerID peer.ID `json:"peer_id"`
+	// Account the node's operator sends transactions from, with a signature
+	// over the peer ID proving the operator runs this node.
+	Operator    string `json:"operator,omitempty"`
+	OperatorSig []byte `json:"operator_sig,omitempty"`
+
+	Arch     string   `json:"arch"`
+	OS       string   `json:"os"`
+	CPUs     int      `json:"cpus"`
+	Memory   uint64   `json:"memory"`
+	Runtimes []string `json:"runtimes"`
+	// The age recipient confidential jobs encrypt their inputs to for this
+	// node. Gossip is signed, so it is the peer ID's.
+	Recipient string `json:"recipient,omitempty"`
+
+	// The proposals whose programs the node has prefetched, by ID.
+	Prefetched []string `json:"prefetched,omitempty"`
+
+	// What runs in each workload, by name.
+	Workloads map[string]workloadHeartbeat `json:"workloads,omitempty"`
+	SentAt    time.Time                    `json:"sent_at"`
+}
+
+type workloadHeartbeat struct {
+	CID   string       `json:"cid,omitempty"`
+	State processState `json:"state"`
+	// The program the workload switches to at its activation point, and
+	// whether it has been fetched.
+	Scheduled string `json:"scheduled,omitempty"`
+	Ready     bool   `json:"ready,omitempty"`
+}
+
+// operatorDigest is what operators sign to vouch for a peer ID.
+func operatorDigest(id peer.ID) []byte {
+	return accounts.TextHash([]byte("updateprogram node " + id.String()))
+}
+
+// verifyOperator checks that the heartbeat's operator signed its peer ID.
+func (hb *heartbeat) verifyOperator() error {
+	pub, err := ethcrypto.SigToPub(operatorDigest(hb.PeerID), hb.OperatorSig)
+	if err != nil {
+		return err
+	}
+	if signer := ethcrypto.PubkeyToAddress(*pub); signer != common.HexToAddress(hb.Operator) {
+		return fmt.Errorf("signed by %s, not %s", signer, hb.Operator)
+	}
+	return nil
+}
+
+// systemMemory returns the total memory in bytes, or 0 if it can't tell.
+func systemMemory() uint64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+// localHeartbeat describes this node. The operator is optional.
+func localHeartbeat(id peer.ID, recipient *age.Recipient, runtimes []string, op *operator) (heartbeat, error) {
+	hb := heartbeat{
+		PeerID:    id,
+		Arch:      runtime.GOARCH,
+		OS:        runtime.GOOS,
+		CPUs:      runtime.NumCPU(),
+		Memory:    systemMemory(),
+		Runtimes:  runtimes,
+		Recipient: recipient.String(),
+	}
+	if op != nil {
+		sig, err := ethcrypto.Sign(operatorDigest(id), op.key.PrivateKey)
+		if err != nil {
+			return hb, err
+		}
+		hb.Operator = op.address().Hex()
+		hb.OperatorSig = sig
+	}
+	return hb, nil
+}
+
+// sendHeartbeats publishes hb on topic, updated with the node's status,
+// every interval until ctx is done.
+func sendHeartbeats(ctx context.Context, log *slog.Logger, topic *pubsub.Topic, interval time.Duration, hb heartbeat, status *nodeStatus) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		status.update(func(s *nodeStatus) {
+			hb.Workloads = map[string]workloadHeartbeat{}
+			for name, w := range s.workloads {
+				beat := workloadHeartbeat{State: w.state}
+				if w.manifest != nil {
+					beat.CID = w.manifest.CID
+				}
+				if w.scheduled != nil {
+					beat.Scheduled = w.scheduled.manifest.CID
+					beat.Ready = w.scheduled.path != ""
+				}
+				hb.Workloads[name] = beat
+			}
+			hb.Prefetched = s.prefetchedProposals()
+		})
+		hb.SentAt = time.Now()
+
+		data, err := json.Marshal(hb)
+		if err == nil {
+			err = publish(ctx, topic, data)
+		}
+		if err != nil {
+			log.Warn("failed to send heartbeat", "err", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// registeredNode is a NodeRegistry entry.
+type registeredNode struct {
+	PeerId       string
+	Arch         string
+	Cpus         uint32
+	MemoryBytes  uint64
+	Runtimes     []string
+	RegisteredAt *big.Int
+	UpdatedAt    *big.Int
+}
+
+// registerNode puts hb on the NodeRegistry at address, unless it is already
+// there as is.
+func registerNode(ctx context.Context, log *slog.Logger, op *operator, address common.Address, hb heartbeat) error {
+	parsed, err := abi.JSON(strings.NewReader(nodeRegistryAbi))
+	if err != nil {
+		return err
+	}
+
+	values, err := callContract(ctx, op.client, address, parsed, "isAllowedOperator", op.address())
+	if err != nil {
+		return err
+	}
+	if !values[0].(bool) {
+		return fmt.Errorf("operator %s is not allowed to register on %s, ask the registry's owner", op.address(), address)
+	}
+
+	values, err = callContract(ctx, op.client, address, parsed, "getNode", op.address())
+	if err != nil {
+		return err
+	}
+	current := *abi.ConvertType(values[0], new(registeredNode)).(*registeredNode)
+
+	cpus, memory := uint32(hb.CPUs), hb.Memory
+	if current.PeerId == hb.PeerID.String() && current.Arch == hb.Arch && current.Cpus == cpus &&
+		current.MemoryBytes == memory && slices.Equal(current.Runtimes, hb.Runtimes) {
+		log.Info("node already registered", "registry", address, "peer", hb.PeerID)
+		return nil
+	}
+
+	input, err := parsed.Pack("register", hb.PeerID.String(), hb.Arch, cpus, memory, hb.Runtimes)
+	if err != nil {
+		return err
+	}
+	receipt, err := op.transact(ctx, address, input)
+	if err != nil {
+		return err
+	}
+
+	log.Info("node registered", "registry", address, "peer", hb.PeerID, "tx", receipt.TxHash)
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ipfs/boxo/files"
+	"github.com/ipfs/go-cid"
+
+	"example.com/v2/executor"
+)
+
+// imageDir is where the OCI image with the given CID is unpacked: its
+// rootfs, and its config once it is ready to run.
+func (cfg *Config) imageDir(c string) string {
+	return cfg.statePath(filepath.Join("images", c))
+}
+
+// fetchImage fetches the OCI image layout m asks for and unpacks it,
+// returning the image dir.
+func (n *node) fetchImage(ctx context.Context, m *Manifest) (string, error) {
+	dir := n.cfg.imageDir(m.CID)
+	if _, err := os.Stat(filepath.Join(dir, "config.json")); err == nil {
+		n.log.fetch.Info("image already unpacked", "cid", m.CID)
+		return dir, nil
+	}
+	// Whatever is there is left from an attempt that didn't finish.
+	os.RemoveAll(dir)
+
+	n.status.update(func(s *nodeStatus) {
+		s.fetch = &fetchProgress{CID: m.CID, StartedAt: time.Now()}
+	})
+
+	layout := filepath.Join(dir, "layout")
+	fetchStart := time.Now()
+	fetchCtx, cancel := context.WithTimeout(ctx, time.Duration(n.cfg.Policy.FetchTimeout))
+	size, err := n.fetchDir(fetchCtx, m.cid(), layout)
+	cancel()
+	n.metrics.fetchDuration.Observe(time.Since(fetchStart).Seconds())
+
+	if err != nil {
+		n.log.fetch.Error("failed to fetch image", "cid", m.CID, "err", err)
+		n.metrics.upgradeFailures.WithLabelValues(failFetch).Inc()
+		n.status.update(func(s *nodeStatus) { s.fetch.Error = err.Error() })
+		return "", err
+	}
+	n.log.fetch.Info("fetched image", "cid", m.CID, "bytes", size, "took", time.Since(fetchStart))
+	n.announce(ctx, m)
+
+	config, err := executor.UnpackImage(layout, filepath.Join(dir, "rootfs"))
+	if err == nil {
+		var data []byte
+		data, err = json.Marshal(config)
+		if err == nil {
+			// Written last, it marks the image ready.
+			err = os.WriteFile(filepath.Join(dir, "config.json"), data, 0644)
+		}
+	}
+	if err != nil {
+		n.log.exec.Error("failed to unpack image", "cid", m.CID, "err", err)
+		n.metrics.upgradeFailures.WithLabelValues(failUnpack).Inc()
+		os.RemoveAll(dir)
+		return "", err
+	}
+	os.RemoveAll(layout)
+	return dir, nil
+}
+
+// fetchDir fetches the directory c and saves it to dir, or only reads it
+// through if dir is empty. It returns how many bytes its files came to.
+func (n *node) fetchDir(ctx context.Context, c cid.Cid, dir string) (int64, error) {
+	n.fetching.Add(1)
+	defer n.fetching.Add(-1)
+
+	d, err := n.fetcher.OpenDir(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	defer d.Close()
+
+	if size, err := d.Size(); err == nil {
+		if err := n.policy.CheckSize(size); err != nil {
+			return 0, err
+		}
+		n.status.update(func(s *nodeStatus) {
+			if s.fetch != nil {
+				s.fetch.Total = size
+			}
+		})
+	}
+
+	var total int64
+	err = files.Walk(d, func(name string, nd files.Node) error {
+		if name != "" && !filepath.IsLocal(name) {
+			return fmt.Errorf("bad path %q in directory", name)
+		}
+		target := filepath.Join(dir, name)
+		switch nd := nd.(type) {
+		case files.Directory:
+			if dir == "" {
+				return nil
+			}
+			return os.MkdirAll(target, 0755)
+		case files.File:
+			defer nd.Close()
+			var w io.Writer = io.Discard
+			if dir != "" {
+				f, err := os.Create(target)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				w = f
+			}
+			written, err := io.Copy(io.MultiWriter(w, progressWriter{n.status}), nd)
+			n.metrics.fetchBytes.Add(float64(written))
+			total += written
+			if err != nil {
+				return err
+			}
+			// Directories can claim a smaller size than their files add
+			// up to.
+			return n.policy.CheckSize(total)
+		default:
+			return fmt.Errorf("%s is neither a file nor a directory", name)
+		}
+	})
+	return total, err
+}
+
+// imageSpec points spec at the image unpacked in dir: it runs the image's
+// entrypoint and cmd, the args replacing the cmd, with the image's
+// environment before the node's. The output dir and shard input the node
+// hands the program are bound into the sandbox at the same paths.
+func imageSpec(spec *executor.Spec, dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return err
+	}
+	var config executor.ImageConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("image config: %w", err)
+	}
+
+	argv := config.Cmd
+	if len(spec.Args) > 0 {
+		argv = spec.Args
+	}
+	argv = slices.Concat(config.Entrypoint, argv)
+	if len(argv) == 0 {
+		return fmt.Errorf("image has no entrypoint or cmd")
+	}
+
+	for _, kv := range spec.Env {
+		key, value, _ := strings.Cut(kv, "=")
+		switch key {
+		case "UPDATEPROGRAM_OUTPUT_DIR":
+			spec.Binds = append(spec.Binds, executor.Bind{Path: value})
+		case "UPDATEPROGRAM_INPUT":
+			// Decrypted inputs are secrets, already in the sandbox.
+			if !strings.HasPrefix(value, executor.SecretDir+"/") {
+				spec.Binds = append(spec.Binds, executor.Bind{Path: value, ReadOnly: true})
+			}
+		}
+	}
+
+	spec.Rootfs = filepath.Join(dir, "rootfs")
+	spec.Path, spec.Args = argv[0], argv[1:]
+	spec.Env = slices.Concat(config.Env, spec.Env)
+	spec.Dir = config.WorkingDir
+	return nil
+}
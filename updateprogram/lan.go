@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+)
+
+// lanPeers connects to the nodes mDNS finds on the local network, so nodes
+// in the same lab share blocks with each other instead of all going through
+// the seed.
+type lanPeers struct {
+	log     *slog.Logger
+	service string
+	h       host.Host
+}
+
+func newLANPeers(log *slog.Logger, service string) *lanPeers {
+	return &lanPeers{log: log, service: service}
+}
+
+// start advertises h and starts looking for other nodes.
+func (l *lanPeers) start(h host.Host) error {
+	l.h = h
+	return mdns.NewMdnsService(h, l.service, l).Start()
+}
+
+func (l *lanPeers) HandlePeerFound(info peer.AddrInfo) {
+	if info.ID == l.h.ID() {
+		return
+	}
+	l.h.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.TempAddrTTL)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		if err := l.h.Connect(ctx, info); err != nil {
+			l.log.Debug("failed to connect to local peer", "peer", info.ID, "err", err)
+			return
+		}
+		l.log.Info("connected to local peer", "peer", info.ID)
+	}()
+}
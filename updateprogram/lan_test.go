@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// A node connects to the peers mDNS turns up, and not to itself.
+func TestLANPeersConnect(t *testing.T) {
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+	a, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	lan := newLANPeers(slog.New(slog.NewTextHandler(io.Discard, nil)), "updateprogram-test")
+	lan.h = a
+	lan.HandlePeerFound(peer.AddrInfo{ID: a.ID(), Addrs: a.Addrs()})
+	lan.HandlePeerFound(peer.AddrInfo{ID: b.ID(), Addrs: b.Addrs()})
+
+	waitFor(t, "the node to connect to its local peer", func() bool {
+		return a.Network().Connectedness(b.ID()) == network.Connected
+	})
+	if len(a.Network().ConnsToPeer(a.ID())) != 0 {
+		t.Error("node connected to itself")
+	}
+	if addrs := a.Peerstore().Addrs(b.ID()); len(addrs) == 0 {
+		t.Error("the local peer's addresses weren't kept")
+	}
+}
+
+func newLANHost(t *testing.T, service string) host.Host {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHost([]string{"/ip4/0.0.0.0/tcp/0"}, priv, newLANPeers(slog.New(slog.NewTextHandler(io.Discard, nil)), service))
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// Hosts on the same network and mDNS service find each other without a
+// seed. Fleets with their own service name keep apart.
+func TestHostFindsLANPeers(t *testing.T) {
+	a, b := newLANHost(t, "updateprogram-test"), newLANHost(t, "updateprogram-test")
+	other := newLANHost(t, "updateprogram-other")
+
+	waitFor(t, "the hosts to find each other", func() bool {
+		return a.Network().Connectedness(b.ID()) == network.Connected
+	})
+	if a.Network().Connectedness(other.ID()) == network.Connected || b.Network().Connectedness(other.ID()) == network.Connected {
+		t.Error("a host on another mDNS service connected")
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+
+	bsnet "github.com/ipfs/boxo/bitswap/network"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	p2pmetrics "github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"golang.org/x/time/rate"
+)
+
+// LimitsConfig caps how much of the machine and the connection the node
+// uses, for volunteers running it at home.
+type LimitsConfig struct {
+	// Connections, streams and memory for all of libp2p. 0 leaves the
+	// libp2p default, which scales with the machine.
+	MaxConnections int   `yaml:"max_connections"`
+	MaxStreams     int   `yaml:"max_streams"`
+	MaxMemory      int64 `yaml:"max_memory"`
+	// Bytes per second bitswap may send blocks to peers at and fetch them
+	// from peers at. 0 means no limit.
+	ServeRate int64 `yaml:"serve_rate"`
+	FetchRate int64 `yaml:"fetch_rate"`
+}
+
+func (cfg *Config) validateLimits(bad func(field, format string, args ...interface{})) {
+	if cfg.Limits.MaxConnections < 0 {
+		bad("limits.max_connections", "must not be negative")
+	}
+	if cfg.Limits.MaxStreams < 0 {
+		bad("limits.max_streams", "must not be negative")
+	}
+	if cfg.Limits.MaxMemory < 0 {
+		bad("limits.max_memory", "must not be negative")
+	}
+	if cfg.Limits.ServeRate < 0 {
+		bad("limits.serve_rate", "must not be negative")
+	}
+	if cfg.Limits.FetchRate < 0 {
+		bad("limits.fetch_rate", "must not be negative")
+	}
+}
+
+// limits enforces LimitsConfig and reports usage against it.
+type limits struct {
+	rm     network.ResourceManager
+	system rcmgr.ResourceLimits
+
+	serve, fetch *rate.Limiter
+	// Bitswap traffic only.
+	bandwidth *p2pmetrics.BandwidthCounter
+}
+
+func newLimits(cfg *LimitsConfig) (*limits, error) {
+	scaling := rcmgr.DefaultLimits
+	libp2p.SetDefaultServiceLimits(&scaling)
+	partial := rcmgr.PartialLimitConfig{
+		System: rcmgr.ResourceLimits{
+			Conns:   rcmgr.LimitVal(cfg.MaxConnections),
+			Streams: rcmgr.LimitVal(cfg.MaxStreams),
+			Memory:  rcmgr.LimitVal64(cfg.MaxMemory),
+		},
+	}
+	concrete := partial.Build(scaling.AutoScale())
+
+	rm, err := rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(concrete))
+	if err != nil {
+		return nil, err
+	}
+
+	return &limits{
+		rm:        rm,
+		system:    concrete.ToPartialLimitConfig().System,
+		serve:     byteRate(cfg.ServeRate),
+		fetch:     byteRate(cfg.FetchRate),
+		bandwidth: p2pmetrics.NewBandwidthCounter(),
+	}, nil
+}
+
+// byteRate is a limiter for bytesPerSecond, or nil for no limit. The burst
+// is a second's worth.
+func byteRate(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond == 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(bytesPerSecond))
+}
+
+func (l *limits) hostOptions() []libp2p.Option {
+	return []libp2p.Option{libp2p.ResourceManager(l.rm)}
+}
+
+// bitswapHost wraps h so the streams bitswap opens and accepts on it are
+// counted and held to the serve and fetch rates.
+func (l *limits) bitswapHost(h host.Host) host.Host {
+	return &limitedHost{Host: h, limits: l}
+}
+
+type limitedHost struct {
+	host.Host
+	limits *limits
+}
+
+func (h *limitedHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	s, err := h.Host.NewStream(ctx, p, pids...)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedStream{Stream: s, limits: h.limits}, nil
+}
+
+func (h *limitedHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	h.Host.SetStreamHandler(pid, func(s network.Stream) {
+		handler(&limitedStream{Stream: s, limits: h.limits})
+	})
+}
+
+type limitedStream struct {
+	network.Stream
+	limits *limits
+}
+
+func (s *limitedStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	if n > 0 {
+		s.limits.bandwidth.LogRecvMessageStream(int64(n), s.Protocol(), s.Conn().RemotePeer())
+		waitBytes(s.limits.fetch, n)
+	}
+	return n, err
+}
+
+func (s *limitedStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := len(p)
+		if s.limits.serve != nil {
+			chunk = min(chunk, s.limits.serve.Burst())
+		}
+		waitBytes(s.limits.serve, chunk)
+
+		n, err := s.Stream.Write(p[:chunk])
+		written += n
+		s.limits.bandwidth.LogSentMessageStream(int64(n), s.Protocol(), s.Conn().RemotePeer())
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+// waitBytes blocks until the limiter lets n bytes through.
+func waitBytes(l *rate.Limiter, n int) {
+	if l == nil {
+		return
+	}
+	for n > 0 {
+		chunk := min(n, l.Burst())
+		l.WaitN(context.Background(), chunk)
+		n -= chunk
+	}
+}
+
+type usage struct {
+	Used int64 `json:"used"`
+	// Left out when there is no limit.
+	Limit int64 `json:"limit,omitempty"`
+}
+
+type bandwidthUsage struct {
+	// Bytes per second.
+	Rate  float64 `json:"rate"`
+	Limit int64   `json:"limit,omitempty"`
+	Total int64   `json:"total"`
+}
+
+type limitsReport struct {
+	Connections usage          `json:"connections"`
+	Streams     usage          `json:"streams"`
+	Memory      usage          `json:"memory"`
+	Serve       bandwidthUsage `json:"serve"`
+	Fetch       bandwidthUsage `json:"fetch"`
+}
+
+func (l *limits) report(cfg *LimitsConfig) *limitsReport {
+	var stat network.ScopeStat
+	l.rm.ViewSystem(func(s network.ResourceScope) error {
+		stat = s.Stat()
+		return nil
+	})
+
+	var r limitsReport
+	r.Connections = usage{Used: int64(stat.NumConnsInbound + stat.NumConnsOutbound), Limit: limitOf(int64(l.system.Conns))}
+	r.Streams = usage{Used: int64(stat.NumStreamsInbound + stat.NumStreamsOutbound), Limit: limitOf(int64(l.system.Streams))}
+	r.Memory = usage{Used: stat.Memory, Limit: limitOf(int64(l.system.Memory))}
+
+	var bitswap p2pmetrics.Stats
+	for _, p := range []protocol.ID{bsnet.ProtocolBitswap, bsnet.ProtocolBitswapOneOne, bsnet.ProtocolBitswapOneZero, bsnet.ProtocolBitswapNoVers} {
+		s := l.bandwidth.GetBandwidthForProtocol(p)
+		bitswap.TotalIn += s.TotalIn
+		bitswap.TotalOut += s.TotalOut
+		bitswap.RateIn += s.RateIn
+		bitswap.RateOut += s.RateOut
+	}
+	r.Serve = bandwidthUsage{Rate: bitswap.RateOut, Limit: cfg.ServeRate, Total: bitswap.TotalOut}
+	r.Fetch = bandwidthUsage{Rate: bitswap.RateIn, Limit: cfg.FetchRate, Total: bitswap.TotalIn}
+	return &r
+}
+
+// limitOf turns a built resource manager limit into one for the report,
+// where unlimited is 0.
+func limitOf(v int64) int64 {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	bsnet "github.com/ipfs/boxo/bitswap/network"
+	"github.com/libp2p/go-libp2p/core/network"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+func TestLimitsConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "updateprogram.yaml")
+	yaml := "limits:\n  max_connections: 64\n  max_streams: 256\n  max_memory: 134217728\n  serve_rate: 1048576\n"
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	if err := loadConfigFile(&cfg, path, true); err != nil {
+		t.Fatal(err)
+	}
+	want := LimitsConfig{MaxConnections: 64, MaxStreams: 256, MaxMemory: 128 << 20, ServeRate: 1 << 20}
+	if cfg.Limits != want {
+		t.Fatalf("loaded %+v, want %+v", cfg.Limits, want)
+	}
+
+	// The resource manager holds the node to them, and the report shows them.
+	l, err := newLimits(&cfg.Limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := l.report(&cfg.Limits)
+	if r.Connections.Limit != 64 || r.Streams.Limit != 256 || r.Memory.Limit != 128<<20 {
+		t.Errorf("reported limits of %d connections, %d streams and %d bytes", r.Connections.Limit, r.Streams.Limit, r.Memory.Limit)
+	}
+	if r.Serve.Limit != 1<<20 || r.Fetch.Limit != 0 {
+		t.Errorf("reported serving at up to %d and fetching at up to %d bytes a second", r.Serve.Limit, r.Fetch.Limit)
+	}
+
+	// Left at 0, libp2p's defaults for the machine apply.
+	l, err = newLimits(&LimitsConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := l.report(&LimitsConfig{}); r.Connections.Limit == 0 || r.Streams.Limit == 0 || r.Memory.Limit == 0 {
+		t.Errorf("default limits %+v", r)
+	}
+
+	var fields []string
+	cfg.Limits = LimitsConfig{MaxConnections: -1, MaxStreams: -1, MaxMemory: -1, ServeRate: -1, FetchRate: -1}
+	cfg.validateLimits(func(field, format string, args ...interface{}) { fields = append(fields, field) })
+	if !slices.Equal(fields, []string{"limits.max_connections", "limits.max_streams", "limits.max_memory", "limits.serve_rate", "limits.fetch_rate"}) {
+		t.Errorf("negative limits flagged %v", fields)
+	}
+}
+
+// Bitswap streams are held to the serve rate, and counted for the report.
+func TestLimitedBitswapStreams(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+	a, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mn.LinkPeers(a.ID(), b.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &LimitsConfig{ServeRate: 64 << 10}
+	l, err := newLimits(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const size = 128 << 10
+	l.bitswapHost(a).SetStreamHandler(bsnet.ProtocolBitswap, func(s network.Stream) {
+		defer s.Close()
+		s.Write(make([]byte, size))
+	})
+
+	start := time.Now()
+	s, err := b.NewStream(ctx, a.ID(), bsnet.ProtocolBitswap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first second's worth goes out at once, the next after a second.
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("served %d bytes in %v at %d bytes a second", len(got), elapsed, cfg.ServeRate)
+	}
+	if len(got) != size {
+		t.Fatalf("read %d bytes, want %d", len(got), size)
+	}
+	// The last write is counted once it returns.
+	waitFor(t, "the served bytes to be counted", func() bool { return l.report(cfg).Serve.Total == size })
+	if r := l.report(cfg); r.Fetch.Total != 0 {
+		t.Errorf("counted %d bytes fetched on a stream the node served", r.Fetch.Total)
+	}
+}
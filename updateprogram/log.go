@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// Subsystems that get their own logger and level.
+const (
+	logChain = "chain"
+	logFetch = "fetch"
+	logExec  = "exec"
+	logP2P   = "p2p"
+	logAPI   = "api"
+)
+
+var logSubsystems = []string{logChain, logFetch, logExec, logP2P, logAPI}
+
+type LogConfig struct {
+	// Default level: debug, info, warn or error.
+	Level string `yaml:"level"`
+	// text or json.
+	Format string `yaml:"format"`
+	// Per subsystem levels, overriding Level.
+	Subsystems map[string]string `yaml:"subsystems"`
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+func (cfg *LogConfig) validate(bad func(field, format string, args ...interface{})) {
+	if _, err := parseLevel(cfg.Level); err != nil {
+		bad("log.level", "%v", err)
+	}
+	switch cfg.Format {
+	case "text", "json":
+	default:
+		bad("log.format", "must be text or json, not %q", cfg.Format)
+	}
+	for name, level := range cfg.Subsystems {
+		known := false
+		for _, s := range logSubsystems {
+			known = known || s == name
+		}
+		if !known {
+			bad("log.subsystems", "unknown subsystem %q, expected one of %s", name, strings.Join(logSubsystems, ", "))
+		}
+		if _, err := parseLevel(level); err != nil {
+			bad("log.subsystems."+name, "%v", err)
+		}
+	}
+}
+
+func (cfg *LogConfig) handler(w io.Writer, level slog.Level) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.Format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// loggers holds one logger per subsystem. Node diagnostics and the output of
+// the program it runs are written to different streams.
+type loggers struct {
+	chain, fetch, exec, p2p, api *slog.Logger
+
+	// Lines the program writes, tagged with its CID.
+	program *slog.Logger
+}
+
+func newLoggers(cfg LogConfig, diagnostics, programOutput io.Writer) *loggers {
+	base, _ := parseLevel(cfg.Level)
+
+	sub := func(name string) *slog.Logger {
+		level := base
+		if s, ok := cfg.Subsystems[name]; ok {
+			level, _ = parseLevel(s)
+		}
+		return slog.New(cfg.handler(diagnostics, level)).With("subsystem", name)
+	}
+
+	return &loggers{
+		chain:   sub(logChain),
+		fetch:   sub(logFetch),
+		exec:    sub(logExec),
+		p2p:     sub(logP2P),
+		api:     sub(logAPI),
+		program: slog.New(cfg.handler(programOutput, slog.LevelDebug)),
+	}
+}
+
+// Longest line logged as one record. Longer lines are split.
+const maxLogLine = 1024 * 1024
+
+// logLines logs every line read from r until it is closed, and copies it to
+// file if that isn't nil. It is used for the program's stdout and stderr pipes,
+// so it reads r to the end whatever the program writes: a writer left blocked
+// on a full pipe would keep the program from ever being reaped.
+func logLines(wg *sync.WaitGroup, r io.Reader, log *slog.Logger, level slog.Level, file *lineWriter) {
+	defer wg.Done()
+
+	emit := func(line []byte) {
+		log.Log(context.Background(), level, string(line))
+		if file != nil {
+			file.WriteLine(string(line))
+		}
+	}
+
+	reader := bufio.NewReaderSize(r, 64*1024)
+	var line []byte
+	for {
+		frag, more, err := reader.ReadLine()
+		line = append(line, frag...)
+		if err == nil && more && len(line) < maxLogLine {
+			continue
+		}
+		if err == nil || len(line) > 0 {
+			emit(line)
+		}
+		line = line[:0]
+
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Warn(fmt.Sprintf("stopped reading output: %v", err))
+			io.Copy(io.Discard, r)
+			return
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogLinesLongLine(t *testing.T) {
+	r, w := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		_, err := io.WriteString(w, strings.Repeat("a", maxLogLine*5/2)+"\nshort\n")
+		w.Close()
+		written <- err
+	}()
+
+	var out bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go logLines(&wg, r, slog.New(slog.NewTextHandler(io.Discard, nil)), slog.LevelInfo, &lineWriter{w: &out, stream: "stdout"})
+
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("writer blocked on a line longer than maxLogLine")
+	}
+	wg.Wait()
+
+	var lengths []int
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			t.Fatalf("bad line %.80q", line)
+		}
+		lengths = append(lengths, len(fields[2]))
+	}
+	want := []int{maxLogLine, maxLogLine, maxLogLine / 2, len("short")}
+	if len(lengths) != len(want) {
+		t.Fatalf("got lines of %v bytes, want %v", lengths, want)
+	}
+	for i := range want {
+		if lengths[i] != want[i] {
+			t.Fatalf("got lines of %v bytes, want %v", lengths, want)
+		}
+	}
+}
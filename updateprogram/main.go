@@ -1,299 +1,391 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"fmt"
-	"io"
-	"math/big"
+	"log/slog"
 	"os"
-	"os/exec"
 	"strings"
 	"time"
 
-	ethcrypto "github.com/ethereum/go-ethereum/crypto"
-
 	bsclient "github.com/ipfs/boxo/bitswap/client"
 	bsnet "github.com/ipfs/boxo/bitswap/network"
 	bsserver "github.com/ipfs/boxo/bitswap/server"
 	"github.com/ipfs/boxo/blockservice"
 	"github.com/ipfs/boxo/blockstore"
-	"github.com/ipfs/boxo/files"
 	"github.com/ipfs/boxo/ipld/merkledag"
-	unixfile "github.com/ipfs/boxo/ipld/unixfs/file"
 	"github.com/ipfs/go-cid"
 	"github.com/joho/godotenv"
 
-	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ipfs/go-datastore"
 	dsync "github.com/ipfs/go-datastore/sync"
 	"github.com/libp2p/go-libp2p"
-	routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
+
+	"example.com/v2/chain"
+	"example.com/v2/executor"
+	"example.com/v2/fetch"
+	"example.com/v2/state"
 )
 
-func connectFromString(ctx context.Context, h host.Host, str string) {
+func connectFromString(ctx context.Context, log *slog.Logger, h host.Host, str string) {
 	maddr, _ := multiaddr.NewMultiaddr(str)
 	info, err := peer.AddrInfoFromP2pAddr(maddr)
 	if err != nil {
-		fmt.Println("Error getting info", err.Error())
+		log.Error("bad peer address", "addr", str, "err", err)
 		return
 	}
 
 	err = h.Connect(ctx, *info)
 	if err == nil {
-		fmt.Println("Connected to address:", str)
+		log.Info("connected", "addr", str)
 	} else {
-		fmt.Println("Error connecting:", err.Error())
+		log.Warn("failed to connect", "addr", str, "err", err)
+	}
+}
+
+// loadIdentity reads the node's libp2p key from path, creating it the first
+// time so the peer ID stays the same across restarts.
+func loadIdentity(path string) (crypto.PrivKey, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		return crypto.UnmarshalPrivateKey(data)
+	}
+
+	priv, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
+	if err != nil {
+		return nil, err
 	}
+	data, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return priv, os.WriteFile(path, data, 0600)
 }
 
-func NewHost() host.Host {
+// NewHost starts a libp2p host. With lan set it also finds and connects to
+// other nodes on the local network with mDNS.
+func NewHost(listenAddrs []string, priv crypto.PrivKey, lan *lanPeers, extra ...libp2p.Option) host.Host {
 	var h host.Host
 	{
-		priv, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
-		if err != nil {
-			panic(err)
-		}
-
+		var err error
 		opts := []libp2p.Option{
-			libp2p.ListenAddrStrings(fmt.Sprintf("/ip4/%s/tcp/%d", "0.0.0.0", 0)),
+			libp2p.ListenAddrStrings(listenAddrs...),
 			libp2p.Identity(priv),
 		}
+		opts = append(opts, extra...)
 
 		h, err = libp2p.New(opts...)
 		if err != nil {
 			panic(err)
 		}
+
+		if lan != nil {
+			if err := lan.start(h); err != nil {
+				panic(err)
+			}
+		}
 	}
 
 	return h
 }
 
-func nextEvent(ctx context.Context, client *ethclient.Client) string {
-	// Actually just get the latest executed state and make sure we aren't already at that version.
-
-	// contractAddress := common.HexToAddress("0x")
-	// eventSignature := ""
-
-	// query := ethereum.FilterQuery{
-	// 	Addresses: []common.Address{},
-	// 	Topics:    [][]common.Hash{[]common.Hash{common.HexToHash(eventSignature)}},
-	// 	FromBlock: nil,
-	// 	ToBlock:   nil,
-	// }
-
-	// Issue: Have to filter to begin with, then run the event loop.
-	// logs, err := client.FilterLogs(ctx, query)
-
-	// Get the event signature for the event.
-	var str string
-	fmt.Scanln(&str)
-
-	return str
+func main() {
+	// The OCI executor runs programs through the node, which sets up their
+	// sandbox. Nothing of the node's own environment gets in.
+	if len(os.Args) > 1 && os.Args[1] == executor.SandboxInitCommand {
+		os.Exit(executor.SandboxInit(os.Args[2:]))
+	}
 
-}
+	// A .env file is optional, anything in it is read as environment overrides.
+	godotenv.Load()
+
+	args := os.Args[1:]
+	seedMode := false
+	if len(args) > 0 {
+		switch args[0] {
+		case "config":
+			os.Exit(configCommand(args[1:]))
+		case "fleet":
+			os.Exit(fleetCommand(args[1:]))
+		case "devnet":
+			os.Exit(devnetCommand(args[1:]))
+		case "proposals":
+			os.Exit(proposalsCommand(args[1:]))
+		case "publish":
+			os.Exit(publishCommand(args[1:]))
+		case "run":
+			args = args[1:]
+		case "seed":
+			seedMode = true
+			args = args[1:]
+		}
+	}
 
-func main() {
-	if err := godotenv.Load(); err != nil {
-		panic("No .env file found.")
+	cfg, err := loadConfig("updateprogram", args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load config:", err)
+		os.Exit(2)
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid config:")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := os.MkdirAll(cfg.statePath("programs"), 0755); err != nil {
+		panic(err)
 	}
 
-	fmt.Println("Welcome to the client.")
+	// Diagnostics go to stderr, the program's own output to stdout.
+	log := newLoggers(cfg.Log, os.Stderr, os.Stdout)
+	log.exec.Info("welcome to the client", "data_dir", cfg.DataDir)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	{
 		// Make the host.
-		h := NewHost()
+		priv, err := loadIdentity(cfg.statePath("identity"))
+		if err != nil {
+			panic(err)
+		}
+		identity, err := ageIdentity(priv)
+		if err != nil {
+			panic(err)
+		}
+		var hostOpts []libp2p.Option
+		if cfg.P2P.SwarmKey != "" {
+			psk, err := loadSwarmKey(cfg.P2P.SwarmKey)
+			if err != nil {
+				panic(err)
+			}
+			hostOpts = append(hostOpts, libp2p.PrivateNetwork(psk))
+			log.p2p.Info("joining private network", "swarm_key", cfg.P2P.SwarmKey)
+			cfg.P2P.ListenAddrs = tcpOnly(log.p2p, cfg.P2P.ListenAddrs)
+		}
+		// Seeds keep their blocks and peers on disk, and relay for everyone.
+		var stores *seedStores
+		if seedMode {
+			stores, err = openSeedStores(ctx, &cfg)
+			if err != nil {
+				panic(err)
+			}
+			defer stores.Close()
+			hostOpts = append(hostOpts, libp2p.Peerstore(stores.peerstore))
+			cfg.P2P.RelayService = true
+		}
 
-		// XXX: Currently stores blocks in memory only.
-		bstore := blockstore.NewBlockstore(dsync.MutexWrap(datastore.NewMapDatastore()))
+		natOpts, err := natOptions(&cfg.P2P)
+		if err != nil {
+			panic(err)
+		}
+		hostOpts = append(hostOpts, natOpts...)
+		limits, err := newLimits(&cfg.Limits)
+		if err != nil {
+			panic(err)
+		}
+		hostOpts = append(hostOpts, limits.hostOptions()...)
+		var gater *allowlistGater
+		if cfg.P2P.allowlist() {
+			gater = newAllowlistGater(log.p2p, &cfg.P2P)
+			hostOpts = append(hostOpts, libp2p.ConnectionGater(gater))
+		}
+
+		var lan *lanPeers
+		if cfg.P2P.MDNS {
+			lan = newLANPeers(log.p2p, cfg.P2P.MDNSService)
+		}
+
+		h := NewHost(cfg.P2P.ListenAddrs, priv, lan, hostOpts...)
+		log.p2p.Info("host started", "peer", h.ID(), "relay", cfg.P2P.RelayService, "seed", seedMode, "mdns", cfg.P2P.MDNS)
 
-		bsnet := bsnet.NewFromIpfsHost(h, routinghelpers.Null{})
+		// XXX: Currently stores blocks in memory only, except on seeds.
+		blockDatastore := datastore.Batching(dsync.MutexWrap(datastore.NewMapDatastore()))
+		if seedMode {
+			blockDatastore = stores.blocks
+			go reconnectKnownPeers(ctx, log.p2p, h)
+		}
+		bstore, err := newCountedBlockstore(ctx, blockstore.NewBlockstore(blockDatastore))
+		if err != nil {
+			panic(err)
+		}
+
+		kad, err := newDHT(ctx, log.p2p, h, seedMode, cfg.P2P.Seeds)
+		if err != nil {
+			panic(err)
+		}
+		defer kad.Close()
+		bsnet := bsnet.NewFromIpfsHost(limits.bitswapHost(h), kad)
 		client := bsclient.New(ctx, bsnet, bstore)
 		server := bsserver.New(ctx, bsnet, bstore)
 		bservice := blockservice.New(bstore, client)
+		dag := merkledag.NewDAGService(bservice)
 		bsnet.Start(client, server)
 
-		addresses := make([]string, 0)
-		// Seed node for network
-		addresses = append(addresses, "/ip4/45.32.243.35/tcp/4001/p2p/12D3KooWE5jRAPoZQSe59FQpsftBJ1Gxj4NquaHT152tso6hCuAm")
-		addresses = append(addresses, strings.Split(os.Getenv("AUTOCONNECT_ADDRESSES"), " ")...)
+		addresses := cfg.P2P.Seeds
 		for i := range addresses {
-			connectFromString(ctx, h, addresses[i])
+			connectFromString(ctx, log.p2p, h, addresses[i])
 		}
 
-		// Get the actual frigging file.
-		dataFromCid := func(c cid.Cid) ([]byte, error) {
-			// HACK: Have to re-register the peers to force them to share files.
-			// This should not be happening, most likely there is a subtle issue too complicated to debug.
-			fmt.Println("Redconnecting")
-			for _, peerId := range h.Network().Peers() {
-				// XXX: Find a good timeout for reconnecting to old peers. Also find if there's a better way to handle this bitswap issue.
-				ctx, cancel := context.WithTimeout(ctx, time.Second*5)
-				defer cancel()
-
-				fmt.Println("Disconnecting")
-				err := bsnet.DisconnectFrom(ctx, peerId)
-				if err != nil {
-					fmt.Println("Failed to disconnect from:", peerId)
-				}
-			}
+		status := newNodeStatus()
+		control := make(chan controlCommand)
+		metrics := newMetrics(client, server, bstore)
+		if err := watchReachability(ctx, log.p2p, h, status); err != nil {
+			panic(err)
+		}
 
-			// Force reconnect all the peers.
-			for i := range addresses {
-				connectFromString(ctx, h, addresses[i])
-			}
+		// Replicas of a job compare results over gossip.
+		ps, err := newPubSub(ctx, log.p2p, h)
+		if err != nil {
+			panic(err)
+		}
+		agreement, err := newAgreement(ctx, cfg.Agreement, log.chain, ps, metrics)
+		if err != nil {
+			panic(err)
+		}
+		fleet, err := newFleet(ctx, log.p2p, ps, time.Duration(cfg.Heartbeat.Interval))
+		if err != nil {
+			panic(err)
+		}
+		providers, err := newProviders(ctx, h, log.p2p, ps)
+		if err != nil {
+			panic(err)
+		}
 
-			dserv := merkledag.NewReadOnlyDagService(merkledag.NewSession(ctx, merkledag.NewDAGService(bservice)))
-			fmt.Println("Downloading...")
-			// TODO: Add deadline
-			nd, err := dserv.Get(ctx, c)
+		var pins *pinSet
+		if seedMode {
+			pins, err = loadPinSet(cfg.statePath("pins.json"))
 			if err != nil {
-				return nil, err
+				panic(err)
 			}
+		}
+
+		ethClient, err := ethclient.Dial(cfg.Chain.RPCURL)
+		if err != nil {
+			panic(err)
+		}
+		// Every proposal's lifecycle, for the status API.
+		tracker, err := newGovernanceTracker(&cfg, log.chain, ethClient)
+		if err != nil {
+			panic(err)
+		}
+		go followGovernance(ctx, log.chain, tracker, time.Duration(cfg.Chain.PollInterval))
 
-			unixFSNode, err := unixfile.NewUnixfsFile(ctx, dserv, nd)
+		{ // Status API.
+			token, err := apiToken(&cfg)
 			if err != nil {
-				return nil, err
+				panic(err)
 			}
 
-			var buf bytes.Buffer
-			if f, ok := unixFSNode.(files.File); ok {
-				if _, err := io.Copy(&buf, f); err != nil {
-					return nil, err
+			api := &apiServer{cfg: &cfg, log: log.api, token: token, status: status, host: h, recipient: identity.Recipient(), bstore: bstore, dag: dag, metrics: metrics, agreement: agreement, fleet: fleet, pins: pins, limits: limits, governance: tracker, control: control}
+			if err := serveAPI(ctx, &cfg, api); err != nil {
+				panic(err)
+			}
+
+			if cfg.API.MetricsListen != "" {
+				if err := serveMetrics(ctx, log.api, cfg.API.MetricsListen, metrics); err != nil {
+					panic(err)
 				}
 			}
-			return buf.Bytes(), nil
 		}
 
-		var cmd *exec.Cmd = &exec.Cmd{}
+		// Get the actual frigging file.
+		fetcher := fetch.NewBitswap(log.fetch, bservice, func(ctx context.Context, c cid.Cid) {
+			for i := range addresses {
+				connectFromString(ctx, log.p2p, h, addresses[i])
+			}
+			// And the ones that announced they have it.
+			for _, id := range providers.For(c.String()) {
+				if err := h.Connect(ctx, h.Peerstore().PeerInfo(id)); err != nil {
+					log.p2p.Debug("failed to connect to provider", "peer", id, "err", err)
+				}
+			}
+		})
+
+		node := &node{
+			cfg:       &cfg,
+			log:       log,
+			id:        h.ID(),
+			fetcher:   fetcher,
+			executor:  executor.Native{Cgroup: cfg.Executor.Cgroup},
+			state:     state.Dir(cfg.DataDir),
+			policy:    cfg.Policy.rules(),
+			status:    status,
+			metrics:   metrics,
+			workloads: map[string]*workload{},
+			dag:       dag,
+			control:   control,
+			providers: providers,
+			agreement: agreement,
+			pins:      pins,
+			proposals: tracker,
+			bstore:    bstore,
+		}
+		if cfg.Executor.OCI {
+			node.oci = executor.OCI{Cgroup: cfg.Executor.Cgroup}
+		}
+		node.identity = identity
 
-		upgrade := func(str string) {
-			c, err := cid.Parse(str)
-			if err != nil {
-				fmt.Println("Not a valid cid")
-			} else {
-				fmt.Println("Valid cid: ", str)
-				bytes, err := dataFromCid(c)
+		{ // Chain.
+			if cfg.Chain.ChainID != 0 {
+				chainID, err := ethClient.ChainID(ctx)
+				if err != nil {
+					panic(err)
+				}
+				if chainID.Uint64() != cfg.Chain.ChainID {
+					panic(fmt.Sprintf("RPC is on chain %v, config expects %d", chainID, cfg.Chain.ChainID))
+				}
+			}
 
+			var op *operator
+			if cfg.needsOperator() {
+				op, err = newOperator(ctx, log.chain, cfg.Results, ethClient)
 				if err != nil {
-					fmt.Println("Failed to parse cid: ", str)
-				} else {
-					fmt.Println("Running: ")
-					// TODO: Check that it's an actual executable type.
-					f, err := os.CreateTemp("", "exe-*.bin")
-					if err != nil {
-						panic(err)
-					} else {
-						{
-							os.Chmod(f.Name(), 0755)
-
-							_, err := f.Write(bytes)
-							if err != nil {
-								panic(err)
-							}
-
-							f.Close()
-						}
-
-						if cmd.Process != nil {
-							err := cmd.Process.Kill()
-							if err != nil {
-								fmt.Println("Failed to kill.")
-							}
-						}
-
-						cmd = exec.Command(f.Name())
-						cmd.Stdout = os.Stdout
-						cmd.Stderr = os.Stderr
-
-						err := cmd.Start()
-
-						if err != nil {
-							fmt.Println("Program returned error.")
-						}
-					}
+					panic(err)
 				}
 			}
-		}
 
-		{ // Event loop.
-			ethClient, err := ethclient.Dial(os.Getenv("RPC_URL"))
-			// ethClient, err := ethclient.Dial("https://testnet.riselabs.xyz")
+			if cfg.Results.enabled() {
+				node.reporter, err = newResultReporter(log.chain, cfg.Results, op)
+				if err != nil {
+					panic(err)
+				}
+				log.chain.Info("reporting results", "registry", cfg.Results.RegistryAddress, "operator", node.reporter.address())
+				agreement.useRegistry(node.reporter)
+			}
+
+			hb, err := localHeartbeat(h.ID(), identity.Recipient(), cfg.runtimes(), op)
 			if err != nil {
 				panic(err)
 			}
+			if cfg.Heartbeat.RegistryAddress != "" {
+				go func() {
+					if err := registerNode(ctx, log.chain, op, common.HexToAddress(cfg.Heartbeat.RegistryAddress), hb); err != nil {
+						log.chain.Error("failed to register node", "err", err)
+					}
+				}()
+			}
+			if gater != nil && cfg.P2P.AllowRegistered {
+				go gater.refreshFromRegistry(ctx, h, ethClient, common.HexToAddress(cfg.Heartbeat.RegistryAddress), time.Duration(cfg.P2P.AllowlistRefresh))
+			}
+			go sendHeartbeats(ctx, log.p2p, fleet.topic, time.Duration(cfg.Heartbeat.Interval), hb, status)
 
-			eventHash := ethcrypto.Keccak256Hash([]byte("VoteCastWithParams(address,uint256,uint8,uint256,string,bytes)"))
-
-			// otherEventHash := ethcrypto.Keccak256Hash([]byte("VotedProgramData(bytes[])"))
-			// contractAddress := "0x71933465B8FC811F93049BBC18a8AdbECc79b5b8"
-			// contractAddress := "0x71933465B8FC811F93049BBC18a8AdbECc79b5b8"
-			contractAddress := os.Getenv("CONTRACT_ADDR")
-
-			ticker := time.Tick(time.Second * 3)
-
+			contractAddress := common.HexToAddress(cfg.Chain.ContractAddress)
 			parsedAbi, err := abi.JSON(strings.NewReader(contractAbi))
-			var lastLog uint = 0
-
 			if err != nil {
 				panic(err)
-			} else {
-				// Event loop.
-
-				for {
-					select {
-					case <-ticker:
-						query := ethereum.FilterQuery{
-							FromBlock: nil,
-							ToBlock:   nil,
-							Addresses: []common.Address{common.HexToAddress(contractAddress)},
-							Topics:    [][]common.Hash{{eventHash}},
-						}
-
-						logs, err := ethClient.FilterLogs(ctx, query)
-						if err != nil {
-							panic(err)
-						}
-
-						if len(logs) > 0 {
-							l := logs[len(logs)-1]
-
-							if uint(l.BlockNumber) > lastLog {
-								fmt.Println("Found a new log!")
-								lastLog = uint(l.BlockNumber)
-
-								test := struct {
-									ProposalId *big.Int `abi:"proposalId"`
-									Support    uint8    `abi:"support"`
-									Weight     *big.Int `abi:"weight"`
-									Reason     string   `abi:"reason"`
-									Params     []byte   `abi:"params"`
-								}{}
-
-								err := parsedAbi.UnpackIntoInterface(&test, "VoteCastWithParams", l.Data)
-								if err != nil {
-									panic(err)
-
-								} else {
-									// Try to run as a cid.
-									upgrade(string(test.Params))
-								}
-							}
-						}
-					}
-				}
 			}
+
+			providers.useChain(&providerChain{client: ethClient, abi: parsedAbi, contract: contractAddress, policy: node.policy, confirmations: cfg.Chain.Confirmations})
+			node.chain = chain.NewWatcher(log.chain, ethClient, parsedAbi, contractAddress, cfg.Chain.Confirmations)
 		}
+
+		node.run(ctx)
 	}
 }
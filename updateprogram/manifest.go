@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ipfs/go-cid"
+
+	"example.com/v2/age"
+)
+
+// Manifest describes the program a vote asks the nodes to run. Votes carry it
+// in their params, either as JSON or as a bare CID string.
+type Manifest struct {
+	CID  string   `json:"cid"`
+	Args []string `json:"args,omitempty"`
+	// How the CID is run: "native" (the default) runs it as an executable,
+	// "oci" as an OCI image layout, in a sandbox.
+	Runtime string `json:"runtime,omitempty"`
+	// A patch that turns a program the nodes may already have into this
+	// one, so they needn't fetch all of it.
+	Delta *Delta `json:"delta,omitempty"`
+
+	// Programs in different workloads run side by side, each upgraded by
+	// its own votes. Empty is the default workload.
+	Workload string `json:"workload,omitempty"`
+	// What the program needs. The node only runs it if it fits next to the
+	// other workloads, and holds it to it where the executor can.
+	Resources Resources `json:"resources,omitempty"`
+
+	// A job can be split into shards, each node runs one of them.
+	Shards []Shard `json:"shards,omitempty"`
+	// How nodes pick their shard: "hash" (the default) or "claim".
+	ShardAssignment string `json:"shard_assignment,omitempty"`
+	// How many nodes should run each shard, or the whole job if it isn't
+	// sharded. Replicas compare their results and flag the odd ones out.
+	Replicas int `json:"replicas,omitempty"`
+
+	// Confidential jobs. With EncryptedInputs the shard inputs are age files
+	// encrypted to the recipients of the nodes meant to run them. Nodes
+	// only decrypt them inside the program's sandbox, so these jobs need
+	// the oci runtime. The published output and logs are encrypted to
+	// OutputRecipient, normally the proposer's age recipient, which jobs
+	// with encrypted inputs have to name.
+	EncryptedInputs bool   `json:"encrypted_inputs,omitempty"`
+	OutputRecipient string `json:"output_recipient,omitempty"`
+
+	// When the fleet switches to the program together: at the first block
+	// at or after ActivationBlock, or at ActivationTime (RFC 3339). Nodes
+	// fetch a scheduled program once its proposal executes and run it then.
+	ActivationBlock uint64     `json:"activation_block,omitempty"`
+	ActivationTime  *time.Time `json:"activation_time,omitempty"`
+
+	// The proposal that was voted for and the transaction of the vote,
+	// filled in from the vote log.
+	proposal *big.Int
+	voteTx   common.Hash
+}
+
+func parseManifest(params []byte) (*Manifest, error) {
+	params = bytes.TrimSpace(params)
+
+	var m Manifest
+	if bytes.HasPrefix(params, []byte("{")) {
+		if err := json.Unmarshal(params, &m); err != nil {
+			return nil, fmt.Errorf("bad manifest: %w", err)
+		}
+	} else {
+		m.CID = strings.TrimSpace(string(params))
+	}
+
+	if _, err := cid.Parse(m.CID); err != nil {
+		return nil, fmt.Errorf("not a valid cid %q: %w", m.CID, err)
+	}
+
+	for i, s := range m.Shards {
+		if _, err := cid.Parse(s.Input); err != nil {
+			return nil, fmt.Errorf("shard %d: not a valid input cid %q: %w", i, s.Input, err)
+		}
+	}
+	switch m.Runtime {
+	case "", runtimeNative, runtimeOCI:
+	default:
+		return nil, fmt.Errorf("unknown runtime %q", m.Runtime)
+	}
+	if m.Delta != nil {
+		if err := m.Delta.validate(); err != nil {
+			return nil, fmt.Errorf("delta: %w", err)
+		}
+		if m.runtime() != runtimeNative {
+			return nil, fmt.Errorf("deltas only apply to %s programs", runtimeNative)
+		}
+	}
+	if m.Workload != "" && !workloadName.MatchString(m.Workload) {
+		return nil, fmt.Errorf("bad workload name %q", m.Workload)
+	}
+	if m.Resources.CPUs < 0 || m.Resources.MemoryMB < 0 {
+		return nil, fmt.Errorf("negative resources")
+	}
+	if m.Replicas < 0 {
+		return nil, fmt.Errorf("negative replicas %d", m.Replicas)
+	}
+	switch m.ShardAssignment {
+	case "", shardByHash, shardByClaim:
+	default:
+		return nil, fmt.Errorf("unknown shard assignment %q", m.ShardAssignment)
+	}
+	if m.OutputRecipient != "" {
+		if _, err := age.ParseRecipient(m.OutputRecipient); err != nil {
+			return nil, fmt.Errorf("output recipient: %w", err)
+		}
+	}
+	if m.EncryptedInputs {
+		switch {
+		case len(m.Shards) == 0:
+			return nil, fmt.Errorf("encrypted inputs without shards")
+		case m.runtime() != runtimeOCI:
+			return nil, fmt.Errorf("encrypted inputs need the %s runtime", runtimeOCI)
+		case m.OutputRecipient == "":
+			return nil, fmt.Errorf("encrypted inputs without an output recipient")
+		}
+	}
+	if m.ActivationBlock != 0 && m.ActivationTime != nil {
+		return nil, fmt.Errorf("both an activation block and time")
+	}
+
+	return &m, nil
+}
+
+func (m *Manifest) cid() cid.Cid {
+	c, _ := cid.Parse(m.CID)
+	return c
+}
+
+// workload is the name of the workload the program runs in.
+func (m *Manifest) workload() string {
+	if m.Workload == "" {
+		return defaultWorkload
+	}
+	return m.Workload
+}
+
+// runtime is how the program is run.
+func (m *Manifest) runtime() string {
+	if m.Runtime == "" {
+		return runtimeNative
+	}
+	return m.Runtime
+}
+
+// replicas is how many nodes are meant to run each shard of the job.
+func (m *Manifest) replicas() int {
+	if m.Replicas < 1 {
+		return 1
+	}
+	return m.Replicas
+}
+
+// scheduled reports whether the program waits for an activation point rather
+// than running as soon as it is voted for.
+func (m *Manifest) scheduled() bool {
+	return m.ActivationBlock != 0 || m.ActivationTime != nil
+}
+
+// due reports whether the activation point has passed at block.
+func (m *Manifest) due(block uint64) bool {
+	if m.ActivationTime != nil {
+		return !time.Now().Before(*m.ActivationTime)
+	}
+	return block >= m.ActivationBlock
+}
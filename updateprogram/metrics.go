@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	bsclient "github.com/ipfs/boxo/bitswap/client"
+	bsserver "github.com/ipfs/boxo/bitswap/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "updateprogram"
+
+// Reasons an upgrade can fail, used as the "reason" label.
+const (
+	failManifest = "manifest"
+	failFetch    = "fetch"
+	failWrite    = "write"
+	failStart    = "start"
+	// The node didn't have room for the program next to the other
+	// workloads, or can't run its runtime.
+	failAdmission = "admission"
+	// An OCI image couldn't be unpacked.
+	failUnpack = "unpack"
+	// An encrypted input couldn't be decrypted, most likely because it
+	// wasn't encrypted to this node.
+	failDecrypt = "decrypt"
+)
+
+type metrics struct {
+	registry *prometheus.Registry
+
+	headBlock      prometheus.Gauge
+	processedBlock prometheus.Gauge
+	blockLag       prometheus.Gauge
+	logsProcessed  prometheus.Counter
+
+	upgradeAttempts prometheus.Counter
+	upgradeFailures *prometheus.CounterVec
+
+	fetchDuration prometheus.Histogram
+	fetchBytes    prometheus.Counter
+
+	programStarts   prometheus.Counter
+	programRestarts prometheus.Counter
+	programExits    *prometheus.CounterVec
+
+	resultDisputes prometheus.Counter
+}
+
+func newMetrics(client *bsclient.Client, server *bsserver.Server, bstore *countedBlockstore) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+
+		headBlock: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace, Subsystem: "chain", Name: "head_block",
+			Help: "Latest block number reported by the RPC.",
+		}),
+		processedBlock: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace, Subsystem: "chain", Name: "processed_block",
+			Help: "Last block whose logs have been processed.",
+		}),
+		blockLag: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace, Subsystem: "chain", Name: "block_lag",
+			Help: "Blocks between the chain head and the last processed block.",
+		}),
+		logsProcessed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "chain", Name: "logs_processed_total",
+			Help: "Vote logs read from the chain.",
+		}),
+
+		upgradeAttempts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "upgrade", Name: "attempts_total",
+			Help: "Upgrades started.",
+		}),
+		upgradeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "upgrade", Name: "failures_total",
+			Help: "Upgrades that failed, by reason.",
+		}, []string{"reason"}),
+
+		fetchDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Subsystem: "fetch", Name: "duration_seconds",
+			Help:    "Time taken to fetch a program.",
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 14),
+		}),
+		fetchBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "fetch", Name: "bytes_total",
+			Help: "Program bytes fetched.",
+		}),
+
+		programStarts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "program", Name: "starts_total",
+			Help: "Times a program was started.",
+		}),
+		programRestarts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "program", Name: "restarts_total",
+			Help: "Times a running program was replaced or started again.",
+		}),
+		programExits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "program", Name: "exits_total",
+			Help: "Program exits, by exit code.",
+		}, []string{"code"}),
+
+		resultDisputes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "agreement", Name: "disputes_total",
+			Help: "Replicated results that disagreed with the majority, or jobs with no majority.",
+		}),
+	}
+
+	// Failure reasons are known up front, so show them at zero.
+	for _, reason := range []string{failManifest, failFetch, failWrite, failStart, failAdmission, failUnpack, failDecrypt} {
+		m.upgradeFailures.WithLabelValues(reason)
+	}
+
+	m.registry.MustRegister(
+		m.headBlock, m.processedBlock, m.blockLag, m.logsProcessed,
+		m.upgradeAttempts, m.upgradeFailures,
+		m.fetchDuration, m.fetchBytes,
+		m.programStarts, m.programRestarts, m.programExits,
+		m.resultDisputes,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		&bitswapCollector{client: client, server: server},
+		&blockstoreCollector{bstore: bstore},
+	)
+
+	return m
+}
+
+func (m *metrics) chainProgress(head, processed uint64) {
+	m.headBlock.Set(float64(head))
+	m.processedBlock.Set(float64(processed))
+	m.blockLag.Set(float64(head - processed))
+}
+
+func (m *metrics) programExited(code int) {
+	m.programExits.WithLabelValues(strconv.Itoa(code)).Inc()
+}
+
+var (
+	bitswapPeersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "bitswap", "peers"),
+		"Peers the bitswap server knows about.", nil, nil)
+	bitswapBlocksReceivedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "bitswap", "blocks_received_total"),
+		"Blocks received over bitswap.", nil, nil)
+	bitswapDataReceivedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "bitswap", "data_received_bytes_total"),
+		"Bytes received over bitswap.", nil, nil)
+	bitswapBlocksSentDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "bitswap", "blocks_sent_total"),
+		"Blocks sent over bitswap.", nil, nil)
+	bitswapDataSentDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "bitswap", "data_sent_bytes_total"),
+		"Bytes sent over bitswap.", nil, nil)
+)
+
+// bitswapCollector reads the bitswap counters on every scrape.
+type bitswapCollector struct {
+	client *bsclient.Client
+	server *bsserver.Server
+}
+
+func (c *bitswapCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bitswapPeersDesc
+	ch <- bitswapBlocksReceivedDesc
+	ch <- bitswapDataReceivedDesc
+	ch <- bitswapBlocksSentDesc
+	ch <- bitswapDataSentDesc
+}
+
+func (c *bitswapCollector) Collect(ch chan<- prometheus.Metric) {
+	if st, err := c.client.Stat(); err == nil {
+		ch <- prometheus.MustNewConstMetric(bitswapBlocksReceivedDesc, prometheus.CounterValue, float64(st.BlocksReceived))
+		ch <- prometheus.MustNewConstMetric(bitswapDataReceivedDesc, prometheus.CounterValue, float64(st.DataReceived))
+	}
+	if st, err := c.server.Stat(); err == nil {
+		ch <- prometheus.MustNewConstMetric(bitswapPeersDesc, prometheus.GaugeValue, float64(len(st.Peers)))
+		ch <- prometheus.MustNewConstMetric(bitswapBlocksSentDesc, prometheus.CounterValue, float64(st.BlocksSent))
+		ch <- prometheus.MustNewConstMetric(bitswapDataSentDesc, prometheus.CounterValue, float64(st.DataSent))
+	}
+}
+
+var (
+	blockstoreBlocksDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "blockstore", "blocks"),
+		"Blocks held in the blockstore.", nil, nil)
+	blockstoreBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "blockstore", "bytes"),
+		"Total size of the blocks in the blockstore.", nil, nil)
+)
+
+type blockstoreCollector struct {
+	bstore *countedBlockstore
+}
+
+func (c *blockstoreCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- blockstoreBlocksDesc
+	ch <- blockstoreBytesDesc
+}
+
+func (c *blockstoreCollector) Collect(ch chan<- prometheus.Metric) {
+	blocks, size := c.bstore.usage()
+	ch <- prometheus.MustNewConstMetric(blockstoreBlocksDesc, prometheus.GaugeValue, float64(blocks))
+	ch <- prometheus.MustNewConstMetric(blockstoreBytesDesc, prometheus.GaugeValue, float64(size))
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// serveMetrics serves /metrics on its own address, for scrapers that can't
+// reach the loopback-only status API.
+func serveMetrics(ctx context.Context, log *slog.Logger, addr string, m *metrics) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", m.handler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	log.Info("metrics listening", "addr", l.Addr())
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("metrics server stopped", "err", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"example.com/v2/fetch"
+)
+
+// The chain loop counts what it read and how far behind the head it is, and
+// every upgrade it tries, whether it failed and how the program ended.
+func TestMetricsFollowUpgrades(t *testing.T) {
+	fn := newFakeNode(t, nil, nil, nil)
+	ctx := context.Background()
+	m := fn.metrics
+	check := func(what string, got, want float64) {
+		t.Helper()
+		if got != want {
+			t.Errorf("%s is %v, want %v", what, got, want)
+		}
+	}
+
+	program := []byte("#!/bin/sh\necho v1\n")
+	fn.vote(1, fn.fetcher.Add(program).String())
+	fn.vote(2, "{not a manifest")
+	fn.chain.Mine()
+	fn.chain.Mine()
+	next := fn.poll(ctx, 0)
+
+	check("logs processed", value(t, m.logsProcessed), 2)
+	check("head block", value(t, m.headBlock), 3)
+	check("processed block", value(t, m.processedBlock), 2)
+	check("block lag", value(t, m.blockLag), 1)
+	check("upgrade attempts", value(t, m.upgradeAttempts), 1)
+	check("manifest failures", value(t, m.upgradeFailures.WithLabelValues(failManifest)), 1)
+	check("fetched bytes", value(t, m.fetchBytes), float64(len(program)))
+	check("program starts", value(t, m.programStarts), 1)
+	check("program restarts", value(t, m.programRestarts), 0)
+
+	first := fn.executor.Last()
+	first.Exit(3)
+	waitFor(t, "the exit to be counted", func() bool {
+		return value(t, m.programExits.WithLabelValues("3")) == 1
+	})
+
+	// Nobody has this one.
+	fn.vote(3, fetch.NewFake().Add([]byte("missing")).String())
+	fn.chain.Mine()
+	next = fn.poll(ctx, next)
+	check("upgrade attempts", value(t, m.upgradeAttempts), 2)
+	check("fetch failures", value(t, m.upgradeFailures.WithLabelValues(failFetch)), 1)
+
+	fn.vote(4, fn.fetcher.Add([]byte("#!/bin/sh\necho v2\n")).String())
+	fn.chain.Mine()
+	fn.poll(ctx, next)
+	check("program starts", value(t, m.programStarts), 2)
+	check("start failures", value(t, m.upgradeFailures.WithLabelValues(failStart)), 0)
+}
+
+func TestBlockstoreMetrics(t *testing.T) {
+	ctx := context.Background()
+	bstore, err := newCountedBlockstore(ctx, blockstore.NewBlockstore(dsync.MutexWrap(datastore.NewMapDatastore())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bstore.PutMany(ctx, []blocks.Block{blocks.NewBlock([]byte("a")), blocks.NewBlock([]byte("bb"))}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &blockstoreCollector{bstore: bstore}
+	if got := gathered(t, c, "updateprogram_blockstore_blocks"); got != 2 {
+		t.Errorf("%v blocks, want 2", got)
+	}
+	if got := gathered(t, c, "updateprogram_blockstore_bytes"); got != 3 {
+		t.Errorf("%v bytes, want 3", got)
+	}
+}
+
+// value reads the one counter or gauge c collects.
+func value(t *testing.T, c prometheus.Collector) float64 {
+	t.Helper()
+	return gathered(t, c, "")
+}
+
+// gathered reads the counter or gauge called name off c, or the only one
+// if name is empty.
+func gathered(t *testing.T, c prometheus.Collector, name string) float64 {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if name != "" && f.GetName() != name {
+			continue
+		}
+		metric := f.GetMetric()[0]
+		if metric.GetCounter() != nil {
+			return metric.GetCounter().GetValue()
+		}
+		return metric.GetGauge().GetValue()
+	}
+	t.Fatalf("no %q collected", name)
+	return 0
+}
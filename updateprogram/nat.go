@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// natOptions are the host options that let nodes behind NAT reach each
+// other: AutoNAT to learn whether the node is reachable, relay reservations
+// when it isn't, and hole punching to upgrade relayed connections to direct
+// ones.
+func natOptions(cfg *P2PConfig) ([]libp2p.Option, error) {
+	opts := []libp2p.Option{
+		libp2p.EnableRelay(),
+		libp2p.EnableAutoNATv2(),
+	}
+
+	relays := cfg.Relays
+	if len(relays) == 0 {
+		relays = cfg.Seeds
+	}
+	var static []multiaddr.Multiaddr
+	for _, s := range relays {
+		maddr, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			return nil, err
+		}
+		static = append(static, maddr)
+	}
+	infos, err := peer.AddrInfosFromP2pAddrs(static...)
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) > 0 {
+		opts = append(opts, libp2p.EnableAutoRelayWithStaticRelays(infos))
+	}
+
+	if cfg.NATPortMap {
+		opts = append(opts, libp2p.NATPortMap())
+	}
+	if cfg.HolePunching {
+		opts = append(opts, libp2p.EnableHolePunching())
+	}
+
+	if cfg.RelayService {
+		// A relay is only useful on a public address, which the operator
+		// vouches for by turning it on. It also answers AutoNAT probes.
+		opts = append(opts,
+			libp2p.EnableRelayService(),
+			libp2p.EnableNATService(),
+			libp2p.ForceReachabilityPublic(),
+		)
+	}
+
+	return opts, nil
+}
+
+// tcpOnly drops the listen addresses a private network can't use. The
+// pre-shared key only works over TCP, not QUIC or WebTransport.
+func tcpOnly(log *slog.Logger, addrs []string) []string {
+	var kept []string
+	for _, a := range addrs {
+		if strings.Contains(a, "/udp/") {
+			log.Warn("not listening on UDP in a private network", "addr", a)
+			continue
+		}
+		kept = append(kept, a)
+	}
+	return kept
+}
+
+// watchReachability keeps the node status up to date with what AutoNAT
+// thinks of the node.
+func watchReachability(ctx context.Context, log *slog.Logger, h host.Host, status *nodeStatus) error {
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case e := <-sub.Out():
+				reachability := e.(event.EvtLocalReachabilityChanged).Reachability
+				log.Info("reachability changed", "reachability", reachability)
+				status.update(func(s *nodeStatus) { s.reachability = reachability })
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+)
+
+func newQUICHost(t *testing.T) host.Host {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHost([]string{"/ip4/127.0.0.1/udp/0/quic-v1"}, priv, nil)
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// Nodes reach each other over QUIC, again after disconnecting, when the
+// server side handles a session ticket.
+func TestHostConnectsOverQUIC(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a, b := newQUICHost(t), newQUICHost(t)
+
+	for i := 0; i < 2; i++ {
+		if err := b.Connect(ctx, peer.AddrInfo{ID: a.ID(), Addrs: a.Addrs()}); err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+		conns := b.Network().ConnsToPeer(a.ID())
+		if len(conns) == 0 || conns[0].ConnState().Transport != "quic-v1" {
+			t.Fatalf("connection %d isn't over QUIC: %v", i, conns)
+		}
+		if res := <-ping.Ping(ctx, b, a.ID()); res.Error != nil {
+			t.Fatalf("ping over connection %d: %v", i, res.Error)
+		}
+		if err := b.Network().ClosePeer(a.ID()); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the connection to close", func() bool {
+			return b.Network().Connectedness(a.ID()) != network.Connected
+		})
+	}
+}
@@ -0,0 +1,721 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"example.com/v2/age"
+	"example.com/v2/chain"
+	"example.com/v2/executor"
+	"example.com/v2/fetch"
+	"example.com/v2/governance"
+	"example.com/v2/policy"
+	"example.com/v2/state"
+)
+
+// node follows the chain and runs the programs that are voted for. main
+// wires it up from the config, tests from fakes.
+type node struct {
+	cfg *Config
+	log *loggers
+	id  peer.ID
+
+	chain    chain.ChainWatcher
+	fetcher  fetch.ContentFetcher
+	executor executor.Executor
+	state    state.StateStore
+	policy   policy.Policy
+	// Runs OCI images. Nil if the node doesn't.
+	oci executor.Executor
+	// Decrypts confidential jobs' inputs. Nil if the node can't.
+	identity *age.Identity
+
+	status  *nodeStatus
+	metrics *metrics
+	// Where program logs and outputs are published.
+	dag     ipld.DAGService
+	control chan controlCommand
+
+	// Optional. Providers and agreement need the network, the reporter a
+	// results registry.
+	providers *providers
+	agreement *agreement
+	reporter  *resultReporter
+	// Set on seeds, which pin the programs instead of running them.
+	pins *pinSet
+	// Optional. The proposals to prefetch programs for while they are voted
+	// on, and the blockstore the blocks go to.
+	proposals *governance.Tracker
+	bstore    blockstore.Blockstore
+	// Fetches the event loop is waiting on. Prefetching holds off while
+	// there are any.
+	fetching atomic.Int32
+
+	// The programs started, by workload name. Held under programs, as both
+	// the chain loop and the status API's commands start and stop them.
+	programs  sync.Mutex
+	workloads map[string]*workload
+	// Set while a scheduled program is ready and waiting for its
+	// activation time.
+	activation *time.Timer
+}
+
+// run handles the chain and the status API's commands until ctx is done.
+func (n *node) run(ctx context.Context) {
+	// Resume after the last block we finished with.
+	nextBlock := n.cfg.Chain.StartBlock
+	if last, err := n.state.LastBlock(); err == nil && last+1 > nextBlock {
+		nextBlock = last + 1
+		n.status.update(func(s *nodeStatus) { s.lastBlock = last })
+	}
+	n.restoreSchedules()
+
+	if n.proposals != nil && n.cfg.Prefetch.Enabled {
+		go n.prefetchProposals(ctx)
+	}
+
+	var control sync.WaitGroup
+	control.Add(1)
+	go func() {
+		defer control.Done()
+		n.serveControl(ctx)
+	}()
+	defer control.Wait()
+
+	ticker := time.NewTicker(time.Duration(n.cfg.Chain.PollInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			nextBlock = n.poll(ctx, nextBlock)
+
+		case <-n.activationDue():
+			n.activateIfDue(ctx)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serveControl handles the status API's commands until ctx is done. It runs
+// apart from the chain loop, so stopping or pausing doesn't wait behind a
+// program being fetched.
+func (n *node) serveControl(ctx context.Context) {
+	for {
+		select {
+		case c := <-n.control:
+			c.done <- n.handleControl(ctx, c.name, c.workload)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// poll handles the votes and executed proposals from block next on, and
+// returns the block to carry on from.
+func (n *node) poll(ctx context.Context, next uint64) uint64 {
+	batch, err := n.chain.Poll(ctx, next)
+	if err != nil {
+		n.log.chain.Warn("failed to poll the chain", "from", next, "err", err)
+		return next
+	}
+	if batch == nil {
+		return next
+	}
+	n.metrics.logsProcessed.Add(float64(batch.Logs))
+
+	// The latest allowed vote for each workload wins.
+	manifests := map[string]*Manifest{}
+	for _, v := range batch.Votes {
+		if err := n.policy.CheckVote(v.Voter, v.Support, v.Weight); err != nil {
+			n.log.chain.Info("ignoring vote", "voter", v.Voter, "proposal", v.ProposalId, "reason", err)
+			continue
+		}
+
+		// Try to read the params as a manifest.
+		m, err := parseManifest(v.Params)
+		if err != nil {
+			n.log.chain.Warn("ignoring vote with bad params", "voter", v.Voter, "proposal", v.ProposalId, "err", err)
+			n.metrics.upgradeFailures.WithLabelValues(failManifest).Inc()
+			continue
+		}
+		m.proposal = v.ProposalId
+		m.voteTx = v.TxHash
+		if m.replicas() > 1 && n.agreement != nil {
+			n.agreement.Expect(m)
+		}
+		if n.pins != nil {
+			n.pinManifest(ctx, m)
+			continue
+		}
+		if m.scheduled() {
+			n.schedule(m)
+			continue
+		}
+		manifests[m.workload()] = m
+	}
+	for _, id := range batch.Executed {
+		n.proposalExecuted(id)
+	}
+
+	n.metrics.chainProgress(batch.Head, batch.To)
+	if err := n.state.SaveLastBlock(batch.To); err != nil {
+		n.log.chain.Error("failed to save last block", "err", err)
+	}
+
+	paused := false
+	n.status.update(func(s *nodeStatus) {
+		s.lastBlock = batch.To
+		paused = s.paused
+		if paused {
+			for name, m := range manifests {
+				s.workload(name).pending = m
+			}
+		}
+	})
+
+	for _, name := range sortedNames(manifests) {
+		m := manifests[name]
+		if paused {
+			n.log.chain.Info("upgrades are paused, holding vote", "workload", name, "cid", m.CID)
+		} else {
+			n.upgrade(ctx, m)
+		}
+	}
+
+	n.prefetchScheduled(ctx)
+	n.activateIfDue(ctx)
+	return batch.To + 1
+}
+
+// fetch downloads the file c, keeping the status up to date.
+func (n *node) fetch(ctx context.Context, c cid.Cid) ([]byte, error) {
+	n.fetching.Add(1)
+	defer n.fetching.Add(-1)
+
+	f, err := n.fetcher.Open(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if size, err := f.Size(); err == nil {
+		if err := n.policy.CheckSize(size); err != nil {
+			return nil, err
+		}
+		n.status.update(func(s *nodeStatus) {
+			if s.fetch != nil {
+				s.fetch.Total = size
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	written, err := io.Copy(io.MultiWriter(&buf, progressWriter{n.status}), f)
+	n.metrics.fetchBytes.Add(float64(written))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (n *node) announce(ctx context.Context, m *Manifest) {
+	if n.providers == nil {
+		return
+	}
+	if err := n.providers.Announce(ctx, m); err != nil {
+		n.log.p2p.Warn("failed to announce program", "cid", m.CID, "err", err)
+	}
+}
+
+// prepareShard picks this node's shard of a sharded job and fetches its
+// input.
+func (n *node) prepareShard(ctx context.Context, m *Manifest) (int, string, error) {
+	count := len(m.Shards)
+	shard := hashShard(n.id, m.proposal, count)
+	if m.ShardAssignment == shardByClaim {
+		if n.reporter == nil || m.proposal == nil {
+			n.log.exec.Warn("can't claim a shard without a results registry, falling back to hashing", "cid", m.CID)
+		} else {
+			claimed, err := n.reporter.claimShard(ctx, m.proposal, shard, count, m.replicas())
+			if err != nil {
+				return 0, "", err
+			}
+			shard = claimed
+		}
+	}
+
+	input := m.Shards[shard].Input
+	n.log.exec.Info("running shard", "cid", m.CID, "shard", shard, "of", count, "input", input)
+
+	fetchCtx, cancel := context.WithTimeout(ctx, time.Duration(n.cfg.Policy.FetchTimeout))
+	defer cancel()
+	data, err := n.fetch(fetchCtx, cid.MustParse(input))
+	if err != nil {
+		return 0, "", fmt.Errorf("fetch input %s: %w", input, err)
+	}
+
+	path, err := n.state.SaveInput(input, data)
+	return shard, path, err
+}
+
+// pinManifest is what seeds do with a vote: fetch the program and shard
+// inputs in full and keep them, instead of running anything.
+func (n *node) pinManifest(ctx context.Context, m *Manifest) {
+	cids := []string{m.CID}
+	for _, s := range m.Shards {
+		cids = append(cids, s.Input)
+	}
+	// Nodes that have the base only need the patch.
+	if m.Delta != nil {
+		cids = append(cids, m.Delta.Patch)
+	}
+
+	for _, c := range cids {
+		if n.pins.Has(c) {
+			continue
+		}
+
+		n.status.update(func(s *nodeStatus) {
+			s.fetch = &fetchProgress{CID: c, StartedAt: time.Now()}
+		})
+		fetchCtx, cancel := context.WithTimeout(ctx, time.Duration(n.cfg.Policy.FetchTimeout))
+		var err error
+		if c == m.CID && m.runtime() == runtimeOCI {
+			_, err = n.fetchDir(fetchCtx, cid.MustParse(c), "")
+		} else {
+			_, err = n.fetch(fetchCtx, cid.MustParse(c))
+		}
+		cancel()
+		if err != nil {
+			n.log.fetch.Error("failed to fetch for pinning", "cid", c, "err", err)
+			n.metrics.upgradeFailures.WithLabelValues(failFetch).Inc()
+			n.status.update(func(s *nodeStatus) { s.fetch.Error = err.Error() })
+			continue
+		}
+
+		if err := n.pins.Add(c, m.proposal.String()); err != nil {
+			n.log.fetch.Error("failed to save pin", "cid", c, "err", err)
+		}
+		n.log.fetch.Info("pinned", "cid", c, "proposal", m.proposal)
+	}
+
+	n.announce(ctx, m)
+	n.status.update(func(s *nodeStatus) {
+		w := s.workload(m.workload())
+		w.manifest = m
+		w.state = stateSeeding
+	})
+}
+
+// upgrade fetches the program m asks for and replaces the running one with
+// it.
+func (n *node) upgrade(ctx context.Context, m *Manifest) {
+	n.log.exec.Info("upgrading", "workload", m.workload(), "cid", m.CID, "proposal", m.proposal)
+	n.metrics.upgradeAttempts.Inc()
+
+	path, err := n.fetchProgram(ctx, m)
+	if err != nil {
+		return
+	}
+	n.switchTo(ctx, m, path)
+}
+
+// fetchProgram fetches the program m asks for and saves it, returning where:
+// the executable, or the image dir of an OCI image.
+func (n *node) fetchProgram(ctx context.Context, m *Manifest) (string, error) {
+	if m.runtime() == runtimeOCI {
+		if n.oci == nil {
+			err := fmt.Errorf("this node doesn't run %s programs", runtimeOCI)
+			n.log.exec.Warn("not admitting program", "workload", m.workload(), "cid", m.CID, "err", err)
+			n.metrics.upgradeFailures.WithLabelValues(failAdmission).Inc()
+			n.status.update(func(s *nodeStatus) { s.workload(m.workload()).rejected = fmt.Sprintf("%s: %v", m.CID, err) })
+			return "", err
+		}
+		return n.fetchImage(ctx, m)
+	}
+
+	c := m.cid()
+	n.status.update(func(s *nodeStatus) {
+		s.fetch = &fetchProgress{CID: m.CID, StartedAt: time.Now()}
+	})
+
+	fetchStart := time.Now()
+	var data []byte
+	var err error
+	if m.Delta != nil {
+		fetchCtx, cancel := context.WithTimeout(ctx, time.Duration(n.cfg.Policy.FetchTimeout))
+		data, err = n.fetchDelta(fetchCtx, m)
+		cancel()
+		if err != nil {
+			n.log.fetch.Warn("can't apply delta, fetching the whole program", "cid", m.CID, "base", m.Delta.Base, "err", err)
+			n.status.update(func(s *nodeStatus) {
+				s.fetch = &fetchProgress{CID: m.CID, StartedAt: time.Now()}
+			})
+		}
+	}
+	if m.Delta == nil || err != nil {
+		fetchCtx, cancel := context.WithTimeout(ctx, time.Duration(n.cfg.Policy.FetchTimeout))
+		data, err = n.fetch(fetchCtx, c)
+		cancel()
+	}
+	n.metrics.fetchDuration.Observe(time.Since(fetchStart).Seconds())
+
+	if err != nil {
+		n.log.fetch.Error("failed to fetch program", "cid", m.CID, "err", err)
+		n.metrics.upgradeFailures.WithLabelValues(failFetch).Inc()
+		n.status.update(func(s *nodeStatus) { s.fetch.Error = err.Error() })
+		return "", err
+	}
+	n.log.fetch.Info("fetched program", "cid", m.CID, "bytes", len(data), "took", time.Since(fetchStart))
+	n.announce(ctx, m)
+
+	// TODO: Check that it's an actual executable type.
+	path, err := n.state.SaveProgram(c.String(), data)
+	if err != nil {
+		n.log.exec.Error("failed to write program", "cid", m.CID, "err", err)
+		n.metrics.upgradeFailures.WithLabelValues(failWrite).Inc()
+		return "", err
+	}
+	return path, nil
+}
+
+// startProgram starts spec with the executor for m's runtime. Its path is
+// what fetchProgram saved.
+func (n *node) startProgram(m *Manifest, spec executor.Spec) (executor.Process, error) {
+	if m.runtime() != runtimeOCI {
+		return n.executor.Start(spec)
+	}
+	if err := imageSpec(&spec, spec.Path); err != nil {
+		return nil, err
+	}
+	return n.oci.Start(spec)
+}
+
+// switchTo replaces the program running in m's workload with m's, saved at
+// path, if the node has room for it.
+func (n *node) switchTo(ctx context.Context, m *Manifest, path string) {
+	name := m.workload()
+	resources := n.cfg.Workloads.resources(m)
+	admitted := func() bool {
+		err := n.admit(name, resources)
+		if err != nil {
+			n.log.exec.Warn("not admitting program", "workload", name, "cid", m.CID, "err", err)
+			n.metrics.upgradeFailures.WithLabelValues(failAdmission).Inc()
+			n.status.update(func(s *nodeStatus) { s.workload(name).rejected = fmt.Sprintf("%s: %v", m.CID, err) })
+		}
+		return err == nil
+	}
+	n.programs.Lock()
+	ok := admitted()
+	n.programs.Unlock()
+	if !ok {
+		return
+	}
+
+	var shard *int
+	var shardEnv []string
+	var secrets []executor.Secret
+	if len(m.Shards) > 0 {
+		index, input, err := n.prepareShard(ctx, m)
+		if err != nil {
+			n.log.exec.Error("failed to prepare shard", "cid", m.CID, "err", err)
+			n.metrics.upgradeFailures.WithLabelValues(failFetch).Inc()
+			return
+		}
+		if m.EncryptedInputs {
+			var secret executor.Secret
+			secret, input, err = n.decryptInput(input)
+			if err != nil {
+				n.log.exec.Error("failed to decrypt shard input", "cid", m.CID, "shard", index, "err", err)
+				n.metrics.upgradeFailures.WithLabelValues(failDecrypt).Inc()
+				n.status.update(func(s *nodeStatus) { s.workload(name).rejected = fmt.Sprintf("%s: shard %d: %v", m.CID, index, err) })
+				return
+			}
+			secrets = append(secrets, secret)
+		}
+		shard = &index
+		shardEnv = []string{
+			fmt.Sprintf("UPDATEPROGRAM_SHARD_INDEX=%d", index),
+			fmt.Sprintf("UPDATEPROGRAM_SHARD_COUNT=%d", len(m.Shards)),
+			"UPDATEPROGRAM_INPUT=" + input,
+		}
+	}
+
+	n.programs.Lock()
+	defer n.programs.Unlock()
+	// Other programs may have started while the shard was prepared.
+	if !admitted() {
+		return
+	}
+	if w := n.workloads[name]; w != nil && w.proc != nil {
+		n.metrics.programRestarts.Inc()
+	}
+	n.stop(name)
+
+	n.start(ctx, m, path, shard, shardEnv, secrets, resources)
+}
+
+// start runs the program at path in m's workload, and reports its results
+// once it exits. n.programs is held.
+func (n *node) start(ctx context.Context, m *Manifest, path string, shard *int, env []string, secrets []executor.Secret, resources Resources) {
+	name := m.workload()
+
+	// Each run starts with an empty output dir.
+	outputDir := n.cfg.programOutputDir(m.CID)
+	os.RemoveAll(outputDir)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		n.log.exec.Warn("failed to create output dir", "dir", outputDir, "err", err)
+	}
+
+	// The program's output is logged line by line, tagged with its CID.
+	var output sync.WaitGroup
+	programLog := n.log.program.With("cid", m.CID)
+	stdout, stdoutW := io.Pipe()
+	stderr, stderrW := io.Pipe()
+
+	// And kept in a file per CID.
+	logDir := n.cfg.programLogDir(m.CID)
+	logFile, err := openRotatingFile(logDir, n.cfg.ProgramLogs.MaxSize, n.cfg.ProgramLogs.MaxFiles)
+	var stdoutFile, stderrFile *lineWriter
+	if err != nil {
+		n.log.exec.Warn("failed to open program log", "dir", logDir, "err", err)
+	} else {
+		stdoutFile = &lineWriter{logFile, "stdout"}
+		stderrFile = &lineWriter{logFile, "stderr"}
+	}
+
+	env = append(slices.Concat(n.cfg.Executor.Env, []string{"UPDATEPROGRAM_OUTPUT_DIR=" + outputDir}), env...)
+	spec := executor.Spec{
+		Path:     path,
+		Args:     slices.Concat(n.cfg.Executor.Args, m.Args),
+		Env:      env,
+		Dir:      n.cfg.Executor.WorkDir,
+		Workload: name,
+		CPUs:     resources.CPUs,
+		Memory:   resources.MemoryMB << 20,
+		Secrets:  secrets,
+		Stdout:   stdoutW,
+		Stderr:   stderrW,
+	}
+	proc, err := n.startProgram(m, spec)
+	if err != nil {
+		stdoutW.Close()
+		stderrW.Close()
+		if logFile != nil {
+			logFile.Close()
+		}
+		n.log.exec.Error("failed to start program", "workload", name, "cid", m.CID, "err", err)
+		n.metrics.upgradeFailures.WithLabelValues(failStart).Inc()
+		return
+	}
+
+	n.metrics.programStarts.Inc()
+	n.status.update(func(s *nodeStatus) {
+		w := s.workload(name)
+		if w.manifest != nil && w.manifest.CID != m.CID {
+			w.previous = w.manifest
+		}
+		w.manifest = m
+		w.proposalID = m.proposal
+		w.rejected = ""
+		w.resources = resources
+		w.state = stateRunning
+		w.pid = proc.Pid()
+		w.runningAt = time.Now()
+		w.exitCode = nil
+		w.shard = shard
+	})
+
+	n.log.exec.Info("program started", "workload", name, "cid", m.CID, "pid", proc.Pid())
+
+	output.Add(2)
+	go logLines(&output, stdout, programLog.With("stream", "stdout"), slog.LevelInfo, stdoutFile)
+	go logLines(&output, stderr, programLog.With("stream", "stderr"), slog.LevelWarn, stderrFile)
+
+	done := make(chan struct{})
+	n.workloads[name] = &workload{proc: proc, exited: done, resources: resources}
+	startedAt := time.Now()
+	go func() {
+		<-proc.Done()
+		stdoutW.Close()
+		stderrW.Close()
+		output.Wait()
+		runtime := time.Since(startedAt)
+		code := proc.ExitCode()
+		n.log.exec.Info("program exited", "workload", name, "cid", m.CID, "pid", proc.Pid(), "code", code)
+		n.metrics.programExited(code)
+
+		if logFile != nil {
+			logFile.Close()
+			if n.cfg.ProgramLogs.Publish {
+				bundle, err := publishLogs(n.dag, logDir, m.outputRecipient())
+				if err != nil {
+					n.log.exec.Error("failed to publish program logs", "cid", m.CID, "err", err)
+				} else {
+					n.log.exec.Info("published program logs", "cid", m.CID, "bundle", bundle)
+					n.status.update(func(s *nodeStatus) { s.logBundles[m.CID] = bundle.String() })
+				}
+			}
+		}
+
+		outputCid, err := publishOutput(n.dag, outputDir, m.outputRecipient())
+		if err != nil {
+			n.log.exec.Error("failed to publish program output", "cid", m.CID, "err", err)
+		} else if outputCid.Defined() {
+			n.log.exec.Info("published program output", "cid", m.CID, "output", outputCid)
+			n.status.update(func(s *nodeStatus) { s.outputs[m.CID] = outputCid.String() })
+		}
+		n.status.update(func(s *nodeStatus) {
+			if w := s.workload(name); w.pid == proc.Pid() && w.state == stateRunning {
+				w.state = stateExited
+				w.exitCode = &code
+			}
+		})
+		close(done)
+
+		if m.proposal == nil {
+			return
+		}
+		res := Result{
+			ProposalID: m.proposal,
+			ProgramCID: m.CID,
+			ExitCode:   code,
+			Runtime:    runtime,
+		}
+		if outputCid.Defined() {
+			res.OutputCID = outputCid.String()
+		}
+		if shard != nil {
+			res.Shard = *shard
+		}
+		n.report(ctx, m, res)
+	}()
+}
+
+// report puts the result of a run on-chain and, for replicated jobs,
+// announces it to the other replicas.
+func (n *node) report(ctx context.Context, m *Manifest, res Result) {
+	if n.reporter == nil {
+		return
+	}
+	if err := n.reporter.Submit(ctx, res); err != nil {
+		n.log.chain.Error("failed to submit result", "proposal", m.proposal, "err", err)
+		return
+	}
+
+	// Announced after the result is on-chain, where the other replicas
+	// check it and can dispute it.
+	if m.replicas() > 1 && n.agreement != nil {
+		ann := resultAnnouncement{
+			ProposalID: res.ProposalID.String(),
+			Shard:      res.Shard,
+			ProgramCID: res.ProgramCID,
+			ExitCode:   res.ExitCode,
+			OutputCID:  res.OutputCID,
+			Operator:   n.reporter.address().Hex(),
+		}
+		if err := n.agreement.Announce(ann); err != nil {
+			n.log.p2p.Error("failed to announce result", "proposal", m.proposal, "err", err)
+		}
+	}
+}
+
+// stop asks the program running in workload name to stop, and kills it if
+// it doesn't in time. n.programs is held.
+func (n *node) stop(name string) {
+	w := n.workloads[name]
+	if w == nil || w.proc == nil {
+		return
+	}
+
+	if err := w.proc.Stop(time.Duration(n.cfg.Executor.StopTimeout)); err != nil {
+		n.log.exec.Error("failed to kill program", "workload", name, "pid", w.proc.Pid(), "err", err)
+	}
+	<-w.exited
+}
+
+// handleControl handles a command from the status API. Stop and rollback
+// act on one workload, or stop all of them and roll back the default one if
+// none is given.
+func (n *node) handleControl(ctx context.Context, command, workload string) error {
+	if n.pins != nil {
+		return fmt.Errorf("seeds don't run programs")
+	}
+
+	var err error
+	var run []*Manifest
+	var stop []string
+	n.status.update(func(s *nodeStatus) {
+		if workload != "" && s.workloads[workload] == nil {
+			err = fmt.Errorf("no workload %q", workload)
+			return
+		}
+		switch command {
+		case "pause":
+			s.paused = true
+		case "resume":
+			s.paused = false
+			for _, name := range sortedNames(s.workloads) {
+				if w := s.workloads[name]; w.pending != nil {
+					run = append(run, w.pending)
+					w.pending = nil
+				}
+			}
+		case "rollback":
+			name := workload
+			if name == "" {
+				name = defaultWorkload
+			}
+			w := s.workloads[name]
+			if w == nil || w.previous == nil {
+				err = fmt.Errorf("no previous program to roll back to")
+				return
+			}
+			run = append(run, w.previous)
+		case "stop":
+			if workload != "" {
+				stop = []string{workload}
+			} else {
+				stop = sortedNames(s.workloads)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range stop {
+		n.programs.Lock()
+		n.stop(name)
+		n.programs.Unlock()
+		n.status.update(func(s *nodeStatus) {
+			if w := s.workload(name); w.state == stateRunning || w.state == stateExited {
+				w.state = stateStopped
+			}
+		})
+	}
+	if command == "rollback" {
+		n.log.exec.Warn("rolling back", "workload", run[0].workload(), "cid", run[0].CID)
+	}
+
+	for _, m := range run {
+		n.upgrade(ctx, m)
+	}
+	return nil
+}
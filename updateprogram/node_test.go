@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+
+	"example.com/v2/chain"
+	"example.com/v2/executor"
+	"example.com/v2/fetch"
+	"example.com/v2/policy"
+	"example.com/v2/state"
+)
+
+// fakeNode is a node wired up from fakes, with the fakes at hand.
+type fakeNode struct {
+	*node
+	chain    *chain.Fake
+	fetcher  *fetch.Fake
+	executor *executor.Fake
+	state    *state.Memory
+	policy   *policy.Fake
+}
+
+// newFakeNode makes a node on the given fakes. Nil ones get new fakes, so
+// tests can share the chain, the content or the saved state between nodes.
+func newFakeNode(t *testing.T, c *chain.Fake, f *fetch.Fake, st *state.Memory) *fakeNode {
+	t.Helper()
+	if c == nil {
+		c = chain.NewFake()
+	}
+	if f == nil {
+		f = fetch.NewFake()
+	}
+	if st == nil {
+		st = state.NewMemory()
+	}
+
+	cfg := defaultConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.Chain.PollInterval = Duration(10 * time.Millisecond)
+	bstore := blockstore.NewBlockstore(dsync.MutexWrap(datastore.NewMapDatastore()))
+
+	fn := &fakeNode{chain: c, fetcher: f, executor: &executor.Fake{}, state: st, policy: &policy.Fake{}}
+	fn.node = &node{
+		cfg:       &cfg,
+		log:       newLoggers(cfg.Log, io.Discard, io.Discard),
+		id:        "fake-peer",
+		chain:     fn.chain,
+		fetcher:   fn.fetcher,
+		executor:  fn.executor,
+		state:     fn.state,
+		policy:    fn.policy,
+		status:    newNodeStatus(),
+		metrics:   newMetrics(nil, nil, nil),
+		workloads: map[string]*workload{},
+		dag:       merkledag.NewDAGService(blockservice.New(bstore, nil)),
+		control:   make(chan controlCommand),
+		bstore:    bstore,
+	}
+	t.Cleanup(fn.stopAll)
+	return fn
+}
+
+// stopAll stops the programs the node started, for the output goroutines
+// to finish before the test's temp dir goes.
+func (fn *fakeNode) stopAll() {
+	for name := range fn.workloads {
+		fn.stop(name)
+	}
+}
+
+// vote casts a vote for params on proposal id in the current block.
+func (fn *fakeNode) vote(id int64, params string) {
+	fn.chain.AddVote(&chain.Vote{
+		Voter:      common.HexToAddress("0x01"),
+		ProposalId: big.NewInt(id),
+		Support:    1,
+		Weight:     big.NewInt(1),
+		Params:     []byte(params),
+	})
+}
+
+// workloadStatus returns a copy of workload name's status.
+func (fn *fakeNode) workloadStatus(name string) workloadStatus {
+	var w workloadStatus
+	fn.status.update(func(s *nodeStatus) { w = *s.workload(name) })
+	return w
+}
+
+func TestVoteFetchStart(t *testing.T) {
+	fn := newFakeNode(t, nil, nil, nil)
+	ctx := context.Background()
+
+	program := []byte("#!/bin/sh\necho v1\n")
+	c := fn.fetcher.Add(program)
+	fn.vote(1, c.String())
+	fn.chain.Mine()
+	next := fn.poll(ctx, 0)
+
+	if next != 2 {
+		t.Errorf("carries on from block %d, want 2", next)
+	}
+	if got := fn.state.Programs[c.String()]; string(got) != string(program) {
+		t.Fatalf("saved program %q, want %q", got, program)
+	}
+	p := fn.executor.Last()
+	if p == nil {
+		t.Fatal("program not started")
+	}
+	if p.Spec.Path != "memory:programs/"+c.String() || p.Spec.Workload != defaultWorkload {
+		t.Errorf("started %s in %q", p.Spec.Path, p.Spec.Workload)
+	}
+	if w := fn.workloadStatus(defaultWorkload); w.state != stateRunning || w.manifest.CID != c.String() || w.proposalID.Int64() != 1 {
+		t.Errorf("workload is %s running %v for proposal %v", w.state, w.manifest, w.proposalID)
+	}
+	if last, err := fn.state.LastBlock(); err != nil || last != 1 {
+		t.Errorf("saved last block %d, %v", last, err)
+	}
+
+	// The next vote replaces it.
+	c2 := fn.fetcher.Add([]byte("#!/bin/sh\necho v2\n"))
+	fn.vote(2, c2.String())
+	fn.chain.Mine()
+	fn.poll(ctx, next)
+
+	select {
+	case <-p.Done():
+	default:
+		t.Error("first program still running")
+	}
+	if len(fn.executor.Started) != 2 {
+		t.Fatalf("started %d programs, want 2", len(fn.executor.Started))
+	}
+	w := fn.workloadStatus(defaultWorkload)
+	if w.manifest.CID != c2.String() || w.previous == nil || w.previous.CID != c.String() {
+		t.Errorf("running %v after %v", w.manifest, w.previous)
+	}
+}
+
+func TestExecutedProposal(t *testing.T) {
+	fn := newFakeNode(t, nil, nil, nil)
+	ctx := context.Background()
+
+	c := fn.fetcher.Add([]byte("#!/bin/sh\necho scheduled\n"))
+	fn.vote(7, fmt.Sprintf(`{"cid": %q, "activation_block": 4}`, c))
+	fn.chain.Mine()
+	next := fn.poll(ctx, 0)
+
+	// Scheduled programs wait for their proposal to execute.
+	if len(fn.fetcher.Opened) != 0 {
+		t.Fatalf("fetched %v before the proposal executed", fn.fetcher.Opened)
+	}
+	if w := fn.workloadStatus(defaultWorkload); w.scheduled == nil || w.scheduled.executed {
+		t.Fatalf("scheduled %+v", w.scheduled)
+	}
+
+	fn.chain.AddExecuted(big.NewInt(7))
+	fn.chain.Mine()
+	next = fn.poll(ctx, next)
+
+	if len(fn.fetcher.Opened) != 1 || !fn.fetcher.Opened[0].Equals(c) {
+		t.Fatalf("fetched %v once the proposal executed, want %s", fn.fetcher.Opened, c)
+	}
+	if fn.executor.Last() != nil {
+		t.Fatal("started before the activation block")
+	}
+
+	// Blocks 3 and 4.
+	fn.chain.Mine()
+	fn.chain.Mine()
+	fn.poll(ctx, next)
+
+	p := fn.executor.Last()
+	if p == nil || p.Spec.Path != "memory:programs/"+c.String() {
+		t.Fatalf("started %v at the activation block", p)
+	}
+	if w := fn.workloadStatus(defaultWorkload); w.scheduled != nil || w.state != stateRunning {
+		t.Errorf("workload is %s with %+v scheduled", w.state, w.scheduled)
+	}
+}
+
+func TestScheduledByTime(t *testing.T) {
+	fn := newFakeNode(t, nil, nil, nil)
+
+	c := fn.fetcher.Add([]byte("#!/bin/sh\necho scheduled\n"))
+	at := time.Now().Add(300 * time.Millisecond).UTC().Truncate(time.Millisecond)
+	fn.vote(7, fmt.Sprintf(`{"cid": %q, "activation_time": %q}`, c, at.Format(time.RFC3339Nano)))
+	fn.chain.AddExecuted(big.NewInt(7))
+	fn.chain.Mine()
+
+	runNode(t, fn)
+	waitFor(t, "the program to be fetched", func() bool {
+		sc := fn.workloadStatus(defaultWorkload).scheduled
+		return sc != nil && sc.path != ""
+	})
+	waitFor(t, "the program to start", func() bool { return fn.executor.Last() != nil })
+	if now := time.Now(); now.Before(at) {
+		t.Errorf("started %v before the activation time", at.Sub(now))
+	}
+	if p := fn.executor.Last(); p.Spec.Path != "memory:programs/"+c.String() {
+		t.Errorf("started %s", p.Spec.Path)
+	}
+}
+
+func TestScheduleSurvivesRestart(t *testing.T) {
+	ch := chain.NewFake()
+	content := fetch.NewFake()
+	st := state.NewMemory()
+	ctx := context.Background()
+
+	c := content.Add([]byte("#!/bin/sh\necho scheduled\n"))
+	first := newFakeNode(t, ch, content, st)
+	first.vote(7, fmt.Sprintf(`{"cid": %q, "activation_block": 4}`, c))
+	ch.Mine()
+	first.poll(ctx, 0)
+	if len(st.Scheduled) != 1 {
+		t.Fatalf("saved %d scheduled programs, want 1", len(st.Scheduled))
+	}
+
+	// The vote is behind the second node's last block, so only the saved
+	// schedule tells it what to do when the proposal executes.
+	second := newFakeNode(t, ch, content, st)
+	ch.AddExecuted(big.NewInt(7))
+	ch.Mine()
+	ch.Mine()
+	ch.Mine()
+	runNode(t, second)
+
+	waitFor(t, "the scheduled program to start", func() bool { return second.executor.Last() != nil })
+	if p := second.executor.Last(); p.Spec.Path != "memory:programs/"+c.String() {
+		t.Errorf("started %s", p.Spec.Path)
+	}
+	if w := second.workloadStatus(defaultWorkload); w.proposalID.Int64() != 7 {
+		t.Errorf("running proposal %v, want 7", w.proposalID)
+	}
+	waitFor(t, "the schedule to be dropped", func() bool {
+		saved, _ := st.Schedules()
+		return len(saved) == 0
+	})
+}
+
+func TestFetchFailure(t *testing.T) {
+	fn := newFakeNode(t, nil, nil, nil)
+	ctx := context.Background()
+
+	// Nobody has it.
+	missing := fetch.NewFake().Add([]byte("missing"))
+	fn.vote(1, missing.String())
+	fn.chain.Mine()
+	next := fn.poll(ctx, 0)
+
+	if fn.executor.Last() != nil {
+		t.Fatal("started a program that couldn't be fetched")
+	}
+	var progress *fetchProgress
+	fn.status.update(func(s *nodeStatus) { progress = s.fetch })
+	if progress == nil || progress.CID != missing.String() || progress.Error == "" {
+		t.Errorf("fetch status %+v", progress)
+	}
+	if _, ok := fn.state.Programs[missing.String()]; ok {
+		t.Error("saved a program that couldn't be fetched")
+	}
+
+	// Carries on with the next vote.
+	c := fn.fetcher.Add([]byte("#!/bin/sh\n"))
+	fn.vote(2, c.String())
+	fn.chain.Mine()
+	fn.poll(ctx, next)
+	if p := fn.executor.Last(); p == nil || p.Spec.Path != "memory:programs/"+c.String() {
+		t.Fatalf("started %v after a failed fetch", p)
+	}
+}
+
+func TestPolicyRejection(t *testing.T) {
+	fn := newFakeNode(t, nil, nil, nil)
+	ctx := context.Background()
+
+	c := fn.fetcher.Add([]byte("#!/bin/sh\n"))
+	fn.policy.VoteErr = errors.New("voter not allowed")
+	fn.vote(1, c.String())
+	fn.chain.Mine()
+	next := fn.poll(ctx, 0)
+
+	if len(fn.fetcher.Opened) != 0 || fn.executor.Last() != nil {
+		t.Fatalf("acted on a rejected vote: fetched %v", fn.fetcher.Opened)
+	}
+
+	// Allowed votes for programs over the size limit aren't run either.
+	fn.policy.VoteErr = nil
+	fn.policy.SizeErr = errors.New("program too large")
+	fn.vote(2, c.String())
+	fn.chain.Mine()
+	fn.poll(ctx, next)
+
+	if len(fn.fetcher.Opened) != 1 {
+		t.Errorf("opened %v, want the program once", fn.fetcher.Opened)
+	}
+	if fn.executor.Last() != nil {
+		t.Fatal("started a program over the size limit")
+	}
+	if _, ok := fn.state.Programs[c.String()]; ok {
+		t.Error("saved a program over the size limit")
+	}
+}
+
+func TestStartError(t *testing.T) {
+	fn := newFakeNode(t, nil, nil, nil)
+	fn.executor.Err = errors.New("exec format error")
+
+	c := fn.fetcher.Add([]byte("not a program"))
+	fn.vote(1, c.String())
+	fn.chain.Mine()
+	fn.poll(context.Background(), 0)
+
+	if w := fn.workloadStatus(defaultWorkload); w.state == stateRunning {
+		t.Errorf("workload is %s after the program failed to start", w.state)
+	}
+}
+
+// runNode runs fn's event loop until the returned func is called or the
+// test ends.
+func runNode(t *testing.T, fn *fakeNode) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		fn.run(ctx)
+		close(done)
+	}()
+	stop = func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+// waitFor fails t unless cond holds within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRestartResumesFromState(t *testing.T) {
+	ch := chain.NewFake()
+	content := fetch.NewFake()
+	st := state.NewMemory()
+
+	c1 := content.Add([]byte("#!/bin/sh\necho v1\n"))
+	first := newFakeNode(t, ch, content, st)
+	first.vote(1, c1.String())
+	ch.Mine()
+
+	stop := runNode(t, first)
+	waitFor(t, "the first node to start the program", func() bool { return first.executor.Last() != nil })
+	stop()
+	first.stopAll()
+	opened := len(content.Opened)
+
+	// A node on the same state carries on after the blocks the first one
+	// handled, without acting on their votes again.
+	second := newFakeNode(t, ch, content, st)
+	c2 := content.Add([]byte("#!/bin/sh\necho v2\n"))
+	second.vote(2, c2.String())
+	ch.Mine()
+
+	stop = runNode(t, second)
+	waitFor(t, "the second node to start the new program", func() bool { return second.executor.Last() != nil })
+	stop()
+
+	if len(second.executor.Started) != 1 || second.executor.Last().Spec.Path != "memory:programs/"+c2.String() {
+		t.Errorf("started %d programs, the last %s", len(second.executor.Started), second.executor.Last().Spec.Path)
+	}
+	for _, c := range content.Opened[opened:] {
+		if c.Equals(c1) {
+			t.Error("fetched the first program again after the restart")
+		}
+	}
+	var lastBlock uint64
+	second.status.update(func(s *nodeStatus) { lastBlock = s.lastBlock })
+	if lastBlock != 2 {
+		t.Errorf("last block %d, want 2", lastBlock)
+	}
+}
+
+// slowFetcher holds up opening one CID until released.
+type slowFetcher struct {
+	*fetch.Fake
+	slow    cid.Cid
+	opened  chan struct{}
+	release chan struct{}
+}
+
+func (f *slowFetcher) Open(ctx context.Context, c cid.Cid) (fetch.File, error) {
+	if c.Equals(f.slow) {
+		close(f.opened)
+		select {
+		case <-f.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return f.Fake.Open(ctx, c)
+}
+
+// Commands from the status API are handled while the chain loop waits on a
+// fetch.
+func TestControlDuringFetch(t *testing.T) {
+	fn := newFakeNode(t, nil, nil, nil)
+	slow := &slowFetcher{
+		Fake:    fn.fetcher,
+		slow:    fn.fetcher.Add([]byte("#!/bin/sh\necho slow\n")),
+		opened:  make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	fn.node.fetcher = slow
+
+	fn.vote(1, fn.fetcher.Add([]byte("#!/bin/sh\necho v1\n")).String())
+	fn.chain.Mine()
+	runNode(t, fn)
+	waitFor(t, "the first program to start", func() bool { return fn.executor.Last() != nil })
+	first := fn.executor.Last()
+
+	fn.vote(2, slow.slow.String())
+	fn.chain.Mine()
+	select {
+	case <-slow.opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the fetch")
+	}
+
+	cmd := controlCommand{name: "stop", done: make(chan error, 1)}
+	select {
+	case fn.control <- cmd:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop wasn't taken while a program was being fetched")
+	}
+	if err := <-cmd.done; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-first.Done():
+	default:
+		t.Error("first program still running after stop")
+	}
+
+	close(slow.release)
+	waitFor(t, "the fetched program to start", func() bool { return fn.executor.Last() != first })
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+func loadOperatorKey(cfg ResultsConfig) (*keystore.Key, error) {
+	data, err := os.ReadFile(cfg.Keystore)
+	if err != nil {
+		return nil, err
+	}
+
+	password := os.Getenv("OPERATOR_PASSWORD")
+	if cfg.PasswordFile != "" {
+		p, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		password = strings.TrimRight(string(p), "\r\n")
+	}
+
+	return keystore.DecryptKey(data, password)
+}
+
+// chainClient is what the operator needs of the chain. It is an
+// *ethclient.Client outside of tests.
+type chainClient interface {
+	bind.ContractBackend
+	bind.DeployBackend
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+}
+
+// operator sends transactions from the operator account. Everything the node
+// writes on-chain goes through the one operator so nonces are handed out in
+// order.
+type operator struct {
+	log            *slog.Logger
+	client         chainClient
+	key            *keystore.Key
+	chainID        *big.Int
+	receiptTimeout time.Duration
+
+	mu    sync.Mutex
+	nonce *uint64
+	// The last transaction sent, until its nonce is known to be used. If
+	// it wasn't mined in time, it is sent again with higher fees before the
+	// next transaction, so one underpriced transaction doesn't hold up every
+	// one after it, nor is what it did lost.
+	stuck *types.Transaction
+}
+
+func newOperator(ctx context.Context, log *slog.Logger, cfg ResultsConfig, client *ethclient.Client) (*operator, error) {
+	key, err := loadOperatorKey(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("operator keystore: %w", err)
+	}
+
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &operator{
+		log:            log,
+		client:         client,
+		key:            key,
+		chainID:        chainID,
+		receiptTimeout: time.Duration(cfg.ReceiptTimeout),
+	}, nil
+}
+
+func (o *operator) address() common.Address {
+	return o.key.Address
+}
+
+// transact sends a transaction calling the contract at to with input and
+// waits for it to be mined. A transaction sent before that wasn't mined in
+// time is sent again, and mined, first.
+func (o *operator) transact(ctx context.Context, to common.Address, input []byte) (*types.Receipt, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.unstick(ctx); err != nil {
+		return nil, err
+	}
+
+	// Estimating first also catches reverts before paying for them.
+	gas, err := o.client.EstimateGas(ctx, ethereum.CallMsg{From: o.address(), To: &to, Data: input})
+	if err != nil {
+		return nil, fmt.Errorf("estimate gas: %w", err)
+	}
+	if o.nonce == nil {
+		nonce, err := o.client.PendingNonceAt(ctx, o.address())
+		if err != nil {
+			return nil, err
+		}
+		o.nonce = &nonce
+	}
+
+	opts, err := o.transactOpts(ctx, *o.nonce)
+	if err != nil {
+		return nil, err
+	}
+	// Leave some headroom over the estimate.
+	opts.GasLimit = gas + gas/5
+
+	tx, err := o.send(opts, to, input)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := o.wait(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return nil, fmt.Errorf("transaction %s reverted", tx.Hash())
+	}
+	return receipt, nil
+}
+
+// unstick sends the transaction that wasn't mined in time again, with the
+// same nonce, gas and calldata but higher fees, and waits for it to be
+// mined, unless it or one it replaced was mined since.
+func (o *operator) unstick(ctx context.Context) error {
+	if o.stuck == nil {
+		return nil
+	}
+	mined, err := o.client.NonceAt(ctx, o.address(), nil)
+	if err != nil {
+		return err
+	}
+	stuck := o.stuck
+	if mined > stuck.Nonce() {
+		o.stuck = nil
+		return nil
+	}
+
+	opts, err := o.transactOpts(ctx, stuck.Nonce())
+	if err != nil {
+		return err
+	}
+	if err := o.outbid(ctx, opts, stuck); err != nil {
+		return err
+	}
+	opts.GasLimit = stuck.Gas()
+	o.log.Warn("resending transaction that wasn't mined", "tx", stuck.Hash(), "nonce", stuck.Nonce())
+
+	tx, err := o.send(opts, *stuck.To(), stuck.Data())
+	if err != nil {
+		return fmt.Errorf("resend %s: %w", stuck.Hash(), err)
+	}
+	receipt, err := o.wait(ctx, tx)
+	if err != nil {
+		return fmt.Errorf("resend %s: %w", stuck.Hash(), err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		o.log.Warn("resent transaction reverted", "tx", tx.Hash(), "nonce", tx.Nonce())
+	}
+	return nil
+}
+
+func (o *operator) transactOpts(ctx context.Context, nonce uint64) (*bind.TransactOpts, error) {
+	opts, err := bind.NewKeyedTransactorWithChainID(o.key.PrivateKey, o.chainID)
+	if err != nil {
+		return nil, err
+	}
+	opts.Context = ctx
+	opts.Nonce = new(big.Int).SetUint64(nonce)
+	return opts, nil
+}
+
+// send sends a transaction calling to with input, and keeps it as the stuck
+// one until it is mined.
+func (o *operator) send(opts *bind.TransactOpts, to common.Address, input []byte) (*types.Transaction, error) {
+	contract := bind.NewBoundContract(to, abi.ABI{}, o.client, o.client, o.client)
+	tx, err := contract.RawTransact(opts, input)
+	if err != nil {
+		// Whatever happened, ask the node for the nonce again next time.
+		o.nonce = nil
+		return nil, fmt.Errorf("send: %w", err)
+	}
+	next := tx.Nonce() + 1
+	o.nonce = &next
+	o.stuck = tx
+	o.log.Debug("sent transaction", "to", to, "tx", tx.Hash(), "nonce", tx.Nonce(), "gas", opts.GasLimit)
+	return tx, nil
+}
+
+// wait waits up to the receipt timeout for tx to be mined.
+func (o *operator) wait(ctx context.Context, tx *types.Transaction) (*types.Receipt, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, o.receiptTimeout)
+	defer cancel()
+	receipt, err := bind.WaitMined(waitCtx, o.client, tx)
+	if err != nil {
+		return nil, fmt.Errorf("wait for %s: %w", tx.Hash(), err)
+	}
+	o.stuck = nil
+	return receipt, nil
+}
+
+// outbid sets opts' fees to a quarter over tx's, or to what the chain asks
+// for now if that is more, for nodes to take the new transaction in its
+// place.
+func (o *operator) outbid(ctx context.Context, opts *bind.TransactOpts, tx *types.Transaction) error {
+	bump := func(v *big.Int) *big.Int {
+		bumped := new(big.Int).Add(v, new(big.Int).Quo(v, big.NewInt(4)))
+		return bumped.Add(bumped, big.NewInt(1))
+	}
+	higher := func(a, b *big.Int) *big.Int {
+		if a.Cmp(b) > 0 {
+			return a
+		}
+		return b
+	}
+
+	if tx.Type() == types.LegacyTxType {
+		price, err := o.client.SuggestGasPrice(ctx)
+		if err != nil {
+			return err
+		}
+		opts.GasPrice = higher(price, bump(tx.GasPrice()))
+		return nil
+	}
+
+	tip, err := o.client.SuggestGasTipCap(ctx)
+	if err != nil {
+		return err
+	}
+	head, err := o.client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// What bind would offer for a new transaction.
+	feeCap := new(big.Int).Set(tip)
+	if head.BaseFee != nil {
+		feeCap.Add(feeCap, new(big.Int).Mul(head.BaseFee, big.NewInt(2)))
+	}
+	opts.GasTipCap = higher(tip, bump(tx.GasTipCap()))
+	opts.GasFeeCap = higher(higher(feeCap, bump(tx.GasFeeCap())), opts.GasTipCap)
+	return nil
+}
+
+// callContract runs a view method of the contract at to and returns its
+// outputs.
+func callContract(ctx context.Context, client ethereum.ContractCaller, to common.Address, contractAbi abi.ABI, method string, args ...interface{}) ([]interface{}, error) {
+	input, err := contractAbi.Pack(method, args...)
+	if err != nil {
+		return nil, err
+	}
+	out, err := client.CallContract(ctx, ethereum.CallMsg{To: &to, Data: input}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return contractAbi.Unpack(method, out)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// poolFake is a chain with a transaction pool for one account. It replaces a
+// pending transaction only for one paying at least 10% more, like geth, and
+// mines when told to, or on every send with autoMine.
+type poolFake struct {
+	// Unused methods panic.
+	bind.ContractBackend
+
+	mu       sync.Mutex
+	pending  map[uint64]*types.Transaction
+	sent     []*types.Transaction
+	receipts map[common.Hash]*types.Receipt
+	mined    uint64
+	autoMine bool
+}
+
+func newPoolFake() *poolFake {
+	return &poolFake{
+		pending:  make(map[uint64]*types.Transaction),
+		receipts: make(map[common.Hash]*types.Receipt),
+	}
+}
+
+func (f *poolFake) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	return 50_000, nil
+}
+
+func (f *poolFake) SuggestGasTipCap(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(1e9), nil
+}
+
+func (f *poolFake) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(2e9), nil
+}
+
+func (f *poolFake) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return &types.Header{BaseFee: big.NewInt(1e9)}, nil
+}
+
+func (f *poolFake) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.mined + uint64(len(f.pending)), nil
+}
+
+func (f *poolFake) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.mined, nil
+}
+
+func (f *poolFake) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if tx.Nonce() < f.mined {
+		return errors.New("nonce too low")
+	}
+	if old, ok := f.pending[tx.Nonce()]; ok {
+		least := func(v *big.Int) *big.Int {
+			return new(big.Int).Quo(new(big.Int).Mul(v, big.NewInt(110)), big.NewInt(100))
+		}
+		if tx.GasTipCap().Cmp(least(old.GasTipCap())) < 0 || tx.GasFeeCap().Cmp(least(old.GasFeeCap())) < 0 {
+			return errors.New("replacement transaction underpriced")
+		}
+	}
+	f.pending[tx.Nonce()] = tx
+	f.sent = append(f.sent, tx)
+	if f.autoMine {
+		f.mineLocked()
+	}
+	return nil
+}
+
+func (f *poolFake) TransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r, ok := f.receipts[hash]; ok {
+		return r, nil
+	}
+	return nil, ethereum.NotFound
+}
+
+func (f *poolFake) mine() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mineLocked()
+}
+
+func (f *poolFake) mineLocked() {
+	for {
+		tx, ok := f.pending[f.mined]
+		if !ok {
+			return
+		}
+		delete(f.pending, f.mined)
+		f.receipts[tx.Hash()] = &types.Receipt{Status: types.ReceiptStatusSuccessful, TxHash: tx.Hash()}
+		f.mined++
+	}
+}
+
+func newTestOperator(t *testing.T, client chainClient) *operator {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &operator{
+		log:            slog.New(slog.NewTextHandler(io.Discard, nil)),
+		client:         client,
+		key:            &keystore.Key{Address: crypto.PubkeyToAddress(key.PublicKey), PrivateKey: key},
+		chainID:        big.NewInt(1337),
+		receiptTimeout: 50 * time.Millisecond,
+	}
+}
+
+func TestOperatorResendsStuck(t *testing.T) {
+	ctx := context.Background()
+	chain := newPoolFake()
+	op := newTestOperator(t, chain)
+	to := common.HexToAddress("0xc0")
+
+	if _, err := op.transact(ctx, to, []byte{1}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("first transaction: %v, want a timeout", err)
+	}
+	chain.autoMine = true
+	if _, err := op.transact(ctx, to, []byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	if len(chain.sent) != 3 {
+		t.Fatalf("sent %d transactions, want 3", len(chain.sent))
+	}
+	stuck, resent, next := chain.sent[0], chain.sent[1], chain.sent[2]
+	if resent.Nonce() != stuck.Nonce() || !bytes.Equal(resent.Data(), stuck.Data()) || *resent.To() != *stuck.To() || resent.Gas() != stuck.Gas() {
+		t.Errorf("resent nonce %d, calldata %x to %s with gas %d; want %d, %x to %s with gas %d",
+			resent.Nonce(), resent.Data(), resent.To(), resent.Gas(), stuck.Nonce(), stuck.Data(), stuck.To(), stuck.Gas())
+	}
+	if resent.GasTipCap().Cmp(stuck.GasTipCap()) <= 0 || resent.GasFeeCap().Cmp(stuck.GasFeeCap()) <= 0 {
+		t.Errorf("resent fees %v/%v, not above %v/%v",
+			resent.GasTipCap(), resent.GasFeeCap(), stuck.GasTipCap(), stuck.GasFeeCap())
+	}
+	if next.Nonce() != stuck.Nonce()+1 || !bytes.Equal(next.Data(), []byte{2}) {
+		t.Errorf("then sent %x at nonce %d, want 02 at %d", next.Data(), next.Nonce(), stuck.Nonce()+1)
+	}
+	if next.GasTipCap().Cmp(stuck.GasTipCap()) != 0 {
+		t.Errorf("fees were bumped for the transaction after the stuck one")
+	}
+	if chain.mined != 2 {
+		t.Errorf("mined %d transactions, want 2", chain.mined)
+	}
+}
+
+func TestOperatorStaysStuck(t *testing.T) {
+	ctx := context.Background()
+	chain := newPoolFake()
+	op := newTestOperator(t, chain)
+	to := common.HexToAddress("0xc0")
+
+	if _, err := op.transact(ctx, to, []byte{1}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("first transaction: %v, want a timeout", err)
+	}
+	// Still not mined after resending it, so what comes next waits.
+	if _, err := op.transact(ctx, to, []byte{2}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("second transaction: %v, want a timeout resending the first", err)
+	}
+	for i, tx := range chain.sent {
+		if !bytes.Equal(tx.Data(), []byte{1}) {
+			t.Errorf("sent %x as transaction %d while the first is stuck", tx.Data(), i)
+		}
+	}
+
+	chain.autoMine = true
+	if _, err := op.transact(ctx, to, []byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	if chain.mined != 2 {
+		t.Errorf("mined %d transactions, want 2", chain.mined)
+	}
+}
+
+func TestOperatorStuckMinedLater(t *testing.T) {
+	ctx := context.Background()
+	chain := newPoolFake()
+	op := newTestOperator(t, chain)
+	to := common.HexToAddress("0xc0")
+
+	if _, err := op.transact(ctx, to, []byte{1}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("first transaction: %v, want a timeout", err)
+	}
+	chain.mine()
+	chain.autoMine = true
+	if _, err := op.transact(ctx, to, []byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	if n := chain.sent[1].Nonce(); n != chain.sent[0].Nonce()+1 {
+		t.Errorf("nonce after the stuck transaction was mined %d, want %d", n, chain.sent[0].Nonce()+1)
+	}
+	if chain.sent[1].GasTipCap().Cmp(chain.sent[0].GasTipCap()) != 0 {
+		t.Errorf("fees were bumped for a transaction that replaced nothing")
+	}
+}
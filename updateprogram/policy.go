@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+
+	"example.com/v2/policy"
+)
+
+// rules turns the policy config into the policy the node checks votes with.
+func (p *PolicyConfig) rules() *policy.Rules {
+	r := &policy.Rules{
+		RequireSupport: p.RequireSupport,
+		MinWeight:      p.MinWeight,
+		MaxProgramSize: p.MaxProgramSize,
+	}
+	for _, a := range p.AllowedVoters {
+		r.AllowedVoters = append(r.AllowedVoters, common.HexToAddress(a))
+	}
+	return r
+}
@@ -0,0 +1,22 @@
+package policy
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Fake is a Policy for tests. It refuses with the errors it is given, and
+// allows everything if they are nil.
+type Fake struct {
+	VoteErr error
+	SizeErr error
+}
+
+func (f *Fake) CheckVote(common.Address, uint8, *big.Int) error {
+	return f.VoteErr
+}
+
+func (f *Fake) CheckSize(int64) error {
+	return f.SizeErr
+}
@@ -0,0 +1,63 @@
+// Package policy decides which votes a node acts on.
+package policy
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Policy decides which votes may upgrade the program, and how large a
+// program may be.
+type Policy interface {
+	// CheckVote returns why a vote is not allowed to upgrade the program, or
+	// nil if it is.
+	CheckVote(voter common.Address, support uint8, weight *big.Int) error
+	// CheckSize returns an error if a program of size bytes is too large.
+	CheckSize(size int64) error
+}
+
+// Rules is the Policy nodes are configured with.
+type Rules struct {
+	// Only votes cast by these addresses are acted on. Empty allows everyone.
+	AllowedVoters []common.Address
+	// Votes must be in favour of the proposal (support == 1).
+	RequireSupport bool
+	// Minimum voting weight a vote needs.
+	MinWeight uint64
+	// Largest program in bytes. 0 means no limit.
+	MaxProgramSize int64
+}
+
+func (r *Rules) CheckVote(voter common.Address, support uint8, weight *big.Int) error {
+	if len(r.AllowedVoters) > 0 {
+		allowed := false
+		for _, a := range r.AllowedVoters {
+			if a == voter {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("voter %s is not allowed", voter.Hex())
+		}
+	}
+
+	if r.RequireSupport && support != 1 {
+		return fmt.Errorf("vote does not support the proposal (support %d)", support)
+	}
+
+	if r.MinWeight > 0 && (weight == nil || weight.Cmp(new(big.Int).SetUint64(r.MinWeight)) < 0) {
+		return fmt.Errorf("vote weight %v is below %d", weight, r.MinWeight)
+	}
+
+	return nil
+}
+
+func (r *Rules) CheckSize(size int64) error {
+	if r.MaxProgramSize > 0 && size > r.MaxProgramSize {
+		return fmt.Errorf("program is %d bytes, limit is %d", size, r.MaxProgramSize)
+	}
+	return nil
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"golang.org/x/time/rate"
+
+	"example.com/v2/governance"
+)
+
+// PrefetchConfig controls fetching the programs proposals name while they
+// are still being voted on, so the fleet has them by the time a vote counts.
+// What is fetched comes from the votes' params, where upgrades read their
+// manifest from, of any voter.
+type PrefetchConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Bytes per second to prefetch at, on top of limits.fetch_rate. 0
+	// means no limit of its own.
+	Rate int64 `yaml:"rate"`
+	// Most bytes fetched ahead for one proposal. Unlike
+	// policy.max_program_size it can't be unlimited: anyone can propose.
+	MaxSize int64 `yaml:"max_size"`
+	// Only proposals by these accounts are prefetched. Empty prefetches
+	// anyone's, up to max_size.
+	Proposers []string `yaml:"proposers"`
+}
+
+func (cfg *Config) validatePrefetch(bad func(field, format string, args ...interface{})) {
+	if cfg.Prefetch.Rate < 0 {
+		bad("prefetch.rate", "must not be negative")
+	}
+	if cfg.Prefetch.MaxSize <= 0 {
+		bad("prefetch.max_size", "must be positive")
+	}
+	for _, a := range cfg.Prefetch.Proposers {
+		if !common.IsHexAddress(a) {
+			bad("prefetch.proposers", "%q is not an address", a)
+		}
+	}
+}
+
+// How far along a proposal's prefetch is.
+type prefetchState string
+
+const (
+	prefetchFetching prefetchState = "fetching"
+	prefetchReady    prefetchState = "ready"
+	prefetchFailed   prefetchState = "failed"
+	// The proposal executed, so its blocks stay.
+	prefetchKept prefetchState = "kept"
+	// The proposal failed, so its blocks were deleted.
+	prefetchDropped prefetchState = "dropped"
+)
+
+const prefetchAttempts = 3
+
+// proposalPrefetch is what a node fetched ahead for a proposal.
+type proposalPrefetch struct {
+	state prefetchState
+	// The DAGs fetched: programs, patches and inputs.
+	cids  []string
+	bytes int64
+	err   string
+	// Failed prefetches are retried on the next polls, up to
+	// prefetchAttempts times.
+	attempts int
+	// Every block fetched, until the outcome says whether to keep them.
+	blocks map[cid.Cid]struct{}
+}
+
+// prefetchProposals follows the proposals until ctx is done. It fetches
+// what the programs voted for in live proposals need, one proposal at a
+// time, and keeps the blocks once a proposal executes or deletes them once
+// it is defeated, canceled or expired.
+func (n *node) prefetchProposals(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(n.cfg.Chain.PollInterval))
+	defer ticker.Stop()
+	limiter := byteRate(n.cfg.Prefetch.Rate)
+
+	for {
+		for _, p := range n.proposals.Proposals(governance.Query{}) {
+			if ctx.Err() != nil {
+				return
+			}
+			n.prefetchProposal(ctx, p, limiter)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (n *node) prefetchProposal(ctx context.Context, p *governance.Proposal, limiter *rate.Limiter) {
+	id := p.ID.String()
+	var pf *proposalPrefetch
+	n.status.update(func(s *nodeStatus) { pf = s.prefetches[id] })
+
+	switch p.State {
+	case governance.Pending, governance.Active, governance.Succeeded, governance.Queued:
+	case governance.Executed:
+		if pf != nil && pf.state != prefetchKept && pf.state != prefetchDropped {
+			n.status.update(func(s *nodeStatus) { pf.state, pf.blocks = prefetchKept, nil })
+		}
+		return
+	default:
+		switch {
+		case pf == nil:
+			// Fetched before a restart, if at all.
+			n.collectPrefetch(ctx, p)
+		case pf.state != prefetchKept && pf.state != prefetchDropped:
+			n.dropPrefetch(ctx, id, pf)
+		}
+		return
+	}
+
+	if err := n.checkProposal(p); err != nil {
+		return
+	}
+	var cids []string
+	for _, m := range votedManifests(p) {
+		for _, c := range n.prefetchCIDs(m) {
+			if !slices.Contains(cids, c) {
+				cids = append(cids, c)
+			}
+		}
+	}
+	switch {
+	case len(cids) == 0:
+		return
+	case pf == nil:
+		pf = &proposalPrefetch{blocks: map[cid.Cid]struct{}{}}
+	case pf.state == prefetchFailed && pf.attempts >= prefetchAttempts:
+		return
+	case pf.state != prefetchFailed && !newCIDs(pf.cids, cids):
+		// Votes for programs not seen before start it again.
+		return
+	}
+	n.status.update(func(s *nodeStatus) {
+		pf.state, pf.err, pf.bytes = prefetchFetching, "", 0
+		pf.cids = cids
+		pf.attempts++
+		s.prefetches[id] = pf
+	})
+	n.log.fetch.Info("prefetching proposal", "proposal", id, "cids", cids)
+
+	start := time.Now()
+	var err error
+	for _, c := range cids {
+		fetchCtx, cancel := context.WithTimeout(ctx, time.Duration(n.cfg.Policy.FetchTimeout))
+		err = merkledag.Walk(fetchCtx, n.prefetchLinks(pf, limiter), cid.MustParse(c), cid.NewSet().Visit)
+		cancel()
+		if err != nil {
+			err = fmt.Errorf("%s: %w", c, err)
+			break
+		}
+	}
+
+	n.status.update(func(s *nodeStatus) {
+		if err != nil {
+			pf.state, pf.err = prefetchFailed, err.Error()
+		} else {
+			pf.state = prefetchReady
+		}
+	})
+	if err != nil {
+		n.log.fetch.Warn("failed to prefetch proposal", "proposal", id, "err", err)
+		return
+	}
+	n.log.fetch.Info("prefetched proposal", "proposal", id, "bytes", pf.bytes, "took", time.Since(start))
+}
+
+// checkProposal errors unless p is one to prefetch for: the node saw it
+// created, by one of prefetch.proposers if there are any, and all it does
+// is call the DAO, the way program proposals do.
+func (n *node) checkProposal(p *governance.Proposal) error {
+	if p.CreatedBlock == 0 {
+		return fmt.Errorf("created before the first block read")
+	}
+	if len(n.cfg.Prefetch.Proposers) > 0 && !slices.ContainsFunc(n.cfg.Prefetch.Proposers, func(a string) bool {
+		return common.HexToAddress(a) == p.Proposer
+	}) {
+		return fmt.Errorf("proposer %s isn't in prefetch.proposers", p.Proposer)
+	}
+	dao := common.HexToAddress(n.cfg.Chain.ContractAddress)
+	if len(p.Targets) == 0 || slices.ContainsFunc(p.Targets, func(a common.Address) bool { return a != dao }) {
+		return fmt.Errorf("targets %v aren't the DAO", p.Targets)
+	}
+	return nil
+}
+
+// votedManifests are the manifests in the params of p's votes, which is what
+// a node upgrades to once a vote its policy allows comes in.
+func votedManifests(p *governance.Proposal) []*Manifest {
+	var manifests []*Manifest
+	for _, v := range p.Votes {
+		if len(v.Params) == 0 {
+			continue
+		}
+		m, err := parseManifest(v.Params)
+		if err != nil {
+			continue
+		}
+		m.proposal = p.ID
+		manifests = append(manifests, m)
+	}
+	return manifests
+}
+
+// newCIDs reports whether cids has any not in had.
+func newCIDs(had, cids []string) bool {
+	for _, c := range cids {
+		if !slices.Contains(had, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefetchCIDs lists what the node would fetch for m once it is voted for,
+// leaving out what it already has. Seeds pin all of it.
+func (n *node) prefetchCIDs(m *Manifest) []string {
+	if n.pins != nil {
+		return manifestCIDs(m)
+	}
+	var cids []string
+	switch {
+	case m.runtime() == runtimeOCI:
+		if _, err := os.Stat(filepath.Join(n.cfg.imageDir(m.CID), "config.json")); err != nil {
+			cids = append(cids, m.CID)
+		}
+	case n.hasProgram(m.CID):
+	case m.Delta != nil && n.hasProgram(m.Delta.Base):
+		cids = append(cids, m.Delta.Patch)
+	default:
+		cids = append(cids, m.CID)
+	}
+	// Claimed shards are only known once claimed.
+	if len(m.Shards) > 0 && m.ShardAssignment != shardByClaim {
+		cids = append(cids, m.Shards[hashShard(n.id, m.proposal, len(m.Shards))].Input)
+	}
+	return cids
+}
+
+func (n *node) hasProgram(c string) bool {
+	_, err := n.state.Program(c)
+	return err == nil
+}
+
+// manifestCIDs is every CID m names.
+func manifestCIDs(m *Manifest) []string {
+	cids := []string{m.CID}
+	if m.Delta != nil {
+		cids = append(cids, m.Delta.Patch)
+	}
+	for _, s := range m.Shards {
+		cids = append(cids, s.Input)
+	}
+	return cids
+}
+
+// prefetchLinks fetches blocks for a walk of pf's DAGs at low priority: one
+// at a time, at the prefetch rate, and not while the node is fetching
+// something it needs now.
+func (n *node) prefetchLinks(pf *proposalPrefetch, limiter *rate.Limiter) merkledag.GetLinks {
+	return func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+		for n.fetching.Load() > 0 {
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		nd, err := n.dag.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		size := len(nd.RawData())
+		waitBytes(limiter, size)
+		n.metrics.fetchBytes.Add(float64(size))
+
+		var total int64
+		n.status.update(func(s *nodeStatus) {
+			pf.bytes += int64(size)
+			pf.blocks[c] = struct{}{}
+			total = pf.bytes
+		})
+		if total > n.cfg.Prefetch.MaxSize {
+			return nil, fmt.Errorf("over prefetch.max_size of %d bytes", n.cfg.Prefetch.MaxSize)
+		}
+		if err := n.policy.CheckSize(total); err != nil {
+			return nil, err
+		}
+		return nd.Links(), nil
+	}
+}
+
+// dropPrefetch deletes the blocks fetched for proposal id, except those that
+// something the node keeps shares: the workloads' programs, pins and other
+// proposals' prefetches.
+func (n *node) dropPrefetch(ctx context.Context, id string, pf *proposalPrefetch) {
+	keep := map[cid.Cid]struct{}{}
+	var roots []string
+	n.status.update(func(s *nodeStatus) {
+		for _, w := range s.workloads {
+			for _, m := range []*Manifest{w.manifest, w.previous, w.pending} {
+				if m != nil {
+					roots = append(roots, manifestCIDs(m)...)
+				}
+			}
+			if w.scheduled != nil {
+				roots = append(roots, manifestCIDs(w.scheduled.manifest)...)
+			}
+		}
+		for other, o := range s.prefetches {
+			if other == id || o.state == prefetchDropped {
+				continue
+			}
+			for c := range o.blocks {
+				keep[c] = struct{}{}
+			}
+			roots = append(roots, o.cids...)
+		}
+	})
+	if n.pins != nil {
+		for _, p := range n.pins.List() {
+			roots = append(roots, p.CID)
+		}
+	}
+
+	for _, root := range roots {
+		c, err := cid.Parse(root)
+		if err != nil {
+			continue
+		}
+		err = merkledag.Walk(ctx, n.localLinks(), c, func(c cid.Cid) bool {
+			if _, ok := keep[c]; ok {
+				return false
+			}
+			keep[c] = struct{}{}
+			return true
+		})
+		if err != nil {
+			n.log.fetch.Warn("failed to walk kept blocks, keeping the proposal's", "proposal", id, "cid", root, "err", err)
+			return
+		}
+	}
+
+	var blocks []cid.Cid
+	n.status.update(func(s *nodeStatus) {
+		for c := range pf.blocks {
+			if _, ok := keep[c]; !ok {
+				blocks = append(blocks, c)
+			}
+		}
+	})
+	var errs []error
+	for _, c := range blocks {
+		if err := n.bstore.DeleteBlock(ctx, c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		n.log.fetch.Warn("failed to delete prefetched blocks", "proposal", id, "err", err)
+	}
+	n.status.update(func(s *nodeStatus) { pf.state, pf.blocks = prefetchDropped, nil })
+	n.log.fetch.Info("dropped prefetched proposal", "proposal", id, "blocks", len(blocks))
+}
+
+// collectPrefetch drops what was fetched for the dead proposal p before the
+// node last started, going by which of its blocks are in the blockstore.
+func (n *node) collectPrefetch(ctx context.Context, p *governance.Proposal) {
+	pf := &proposalPrefetch{blocks: map[cid.Cid]struct{}{}}
+	for _, m := range votedManifests(p) {
+		for _, c := range manifestCIDs(m) {
+			if !slices.Contains(pf.cids, c) {
+				pf.cids = append(pf.cids, c)
+			}
+		}
+	}
+	if len(pf.cids) == 0 {
+		return
+	}
+
+	for _, root := range pf.cids {
+		err := merkledag.Walk(ctx, n.localLinks(), cid.MustParse(root), func(c cid.Cid) bool {
+			if has, _ := n.bstore.Has(ctx, c); !has {
+				return false
+			}
+			if _, ok := pf.blocks[c]; ok {
+				return false
+			}
+			pf.blocks[c] = struct{}{}
+			return true
+		})
+		if err != nil {
+			n.log.fetch.Warn("failed to walk blocks of a dead proposal, keeping them", "proposal", p.ID, "cid", root, "err", err)
+			pf.blocks = nil
+			break
+		}
+	}
+	// Remembered either way, so the blockstore is only walked once.
+	n.status.update(func(s *nodeStatus) {
+		pf.state = prefetchDropped
+		s.prefetches[p.ID.String()] = pf
+	})
+	if len(pf.blocks) > 0 {
+		n.dropPrefetch(ctx, p.ID.String(), pf)
+	}
+}
+
+// localLinks walks DAGs as far as they are in the blockstore, fetching
+// nothing.
+func (n *node) localLinks() merkledag.GetLinks {
+	local := merkledag.NewDAGService(blockservice.New(n.bstore, nil))
+	return func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+		nd, err := local.Get(ctx, c)
+		if ipld.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nd.Links(), nil
+	}
+}
+
+// prefetchedProposals are the IDs of the proposals whose programs the node
+// has ready. Call with the status locked.
+func (s *nodeStatus) prefetchedProposals() []string {
+	var ids []string
+	for _, id := range sortedNames(s.prefetches) {
+		if st := s.prefetches[id].state; st == prefetchReady || st == prefetchKept {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+type prefetchReport struct {
+	State prefetchState `json:"state"`
+	CIDs  []string      `json:"cids"`
+	Bytes int64         `json:"bytes"`
+	Error string        `json:"error,omitempty"`
+
+	Fleet *fleetReadiness `json:"fleet,omitempty"`
+}
+
+// reportPrefetch describes this node's prefetch for proposal id and how many
+// of the live nodes have it ready, or returns nil if nothing was prefetched
+// for it.
+func (api *apiServer) reportPrefetch(id *big.Int) *prefetchReport {
+	var r *prefetchReport
+	api.status.update(func(s *nodeStatus) {
+		if pf := s.prefetches[id.String()]; pf != nil {
+			r = &prefetchReport{State: pf.state, CIDs: pf.cids, Bytes: pf.bytes, Error: pf.err}
+		}
+	})
+	if r != nil && api.fleet != nil {
+		r.Fleet = api.fleet.prefetchReadiness(id.String())
+	}
+	return r
+}
+
+// prefetchReadiness counts the live nodes that have what proposal id needs
+// ready, going by their heartbeats.
+func (f *fleet) prefetchReadiness(id string) *fleetReadiness {
+	r := &fleetReadiness{NotReady: []string{}}
+	for _, n := range f.Live() {
+		r.Nodes++
+		if slices.Contains(n.Prefetched, id) {
+			r.Ready++
+		} else {
+			r.NotReady = append(r.NotReady, n.PeerID.String())
+		}
+	}
+	return r
+}
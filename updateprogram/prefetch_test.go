@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+
+	"example.com/v2/chain"
+	"example.com/v2/governance"
+)
+
+// copyExchange serves blocks from another blockstore, as bitswap would from
+// a peer, storing them in the node's.
+type copyExchange struct {
+	from, to blockstore.Blockstore
+}
+
+func (e copyExchange) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	b, err := e.from.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return b, e.to.Put(ctx, b)
+}
+
+func (e copyExchange) GetBlocks(ctx context.Context, cids []cid.Cid) (<-chan blocks.Block, error) {
+	out := make(chan blocks.Block, len(cids))
+	for _, c := range cids {
+		if b, err := e.GetBlock(ctx, c); err == nil {
+			out <- b
+		}
+	}
+	close(out)
+	return out, nil
+}
+
+func (e copyExchange) NotifyNewBlocks(context.Context, ...blocks.Block) error { return nil }
+func (e copyExchange) Close() error                                           { return nil }
+
+// prefetchFixture is a node that prefetches from network, with helpers to
+// publish programs there and propose them.
+type prefetchFixture struct {
+	*fakeNode
+	network blockstore.Blockstore
+	dao     common.Address
+}
+
+func newPrefetchFixture(t *testing.T) *prefetchFixture {
+	fn := newFakeNode(t, nil, nil, nil)
+	fn.cfg.Prefetch.MaxSize = 1 << 20
+	fn.cfg.Chain.ContractAddress = "0x00000000000000000000000000000000000000da"
+	network := blockstore.NewBlockstore(dsync.MutexWrap(datastore.NewMapDatastore()))
+	fn.dag = merkledag.NewDAGService(blockservice.New(fn.bstore, copyExchange{network, fn.bstore}))
+	return &prefetchFixture{fakeNode: fn, network: network, dao: common.HexToAddress(fn.cfg.Chain.ContractAddress)}
+}
+
+func (f *prefetchFixture) publish(t *testing.T, data []byte) cid.Cid {
+	t.Helper()
+	c, err := importFile(merkledag.NewDAGService(blockservice.New(f.network, nil)), data, publishChunker, merkledag.V0CidPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// proposal is an active proposal to the DAO for c, with a vote carrying
+// the manifest for each of voted.
+func (f *prefetchFixture) proposal(id int64, c cid.Cid, voted ...cid.Cid) *governance.Proposal {
+	p := &governance.Proposal{
+		ID:           big.NewInt(id),
+		Proposer:     common.HexToAddress("0x02"),
+		Targets:      []common.Address{f.dao},
+		Calldatas:    [][]byte{[]byte(c.String())},
+		State:        governance.Active,
+		CreatedBlock: 1,
+	}
+	for _, v := range voted {
+		p.Votes = append(p.Votes, &chain.Vote{Voter: common.HexToAddress("0x01"), Support: 1, Weight: big.NewInt(1), Params: []byte(v.String())})
+	}
+	return p
+}
+
+func (f *prefetchFixture) prefetch(id int64) *proposalPrefetch {
+	var pf *proposalPrefetch
+	f.status.update(func(s *nodeStatus) { pf = s.prefetches[big.NewInt(id).String()] })
+	return pf
+}
+
+func TestPrefetchProposal(t *testing.T) {
+	f := newPrefetchFixture(t)
+	ctx := context.Background()
+	small := f.publish(t, bytes.Repeat([]byte("small program "), 1000))
+
+	// Calldata alone isn't what nodes upgrade to, so nothing is fetched for
+	// it.
+	f.prefetchProposal(ctx, f.proposal(1, small), nil)
+	if pf := f.prefetch(1); pf != nil {
+		t.Fatalf("prefetched a proposal without a vote for a program: %+v", pf)
+	}
+
+	// Any voter's params count, whatever the policy makes of the vote.
+	f.policy.VoteErr = errors.New("voter not allowed")
+	f.prefetchProposal(ctx, f.proposal(1, small, small), nil)
+	if pf := f.prefetch(1); pf == nil || pf.state != prefetchReady {
+		t.Fatalf("prefetch %+v, want ready", pf)
+	}
+	if has, _ := f.bstore.Has(ctx, small); !has {
+		t.Error("prefetched program isn't in the blockstore")
+	}
+
+	// A vote for another program starts it again.
+	other := f.publish(t, bytes.Repeat([]byte("other program "), 1000))
+	f.prefetchProposal(ctx, f.proposal(1, small, small, other), nil)
+	if pf := f.prefetch(1); pf.state != prefetchReady || len(pf.cids) != 2 {
+		t.Fatalf("prefetch %+v, want both programs ready", pf)
+	}
+
+	// Nor past prefetch.max_size, whatever the policy's limit.
+	large := f.publish(t, bytes.Repeat([]byte("large program "), 200000))
+	f.prefetchProposal(ctx, f.proposal(2, large, large), nil)
+	if pf := f.prefetch(2); pf == nil || pf.state != prefetchFailed || !strings.Contains(pf.err, "max_size") {
+		t.Fatalf("prefetch %+v, want failed over max_size", pf)
+	}
+	if pf := f.prefetch(2); pf.bytes > f.cfg.Prefetch.MaxSize+1<<18 {
+		t.Errorf("fetched %d bytes past max_size", pf.bytes)
+	}
+}
+
+func TestPrefetchChecksProposal(t *testing.T) {
+	f := newPrefetchFixture(t)
+	c := f.publish(t, []byte("program"))
+
+	tests := []struct {
+		name   string
+		change func(p *governance.Proposal)
+	}{
+		{"not seen created", func(p *governance.Proposal) { p.CreatedBlock = 0 }},
+		{"no targets", func(p *governance.Proposal) { p.Targets = nil }},
+		{"calls another contract", func(p *governance.Proposal) { p.Targets = append(p.Targets, common.HexToAddress("0x03")) }},
+		{"proposer not listed", func(p *governance.Proposal) {
+			f.cfg.Prefetch.Proposers = []string{"0x0000000000000000000000000000000000000004"}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f.cfg.Prefetch.Proposers = nil
+			p := f.proposal(1, c, c)
+			if err := f.checkProposal(p); err != nil {
+				t.Fatalf("proposal refused before the change: %v", err)
+			}
+			tt.change(p)
+			if err := f.checkProposal(p); err == nil {
+				t.Error("proposal allowed")
+			}
+		})
+	}
+}
+
+// Blocks prefetched before a restart are deleted once the proposal is
+// defeated, though the node no longer remembers fetching them.
+func TestPrefetchDroppedAfterRestart(t *testing.T) {
+	f := newPrefetchFixture(t)
+	ctx := context.Background()
+	c := f.publish(t, bytes.Repeat([]byte("program "), 1000))
+	f.prefetchProposal(ctx, f.proposal(1, c, c), nil)
+	if pf := f.prefetch(1); pf == nil || pf.state != prefetchReady {
+		t.Fatalf("prefetch %+v, want ready", pf)
+	}
+
+	f.status.update(func(s *nodeStatus) { delete(s.prefetches, "1") })
+	p := f.proposal(1, c, c)
+	p.State = governance.Defeated
+	f.prefetchProposal(ctx, p, nil)
+
+	if has, _ := f.bstore.Has(ctx, c); has {
+		t.Error("the defeated proposal's program is still in the blockstore")
+	}
+	if pf := f.prefetch(1); pf == nil || pf.state != prefetchDropped {
+		t.Errorf("prefetch %+v, want dropped", pf)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	chunker "github.com/ipfs/boxo/chunker"
+	"github.com/ipfs/boxo/ipld/unixfs/importer"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+
+	"example.com/v2/age"
+)
+
+const programLogName = "program.log"
+
+// ProgramLogsConfig controls the files the program's output is kept in.
+type ProgramLogsConfig struct {
+	// Size in bytes at which program.log is rotated.
+	MaxSize int64 `yaml:"max_size"`
+	// Rotated files to keep next to program.log.
+	MaxFiles int `yaml:"max_files"`
+	// Add a gzipped tarball of the logs to the blockstore when the program
+	// exits, so others can fetch it over bitswap.
+	Publish bool `yaml:"publish"`
+}
+
+// programLogDir is where the logs of the program with the given CID live.
+func (cfg *Config) programLogDir(c string) string {
+	return cfg.statePath(filepath.Join("logs", c))
+}
+
+// rotatingFile is an io.Writer over dir/program.log that moves the file to
+// program.log.1, .2, ... once it grows past maxSize.
+type rotatingFile struct {
+	mu       sync.Mutex
+	dir      string
+	maxSize  int64
+	maxFiles int
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(dir string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	r := &rotatingFile{dir: dir, maxSize: maxSize, maxFiles: maxFiles}
+	return r, r.open()
+}
+
+func (r *rotatingFile) path(n int) string {
+	if n == 0 {
+		return filepath.Join(r.dir, programLogName)
+	}
+	return filepath.Join(r.dir, fmt.Sprintf("%s.%d", programLogName, n))
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path(0), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(r.path(r.maxFiles))
+	for n := r.maxFiles - 1; n >= 0; n-- {
+		os.Rename(r.path(n), r.path(n+1))
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// lineWriter writes lines to w prefixed with a timestamp and the stream name.
+type lineWriter struct {
+	w      io.Writer
+	stream string
+}
+
+func (l lineWriter) WriteLine(line string) {
+	fmt.Fprintf(l.w, "%s %s %s\n", time.Now().UTC().Format(time.RFC3339Nano), l.stream, line)
+}
+
+// logFiles returns the log files in dir, oldest first.
+func logFiles(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, programLogName+"*"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	// program.log.N is older the bigger N is, and program.log is the newest.
+	sort.Slice(paths, func(i, j int) bool {
+		return logAge(paths[i]) > logAge(paths[j])
+	})
+	return paths, nil
+}
+
+func logAge(path string) int {
+	var n int
+	fmt.Sscanf(strings.TrimPrefix(filepath.Base(path), programLogName), ".%d", &n)
+	return n
+}
+
+// tailLogs returns the last n lines logged in dir, reading back through the
+// rotated files as needed.
+func tailLogs(dir string, n int) ([]string, error) {
+	paths, err := logFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for i := len(paths) - 1; i >= 0 && len(lines) < n; i-- {
+		data, err := os.ReadFile(paths[i])
+		if err != nil {
+			return nil, err
+		}
+
+		var fileLines []string
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			fileLines = append(fileLines, scanner.Text())
+		}
+		lines = append(fileLines, lines...)
+	}
+
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
+
+// writeTarball writes a gzipped tarball of the named files under root to w.
+func writeTarball(w io.Writer, root string, names []string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		path := filepath.Join(root, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		hdr := &tar.Header{
+			Name:    filepath.ToSlash(name),
+			Mode:    int64(fi.Mode().Perm()),
+			Size:    int64(len(data)),
+			ModTime: fi.ModTime(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// publishTarball adds a tarball of the named files under root to dag as a
+// UnixFS file and returns its CID. With a recipient the tarball is encrypted
+// to it first.
+func publishTarball(dag ipld.DAGService, root string, names []string, to *age.Recipient) (cid.Cid, error) {
+	var buf bytes.Buffer
+	if err := writeTarball(&buf, root, names); err != nil {
+		return cid.Undef, err
+	}
+	var data io.Reader = &buf
+	if to != nil {
+		encrypted, err := age.Encrypt(buf.Bytes(), to)
+		if err != nil {
+			return cid.Undef, err
+		}
+		data = bytes.NewReader(encrypted)
+	}
+
+	nd, err := importer.BuildDagFromReader(dag, chunker.DefaultSplitter(data))
+	if err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+// publishLogs adds the log files in dir to dag, encrypted to to if set, and
+// returns the bundle's CID.
+func publishLogs(dag ipld.DAGService, dir string, to *age.Recipient) (cid.Cid, error) {
+	paths, err := logFiles(dir)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	names := make([]string, len(paths))
+	for i, path := range paths {
+		names[i] = filepath.Base(path)
+	}
+	return publishTarball(dag, dir, names, to)
+}
+
+// programOutputDir is where the program with the given CID can leave files
+// that make up its result. It is passed to the program as
+// UPDATEPROGRAM_OUTPUT_DIR.
+func (cfg *Config) programOutputDir(c string) string {
+	return cfg.statePath(filepath.Join("outputs", c))
+}
+
+// publishOutput adds everything the program left in dir to dag, encrypted to
+// to if set, and returns the bundle's CID, or cid.Undef if it left nothing.
+func publishOutput(dag ipld.DAGService, dir string, to *age.Recipient) (cid.Cid, error) {
+	var names []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			name, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil || len(names) == 0 {
+		return cid.Undef, err
+	}
+	return publishTarball(dag, dir, names, to)
+}
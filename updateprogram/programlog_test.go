@@ -0,0 +1,205 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	uio "github.com/ipfs/boxo/ipld/unixfs/io"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+
+	"example.com/v2/age"
+)
+
+// The log moves to program.log.1, .2, ... as it fills up, the oldest file
+// goes, and tailing reads back through the files in order.
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	r, err := openRotatingFile(dir, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(r, "line %02d of the program's output\n", i)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := logFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, path := range paths {
+		names = append(names, filepath.Base(path))
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > 100 {
+			t.Errorf("%s is %d bytes, over the limit", path, fi.Size())
+		}
+	}
+	if want := "program.log.2 program.log.1 program.log"; strings.Join(names, " ") != want {
+		t.Errorf("log files %v, want %s", names, want)
+	}
+
+	lines, err := tailLogs(dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 4 || lines[0] != "line 16 of the program's output" || lines[3] != "line 19 of the program's output" {
+		t.Errorf("last 4 lines %q", lines)
+	}
+	// Asking for more than is kept gives what is left, in order.
+	lines, err = tailLogs(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range lines {
+		if want := fmt.Sprintf("line %02d of the program's output", 20-len(lines)+i); line != want {
+			t.Fatalf("line %d is %q, want %q", i, line, want)
+		}
+	}
+	if len(lines) >= 20 || len(lines) < 6 {
+		t.Errorf("kept %d lines", len(lines))
+	}
+
+	if _, err := tailLogs(t.TempDir(), 4); !os.IsNotExist(err) {
+		t.Errorf("tailing a dir without logs: %v", err)
+	}
+}
+
+// readTarball reads back the files in the bundle at c, decrypting it with
+// identity if set.
+func readTarball(t *testing.T, dag ipld.DAGService, c cid.Cid, identity *age.Identity) map[string]string {
+	t.Helper()
+	ctx := context.Background()
+	nd, err := dag.Get(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := uio.NewDagReader(ctx, nd, dag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity != nil {
+		if data, err = age.Decrypt(data, identity); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		var content bytes.Buffer
+		if _, err := content.ReadFrom(tr); err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = content.String()
+	}
+	return files
+}
+
+func TestPublishLogs(t *testing.T) {
+	dir := t.TempDir()
+	r, err := openRotatingFile(dir, 20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(r, "first line\n")
+	io.WriteString(r, "second line\n")
+	r.Close()
+
+	dag := newMemoryDAG()
+	bundle, err := publishLogs(dag, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := readTarball(t, dag, bundle, nil)
+	if len(files) != 2 || files["program.log.1"] != "first line\n" || files["program.log"] != "second line\n" {
+		t.Errorf("bundle holds %q", files)
+	}
+
+	// Encrypted to the proposer, only they can read it.
+	scalar := make([]byte, 32)
+	rand.Read(scalar)
+	identity, err := age.NewIdentity(scalar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err = publishLogs(dag, dir, identity.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := readTarball(t, dag, bundle, identity); files["program.log"] != "second line\n" {
+		t.Errorf("encrypted bundle holds %q", files)
+	}
+
+	if _, err := publishLogs(dag, t.TempDir(), nil); !os.IsNotExist(err) {
+		t.Errorf("publishing a dir without logs: %v", err)
+	}
+}
+
+// A node keeps what its program writes, serves the tail of it, and
+// publishes it when the program exits if asked to.
+func TestProgramLogsPublishedOnExit(t *testing.T) {
+	fn := newFakeNode(t, nil, nil, nil)
+	fn.cfg.ProgramLogs.Publish = true
+	c := fn.fetcher.Add([]byte("#!/bin/sh\necho hello\n"))
+	fn.vote(1, c.String())
+	fn.chain.Mine()
+	fn.poll(context.Background(), 0)
+
+	p := fn.executor.Last()
+	if p == nil {
+		t.Fatal("program not started")
+	}
+	p.Exit(0)
+	var bundle string
+	waitFor(t, "the logs to be published", func() bool {
+		fn.status.update(func(s *nodeStatus) { bundle = s.logBundles[c.String()] })
+		return bundle != ""
+	})
+
+	api := &apiServer{cfg: fn.cfg, token: "secret"}
+	req := httptest.NewRequest("GET", "/logs/"+c.String()+"?lines=1", nil)
+	req.SetPathValue("cid", c.String())
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	api.handleLogTail(w, req)
+	if w.Code != http.StatusOK || !strings.HasSuffix(w.Body.String(), " stdout exiting with 0\n") {
+		t.Errorf("tail: %d %q", w.Code, w.Body)
+	}
+
+	files := readTarball(t, fn.dag, cid.MustParse(bundle), nil)
+	if !strings.Contains(files[programLogName], "exiting with 0") {
+		t.Errorf("published logs %q", files)
+	}
+}
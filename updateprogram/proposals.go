@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+
+	"example.com/v2/governance"
+)
+
+// manifestCID reads the program CID out of a proposal's calldata or a vote's
+// params, if they hold a manifest.
+func manifestCID(data []byte) (string, bool) {
+	m, err := parseManifest(data)
+	if err != nil {
+		return "", false
+	}
+	return m.CID, true
+}
+
+func newGovernanceTracker(cfg *Config, log *slog.Logger, client governance.Client) (*governance.Tracker, error) {
+	parsedAbi, err := abi.JSON(strings.NewReader(contractAbi))
+	if err != nil {
+		return nil, err
+	}
+	contract := common.HexToAddress(cfg.Chain.ContractAddress)
+	return governance.NewTracker(log, client, parsedAbi, contract, cfg.Chain.StartBlock, cfg.Chain.Confirmations, manifestCID), nil
+}
+
+// followGovernance keeps tracker up to date until ctx is done.
+func followGovernance(ctx context.Context, log *slog.Logger, tracker *governance.Tracker, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := tracker.Poll(ctx); err != nil {
+			log.Warn("failed to update proposals", "err", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// parseProposalQuery reads a query from a comma separated list of states, a
+// proposer address and a CID, any of which may be empty.
+func parseProposalQuery(states, proposer, cid string) (governance.Query, error) {
+	var q governance.Query
+	for _, name := range strings.FieldsFunc(states, func(r rune) bool { return r == ',' }) {
+		s, err := governance.ParseState(strings.ToLower(strings.TrimSpace(name)))
+		if err != nil {
+			return q, err
+		}
+		q.States = append(q.States, s)
+	}
+	if proposer != "" {
+		if !common.IsHexAddress(proposer) {
+			return q, fmt.Errorf("%q is not an address", proposer)
+		}
+		q.Proposer = common.HexToAddress(proposer)
+	}
+	q.CID = cid
+	return q, nil
+}
+
+type voteReport struct {
+	Voter   string        `json:"voter"`
+	Support uint8         `json:"support"`
+	Weight  string        `json:"weight"`
+	Reason  string        `json:"reason,omitempty"`
+	Params  hexutil.Bytes `json:"params,omitempty"`
+	Block   uint64        `json:"block"`
+	Tx      string        `json:"tx"`
+}
+
+type proposalReport struct {
+	ID          string          `json:"id"`
+	State       string          `json:"state"`
+	Proposer    string          `json:"proposer"`
+	Description string          `json:"description"`
+	Targets     []string        `json:"targets"`
+	Values      []string        `json:"values"`
+	Calldatas   []hexutil.Bytes `json:"calldatas"`
+	CIDs        []string        `json:"cids,omitempty"`
+
+	Snapshot uint64 `json:"snapshot"`
+	Deadline uint64 `json:"deadline"`
+	Quorum   string `json:"quorum,omitempty"`
+	For      string `json:"for"`
+	Against  string `json:"against"`
+	Abstain  string `json:"abstain"`
+
+	CreatedBlock  uint64 `json:"created_block"`
+	CreatedTx     string `json:"created_tx"`
+	QueuedBlock   uint64 `json:"queued_block,omitempty"`
+	ETA           uint64 `json:"eta,omitempty"`
+	ExecutedBlock uint64 `json:"executed_block,omitempty"`
+	CanceledBlock uint64 `json:"canceled_block,omitempty"`
+
+	Votes []voteReport `json:"votes"`
+
+	// What the node fetched ahead for the proposal, on the status API.
+	Prefetch *prefetchReport `json:"prefetch,omitempty"`
+}
+
+func reportProposal(p *governance.Proposal) proposalReport {
+	r := proposalReport{
+		ID:            p.ID.String(),
+		State:         p.State.String(),
+		Proposer:      p.Proposer.Hex(),
+		Description:   p.Description,
+		CIDs:          p.CIDs,
+		Snapshot:      p.Snapshot,
+		Deadline:      p.Deadline,
+		For:           p.For.String(),
+		Against:       p.Against.String(),
+		Abstain:       p.Abstain.String(),
+		CreatedBlock:  p.CreatedBlock,
+		CreatedTx:     p.CreatedTx.Hex(),
+		QueuedBlock:   p.QueuedBlock,
+		ETA:           p.ETA,
+		ExecutedBlock: p.ExecutedBlock,
+		CanceledBlock: p.CanceledBlock,
+		Votes:         make([]voteReport, 0, len(p.Votes)),
+	}
+	for _, t := range p.Targets {
+		r.Targets = append(r.Targets, t.Hex())
+	}
+	for _, v := range p.Values {
+		r.Values = append(r.Values, v.String())
+	}
+	for _, c := range p.Calldatas {
+		r.Calldatas = append(r.Calldatas, c)
+	}
+	if p.Quorum != nil {
+		r.Quorum = p.Quorum.String()
+	}
+	for _, v := range p.Votes {
+		r.Votes = append(r.Votes, voteReport{
+			Voter:   v.Voter.Hex(),
+			Support: v.Support,
+			Weight:  v.Weight.String(),
+			Reason:  v.Reason,
+			Params:  v.Params,
+			Block:   v.Block,
+			Tx:      v.TxHash.Hex(),
+		})
+	}
+	return r
+}
+
+// handleProposals lists the DAO's proposals, filtered by ?state= (comma
+// separated), ?proposer= and ?cid=.
+func (api *apiServer) handleProposals(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q, err := parseProposalQuery(query.Get("state"), query.Get("proposer"), query.Get("cid"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	proposals := make([]proposalReport, 0)
+	for _, p := range api.governance.Proposals(q) {
+		report := reportProposal(p)
+		report.Prefetch = api.reportPrefetch(p.ID)
+		proposals = append(proposals, report)
+	}
+	writeJSON(w, http.StatusOK, proposals)
+}
+
+func (api *apiServer) handleProposal(w http.ResponseWriter, r *http.Request) {
+	id, ok := new(big.Int).SetString(r.PathValue("id"), 0)
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("bad proposal ID %q", r.PathValue("id")))
+		return
+	}
+	p := api.governance.Proposal(id)
+	if p == nil {
+		writeError(w, http.StatusNotFound, errors.New("no such proposal"))
+		return
+	}
+	report := reportProposal(p)
+	report.Prefetch = api.reportPrefetch(p.ID)
+	writeJSON(w, http.StatusOK, report)
+}
+
+// proposalsCommand reads the proposals straight off the chain and lists the
+// ones that match the flags.
+func proposalsCommand(args []string) int {
+	var states, proposer, cid string
+	var asJSON bool
+	cfg, err := loadConfig("proposals", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&states, "state", "", "only list proposals in these states, comma separated")
+		fs.StringVar(&proposer, "proposer", "", "only list proposals by this address")
+		fs.StringVar(&cid, "cid", "", "only list proposals for this program CID")
+		fs.BoolVar(&asJSON, "json", false, "print the proposals as JSON")
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 2
+	}
+	q, err := parseProposalQuery(states, proposer, cid)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 2
+	}
+
+	ctx := context.Background()
+	client, err := ethclient.DialContext(ctx, cfg.Chain.RPCURL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	defer client.Close()
+
+	log := newLoggers(cfg.Log, os.Stderr, os.Stdout)
+	tracker, err := newGovernanceTracker(&cfg, log.chain, client)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if err := tracker.Poll(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	proposals := tracker.Proposals(q)
+
+	if asJSON {
+		reports := make([]proposalReport, 0, len(proposals))
+		for _, p := range proposals {
+			reports = append(reports, reportProposal(p))
+		}
+		out, _ := json.MarshalIndent(reports, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tPROPOSER\tFOR\tAGAINST\tABSTAIN\tQUORUM\tDEADLINE\tCIDS")
+	for _, p := range proposals {
+		quorum := "-"
+		if p.Quorum != nil {
+			quorum = p.Quorum.String()
+		}
+		cids := strings.Join(p.CIDs, ",")
+		if cids == "" {
+			cids = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			p.ID, p.State, p.Proposer.Hex(), p.For, p.Against, p.Abstain, quorum, p.Deadline, cids)
+	}
+	w.Flush()
+	fmt.Printf("as of block %d\n", tracker.Head())
+	return 0
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+
+	"example.com/v2/chain"
+	"example.com/v2/policy"
+)
+
+// Gossip topic nodes announce the programs they hold on.
+const providersTopic = "updateprogram/providers"
+
+const (
+	// How long a provider, or a vote transaction checked for one, is
+	// remembered.
+	providerTTL = time.Hour
+	// How long a vote transaction that failed the check is remembered, so
+	// announcements of it aren't checked again and again.
+	providerNegativeTTL = 10 * time.Minute
+	// Most receipts being fetched at once. Announcements beyond that are
+	// dropped.
+	maxReceiptChecks = 8
+)
+
+// errUnchecked is why an announcement that couldn't be checked against the
+// chain, as opposed to one found not to hold, is dropped.
+var errUnchecked = errors.New("can't check the vote")
+
+// errUnconfirmed is why an announcement of a vote without enough
+// confirmations yet is dropped. Unlike other outcomes it isn't remembered,
+// so the vote is checked again once it is deep enough.
+var errUnconfirmed = fmt.Errorf("%w: not confirmed yet", errUnchecked)
+
+// providerAnnouncement says the sender has fetched the program a vote asked
+// for and can serve its blocks.
+type providerAnnouncement struct {
+	CID        string `json:"cid"`
+	ProposalID string `json:"proposal_id"`
+	// Transaction of the vote, so receivers can check the claim on-chain.
+	VoteTx common.Hash `json:"vote_tx"`
+	Addrs  []string    `json:"addrs"`
+}
+
+// providerChain is what announcements are checked against.
+type providerChain struct {
+	client   receiptClient
+	abi      abi.ABI
+	contract common.Address
+	policy   policy.Policy
+	// Blocks a vote needs on top of it to count, as for the node's own
+	// chain.confirmations.
+	confirmations uint64
+}
+
+// receiptClient is the part of an ethclient.Client announcements are
+// checked with.
+type receiptClient interface {
+	TransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error)
+	BlockNumber(ctx context.Context) (uint64, error)
+}
+
+// checkedVote is what checking a vote transaction found.
+type checkedVote struct {
+	cid string
+	err error
+	at  time.Time
+}
+
+// providers learns which peers hold which programs from their announcements
+// and connects to them ahead of the vote reaching this node. Announcements
+// only ever make connections, never start a program.
+type providers struct {
+	h     host.Host
+	log   *slog.Logger
+	topic *pubsub.Topic
+
+	mu    sync.Mutex
+	chain *providerChain
+	// Providers by program CID, with when they were last announced.
+	byCID map[string]map[peer.ID]time.Time
+	// Vote transactions already checked, and the CID they voted for or
+	// why they don't count.
+	verified map[common.Hash]checkedVote
+	pruned   time.Time
+}
+
+func newProviders(ctx context.Context, h host.Host, log *slog.Logger, ps *pubsub.PubSub) (*providers, error) {
+	p := &providers{
+		h:        h,
+		log:      log,
+		byCID:    map[string]map[peer.ID]time.Time{},
+		verified: map[common.Hash]checkedVote{},
+		pruned:   time.Now(),
+	}
+	// Checking means a round trip to the RPC, so don't let a flood of
+	// announcements make as many round trips.
+	topic, err := joinTopic(ctx, ps, log, providersTopic, p.validate, p.handle,
+		pubsub.WithValidatorConcurrency(maxReceiptChecks), pubsub.WithValidatorTimeout(30*time.Second))
+	if err != nil {
+		return nil, err
+	}
+	p.topic = topic
+	return p, nil
+}
+
+// useChain starts checking announcements against the chain. Until then they
+// are dropped.
+func (p *providers) useChain(chain *providerChain) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.chain = chain
+}
+
+// Announce tells the network this node has fetched m.
+func (p *providers) Announce(ctx context.Context, m *Manifest) error {
+	if m.proposal == nil || m.voteTx == (common.Hash{}) {
+		return nil
+	}
+
+	ann := providerAnnouncement{
+		CID:        m.CID,
+		ProposalID: m.proposal.String(),
+		VoteTx:     m.voteTx,
+	}
+	for _, addr := range p.h.Addrs() {
+		ann.Addrs = append(ann.Addrs, addr.String())
+	}
+
+	data, err := json.Marshal(ann)
+	if err != nil {
+		return err
+	}
+	return publish(ctx, p.topic, data)
+}
+
+// validate only lets through announcements backed by an allowed vote on
+// the chain, so peers don't pass on, or connect to, made up providers.
+func (p *providers) validate(ctx context.Context, msg *pubsub.Message) pubsub.ValidationResult {
+	if msg.GetFrom() == p.h.ID() {
+		return pubsub.ValidationAccept
+	}
+
+	var ann providerAnnouncement
+	if err := json.Unmarshal(msg.Data, &ann); err != nil {
+		p.log.Warn("bad provider announcement", "from", msg.GetFrom(), "err", err)
+		return pubsub.ValidationReject
+	}
+
+	p.mu.Lock()
+	if now := time.Now(); now.Sub(p.pruned) > time.Minute {
+		p.prune(now)
+	}
+	p.mu.Unlock()
+
+	if err := p.verify(ctx, &ann); err != nil {
+		if errors.Is(err, errUnchecked) {
+			p.log.Debug("ignoring provider announcement", "from", msg.GetFrom(), "cid", ann.CID, "tx", ann.VoteTx, "err", err)
+			return pubsub.ValidationIgnore
+		}
+		p.log.Warn("rejecting provider announcement", "from", msg.GetFrom(), "cid", ann.CID, "tx", ann.VoteTx, "err", err)
+		return pubsub.ValidationReject
+	}
+	msg.ValidatorData = &ann
+	return pubsub.ValidationAccept
+}
+
+func (p *providers) handle(msg *pubsub.Message) {
+	if msg.GetFrom() == p.h.ID() {
+		return
+	}
+	// Connecting can take a while, so don't hold up the next message.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		p.add(ctx, msg.GetFrom(), msg.ValidatorData.(*providerAnnouncement))
+	}()
+}
+
+// verify checks that the announced vote transaction holds an allowed vote
+// for the announced proposal and CID.
+func (p *providers) verify(ctx context.Context, ann *providerAnnouncement) error {
+	p.mu.Lock()
+	pc := p.chain
+	known, seen := p.verified[ann.VoteTx]
+	p.mu.Unlock()
+
+	if !seen {
+		if pc == nil {
+			return fmt.Errorf("%w: not following the chain yet", errUnchecked)
+		}
+		cid, err := pc.checkVote(ctx, ann)
+		if ctx.Err() != nil {
+			// The RPC was slow, not the vote bad.
+			return fmt.Errorf("%w: %w", errUnchecked, err)
+		}
+		if errors.Is(err, errUnconfirmed) {
+			return err
+		}
+		known = checkedVote{cid: cid, err: err, at: time.Now()}
+		p.mu.Lock()
+		p.verified[ann.VoteTx] = known
+		p.mu.Unlock()
+	}
+
+	if known.err != nil {
+		return known.err
+	}
+	if known.cid != ann.CID {
+		return fmt.Errorf("vote was for %s", known.cid)
+	}
+	return nil
+}
+
+// checkVote returns the CID the allowed vote for the announced proposal in
+// the announced transaction is for. The transaction has to have succeeded,
+// with as many confirmations as the node waits for on its own votes.
+func (pc *providerChain) checkVote(ctx context.Context, ann *providerAnnouncement) (string, error) {
+	receipt, err := pc.client.TransactionReceipt(ctx, ann.VoteTx)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errUnchecked, err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return "", errors.New("the vote transaction reverted")
+	}
+	// A vote the node's own chain loop wouldn't act on yet could still be
+	// reorged away.
+	head, err := pc.client.BlockNumber(ctx)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errUnchecked, err)
+	}
+	if receipt.BlockNumber == nil || head < pc.confirmations || receipt.BlockNumber.Uint64() > head-pc.confirmations {
+		return "", errUnconfirmed
+	}
+
+	event := pc.abi.Events["VoteCastWithParams"].ID
+	for _, l := range receipt.Logs {
+		if l.Address != pc.contract || len(l.Topics) == 0 || l.Topics[0] != event {
+			continue
+		}
+
+		v, err := chain.UnpackVote(pc.abi, *l)
+		if err != nil {
+			continue
+		}
+		if v.ProposalId.String() != ann.ProposalID {
+			continue
+		}
+		if err := pc.policy.CheckVote(v.Voter, v.Support, v.Weight); err != nil {
+			return "", err
+		}
+		m, err := parseManifest(v.Params)
+		if err != nil {
+			return "", err
+		}
+		return m.CID, nil
+	}
+	return "", fmt.Errorf("no vote for proposal %s in the transaction", ann.ProposalID)
+}
+
+// prune forgets providers and checked transactions past their TTLs. p.mu
+// is held.
+func (p *providers) prune(now time.Time) {
+	for c, ids := range p.byCID {
+		for id, at := range ids {
+			if now.Sub(at) > providerTTL {
+				delete(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			delete(p.byCID, c)
+		}
+	}
+	for tx, v := range p.verified {
+		ttl := providerTTL
+		if v.err != nil {
+			ttl = providerNegativeTTL
+		}
+		if now.Sub(v.at) > ttl {
+			delete(p.verified, tx)
+		}
+	}
+	p.pruned = now
+}
+
+// add remembers the provider and connects to it, so the connection is up by
+// the time this node wants the blocks.
+func (p *providers) add(ctx context.Context, id peer.ID, ann *providerAnnouncement) {
+	p.mu.Lock()
+	if p.byCID[ann.CID] == nil {
+		p.byCID[ann.CID] = map[peer.ID]time.Time{}
+	}
+	p.byCID[ann.CID][id] = time.Now()
+	p.mu.Unlock()
+
+	info := peer.AddrInfo{ID: id}
+	for _, s := range ann.Addrs {
+		if addr, err := multiaddr.NewMultiaddr(s); err == nil {
+			info.Addrs = append(info.Addrs, addr)
+		}
+	}
+	p.h.Peerstore().AddAddrs(id, info.Addrs, providerTTL)
+
+	if err := p.h.Connect(ctx, info); err != nil {
+		p.log.Debug("failed to connect to provider", "peer", id, "cid", ann.CID, "err", err)
+		return
+	}
+	p.log.Info("connected to provider", "peer", id, "cid", ann.CID, "proposal", ann.ProposalID)
+}
+
+// For returns the peers known to hold the program with the given CID.
+func (p *providers) For(c string) []peer.ID {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var ids []peer.ID
+	for id, at := range p.byCID[c] {
+		if time.Since(at) > providerTTL {
+			delete(p.byCID[c], id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	"example.com/v2/fetch"
+	"example.com/v2/policy"
+)
+
+// receiptFake serves receipts, counting the calls, on a chain at head.
+type receiptFake struct {
+	receipts map[common.Hash]*types.Receipt
+	head     atomic.Uint64
+
+	calls atomic.Int32
+}
+
+func newReceiptFake(head uint64) *receiptFake {
+	f := &receiptFake{receipts: map[common.Hash]*types.Receipt{}}
+	f.head.Store(head)
+	return f
+}
+
+func (f *receiptFake) BlockNumber(ctx context.Context) (uint64, error) {
+	return f.head.Load(), nil
+}
+
+func (f *receiptFake) TransactionReceipt(ctx context.Context, hash common.Hash) (*types.Receipt, error) {
+	f.calls.Add(1)
+	if r, ok := f.receipts[hash]; ok {
+		return r, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func newTestProviders(t *testing.T, client receiptClient, pol policy.Policy) (*providers, abi.ABI, common.Address) {
+	t.Helper()
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+	h, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	parsed, err := abi.JSON(strings.NewReader(contractAbi))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract := common.HexToAddress("0xc0")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ps, err := newPubSub(ctx, log, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newProviders(ctx, h, log, ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.useChain(&providerChain{client: client, abi: parsed, contract: contract, policy: pol})
+	return p, parsed, contract
+}
+
+// voteReceipt is the receipt of a transaction in block 1 voting for params
+// on proposal id.
+func voteReceipt(t *testing.T, parsed abi.ABI, contract common.Address, id int64, params string) *types.Receipt {
+	t.Helper()
+	event := parsed.Events["VoteCastWithParams"]
+	data, err := event.Inputs.NonIndexed().Pack(big.NewInt(id), uint8(1), big.NewInt(1), "", []byte(params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &types.Receipt{
+		Status:      types.ReceiptStatusSuccessful,
+		BlockNumber: big.NewInt(1),
+		Logs: []*types.Log{{
+			Address: contract,
+			Topics:  []common.Hash{event.ID, common.BytesToHash(common.HexToAddress("0x01").Bytes())},
+			Data:    data,
+		}},
+	}
+}
+
+// announce has p validate an announcement as if gossiped by another node.
+func announce(t *testing.T, p *providers, ann providerAnnouncement) pubsub.ValidationResult {
+	t.Helper()
+	data, err := json.Marshal(ann)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, err := test.RandPeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := providersTopic
+	return p.validate(context.Background(), &pubsub.Message{Message: &pb.Message{From: []byte(from), Data: data, Topic: &topic}})
+}
+
+func TestProvidersVerify(t *testing.T) {
+	client := newReceiptFake(1)
+	p, parsed, contract := newTestProviders(t, client, &policy.Fake{})
+	ctx := context.Background()
+
+	c := fetch.NewFake().Add([]byte("program")).String()
+	good := common.HexToHash("0x01")
+	client.receipts[good] = voteReceipt(t, parsed, contract, 1, c)
+
+	ann := &providerAnnouncement{CID: c, ProposalID: "1", VoteTx: good}
+	if err := p.verify(ctx, ann); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.verify(ctx, &providerAnnouncement{CID: "other", ProposalID: "1", VoteTx: good}); err == nil {
+		t.Error("verified an announcement for a CID the vote wasn't for")
+	}
+
+	// Transactions that don't hold the vote are remembered as such too.
+	bad := common.HexToHash("0x02")
+	for i := 0; i < 3; i++ {
+		if err := p.verify(ctx, &providerAnnouncement{CID: c, ProposalID: "1", VoteTx: bad}); err == nil {
+			t.Fatal("verified a transaction without a receipt")
+		}
+	}
+	if n := client.calls.Load(); n != 2 {
+		t.Errorf("fetched %d receipts, want one per transaction", n)
+	}
+}
+
+func TestProvidersValidate(t *testing.T) {
+	client := newReceiptFake(1)
+	p, parsed, contract := newTestProviders(t, client, &policy.Fake{})
+
+	c := fetch.NewFake().Add([]byte("program")).String()
+	good := common.HexToHash("0x01")
+	client.receipts[good] = voteReceipt(t, parsed, contract, 1, c)
+	rejected := common.HexToHash("0x02")
+	client.receipts[rejected] = voteReceipt(t, parsed, contract, 2, c)
+
+	for _, tc := range []struct {
+		name string
+		ann  providerAnnouncement
+		want pubsub.ValidationResult
+	}{
+		{"vote for the program", providerAnnouncement{CID: c, ProposalID: "1", VoteTx: good}, pubsub.ValidationAccept},
+		{"vote for another program", providerAnnouncement{CID: "other", ProposalID: "1", VoteTx: good}, pubsub.ValidationReject},
+		{"no vote for the proposal", providerAnnouncement{CID: c, ProposalID: "3", VoteTx: rejected}, pubsub.ValidationReject},
+		{"receipt not found", providerAnnouncement{CID: c, ProposalID: "1", VoteTx: common.HexToHash("0x03")}, pubsub.ValidationIgnore},
+	} {
+		if got := announce(t, p, tc.ann); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// Until the node follows the chain it can't tell.
+	p.useChain(nil)
+	if got := announce(t, p, providerAnnouncement{CID: c, ProposalID: "1", VoteTx: common.HexToHash("0x04")}); got != pubsub.ValidationIgnore {
+		t.Errorf("before following the chain: got %v, want ignore", got)
+	}
+}
+
+// Only votes that went through, and are as deep as the node's own chain loop
+// wants, back an announcement. Shallow ones are checked again later.
+func TestProvidersVoteConfirmed(t *testing.T) {
+	client := newReceiptFake(2)
+	p, parsed, contract := newTestProviders(t, client, &policy.Fake{})
+	p.chain.confirmations = 2
+
+	c := fetch.NewFake().Add([]byte("program")).String()
+	vote := common.HexToHash("0x01")
+	client.receipts[vote] = voteReceipt(t, parsed, contract, 1, c)
+	reverted := common.HexToHash("0x02")
+	client.receipts[reverted] = voteReceipt(t, parsed, contract, 1, c)
+	client.receipts[reverted].Status = types.ReceiptStatusFailed
+
+	ann := providerAnnouncement{CID: c, ProposalID: "1", VoteTx: vote}
+	if got := announce(t, p, ann); got != pubsub.ValidationIgnore {
+		t.Errorf("vote with one confirmation of two: got %v, want ignore", got)
+	}
+	client.head.Store(3)
+	if got := announce(t, p, ann); got != pubsub.ValidationAccept {
+		t.Errorf("vote with two confirmations: got %v, want accept", got)
+	}
+	if got := announce(t, p, providerAnnouncement{CID: c, ProposalID: "1", VoteTx: reverted}); got != pubsub.ValidationReject {
+		t.Errorf("reverted vote: got %v, want reject", got)
+	}
+}
+
+func TestProvidersPrune(t *testing.T) {
+	p, _, _ := newTestProviders(t, newReceiptFake(1), &policy.Fake{})
+	now := time.Now()
+
+	p.byCID["old"] = map[peer.ID]time.Time{"a": now.Add(-2 * providerTTL)}
+	p.byCID["new"] = map[peer.ID]time.Time{"a": now.Add(-2 * providerTTL), "b": now}
+	p.verified[common.HexToHash("0x01")] = checkedVote{cid: "c", at: now.Add(-2 * providerTTL)}
+	p.verified[common.HexToHash("0x02")] = checkedVote{cid: "c", at: now.Add(-providerNegativeTTL - time.Minute)}
+	p.verified[common.HexToHash("0x03")] = checkedVote{err: errors.New("bad"), at: now.Add(-providerNegativeTTL - time.Minute)}
+	p.prune(now)
+
+	if _, ok := p.byCID["old"]; ok || len(p.byCID["new"]) != 1 {
+		t.Errorf("providers after pruning: %v", p.byCID)
+	}
+	if len(p.verified) != 1 || p.verified[common.HexToHash("0x02")].cid != "c" {
+		t.Errorf("checked transactions after pruning: %v", p.verified)
+	}
+}
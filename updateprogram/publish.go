@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/ipfs/boxo/files"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	unixfile "github.com/ipfs/boxo/ipld/unixfs/file"
+	"github.com/ipfs/go-cid"
+)
+
+// handlePublish adds the program in the request body to the node's blocks,
+// split with content-defined chunking, and returns a manifest for it. With a
+// base CID the manifest also gets a delta from that program, which the node
+// reads from its blocks or fetches.
+func (api *apiServer) handlePublish(w http.ResponseWriter, r *http.Request) {
+	if !api.authorized(r) {
+		writeError(w, http.StatusUnauthorized, errors.New("missing or wrong bearer token"))
+		return
+	}
+	rules := api.cfg.Policy.rules()
+	if rules.MaxProgramSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, rules.MaxProgramSize)
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+
+	c, err := importFile(api.dag, data, publishChunker, merkledag.V0CidPrefix())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	m := Manifest{CID: c.String()}
+
+	if v := r.URL.Query().Get("base"); v != "" {
+		baseCid, err := cid.Parse(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad base %q: %w", v, err))
+			return
+		}
+		base, err := api.readFile(r, baseCid)
+		if err != nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("base: %w", err))
+			return
+		}
+		patch, err := makePatch(base, data)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		patchCid, err := importFile(api.dag, patch, "", merkledag.V0CidPrefix())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		m.Delta = &Delta{Base: baseCid.String(), Patch: patchCid.String(), Chunker: publishChunker}
+		api.log.Info("published program", "cid", m.CID, "bytes", len(data), "base", m.Delta.Base, "patch", m.Delta.Patch, "patch_bytes", len(patch))
+	} else {
+		api.log.Info("published program", "cid", m.CID, "bytes", len(data))
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// readFile reads the UnixFS file c from the node's blocks, fetching the ones
+// it doesn't have.
+func (api *apiServer) readFile(r *http.Request, c cid.Cid) ([]byte, error) {
+	nd, err := api.dag.Get(r.Context(), c)
+	if err != nil {
+		return nil, err
+	}
+	f, err := unixfile.NewUnixfsFile(r.Context(), api.dag, nd)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	file, ok := f.(files.File)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a file", c)
+	}
+	return io.ReadAll(file)
+}
+
+// publishCommand sends a program to the running node to publish, and prints
+// the manifest to propose it with.
+func publishCommand(args []string) int {
+	var base string
+	var flags *flag.FlagSet
+	cfg, err := loadConfig("publish", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&base, "base", "", "CID of the program this one replaces, to make a delta from")
+		flags = fs
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: updateprogram publish [-base cid] [flags] <program>")
+		return 2
+	}
+
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	token, err := apiToken(&cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	client, baseURL, err := apiClient(&cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	u := baseURL + "/publish"
+	if base != "" {
+		u += "?base=" + url.QueryEscape(base)
+	}
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: is the node running?", err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(body, &e)
+		fmt.Fprintln(os.Stderr, "error:", resp.Status, e.Error)
+		return 1
+	}
+	fmt.Print(string(body))
+	return 0
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// Largest message data a node publishes or takes from a peer.
+	maxGossipMessage = 64 << 10
+	// How long message IDs are remembered so a message is only handled
+	// once.
+	gossipSeenTTL = 10 * time.Minute
+
+	// Messages a peer may send per second, and in a burst, before the rest
+	// are dropped. Peers forward everyone's messages, so this is sized for
+	// a fleet's heartbeats rather than one node's.
+	gossipPeerRate  = 100
+	gossipPeerBurst = 500
+)
+
+// gossipTopics are the topics nodes gossip on, each scored on its own.
+var gossipTopics = []string{heartbeatTopic, resultsTopic, providersTopic}
+
+// newPubSub starts gossipsub on h. Messages are signed by their authors, and
+// peers that send messages the topics' validators reject, or more than their
+// rate, lose score until they are no longer gossiped with.
+func newPubSub(ctx context.Context, log *slog.Logger, h host.Host) (*pubsub.PubSub, error) {
+	limits := newGossipLimits()
+	score, thresholds := gossipScore()
+	return pubsub.NewGossipSub(ctx, h,
+		pubsub.WithMessageSignaturePolicy(pubsub.StrictSign),
+		pubsub.WithMaxMessageSize(2*maxGossipMessage),
+		pubsub.WithSeenMessagesTTL(gossipSeenTTL),
+		pubsub.WithPeerScore(score, thresholds),
+		pubsub.WithAppSpecificRpcInspector(func(p peer.ID, rpc *pubsub.RPC) error {
+			if err := limits.check(p, len(rpc.GetPublish()), time.Now()); err != nil {
+				log.Debug("dropping gossip", "peer", p, "err", err)
+				return err
+			}
+			return nil
+		}),
+	)
+}
+
+// gossipScore returns the peer score parameters and thresholds. Only bad
+// behaviour counts: invalid messages, broken promises of gossip and
+// backing off too little. Nodes on one machine, as on a devnet, share an IP,
+// so that isn't held against them.
+func gossipScore() (*pubsub.PeerScoreParams, *pubsub.PeerScoreThresholds) {
+	topics := map[string]*pubsub.TopicScoreParams{}
+	for _, t := range gossipTopics {
+		topics[t] = &pubsub.TopicScoreParams{
+			TopicWeight:                    1,
+			TimeInMeshQuantum:              time.Second,
+			InvalidMessageDeliveriesWeight: -100,
+			InvalidMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(time.Hour),
+		}
+	}
+	params := &pubsub.PeerScoreParams{
+		Topics:                    topics,
+		AppSpecificScore:          func(peer.ID) float64 { return 0 },
+		BehaviourPenaltyWeight:    -10,
+		BehaviourPenaltyThreshold: 6,
+		BehaviourPenaltyDecay:     pubsub.ScoreParameterDecay(10 * time.Minute),
+		DecayInterval:             pubsub.DefaultDecayInterval,
+		DecayToZero:               pubsub.DefaultDecayToZero,
+		RetainScore:               time.Hour,
+	}
+	// One invalid message takes a peer to -100, a few stop it being
+	// gossiped with and ten grey-list it.
+	thresholds := &pubsub.PeerScoreThresholds{
+		GossipThreshold:             -500,
+		PublishThreshold:            -1000,
+		GraylistThreshold:           -10000,
+		AcceptPXThreshold:           10,
+		OpportunisticGraftThreshold: 5,
+	}
+	return params, thresholds
+}
+
+// gossipLimits holds each peer to gossipPeerRate messages a second.
+type gossipLimits struct {
+	mu     sync.Mutex
+	peers  map[peer.ID]*peerLimiter
+	pruned time.Time
+}
+
+type peerLimiter struct {
+	*rate.Limiter
+	used time.Time
+}
+
+func newGossipLimits() *gossipLimits {
+	return &gossipLimits{peers: map[peer.ID]*peerLimiter{}, pruned: time.Now()}
+}
+
+// check takes n messages from p's allowance, and errors if there aren't as
+// many left.
+func (l *gossipLimits) check(p peer.ID, n int, now time.Time) error {
+	if n == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.pruned) > time.Minute {
+		for id, pl := range l.peers {
+			if now.Sub(pl.used) > gossipSeenTTL {
+				delete(l.peers, id)
+			}
+		}
+		l.pruned = now
+	}
+
+	pl := l.peers[p]
+	if pl == nil {
+		pl = &peerLimiter{Limiter: rate.NewLimiter(gossipPeerRate, gossipPeerBurst)}
+		l.peers[p] = pl
+	}
+	pl.used = now
+	if !pl.AllowN(now, n) {
+		return fmt.Errorf("%d messages over the rate of %d a second", n, gossipPeerRate)
+	}
+	return nil
+}
+
+// joinTopic joins topic on ps. validate decides which messages are handled
+// and passed on to other peers, the node's own included; it can leave what it
+// decoded in the message's ValidatorData. handle is called with every
+// message that passes, one at a time, until ctx is done.
+func joinTopic(ctx context.Context, ps *pubsub.PubSub, log *slog.Logger, topic string,
+	validate func(ctx context.Context, msg *pubsub.Message) pubsub.ValidationResult,
+	handle func(msg *pubsub.Message), opts ...pubsub.ValidatorOpt) (*pubsub.Topic, error) {
+
+	err := ps.RegisterTopicValidator(topic, func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		if len(msg.Data) > maxGossipMessage {
+			log.Debug("gossip message too large", "topic", topic, "from", msg.GetFrom(), "size", len(msg.Data))
+			return pubsub.ValidationReject
+		}
+		return validate(ctx, msg)
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	t, err := ps.Join(topic)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := t.Subscribe()
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		defer sub.Cancel()
+		for {
+			msg, err := sub.Next(ctx)
+			if err != nil {
+				return
+			}
+			handle(msg)
+		}
+	}()
+	return t, nil
+}
+
+// publish sends data on t, refusing what peers would drop as too large.
+func publish(ctx context.Context, t *pubsub.Topic, data []byte) error {
+	if len(data) > maxGossipMessage {
+		return fmt.Errorf("gossip message is %d bytes, over the limit of %d", len(data), maxGossipMessage)
+	}
+	return t.Publish(ctx, data)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+const testTopic = "updateprogram/test"
+
+// received collects the data of the messages a node handles.
+type received struct {
+	mu   sync.Mutex
+	data []string
+}
+
+func (r *received) handle(msg *pubsub.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.data = append(r.data, string(msg.Data))
+}
+
+func (r *received) has(data string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, d := range r.data {
+		if d == data {
+			return true
+		}
+	}
+	return false
+}
+
+// gossipLine connects gossiping hosts in a line, one for each validator,
+// each only to its neighbours, so messages have to be forwarded to get to
+// the far end.
+func gossipLine(t *testing.T, validators ...func(context.Context, *pubsub.Message) pubsub.ValidationResult) ([]*pubsub.Topic, []*received) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var hosts []host.Host
+	var topics []*pubsub.Topic
+	var got []*received
+	for i, validate := range validators {
+		h, err := mn.GenPeer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			if _, err := mn.LinkPeers(hosts[i-1].ID(), h.ID()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hosts = append(hosts, h)
+		ps, err := newPubSub(ctx, log, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &received{}
+		topic, err := joinTopic(ctx, ps, log, testTopic, validate, r.handle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		topics = append(topics, topic)
+		got = append(got, r)
+	}
+	for i := 1; i < len(validators); i++ {
+		if _, err := mn.ConnectPeers(hosts[i-1].ID(), hosts[i].ID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, topic := range topics {
+		neighbours := 2
+		if i == 0 || i == len(topics)-1 {
+			neighbours = 1
+		}
+		waitFor(t, "neighbours to join the topic", func() bool { return len(topic.ListPeers()) == neighbours })
+	}
+	return topics, got
+}
+
+func acceptAll(context.Context, *pubsub.Message) pubsub.ValidationResult {
+	return pubsub.ValidationAccept
+}
+
+// publishUntil publishes on topic until cond holds, as the mesh takes a
+// heartbeat or two to form.
+func publishUntil(t *testing.T, topic *pubsub.Topic, data string, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		if err := publish(context.Background(), topic, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func TestGossipForwards(t *testing.T) {
+	topics, got := gossipLine(t, acceptAll, acceptAll, acceptAll)
+
+	publishUntil(t, topics[0], "hello", "the far end to get the message", func() bool { return got[2].has("hello") })
+	if !got[0].has("hello") {
+		t.Error("the publisher didn't handle its own message")
+	}
+}
+
+func TestGossipRejects(t *testing.T) {
+	rejectBad := func(ctx context.Context, msg *pubsub.Message) pubsub.ValidationResult {
+		if string(msg.Data) == "bad" {
+			return pubsub.ValidationReject
+		}
+		return pubsub.ValidationAccept
+	}
+	// The first node passes on anything, the others don't.
+	topics, got := gossipLine(t, acceptAll, rejectBad, rejectBad)
+
+	if err := publish(context.Background(), topics[0], []byte("bad")); err != nil {
+		t.Fatal(err)
+	}
+	publishUntil(t, topics[0], "good", "a good message to get through", func() bool { return got[2].has("good") })
+	for i, r := range got[1:] {
+		if r.has("bad") {
+			t.Errorf("node %d handled a rejected message", i+1)
+		}
+	}
+
+	// A node's own messages are validated too.
+	if err := publish(context.Background(), topics[1], []byte("bad")); err == nil {
+		t.Error("published a message the node's own validator rejects")
+	}
+}
+
+func TestGossipRateLimit(t *testing.T) {
+	limits := newGossipLimits()
+	now := time.Now()
+
+	if err := limits.check("peer", gossipPeerBurst, now); err != nil {
+		t.Fatalf("burst refused: %v", err)
+	}
+	if err := limits.check("peer", 1, now); err == nil {
+		t.Error("message over the burst allowed")
+	}
+	if err := limits.check("other", 1, now); err != nil {
+		t.Errorf("another peer held to the first one's rate: %v", err)
+	}
+	if err := limits.check("peer", gossipPeerRate, now.Add(time.Second)); err != nil {
+		t.Errorf("a second's worth refused a second later: %v", err)
+	}
+}
+
+func TestGossipMessageSize(t *testing.T) {
+	topics, got := gossipLine(t, acceptAll, acceptAll)
+
+	big := strings.Repeat("x", maxGossipMessage+1)
+	if err := publish(context.Background(), topics[0], []byte(big)); err == nil {
+		t.Error("published a message over the limit")
+	}
+	publishUntil(t, topics[0], "small", "a small message to get through", func() bool { return got[1].has("small") })
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// ResultsConfig controls reporting run results to the ResultsRegistry contract.
+type ResultsConfig struct {
+	// Address of the ResultsRegistry. Empty disables reporting.
+	RegistryAddress string `yaml:"registry_address"`
+	// Encrypted JSON key file of the operator account that pays for and
+	// signs the submissions.
+	Keystore string `yaml:"keystore"`
+	// File holding the keystore password. OPERATOR_PASSWORD is used if unset.
+	PasswordFile string `yaml:"password_file"`
+
+	MaxRetries     int      `yaml:"max_retries"`
+	RetryInterval  Duration `yaml:"retry_interval"`
+	ReceiptTimeout Duration `yaml:"receipt_timeout"`
+}
+
+func (cfg *ResultsConfig) enabled() bool {
+	return cfg.RegistryAddress != ""
+}
+
+func (cfg *ResultsConfig) validate(bad func(field, format string, args ...interface{})) {
+	if !cfg.enabled() {
+		return
+	}
+	if !common.IsHexAddress(cfg.RegistryAddress) {
+		bad("results.registry_address", "%q is not an address", cfg.RegistryAddress)
+	}
+	if cfg.Keystore == "" {
+		bad("results.keystore", "is required to submit results")
+	} else if _, err := os.Stat(cfg.Keystore); err != nil {
+		bad("results.keystore", "%v", err)
+	}
+	if cfg.PasswordFile != "" {
+		if _, err := os.Stat(cfg.PasswordFile); err != nil {
+			bad("results.password_file", "%v", err)
+		}
+	}
+	if cfg.MaxRetries < 0 {
+		bad("results.max_retries", "must not be negative")
+	}
+	if cfg.RetryInterval <= 0 {
+		bad("results.retry_interval", "must be positive")
+	}
+	if cfg.ReceiptTimeout <= 0 {
+		bad("results.receipt_timeout", "must be positive")
+	}
+}
+
+// Result is what a node reports after running a program.
+type Result struct {
+	ProposalID *big.Int
+	// Shard of the job this node ran, 0 if it isn't sharded.
+	Shard      int
+	ProgramCID string
+	ExitCode   int
+	// CID of the bundle of files the program left in its output dir, if any.
+	OutputCID string
+	Runtime   time.Duration
+}
+
+// resultReporter submits results to the registry from the operator account.
+type resultReporter struct {
+	log      *slog.Logger
+	cfg      ResultsConfig
+	op       *operator
+	abi      abi.ABI
+	registry common.Address
+
+	// Check-then-send sequences, like skipping results already submitted,
+	// are serialised.
+	mu sync.Mutex
+}
+
+func newResultReporter(log *slog.Logger, cfg ResultsConfig, op *operator) (*resultReporter, error) {
+	parsed, err := abi.JSON(strings.NewReader(resultsRegistryAbi))
+	if err != nil {
+		return nil, err
+	}
+
+	return &resultReporter{
+		log:      log,
+		cfg:      cfg,
+		op:       op,
+		abi:      parsed,
+		registry: common.HexToAddress(cfg.RegistryAddress),
+	}, nil
+}
+
+func (r *resultReporter) address() common.Address {
+	return r.op.address()
+}
+
+// Submit reports res, retrying until it is mined, the retries run out or ctx
+// is done. Results the registry already has are not sent again.
+func (r *resultReporter) Submit(ctx context.Context, res Result) error {
+	var err error
+	for attempt := 0; attempt <= r.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			r.log.Warn("retrying result submission", "proposal", res.ProposalID, "attempt", attempt, "err", err)
+			select {
+			case <-time.After(time.Duration(r.cfg.RetryInterval)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		err = r.submitOnce(ctx, res)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (r *resultReporter) hasSubmitted(ctx context.Context, proposalID *big.Int) (bool, error) {
+	values, err := r.call(ctx, "hasSubmitted", proposalID, r.address())
+	if err != nil {
+		return false, err
+	}
+	return values[0].(bool), nil
+}
+
+func (r *resultReporter) submitOnce(ctx context.Context, res Result) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	done, err := r.hasSubmitted(ctx, res.ProposalID)
+	if err != nil {
+		return err
+	}
+	if done {
+		r.log.Info("result already submitted", "proposal", res.ProposalID)
+		return nil
+	}
+	if err := r.ensureClaim(ctx, res.ProposalID, res.Shard); err != nil {
+		return err
+	}
+
+	input, err := r.abi.Pack("submitResult",
+		res.ProposalID,
+		big.NewInt(int64(res.Shard)),
+		res.ProgramCID,
+		big.NewInt(int64(res.ExitCode)),
+		res.OutputCID,
+		new(big.Int).SetUint64(uint64(res.Runtime/time.Second)),
+	)
+	if err != nil {
+		return err
+	}
+
+	receipt, err := r.transact(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	r.log.Info("result mined", "proposal", res.ProposalID, "tx", receipt.TxHash, "block", receipt.BlockNumber)
+	return nil
+}
+
+// transact calls the registry with input from the operator account and
+// waits for it to be mined.
+func (r *resultReporter) transact(ctx context.Context, input []byte) (*types.Receipt, error) {
+	return r.op.transact(ctx, r.registry, input)
+}
+
+// call runs a view method of the registry and returns its outputs.
+func (r *resultReporter) call(ctx context.Context, method string, args ...interface{}) ([]interface{}, error) {
+	return callContract(ctx, r.op.client, r.registry, r.abi, method, args...)
+}
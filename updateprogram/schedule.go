@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// scheduledUpgrade is a voted program waiting for its activation point. It is
+// fetched once its proposal executes, and run once the point has passed.
+type scheduledUpgrade struct {
+	manifest *Manifest
+	executed bool
+	// Where the fetched program was saved, once it is ready to run.
+	path string
+	// Why the last attempt at fetching it failed.
+	err string
+}
+
+// schedule holds m until its activation point. Every vote on a proposal
+// carries the same manifest, so only a different program replaces the one
+// already scheduled in its workload.
+func (n *node) schedule(m *Manifest) {
+	var replaced *Manifest
+	changed := false
+	n.status.update(func(s *nodeStatus) {
+		w := s.workload(m.workload())
+		if sc := w.scheduled; sc != nil {
+			if sc.manifest.CID == m.CID && sc.manifest.proposal.Cmp(m.proposal) == 0 {
+				return
+			}
+			replaced = sc.manifest
+		}
+		w.scheduled = &scheduledUpgrade{manifest: m}
+		changed = true
+	})
+	if !changed {
+		return
+	}
+
+	n.saveSchedule(m.workload(), &scheduledUpgrade{manifest: m})
+	if replaced != nil {
+		n.log.exec.Info("replacing scheduled program", "workload", m.workload(), "cid", replaced.CID, "proposal", replaced.proposal)
+	}
+	n.log.exec.Info("scheduled program", "workload", m.workload(), "cid", m.CID, "proposal", m.proposal,
+		"activation_block", m.ActivationBlock, "activation_time", m.ActivationTime)
+	n.resetActivationTimer()
+}
+
+// proposalExecuted marks the programs scheduled by proposal id ready to
+// fetch.
+func (n *node) proposalExecuted(id *big.Int) {
+	var executed []*Manifest
+	n.status.update(func(s *nodeStatus) {
+		for _, w := range s.workloads {
+			if sc := w.scheduled; sc != nil && !sc.executed && sc.manifest.proposal.Cmp(id) == 0 {
+				sc.executed = true
+				executed = append(executed, sc.manifest)
+			}
+		}
+	})
+	for _, m := range executed {
+		n.saveSchedule(m.workload(), &scheduledUpgrade{manifest: m, executed: true})
+		n.log.exec.Info("scheduled proposal executed, prefetching", "workload", m.workload(), "cid", m.CID, "proposal", id)
+	}
+}
+
+// savedSchedule is a scheduled program as the state store keeps it. Its
+// vote is behind the last block handled, so it isn't seen again after a
+// restart.
+type savedSchedule struct {
+	Manifest   *Manifest   `json:"manifest"`
+	ProposalID string      `json:"proposal_id"`
+	VoteTx     common.Hash `json:"vote_tx"`
+	Executed   bool        `json:"executed"`
+}
+
+// saveSchedule keeps sc as workload's scheduled program in the state store,
+// or drops the one there if sc is nil.
+func (n *node) saveSchedule(workload string, sc *scheduledUpgrade) {
+	var data []byte
+	if sc != nil {
+		var err error
+		data, err = json.Marshal(savedSchedule{
+			Manifest:   sc.manifest,
+			ProposalID: sc.manifest.proposal.String(),
+			VoteTx:     sc.manifest.voteTx,
+			Executed:   sc.executed,
+		})
+		if err != nil {
+			n.log.exec.Error("failed to save scheduled program", "workload", workload, "err", err)
+			return
+		}
+	}
+	if err := n.state.SaveSchedule(workload, data); err != nil {
+		n.log.exec.Error("failed to save scheduled program", "workload", workload, "err", err)
+	}
+}
+
+// restoreSchedules puts back the programs that were scheduled when the node
+// stopped. Executed ones are fetched again on the next poll.
+func (n *node) restoreSchedules() {
+	saved, err := n.state.Schedules()
+	if err != nil {
+		n.log.exec.Error("failed to load scheduled programs", "err", err)
+		return
+	}
+	for workload, data := range saved {
+		sc, err := loadSchedule(data)
+		if err != nil {
+			n.log.exec.Error("dropping saved scheduled program", "workload", workload, "err", err)
+			n.saveSchedule(workload, nil)
+			continue
+		}
+		n.status.update(func(s *nodeStatus) { s.workload(workload).scheduled = sc })
+		n.log.exec.Info("restored scheduled program", "workload", workload, "cid", sc.manifest.CID, "proposal", sc.manifest.proposal, "executed", sc.executed)
+	}
+}
+
+func loadSchedule(data []byte) (*scheduledUpgrade, error) {
+	var saved savedSchedule
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	if saved.Manifest == nil {
+		return nil, fmt.Errorf("no manifest")
+	}
+	proposal, ok := new(big.Int).SetString(saved.ProposalID, 10)
+	if !ok {
+		return nil, fmt.Errorf("bad proposal ID %q", saved.ProposalID)
+	}
+	m := saved.Manifest
+	m.proposal, m.voteTx = proposal, saved.VoteTx
+	return &scheduledUpgrade{manifest: m, executed: saved.Executed}, nil
+}
+
+// prefetchScheduled fetches the scheduled programs whose proposals have
+// executed, retrying on every poll until they succeed.
+func (n *node) prefetchScheduled(ctx context.Context) {
+	var fetch []*Manifest
+	n.status.update(func(s *nodeStatus) {
+		for _, w := range s.workloads {
+			if sc := w.scheduled; sc != nil && sc.executed && sc.path == "" {
+				fetch = append(fetch, sc.manifest)
+			}
+		}
+	})
+
+	for _, m := range fetch {
+		path, err := n.fetchProgram(ctx, m)
+		n.status.update(func(s *nodeStatus) {
+			sc := s.workload(m.workload()).scheduled
+			if sc == nil || sc.manifest != m {
+				return
+			}
+			if err != nil {
+				sc.err = err.Error()
+				return
+			}
+			sc.path, sc.err = path, ""
+		})
+		if err != nil {
+			continue
+		}
+
+		n.log.exec.Info("scheduled program ready", "workload", m.workload(), "cid", m.CID,
+			"activation_block", m.ActivationBlock, "activation_time", m.ActivationTime)
+		n.resetActivationTimer()
+	}
+}
+
+// activateIfDue switches each workload to its scheduled program once it is
+// ready and its activation point has passed.
+func (n *node) activateIfDue(ctx context.Context) {
+	type activation struct {
+		m    *Manifest
+		path string
+	}
+	var due []activation
+	paused := false
+	n.status.update(func(s *nodeStatus) {
+		paused = s.paused
+		for _, w := range s.workloads {
+			sc := w.scheduled
+			if sc == nil || sc.path == "" || !sc.manifest.due(s.lastBlock) {
+				continue
+			}
+			due = append(due, activation{sc.manifest, sc.path})
+			w.scheduled = nil
+			if paused {
+				w.pending = sc.manifest
+			}
+		}
+	})
+	if len(due) == 0 {
+		return
+	}
+	n.resetActivationTimer()
+
+	for _, a := range due {
+		n.saveSchedule(a.m.workload(), nil)
+		// The other replicas announce once they activate it too.
+		if a.m.replicas() > 1 && n.agreement != nil {
+			n.agreement.Expect(a.m)
+		}
+		if paused {
+			n.log.exec.Info("upgrades are paused, holding scheduled program", "workload", a.m.workload(), "cid", a.m.CID)
+			continue
+		}
+		n.log.exec.Info("activating scheduled program", "workload", a.m.workload(), "cid", a.m.CID, "proposal", a.m.proposal)
+		n.metrics.upgradeAttempts.Inc()
+		n.switchTo(ctx, a.m, a.path)
+	}
+}
+
+// activationDue fires at the earliest activation time of the ready scheduled
+// programs.
+func (n *node) activationDue() <-chan time.Time {
+	if n.activation == nil {
+		return nil
+	}
+	return n.activation.C
+}
+
+func (n *node) resetActivationTimer() {
+	if n.activation != nil {
+		n.activation.Stop()
+		n.activation = nil
+	}
+
+	var next *time.Time
+	n.status.update(func(s *nodeStatus) {
+		for _, w := range s.workloads {
+			sc := w.scheduled
+			if sc == nil || sc.path == "" || sc.manifest.ActivationTime == nil {
+				continue
+			}
+			if at := sc.manifest.ActivationTime; next == nil || at.Before(*next) {
+				next = at
+			}
+		}
+	})
+	if next != nil {
+		n.activation = time.NewTimer(time.Until(*next))
+	}
+}
+
+type fleetReadiness struct {
+	// Live nodes heard from, not counting this one.
+	Nodes int `json:"nodes"`
+	// Of those, the ones that have the program fetched and waiting, or
+	// already running.
+	Ready int `json:"ready"`
+	// And the peer IDs of the rest.
+	NotReady []string `json:"not_ready"`
+}
+
+type scheduleReport struct {
+	Manifest   *Manifest `json:"manifest"`
+	ProposalID string    `json:"proposal_id,omitempty"`
+	Executed   bool      `json:"executed"`
+	Ready      bool      `json:"ready"`
+	Error      string    `json:"error,omitempty"`
+	// Until the activation point, whichever kind it is.
+	BlocksLeft *uint64 `json:"blocks_left,omitempty"`
+	TimeLeft   string  `json:"time_left,omitempty"`
+
+	Fleet *fleetReadiness `json:"fleet,omitempty"`
+}
+
+// reportSchedule describes sc as of block. Call with the status locked.
+func reportSchedule(sc *scheduledUpgrade, block uint64) *scheduleReport {
+	m := sc.manifest
+	r := &scheduleReport{
+		Manifest: m,
+		Executed: sc.executed,
+		Ready:    sc.path != "",
+		Error:    sc.err,
+	}
+	if m.proposal != nil {
+		r.ProposalID = m.proposal.String()
+	}
+	if m.ActivationTime != nil {
+		r.TimeLeft = max(time.Until(*m.ActivationTime), 0).Round(time.Second).String()
+	} else {
+		left := uint64(0)
+		if m.ActivationBlock > block {
+			left = m.ActivationBlock - block
+		}
+		r.BlocksLeft = &left
+	}
+	return r
+}
+
+// readiness counts the live nodes that are ready to switch workload name to
+// the program c, going by their heartbeats.
+func (f *fleet) readiness(name, c string) *fleetReadiness {
+	r := &fleetReadiness{NotReady: []string{}}
+	for _, n := range f.Live() {
+		r.Nodes++
+		if w := n.Workloads[name]; (w.Scheduled == c && w.Ready) || w.CID == c {
+			r.Ready++
+		} else {
+			r.NotReady = append(r.NotReady, n.PeerID.String())
+		}
+	}
+	return r
+}
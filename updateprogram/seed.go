@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoreds"
+)
+
+// A seed follows the chain like any node but never runs programs. It keeps
+// every voted program and input on disk and serves them, relays for nodes
+// behind NAT, and remembers its peers across restarts so the rest of the
+// network can bootstrap from it.
+
+// seedStores are the on-disk stores a seed keeps in its data dir.
+type seedStores struct {
+	blocks    datastore.Batching
+	peers     datastore.Batching
+	peerstore peerstore.Peerstore
+}
+
+func openSeedStores(ctx context.Context, cfg *Config) (*seedStores, error) {
+	blocks, err := leveldb.NewDatastore(cfg.statePath("blocks"), nil)
+	if err != nil {
+		return nil, err
+	}
+	peers, err := leveldb.NewDatastore(cfg.statePath("peerstore"), nil)
+	if err != nil {
+		blocks.Close()
+		return nil, err
+	}
+	ps, err := pstoreds.NewPeerstore(ctx, peers, pstoreds.DefaultOpts())
+	if err != nil {
+		blocks.Close()
+		peers.Close()
+		return nil, err
+	}
+	return &seedStores{blocks: blocks, peers: peers, peerstore: ps}, nil
+}
+
+func (s *seedStores) Close() error {
+	return errors.Join(s.peerstore.Close(), s.peers.Close(), s.blocks.Close())
+}
+
+// reconnectKnownPeers dials the peers left in the persisted peerstore from
+// the last run.
+func reconnectKnownPeers(ctx context.Context, log *slog.Logger, h host.Host) {
+	var wg sync.WaitGroup
+	for _, id := range h.Peerstore().PeersWithAddrs() {
+		if id == h.ID() {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+			defer cancel()
+			if err := h.Connect(ctx, h.Peerstore().PeerInfo(id)); err != nil {
+				log.Debug("failed to reconnect known peer", "peer", id, "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+	log.Info("reconnected known peers", "peers", len(h.Network().Peers()))
+}
+
+type pin struct {
+	CID        string    `json:"cid"`
+	ProposalID string    `json:"proposal_id,omitempty"`
+	PinnedAt   time.Time `json:"pinned_at"`
+}
+
+// pinSet is the list of CIDs a seed keeps, saved in the data dir. Blocks
+// are never collected, so it records what the seed has fetched in full.
+type pinSet struct {
+	path string
+
+	mu   sync.Mutex
+	pins map[string]pin
+}
+
+func loadPinSet(path string) (*pinSet, error) {
+	p := &pinSet{path: path, pins: map[string]pin{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var pins []pin
+	if err := json.Unmarshal(data, &pins); err != nil {
+		return nil, err
+	}
+	for _, pin := range pins {
+		p.pins[pin.CID] = pin
+	}
+	return p, nil
+}
+
+func (p *pinSet) Has(c string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.pins[c]
+	return ok
+}
+
+func (p *pinSet) Add(c, proposal string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pins[c] = pin{CID: c, ProposalID: proposal, PinnedAt: time.Now()}
+	data, err := json.MarshalIndent(p.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p.path, data, 0644)
+}
+
+// List returns the pins, oldest first.
+func (p *pinSet) List() []pin {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.list()
+}
+
+func (p *pinSet) list() []pin {
+	pins := make([]pin, 0, len(p.pins))
+	for _, pin := range p.pins {
+		pins = append(pins, pin)
+	}
+	sort.Slice(pins, func(i, j int) bool {
+		return pins[i].PinnedAt.Before(pins[j].PinnedAt)
+	})
+	return pins
+}
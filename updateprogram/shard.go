@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Ways nodes can pick which shard of a job to run.
+const (
+	// Every node works its shard out from its peer ID, without talking to
+	// anyone. Several nodes may end up on the same shard.
+	shardByHash = "hash"
+	// Nodes claim a shard on the ResultsRegistry, so each is run once.
+	shardByClaim = "claim"
+)
+
+// Shard is one part of a job's input.
+type Shard struct {
+	Input string `json:"input"`
+}
+
+// hashShard deterministically maps a node and proposal to one of n shards.
+func hashShard(id peer.ID, proposal *big.Int, n int) int {
+	h := sha256.New()
+	h.Write([]byte(id))
+	if proposal != nil {
+		h.Write(common.BigToHash(proposal).Bytes())
+	}
+	sum := new(big.Int).SetBytes(h.Sum(nil))
+	return int(sum.Mod(sum, big.NewInt(int64(n))).Int64())
+}
+
+// claimShard claims the first free shard on the registry, starting from the
+// one the node's hash points at so nodes don't all race for shard 0. A shard
+// this node already claimed, for example before a restart, is reused. The
+// registry gives each node one claim per job, and only to nodes registered
+// on its NodeRegistry.
+//
+// Each of the n shards can be claimed once per replica, so that many nodes
+// run it.
+func (r *resultReporter) claimShard(ctx context.Context, proposal *big.Int, start, n, replicas int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.checkNode(ctx); err != nil {
+		return 0, err
+	}
+	claimed, shard, err := r.claimOf(ctx, proposal)
+	if err != nil {
+		return 0, err
+	}
+	if claimed {
+		if shard >= n {
+			return 0, fmt.Errorf("claimed shard %d of proposal %v, past its %d shards", shard, proposal, n)
+		}
+		return shard, nil
+	}
+
+	slots := n * replicas
+	for i := 0; i < slots; i++ {
+		slot := (start*replicas + i) % slots
+		shard, replica := slot/replicas, slot%replicas
+		if ok, err := r.tryClaim(ctx, proposal, shard, replica); err != nil {
+			return 0, err
+		} else if ok {
+			return shard, nil
+		}
+	}
+
+	return 0, fmt.Errorf("all %d replicas of the %d shards of proposal %v are taken", replicas, n, proposal)
+}
+
+// ensureClaim makes sure the node holds a claim on the shard it reports a
+// result for, as the registry only takes results under one. Jobs whose
+// nodes pick their shard themselves, or that aren't sharded, have no limit
+// on replicas, so the first free replica of the shard is claimed.
+// r.mu is held.
+func (r *resultReporter) ensureClaim(ctx context.Context, proposal *big.Int, shard int) error {
+	claimed, own, err := r.claimOf(ctx, proposal)
+	if err != nil {
+		return err
+	}
+	if claimed {
+		if own != shard {
+			return fmt.Errorf("claimed shard %d of proposal %v, not %d", own, proposal, shard)
+		}
+		return nil
+	}
+	if err := r.checkNode(ctx); err != nil {
+		return err
+	}
+
+	for replica := 0; replica < maxOpenReplicas; replica++ {
+		if ok, err := r.tryClaim(ctx, proposal, shard, replica); err != nil {
+			return err
+		} else if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("the first %d replicas of shard %d of proposal %v are taken", maxOpenReplicas, shard, proposal)
+}
+
+// Most replicas of a shard ensureClaim looks through for a free one.
+const maxOpenReplicas = 256
+
+// checkNode errors if the registry won't take claims or results from the
+// node.
+func (r *resultReporter) checkNode(ctx context.Context) error {
+	values, err := r.call(ctx, "isNode", r.address())
+	if err != nil {
+		return err
+	}
+	if !values[0].(bool) {
+		return fmt.Errorf("%s can't claim shards or submit results, it isn't registered on the registry's NodeRegistry by an allowed operator", r.address())
+	}
+	return nil
+}
+
+// claimOf returns the shard the node holds a claim on for the proposal, if
+// any.
+func (r *resultReporter) claimOf(ctx context.Context, proposal *big.Int) (bool, int, error) {
+	values, err := r.call(ctx, "claimOf", proposal, r.address())
+	if err != nil {
+		return false, 0, err
+	}
+	claimed, shard := values[0].(bool), values[1].(*big.Int)
+	if !claimed {
+		return false, 0, nil
+	}
+	if !shard.IsInt64() || shard.Int64() > math.MaxInt32 {
+		return false, 0, fmt.Errorf("claimed shard %v of proposal %v is out of range", shard, proposal)
+	}
+	return true, int(shard.Int64()), nil
+}
+
+// tryClaim claims the replica of the shard if it is free, and reports
+// whether it did.
+func (r *resultReporter) tryClaim(ctx context.Context, proposal *big.Int, shard, replica int) (bool, error) {
+	values, err := r.call(ctx, "shardClaimant", proposal, big.NewInt(int64(shard)), big.NewInt(int64(replica)))
+	if err != nil {
+		return false, err
+	}
+	if values[0].(common.Address) != (common.Address{}) {
+		return false, nil
+	}
+
+	input, err := r.abi.Pack("claimShard", proposal, big.NewInt(int64(shard)), big.NewInt(int64(replica)))
+	if err != nil {
+		return false, err
+	}
+	if _, err := r.transact(ctx, input); err != nil {
+		// Most likely someone else got it first.
+		r.log.Debug("failed to claim shard", "proposal", proposal, "shard", shard, "replica", replica, "err", err)
+		return false, nil
+	}
+
+	r.log.Info("claimed shard", "proposal", proposal, "shard", shard, "replica", replica)
+	return true, nil
+}
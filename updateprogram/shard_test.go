@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestHashShard(t *testing.T) {
+	proposal := big.NewInt(42)
+	counts := make([]int, 4)
+	moved := 0
+	for i := 0; i < 200; i++ {
+		id := peer.ID(fmt.Sprintf("peer%d", i))
+		shard := hashShard(id, proposal, len(counts))
+		if shard < 0 || shard >= len(counts) {
+			t.Fatalf("%s got shard %d of %d", id, shard, len(counts))
+		}
+		if again := hashShard(id, proposal, len(counts)); again != shard {
+			t.Fatalf("%s got shard %d, then %d", id, shard, again)
+		}
+		counts[shard]++
+		if hashShard(id, big.NewInt(43), len(counts)) != shard {
+			moved++
+		}
+	}
+	for shard, n := range counts {
+		if n < 25 {
+			t.Errorf("only %d of 200 nodes got shard %d: %v", n, shard, counts)
+		}
+	}
+	// Nodes don't end up on the same shards for every job.
+	if moved < 100 {
+		t.Errorf("%d of 200 nodes changed shards for another proposal", moved)
+	}
+	if shard := hashShard("peer", nil, 3); shard < 0 || shard >= 3 {
+		t.Errorf("got shard %d of 3 without a proposal", shard)
+	}
+}
+
+// claimsFake is a ResultsRegistry's claims and results for one proposal,
+// shared by the nodes that claim on it.
+type claimsFake struct {
+	abi abi.ABI
+
+	mu         sync.Mutex
+	registered map[common.Address]bool
+	// Who holds each shard and replica.
+	claimants map[[2]int64]common.Address
+	// The shard each node claimed.
+	claims  map[common.Address]int64
+	results map[common.Address]int64
+}
+
+func newClaimsFake(t *testing.T) *claimsFake {
+	parsed, err := abi.JSON(strings.NewReader(resultsRegistryAbi))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &claimsFake{
+		abi:        parsed,
+		registered: map[common.Address]bool{},
+		claimants:  map[[2]int64]common.Address{},
+		claims:     map[common.Address]int64{},
+		results:    map[common.Address]int64{},
+	}
+}
+
+// claimsClient is one node's connection to a claimsFake. Its transactions are
+// applied when they are sent, and fail as the contract would revert them.
+type claimsClient struct {
+	*poolFake
+	registry *claimsFake
+	from     common.Address
+}
+
+func (c *claimsClient) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	r := c.registry
+	method, args := r.unpack(call.Data)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch method.Name {
+	case "isNode":
+		return method.Outputs.Pack(r.registered[args[0].(common.Address)])
+	case "claimOf":
+		shard, ok := r.claims[args[1].(common.Address)]
+		return method.Outputs.Pack(ok, big.NewInt(shard), big.NewInt(0))
+	case "shardClaimant":
+		return method.Outputs.Pack(r.claimants[[2]int64{args[1].(*big.Int).Int64(), args[2].(*big.Int).Int64()}])
+	case "hasSubmitted":
+		_, ok := r.results[args[1].(common.Address)]
+		return method.Outputs.Pack(ok)
+	}
+	return nil, fmt.Errorf("no %s on the fake", method.Name)
+}
+
+func (c *claimsClient) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	r := c.registry
+	method, args := r.unpack(tx.Data())
+	r.mu.Lock()
+	switch method.Name {
+	case "claimShard":
+		slot := [2]int64{args[1].(*big.Int).Int64(), args[2].(*big.Int).Int64()}
+		_, claimed := r.claims[c.from]
+		if !r.registered[c.from] || claimed || r.claimants[slot] != (common.Address{}) {
+			r.mu.Unlock()
+			return errors.New("execution reverted")
+		}
+		r.claimants[slot] = c.from
+		r.claims[c.from] = slot[0]
+	case "submitResult":
+		shard, claimed := r.claims[c.from]
+		if !claimed || shard != args[1].(*big.Int).Int64() {
+			r.mu.Unlock()
+			return errors.New("execution reverted: NotClaimed")
+		}
+		r.results[c.from] = shard
+	}
+	r.mu.Unlock()
+	return c.poolFake.SendTransaction(ctx, tx)
+}
+
+func (r *claimsFake) unpack(data []byte) (*abi.Method, []interface{}) {
+	method, err := r.abi.MethodById(data[:4])
+	if err != nil {
+		panic(err)
+	}
+	args, err := method.Inputs.Unpack(data[4:])
+	if err != nil {
+		panic(err)
+	}
+	return method, args
+}
+
+// claimingNode is a node's reporter on registry, registered on it or not.
+func claimingNode(t *testing.T, registry *claimsFake, registered bool) *resultReporter {
+	t.Helper()
+	op := newTestOperator(t, nil)
+	pool := newPoolFake()
+	pool.autoMine = true
+	op.client = &claimsClient{poolFake: pool, registry: registry, from: op.address()}
+	r, err := newResultReporter(slog.New(slog.NewTextHandler(io.Discard, nil)), ResultsConfig{RegistryAddress: "0x01"}, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.registered[op.address()] = registered
+	return r
+}
+
+// Nodes claim the shards of a job one replica each, starting where their
+// hash points, and keep the claim they have.
+func TestClaimShard(t *testing.T) {
+	ctx := context.Background()
+	registry := newClaimsFake(t)
+	a, b, c := claimingNode(t, registry, true), claimingNode(t, registry, true), claimingNode(t, registry, true)
+	proposal := big.NewInt(42)
+
+	claim := func(r *resultReporter, start int) (int, error) {
+		return r.claimShard(ctx, proposal, start, 2, 1)
+	}
+	if shard, err := claim(a, 1); err != nil || shard != 1 {
+		t.Fatalf("first node claimed shard %d: %v, want 1", shard, err)
+	}
+	if shard, err := claim(b, 1); err != nil || shard != 0 {
+		t.Fatalf("second node claimed shard %d: %v, want the free shard 0", shard, err)
+	}
+	if shard, err := claim(c, 0); err == nil {
+		t.Errorf("third node claimed shard %d of a job with all shards taken", shard)
+	}
+	if shard, err := claim(a, 0); err != nil || shard != 1 {
+		t.Errorf("first node claimed shard %d: %v, want the one it holds", shard, err)
+	}
+
+	// Replicated shards are claimed once per replica.
+	registry = newClaimsFake(t)
+	for i, want := range []int{1, 1, 0} {
+		r := claimingNode(t, registry, true)
+		if shard, err := r.claimShard(ctx, proposal, 1, 2, 2); err != nil || shard != want {
+			t.Errorf("node %d claimed shard %d: %v, want %d", i, shard, err, want)
+		}
+	}
+
+	if _, err := claim(claimingNode(t, registry, false), 0); err == nil {
+		t.Error("an unregistered node claimed a shard")
+	}
+}
+
+// A node submitting a result for a shard it didn't claim claims it first, on
+// the next free replica.
+func TestSubmitClaimsShard(t *testing.T) {
+	ctx := context.Background()
+	registry := newClaimsFake(t)
+	res := Result{ProposalID: big.NewInt(42), Shard: 1, ProgramCID: "bafyprogram"}
+
+	for i := 0; i < 2; i++ {
+		r := claimingNode(t, registry, true)
+		if err := r.submitOnce(ctx, res); err != nil {
+			t.Fatalf("node %d: %v", i, err)
+		}
+		if got := registry.claimants[[2]int64{1, int64(i)}]; got != r.address() {
+			t.Errorf("replica %d of shard 1 is held by %s, not node %d", i, got, i)
+		}
+		if shard, ok := registry.results[r.address()]; !ok || shard != 1 {
+			t.Errorf("node %d submitted %v for shard %d", i, ok, shard)
+		}
+	}
+
+	// A node holding another shard can't submit for this one.
+	other := claimingNode(t, registry, true)
+	if _, err := other.claimShard(ctx, res.ProposalID, 0, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.submitOnce(ctx, res); err == nil {
+		t.Error("submitted a result for a shard the node didn't claim")
+	}
+
+	if err := claimingNode(t, registry, false).submitOnce(ctx, res); err == nil {
+		t.Error("an unregistered node submitted a result")
+	}
+}
@@ -0,0 +1,82 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Memory is a StateStore for tests that keeps everything in memory. The
+// paths it returns don't exist on disk.
+type Memory struct {
+	mu        sync.Mutex
+	lastBlock *uint64
+	Programs  map[string][]byte
+	Inputs    map[string][]byte
+	Scheduled map[string][]byte
+}
+
+func NewMemory() *Memory {
+	return &Memory{Programs: map[string][]byte{}, Inputs: map[string][]byte{}, Scheduled: map[string][]byte{}}
+}
+
+func (m *Memory) LastBlock() (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lastBlock == nil {
+		return 0, fmt.Errorf("last block: %w", os.ErrNotExist)
+	}
+	return *m.lastBlock, nil
+}
+
+func (m *Memory) SaveLastBlock(block uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastBlock = &block
+	return nil
+}
+
+func (m *Memory) SaveProgram(cid string, data []byte) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Programs[cid] = data
+	return "memory:programs/" + cid, nil
+}
+
+func (m *Memory) Program(cid string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.Programs[cid]
+	if !ok {
+		return nil, fmt.Errorf("program %s: %w", cid, os.ErrNotExist)
+	}
+	return data, nil
+}
+
+func (m *Memory) SaveInput(cid string, data []byte) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Inputs[cid] = data
+	return "memory:inputs/" + cid, nil
+}
+
+func (m *Memory) Schedules() (map[string][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	schedules := map[string][]byte{}
+	for workload, data := range m.Scheduled {
+		schedules[workload] = data
+	}
+	return schedules, nil
+}
+
+func (m *Memory) SaveSchedule(workload string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if data == nil {
+		delete(m.Scheduled, workload)
+	} else {
+		m.Scheduled[workload] = data
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Package state keeps what a node needs across restarts.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// StateStore keeps the node's progress along the chain, the programs and
+// inputs it has fetched, and the programs waiting for their activation
+// point.
+type StateStore interface {
+	// LastBlock is the last block whose votes were handled. It returns an
+	// error wrapping os.ErrNotExist if there is none yet.
+	LastBlock() (uint64, error)
+	SaveLastBlock(block uint64) error
+	// SaveProgram stores an executable and returns the path to run it from.
+	SaveProgram(cid string, data []byte) (string, error)
+	// Program returns a program saved before. It returns an error wrapping
+	// os.ErrNotExist if there is none with that CID.
+	Program(cid string) ([]byte, error)
+	// SaveInput stores a job's input and returns the path to read it from.
+	SaveInput(cid string, data []byte) (string, error)
+	// Schedules returns what SaveSchedule kept, by workload.
+	Schedules() (map[string][]byte, error)
+	// SaveSchedule keeps the JSON data describing the program scheduled in
+	// workload, or drops it if data is nil.
+	SaveSchedule(workload string, data []byte) error
+}
+
+// Dir is a StateStore in a directory.
+type Dir string
+
+func (d Dir) path(name string) string {
+	return filepath.Join(string(d), name)
+}
+
+func (d Dir) LastBlock() (uint64, error) {
+	data, err := os.ReadFile(d.path("last_block"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func (d Dir) SaveLastBlock(block uint64) error {
+	return os.WriteFile(d.path("last_block"), []byte(strconv.FormatUint(block, 10)), 0644)
+}
+
+func (d Dir) SaveProgram(cid string, data []byte) (string, error) {
+	return d.save(filepath.Join("programs", cid), data, 0755)
+}
+
+func (d Dir) Program(cid string) ([]byte, error) {
+	return os.ReadFile(d.path(filepath.Join("programs", cid)))
+}
+
+func (d Dir) SaveInput(cid string, data []byte) (string, error) {
+	return d.save(filepath.Join("inputs", cid), data, 0644)
+}
+
+func (d Dir) Schedules() (map[string][]byte, error) {
+	data, err := os.ReadFile(d.path("scheduled.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string][]byte{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved map[string]json.RawMessage
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	schedules := map[string][]byte{}
+	for workload, data := range saved {
+		schedules[workload] = data
+	}
+	return schedules, nil
+}
+
+func (d Dir) SaveSchedule(workload string, data []byte) error {
+	schedules, err := d.Schedules()
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		delete(schedules, workload)
+	} else {
+		schedules[workload] = data
+	}
+	saved := map[string]json.RawMessage{}
+	for workload, data := range schedules {
+		saved[workload] = data
+	}
+	out, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(d.path("scheduled.json"), out, 0644)
+}
+
+func (d Dir) save(name string, data []byte, perm os.FileMode) (string, error) {
+	path := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(path, data, perm)
+}
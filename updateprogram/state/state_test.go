@@ -0,0 +1,28 @@
+package state
+
+import "testing"
+
+func TestDirSchedules(t *testing.T) {
+	d := Dir(t.TempDir())
+
+	if saved, err := d.Schedules(); err != nil || len(saved) != 0 {
+		t.Fatalf("fresh dir has schedules %v, %v", saved, err)
+	}
+	if err := d.SaveSchedule("", []byte(`{"cid":"a"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveSchedule("batch", []byte(`{"cid":"b"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveSchedule("", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := d.Schedules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || string(saved["batch"]) != `{"cid":"b"}` {
+		t.Errorf("schedules %q, want only batch's", saved)
+	}
+}
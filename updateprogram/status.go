@@ -0,0 +1,600 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+
+	"example.com/v2/age"
+	"example.com/v2/governance"
+)
+
+type processState string
+
+const (
+	stateIdle     processState = "idle"
+	stateFetching processState = "fetching"
+	stateRunning  processState = "running"
+	stateExited   processState = "exited"
+	stateStopped  processState = "stopped"
+	// Seeds only fetch and serve programs.
+	stateSeeding processState = "seeding"
+)
+
+type fetchProgress struct {
+	CID       string    `json:"cid"`
+	Bytes     int64     `json:"bytes"`
+	Total     int64     `json:"total"`
+	StartedAt time.Time `json:"started_at"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// nodeStatus is what the node is doing right now. The event loop writes it
+// and the status API reads it.
+type nodeStatus struct {
+	mu sync.Mutex
+
+	startedAt time.Time
+	// By workload name.
+	workloads map[string]*workloadStatus
+
+	lastBlock    uint64
+	paused       bool
+	reachability network.Reachability
+	fetch        *fetchProgress
+
+	// CIDs of the published log and output bundles, by program CID.
+	logBundles map[string]string
+	outputs    map[string]string
+	// What was fetched ahead for proposals, by proposal ID.
+	prefetches map[string]*proposalPrefetch
+}
+
+func newNodeStatus() *nodeStatus {
+	return &nodeStatus{
+		startedAt:  time.Now(),
+		workloads:  map[string]*workloadStatus{},
+		logBundles: map[string]string{},
+		outputs:    map[string]string{},
+		prefetches: map[string]*proposalPrefetch{},
+	}
+}
+
+func (s *nodeStatus) update(f func(s *nodeStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s)
+}
+
+// workload returns the status of the named workload, adding it the first
+// time. Call it inside update.
+func (s *nodeStatus) workload(name string) *workloadStatus {
+	w, ok := s.workloads[name]
+	if !ok {
+		w = &workloadStatus{state: stateIdle}
+		s.workloads[name] = w
+	}
+	return w
+}
+
+// workloadStatus is what one workload is doing.
+type workloadStatus struct {
+	manifest   *Manifest
+	proposalID *big.Int
+	// The manifest that ran before the current one, for rollbacks.
+	previous *Manifest
+	// A vote that arrived while upgrades were paused.
+	pending *Manifest
+	// A program waiting for its activation point.
+	scheduled *scheduledUpgrade
+	// Why the latest program wasn't admitted.
+	rejected  string
+	resources Resources
+
+	state     processState
+	pid       int
+	runningAt time.Time
+	exitCode  *int
+	// Shard of the current job this node runs, if it is sharded.
+	shard *int
+}
+
+// progressWriter counts the bytes of a download into the node status.
+type progressWriter struct {
+	status *nodeStatus
+}
+
+func (w progressWriter) Write(p []byte) (int, error) {
+	w.status.update(func(s *nodeStatus) {
+		if s.fetch != nil {
+			s.fetch.Bytes += int64(len(p))
+		}
+	})
+	return len(p), nil
+}
+
+type peerReport struct {
+	ID    string   `json:"id"`
+	Addrs []string `json:"addrs"`
+}
+
+type statusReport struct {
+	Workloads map[string]workloadReport `json:"workloads"`
+	Capacity  capacityReport            `json:"capacity"`
+	Paused    bool                      `json:"paused"`
+	Uptime    string                    `json:"uptime"`
+	LastBlock uint64                    `json:"last_block"`
+	Fetch     *fetchProgress            `json:"fetch,omitempty"`
+	PeerID    string                    `json:"peer_id"`
+	Recipient string                    `json:"recipient"`
+	Addrs     []string                  `json:"addrs"`
+	// Whether other peers can dial the node: unknown, public or private.
+	Reachability string       `json:"reachability"`
+	Peers        []peerReport `json:"peers"`
+	Blockstore   struct {
+		Blocks int   `json:"blocks"`
+		Bytes  int64 `json:"bytes"`
+	} `json:"blockstore"`
+	// Usage against the configured limits.
+	Limits *limitsReport `json:"limits,omitempty"`
+}
+
+type workloadReport struct {
+	CID        string        `json:"cid,omitempty"`
+	Manifest   *Manifest     `json:"manifest,omitempty"`
+	ProposalID string        `json:"proposal_id,omitempty"`
+	Previous   *Manifest     `json:"previous,omitempty"`
+	Pending    *Manifest     `json:"pending,omitempty"`
+	Rejected   string        `json:"rejected,omitempty"`
+	Resources  Resources     `json:"resources"`
+	Process    processReport `json:"process"`
+	LogBundle  string        `json:"log_bundle,omitempty"`
+	Output     string        `json:"output,omitempty"`
+	// The program the workload switches to next, and how ready the fleet
+	// is.
+	Scheduled *scheduleReport `json:"scheduled,omitempty"`
+}
+
+type processReport struct {
+	State    processState `json:"state"`
+	PID      int          `json:"pid,omitempty"`
+	Uptime   string       `json:"uptime,omitempty"`
+	ExitCode *int         `json:"exit_code,omitempty"`
+	Shard    *int         `json:"shard,omitempty"`
+}
+
+// controlCommand asks the event loop to do something on behalf of the API.
+type controlCommand struct {
+	name string
+	// The workload to roll back or stop. Empty stops all of them and rolls
+	// back the default one.
+	workload string
+	done     chan error
+}
+
+type apiServer struct {
+	cfg       *Config
+	log       *slog.Logger
+	token     string
+	status    *nodeStatus
+	host      host.Host
+	recipient *age.Recipient
+	bstore    *countedBlockstore
+	dag       ipld.DAGService
+	metrics   *metrics
+	agreement *agreement
+	fleet     *fleet
+	// Set in seed mode.
+	pins       *pinSet
+	limits     *limits
+	governance *governance.Tracker
+	control    chan<- controlCommand
+}
+
+// apiToken returns the configured token, or the one stored in the data dir,
+// creating it the first time.
+func apiToken(cfg *Config) (string, error) {
+	if cfg.API.Token != "" {
+		return cfg.API.Token, nil
+	}
+
+	path := cfg.statePath("api_token")
+	if data, err := os.ReadFile(path); err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	return token, os.WriteFile(path, []byte(token+"\n"), 0600)
+}
+
+// serveAPI starts the status API on the configured TCP address and unix
+// socket. It returns once the listeners are open.
+func serveAPI(ctx context.Context, cfg *Config, api *apiServer) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", api.handleStatus)
+	mux.HandleFunc("GET /peers", api.handlePeers)
+	mux.HandleFunc("GET /agreement", api.handleAgreement)
+	mux.HandleFunc("GET /fleet", api.handleFleet)
+	if api.pins != nil {
+		mux.HandleFunc("GET /pins", api.handlePins)
+	}
+	mux.HandleFunc("GET /proposals", api.handleProposals)
+	mux.HandleFunc("GET /proposals/{id}", api.handleProposal)
+	mux.HandleFunc("GET /logs", api.handleLogList)
+	mux.HandleFunc("GET /logs/{cid}", api.handleLogTail)
+	mux.HandleFunc("POST /control/{command}", api.handleControl)
+	mux.HandleFunc("POST /publish", api.handlePublish)
+	mux.Handle("GET /metrics", api.metrics.handler())
+
+	var listeners []net.Listener
+	if cfg.API.Listen != "" {
+		l, err := net.Listen("tcp", cfg.API.Listen)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+	if cfg.API.Socket != "" {
+		os.Remove(cfg.API.Socket)
+		l, err := net.Listen("unix", cfg.API.Socket)
+		if err != nil {
+			return err
+		}
+		os.Chmod(cfg.API.Socket, 0600)
+		listeners = append(listeners, l)
+	}
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	for _, l := range listeners {
+		api.log.Info("status API listening", "addr", l.Addr())
+		go func(l net.Listener) {
+			if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				api.log.Error("status API stopped", "err", err)
+			}
+		}(l)
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func (api *apiServer) peers() []peerReport {
+	peers := make([]peerReport, 0)
+	for _, id := range api.host.Network().Peers() {
+		p := peerReport{ID: id.String()}
+		for _, conn := range api.host.Network().ConnsToPeer(id) {
+			p.Addrs = append(p.Addrs, conn.RemoteMultiaddr().String())
+		}
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+func (api *apiServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	report := statusReport{Workloads: map[string]workloadReport{}}
+	report.Capacity.Max = api.cfg.Workloads.Max
+	report.Capacity.Capacity = api.cfg.Workloads.capacity()
+
+	api.status.update(func(s *nodeStatus) {
+		for name, w := range s.workloads {
+			report.Workloads[name] = reportWorkload(s, w)
+			if w.state == stateRunning {
+				report.Capacity.Running++
+				report.Capacity.Used.CPUs += w.resources.CPUs
+				report.Capacity.Used.MemoryMB += w.resources.MemoryMB
+			}
+		}
+		report.Paused = s.paused
+		report.Reachability = strings.ToLower(s.reachability.String())
+		report.Uptime = time.Since(s.startedAt).Round(time.Second).String()
+		report.LastBlock = s.lastBlock
+		if s.fetch != nil {
+			fetch := *s.fetch
+			report.Fetch = &fetch
+		}
+	})
+
+	for name, w := range report.Workloads {
+		if w.Scheduled != nil {
+			w.Scheduled.Fleet = api.fleet.readiness(name, w.Scheduled.Manifest.CID)
+		}
+	}
+
+	report.PeerID = api.host.ID().String()
+	report.Recipient = api.recipient.String()
+	for _, addr := range api.host.Addrs() {
+		report.Addrs = append(report.Addrs, addr.String())
+	}
+	report.Peers = api.peers()
+
+	report.Blockstore.Blocks, report.Blockstore.Bytes = api.bstore.usage()
+	if api.limits != nil {
+		report.Limits = api.limits.report(&api.cfg.Limits)
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// reportWorkload describes w. Call it inside update.
+func reportWorkload(s *nodeStatus, w *workloadStatus) workloadReport {
+	r := workloadReport{
+		Manifest:  w.manifest,
+		Previous:  w.previous,
+		Pending:   w.pending,
+		Rejected:  w.rejected,
+		Resources: w.resources,
+		Process:   processReport{State: w.state, ExitCode: w.exitCode, Shard: w.shard},
+	}
+	if w.manifest != nil {
+		r.CID = w.manifest.CID
+		r.LogBundle = s.logBundles[w.manifest.CID]
+		r.Output = s.outputs[w.manifest.CID]
+	}
+	if w.proposalID != nil {
+		r.ProposalID = w.proposalID.String()
+	}
+	if w.state == stateRunning {
+		r.Process.PID = w.pid
+		r.Process.Uptime = time.Since(w.runningAt).Round(time.Second).String()
+	}
+	if w.scheduled != nil {
+		r.Scheduled = reportSchedule(w.scheduled, s.lastBlock)
+	}
+	return r
+}
+
+// countedBlockstore keeps a running count of the blocks in a blockstore and
+// their total size, for /status and the metrics to report without walking
+// the whole store. Everything has to go through it for the count to hold.
+type countedBlockstore struct {
+	blockstore.Blockstore
+
+	// Held over each write, so a block is only counted when the write
+	// added it.
+	mu     sync.Mutex
+	blocks int
+	size   int64
+}
+
+// newCountedBlockstore wraps bstore, counting what it holds already.
+func newCountedBlockstore(ctx context.Context, bstore blockstore.Blockstore) (*countedBlockstore, error) {
+	keys, err := bstore.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := &countedBlockstore{Blockstore: bstore}
+	for k := range keys {
+		c.blocks++
+		if n, err := bstore.GetSize(ctx, k); err == nil {
+			c.size += int64(n)
+		}
+	}
+	return c, ctx.Err()
+}
+
+func (c *countedBlockstore) Put(ctx context.Context, b blocks.Block) error {
+	return c.PutMany(ctx, []blocks.Block{b})
+}
+
+func (c *countedBlockstore) PutMany(ctx context.Context, bs []blocks.Block) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	added := make(map[cid.Cid]int)
+	for _, b := range bs {
+		if _, ok := added[b.Cid()]; ok {
+			continue
+		}
+		has, err := c.Blockstore.Has(ctx, b.Cid())
+		if err != nil {
+			return err
+		}
+		if !has {
+			added[b.Cid()] = len(b.RawData())
+		}
+	}
+	if err := c.Blockstore.PutMany(ctx, bs); err != nil {
+		return err
+	}
+	for _, size := range added {
+		c.blocks++
+		c.size += int64(size)
+	}
+	return nil
+}
+
+func (c *countedBlockstore) DeleteBlock(ctx context.Context, k cid.Cid) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size, err := c.Blockstore.GetSize(ctx, k)
+	if ipld.IsNotFound(err) {
+		return c.Blockstore.DeleteBlock(ctx, k)
+	}
+	if err != nil {
+		return err
+	}
+	if err := c.Blockstore.DeleteBlock(ctx, k); err != nil {
+		return err
+	}
+	c.blocks--
+	c.size -= int64(size)
+	return nil
+}
+
+// usage returns the number of blocks held and their total size.
+func (c *countedBlockstore) usage() (blocks int, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.blocks, c.size
+}
+
+func (api *apiServer) handlePeers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.peers())
+}
+
+// handleAgreement lists the replicated jobs seen and whether their replicas
+// agreed. ?disputed=1 only lists the ones that didn't.
+func (api *apiServer) handleAgreement(w http.ResponseWriter, r *http.Request) {
+	jobs := api.agreement.Jobs()
+	if disputed, _ := strconv.ParseBool(r.URL.Query().Get("disputed")); disputed {
+		var filtered []jobTally
+		for _, job := range jobs {
+			if job.Disputed {
+				filtered = append(filtered, job)
+			}
+		}
+		jobs = filtered
+	}
+	if jobs == nil {
+		jobs = []jobTally{}
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// handleFleet lists the nodes heard from over heartbeats.
+func (api *apiServer) handleFleet(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.fleet.Live())
+}
+
+func (api *apiServer) handlePins(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.pins.List())
+}
+
+type logReport struct {
+	CID    string `json:"cid"`
+	Bundle string `json:"bundle,omitempty"`
+}
+
+func (api *apiServer) handleLogList(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(api.cfg.statePath("logs"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	logs := make([]logReport, 0, len(entries))
+	api.status.update(func(s *nodeStatus) {
+		for _, e := range entries {
+			if e.IsDir() {
+				logs = append(logs, logReport{CID: e.Name(), Bundle: s.logBundles[e.Name()]})
+			}
+		}
+	})
+	writeJSON(w, http.StatusOK, logs)
+}
+
+// handleLogTail returns the last lines of a program's log, 100 unless the
+// lines query parameter says otherwise. Logs can hold a confidential job's
+// output, so it takes the bearer token like the control endpoints.
+func (api *apiServer) handleLogTail(w http.ResponseWriter, r *http.Request) {
+	if !api.authorized(r) {
+		writeError(w, http.StatusUnauthorized, errors.New("missing or wrong bearer token"))
+		return
+	}
+
+	c, err := cid.Parse(r.PathValue("cid"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	n := 100
+	if v := r.URL.Query().Get("lines"); v != "" {
+		n, err = strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("bad lines %q", v))
+			return
+		}
+	}
+
+	lines, err := tailLogs(api.cfg.programLogDir(c.String()), n)
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no logs for %s", c))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+func (api *apiServer) authorized(r *http.Request) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(given), []byte(api.token)) == 1
+}
+
+func (api *apiServer) handleControl(w http.ResponseWriter, r *http.Request) {
+	if !api.authorized(r) {
+		writeError(w, http.StatusUnauthorized, errors.New("missing or wrong bearer token"))
+		return
+	}
+
+	command := r.PathValue("command")
+	switch command {
+	case "pause", "resume", "rollback", "stop":
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown command %q", command))
+		return
+	}
+
+	cmd := controlCommand{name: command, workload: r.URL.Query().Get("workload"), done: make(chan error, 1)}
+	select {
+	case api.control <- cmd:
+	case <-r.Context().Done():
+		return
+	}
+
+	select {
+	case err := <-cmd.done:
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	case <-r.Context().Done():
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+)
+
+func TestCountedBlockstore(t *testing.T) {
+	ctx := context.Background()
+	inner := blockstore.NewBlockstore(dsync.MutexWrap(datastore.NewMapDatastore()))
+	existing := blocks.NewBlock([]byte("already there"))
+	if err := inner.Put(ctx, existing); err != nil {
+		t.Fatal(err)
+	}
+
+	bstore, err := newCountedBlockstore(ctx, inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(what string, wantBlocks int, wantSize int64) {
+		t.Helper()
+		if n, size := bstore.usage(); n != wantBlocks || size != wantSize {
+			t.Errorf("%s: %d blocks of %d bytes, want %d of %d", what, n, size, wantBlocks, wantSize)
+		}
+	}
+	check("start", 1, 13)
+
+	a, b := blocks.NewBlock([]byte("a")), blocks.NewBlock([]byte("bb"))
+	if err := bstore.PutMany(ctx, []blocks.Block{a, b, a, existing}); err != nil {
+		t.Fatal(err)
+	}
+	check("put", 3, 16)
+	if err := bstore.Put(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	check("put again", 3, 16)
+
+	if err := bstore.DeleteBlock(ctx, existing.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	check("delete", 2, 3)
+	if err := bstore.DeleteBlock(ctx, existing.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	check("delete again", 2, 3)
+}
+
+func TestLogTailNeedsToken(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.DataDir = t.TempDir()
+	api := &apiServer{cfg: &cfg, token: "secret"}
+	path := "/logs/QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"
+
+	for _, tc := range []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusNotFound},
+	} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.SetPathValue("cid", strings.TrimPrefix(path, "/logs/"))
+		if tc.auth != "" {
+			r.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		api.handleLogTail(w, r)
+		if w.Code != tc.want {
+			t.Errorf("Authorization %q: status %d, want %d", tc.auth, w.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"sort"
+
+	"example.com/v2/executor"
+)
+
+// Workload of manifests that don't name one.
+const defaultWorkload = "default"
+
+// Workload names end up in paths and cgroup names.
+var workloadName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// Resources is what a program needs: CPU cores, which may be fractional,
+// and memory.
+type Resources struct {
+	CPUs     float64 `json:"cpus,omitempty" yaml:"cpus"`
+	MemoryMB int64   `json:"memory_mb,omitempty" yaml:"memory_mb"`
+}
+
+// WorkloadsConfig decides how many programs the node runs side by side.
+type WorkloadsConfig struct {
+	// Most workloads running at once. 0 means no limit.
+	Max int `yaml:"max"`
+	// What the running programs' resources have to fit in. 0 is all of the
+	// machine's CPUs or memory.
+	CPUs     float64 `yaml:"cpus"`
+	MemoryMB int64   `yaml:"memory_mb"`
+	// What a program needs if its manifest doesn't say.
+	Default Resources `yaml:"default"`
+}
+
+func (cfg *Config) validateWorkloads(bad func(field, format string, args ...interface{})) {
+	if cfg.Workloads.Max < 0 {
+		bad("workloads.max", "must not be negative")
+	}
+	if cfg.Workloads.CPUs < 0 {
+		bad("workloads.cpus", "must not be negative")
+	}
+	if cfg.Workloads.MemoryMB < 0 {
+		bad("workloads.memory_mb", "must not be negative")
+	}
+	if cfg.Workloads.Default.CPUs < 0 {
+		bad("workloads.default.cpus", "must not be negative")
+	}
+	if cfg.Workloads.Default.MemoryMB < 0 {
+		bad("workloads.default.memory_mb", "must not be negative")
+	}
+}
+
+// capacity is what the running programs' resources have to fit in. 0 means
+// no limit.
+func (cfg *WorkloadsConfig) capacity() Resources {
+	c := Resources{CPUs: cfg.CPUs, MemoryMB: cfg.MemoryMB}
+	if c.CPUs == 0 {
+		c.CPUs = float64(runtime.NumCPU())
+	}
+	if c.MemoryMB == 0 {
+		c.MemoryMB = int64(systemMemory() >> 20)
+	}
+	return c
+}
+
+// resources is what m's program needs, falling back to the default.
+func (cfg *WorkloadsConfig) resources(m *Manifest) Resources {
+	r := m.Resources
+	if r.CPUs == 0 {
+		r.CPUs = cfg.Default.CPUs
+	}
+	if r.MemoryMB == 0 {
+		r.MemoryMB = cfg.Default.MemoryMB
+	}
+	return r
+}
+
+// sortedNames returns the workload names in m in order.
+func sortedNames[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// workload is a program the node runs, and what it was admitted with.
+type workload struct {
+	proc executor.Process
+	// Closed once the program has exited and its results are out.
+	exited    chan struct{}
+	resources Resources
+}
+
+func (w *workload) running() bool {
+	if w.proc == nil {
+		return false
+	}
+	select {
+	case <-w.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// admit checks that a program needing want can run in workload name, next
+// to the programs running in the others. n.programs is held.
+func (n *node) admit(name string, want Resources) error {
+	var used Resources
+	running := 0
+	for other, w := range n.workloads {
+		if other == name || !w.running() {
+			continue
+		}
+		running++
+		used.CPUs += w.resources.CPUs
+		used.MemoryMB += w.resources.MemoryMB
+	}
+
+	capacity := n.cfg.Workloads.capacity()
+	if max := n.cfg.Workloads.Max; max > 0 && running >= max {
+		return fmt.Errorf("already running %d workloads", running)
+	}
+	if capacity.CPUs > 0 && used.CPUs+want.CPUs > capacity.CPUs {
+		return fmt.Errorf("needs %g CPUs, %g of %g are free", want.CPUs, capacity.CPUs-used.CPUs, capacity.CPUs)
+	}
+	if capacity.MemoryMB > 0 && used.MemoryMB+want.MemoryMB > capacity.MemoryMB {
+		return fmt.Errorf("needs %d MiB of memory, %d of %d are free", want.MemoryMB, capacity.MemoryMB-used.MemoryMB, capacity.MemoryMB)
+	}
+	return nil
+}
+
+type capacityReport struct {
+	Max      int       `json:"max,omitempty"`
+	Capacity Resources `json:"capacity"`
+	Running  int       `json:"running"`
+	Used     Resources `json:"used"`
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Workloads run side by side, each replaced by its own votes, and programs
+// that don't fit next to the others are turned away.
+func TestWorkloadAdmission(t *testing.T) {
+	fn := newFakeNode(t, nil, nil, nil)
+	fn.cfg.Workloads = WorkloadsConfig{Max: 2, CPUs: 2, MemoryMB: 1024, Default: Resources{CPUs: 1, MemoryMB: 256}}
+	ctx := context.Background()
+	var next uint64
+	vote := func(id int64, workload string, cpus float64) string {
+		c := fn.fetcher.Add([]byte(fmt.Sprintf("#!/bin/sh\necho %d\n", id)))
+		fn.vote(id, fmt.Sprintf(`{"cid": %q, "workload": %q, "resources": {"cpus": %g}}`, c, workload, cpus))
+		fn.chain.Mine()
+		next = fn.poll(ctx, next)
+		return c.String()
+	}
+	running := func(name, cid string) {
+		t.Helper()
+		if w := fn.workloadStatus(name); w.state != stateRunning || w.manifest.CID != cid {
+			t.Fatalf("%s is %s running %v, want %s", name, w.state, w.manifest, cid)
+		}
+	}
+	rejected := func(name, cid, why string) {
+		t.Helper()
+		if w := fn.workloadStatus(name); !strings.HasPrefix(w.rejected, cid) || !strings.Contains(w.rejected, why) {
+			t.Errorf("%s rejected %q, want %s for %q", name, w.rejected, cid, why)
+		}
+	}
+
+	indexer := vote(1, "indexer", 1)
+	// Takes the default resources.
+	def := vote(2, "", 0)
+	running("indexer", indexer)
+	running(defaultWorkload, def)
+	if r := fn.workloadStatus(defaultWorkload).resources; r != fn.cfg.Workloads.Default {
+		t.Errorf("default workload got %+v, want the default resources", r)
+	}
+
+	other := vote(3, "other", 0.5)
+	rejected("other", other, "already running 2 workloads")
+
+	// A workload's own program doesn't count against its replacement, but
+	// the others do.
+	big := vote(4, "indexer", 1.5)
+	rejected("indexer", big, "needs 1.5 CPUs, 1 of 2 are free")
+	running("indexer", indexer)
+	smaller := vote(5, "indexer", 0.5)
+	running("indexer", smaller)
+	running(defaultWorkload, def)
+
+	// Room frees up when a program exits.
+	fn.executor.Started[1].Exit(0)
+	waitFor(t, "the default workload to exit", func() bool { return !fn.workloads[defaultWorkload].running() })
+	other = vote(6, "other", 1.5)
+	running("other", other)
+	running("indexer", smaller)
+	if len(fn.executor.Started) != 4 {
+		t.Errorf("started %d programs, want 4", len(fn.executor.Started))
+	}
+}
+
+func TestWorkloadResources(t *testing.T) {
+	cfg := WorkloadsConfig{Default: Resources{CPUs: 0.5, MemoryMB: 128}}
+	if r := cfg.resources(&Manifest{Resources: Resources{CPUs: 2}}); r != (Resources{CPUs: 2, MemoryMB: 128}) {
+		t.Errorf("resources %+v, want the manifest's CPUs and the default memory", r)
+	}
+	if c := cfg.capacity(); c.CPUs != float64(runtime.NumCPU()) || c.MemoryMB <= 0 {
+		t.Errorf("capacity %+v, want the whole machine", c)
+	}
+	cfg.CPUs, cfg.MemoryMB = 1.5, 512
+	if c := cfg.capacity(); c != (Resources{CPUs: 1.5, MemoryMB: 512}) {
+		t.Errorf("capacity %+v, want the configured one", c)
+	}
+}